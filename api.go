@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/monasticacademy/httptap/pkg/reqmatch"
+	"github.com/monasticacademy/httptap/pkg/websocket"
+)
+
+// the OpenAPI document that describes the API served with --webui, from which clients can be generated
+//
+//go:embed webui/openapi.json
+var apiSpec []byte
+
+// apiState is what GET /api/state returns, and what the endpoints that change the state return after
+// changing it
+type apiState struct {
+	Paused bool   `json:"paused"`           // whether capture is paused
+	Filter string `json:"filter,omitempty"` // the expression that calls are shown for, if any
+	Calls  int    `json:"calls"`            // the number of HTTP calls captured so far
+	Rules  int    `json:"rules"`            // the number of rules that apply to requests
+}
+
+// apiReplay is what POST /api/replay/{id} returns
+type apiReplay struct {
+	ID   int       `json:"id"` // the position of the new call in the history, or -1 if it was not captured
+	Call *HTTPCall `json:"call"`
+}
+
+// apiEvent is one of the events streamed from /api/events, and a message sent over /api/ws
+type apiEvent struct {
+	Type string `json:"type"` // "call", "dns", or "policy", or "subscribed" or "error" over /api/ws
+	Data any    `json:"data"`
+}
+
+// eventHub passes the events that happen in a running httptap to each client streaming /api/events.
+// Clients that fall behind miss events rather than hold up the proxy.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan apiEvent]struct{}
+}
+
+// newEventHub starts collecting HTTP calls, DNS queries, and policy decisions for /api/events
+func newEventHub() *eventHub {
+	h := &eventHub{subscribers: make(map[chan apiEvent]struct{})}
+	calls, _ := listenHTTP()
+	go func() {
+		for c := range calls {
+			h.publish(apiEvent{Type: "call", Data: c})
+		}
+	}()
+	watchDNS(func(c *DNSCall) {
+		h.publish(apiEvent{Type: "dns", Data: c})
+	})
+	watchPolicyDecisions(func(d *PolicyDecision) {
+		h.publish(apiEvent{Type: "policy", Data: d})
+	})
+	return h
+}
+
+// publish passes an event to every subscriber that has room for it
+func (h *eventHub) publish(e apiEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel of events from now on, and a function to call when done with it
+func (h *eventHub) subscribe() (<-chan apiEvent, func()) {
+	ch := make(chan apiEvent, 128)
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers, ch)
+		h.mu.Unlock()
+	}
+}
+
+// handleAPI adds the routes of the API that controls a running httptap
+func (ui *webUI) handleAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(apiSpec)
+	})
+	mux.HandleFunc("GET /api/state", ui.serveState)
+	mux.HandleFunc("POST /api/pause", func(w http.ResponseWriter, r *http.Request) {
+		ui.control.setPaused(true)
+		ui.serveState(w, r)
+	})
+	mux.HandleFunc("POST /api/resume", func(w http.ResponseWriter, r *http.Request) {
+		ui.control.setPaused(false)
+		ui.serveState(w, r)
+	})
+	mux.HandleFunc("PUT /api/filter", ui.serveSetFilter)
+	mux.HandleFunc("GET /api/rules", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIResponse(w, http.StatusOK, ui.control.rules.list())
+	})
+	mux.HandleFunc("POST /api/rules", ui.serveAddRules)
+	mux.HandleFunc("GET /api/har", func(w http.ResponseWriter, r *http.Request) {
+		har, err := ui.control.exportHAR()
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, err)
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, har)
+	})
+	mux.HandleFunc("POST /api/har/rotate", func(w http.ResponseWriter, r *http.Request) {
+		if err := ui.control.rotateHAR(); err != nil {
+			writeAPIError(w, http.StatusConflict, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /api/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, summaryText())
+	})
+	mux.HandleFunc("GET /api/events", ui.serveEvents)
+	mux.HandleFunc("GET /api/ws", ui.serveWebSocket)
+	mux.HandleFunc("POST /api/replay/{id}", ui.serveReplay)
+}
+
+// serveState writes the state of capture
+func (ui *webUI) serveState(w http.ResponseWriter, r *http.Request) {
+	httpMu.Lock()
+	calls := len(httpCalls)
+	httpMu.Unlock()
+	writeAPIResponse(w, http.StatusOK, apiState{
+		Paused: capturePaused.Load(),
+		Filter: ui.control.filter(),
+		Calls:  calls,
+		Rules:  len(ui.control.rules.list()),
+	})
+}
+
+// serveSetFilter replaces --filter with the expression in the request, which is {"filter": "..."}
+func (ui *webUI) serveSetFilter(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Filter string `json:"filter"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("error parsing request: %w", err))
+		return
+	}
+	if err := ui.control.setFilter(body.Filter); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	ui.serveState(w, r)
+}
+
+// serveAddRules adds the rules in the request, which are written as in a --rules file, in JSON or in
+// YAML if the content type says so. Files that mocks refer to are read relative to httptap's working
+// directory.
+func (ui *webUI) serveAddRules(w http.ResponseWriter, r *http.Request) {
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("error reading request: %w", err))
+		return
+	}
+	isYAML := strings.Contains(r.Header.Get("Content-Type"), "yaml")
+	rules, err := parseRules(buf, isYAML, "", "request")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	ui.control.rules.add(rules...)
+	writeAPIResponse(w, http.StatusOK, map[string]int{"added": len(rules)})
+}
+
+// serveEvents streams HTTP calls, DNS queries, and policy decisions as they happen, as server-sent
+// events named "call", "dns", and "policy"
+func (ui *webUI) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events, done := ui.events.subscribe()
+	defer done()
+	for {
+		select {
+		case e := <-events:
+			data, err := json.Marshal(e.Data)
+			if err != nil {
+				verbosef("error encoding %s event for the API: %v", e.Type, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				verbosef("error sending event to the API: %v", err)
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveReplay sends the request of a captured call again, through the same rules, rate limits, and HAR
+// log as the requests of the subprocess, and captures it as a new call, which is returned. The call is
+// given by its position in the history, which is the ID of its event from /api/calls.
+func (ui *webUI) serveReplay(w http.ResponseWriter, r *http.Request) {
+	history := ui.history()
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 0 || id >= len(history) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("there is no call %q", r.PathValue("id")))
+		return
+	}
+	req, err := replayRequest(r.Context(), history[id])
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, err)
+		return
+	}
+
+	req, reqbody := prepareRequest(req, tunnelAddr(req.URL.Host), req.URL.Scheme)
+	resp, err := ui.transport.RoundTrip(req)
+	if err != nil {
+		// this includes resets asked for by --rules faults, since there is no connection here to reset
+		resp = badGatewayResponse(err)
+		errorf("error replaying request to %v: %v, returning %v", req.URL, err, resp.Status)
+	}
+	var respbody bodyCapture
+	if _, err := io.Copy(&respbody, resp.Body); err != nil {
+		verbosef("error reading response to replayed request to %v: %v", req.URL, err)
+	}
+	resp.Body.Close()
+
+	call := newHTTPCall(req, reqbody, resp, &respbody, reqbody.Len()+respbody.Len())
+	captured, newID := notifyHTTP(call)
+	if captured == nil {
+		captured = redactCall(call)
+	}
+	writeAPIResponse(w, http.StatusOK, apiReplay{ID: newID, Call: captured})
+}
+
+// replayRequest makes a new request with the method, URL, headers, and body of a captured call, as the
+// subprocess sent them rather than as --redact-header and --scrub-rules left them, leaving out the headers
+// that the transport works out for itself
+func replayRequest(ctx context.Context, call *HTTPCall) (*http.Request, error) {
+	body, header := call.Request.Body, call.Request.Header
+	if call.sent != nil {
+		body, header = call.sent.body, call.sent.header
+	}
+	header = header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if call.Request.Truncated {
+		// bodies that were spilled to disk are kept there as they were sent
+		if call.Request.File == "" {
+			return nil, fmt.Errorf("the request body was cut short by --max-body-size, so it cannot be sent again")
+		}
+		var err error
+		body, err = os.ReadFile(call.Request.File)
+		if err != nil {
+			return nil, fmt.Errorf("error reading request body: %w", err)
+		}
+	} else {
+		// bodies are captured decompressed
+		header.Del("Content-Encoding")
+	}
+	for _, name := range replayOmitHeaders {
+		header.Del(name)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, call.Request.Method, call.Request.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+	req.Header = header
+	return req, nil
+}
+
+// wsSubscription chooses which HTTP calls are sent to a client of /api/ws. Calls are sent if they match
+// any of the hosts, or there are none, and any of the statuses, or there are none.
+type wsSubscription struct {
+	Hosts  []string `json:"hosts,omitempty"`  // patterns such as "*.example.com"
+	Status []string `json:"status,omitempty"` // classes such as "4xx", or codes such as "404"
+}
+
+// check returns an error if a status is neither a class nor a code
+func (s *wsSubscription) check() error {
+	for _, status := range s.Status {
+		class, ok := strings.CutSuffix(strings.ToLower(status), "xx")
+		if ok && len(class) == 1 && class >= "1" && class <= "5" {
+			continue
+		}
+		if code, err := strconv.Atoi(status); err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("status must be a class such as 4xx or a code such as 404, not %q", status)
+		}
+	}
+	return nil
+}
+
+// matches checks whether a call is one that the client asked for
+func (s *wsSubscription) matches(call *HTTPCall) bool {
+	if len(s.Hosts) > 0 {
+		u, err := url.Parse(call.Request.URL)
+		if err != nil || !slices.ContainsFunc(s.Hosts, func(host string) bool { return reqmatch.Host(host, u.Hostname()) }) {
+			return false
+		}
+	}
+	if len(s.Status) > 0 {
+		code := strconv.Itoa(call.Response.StatusCode)
+		if !slices.ContainsFunc(s.Status, func(status string) bool {
+			return status == code || strings.EqualFold(status, code[:1]+"xx")
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// serveWebSocket streams new HTTP calls over a websocket, for clients that cannot use server-sent events,
+// as when behind proxies that buffer responses. Each message is JSON in the form {"type": "call", "data":
+// {...}}. Clients choose which calls they receive with the query parameters "host" and "status", which can
+// be repeated, and can change their choice at any time by sending a message such as {"hosts":
+// ["*.example.com"], "status": ["5xx"]}, which is answered with a message of type "subscribed", or "error"
+// if it cannot be understood.
+func (ui *webUI) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("/api/ws only accepts websocket connections"))
+		return
+	}
+	// browsers let any page open a websocket, so pages from other origins are turned away here
+	if !ui.sameOrAllowedOrigin(r) {
+		writeAPIError(w, http.StatusForbidden, fmt.Errorf("pages from %v may not use the API, see --webui-cors", r.Header.Get("Origin")))
+		return
+	}
+	initial := &wsSubscription{Hosts: r.URL.Query()["host"], Status: r.URL.Query()["status"]}
+	if err := initial.check(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "websockets are not supported", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocket.AcceptKey(key))
+	if err := rw.Flush(); err != nil {
+		verbosef("error accepting websocket for the API: %v", err)
+		return
+	}
+
+	// frames are written both from here and, to answer pings and subscriptions, from the goroutine below
+	var mu sync.Mutex
+	write := func(op websocket.Opcode, payload []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := websocket.WriteFrame(rw, &websocket.Frame{Fin: true, Opcode: op, Payload: payload}); err != nil {
+			return err
+		}
+		return rw.Flush()
+	}
+	send := func(e apiEvent) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return write(websocket.OpText, data)
+	}
+
+	var subscription atomic.Pointer[wsSubscription]
+	subscription.Store(initial)
+	events, done := ui.events.subscribe()
+	defer done()
+
+	// read subscriptions until the client closes the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var message []byte
+		for {
+			frame, err := websocket.ReadFrame(rw)
+			if err != nil {
+				return
+			}
+			switch frame.Opcode {
+			case websocket.OpPing:
+				write(websocket.OpPong, frame.Payload)
+			case websocket.OpClose:
+				write(websocket.OpClose, nil)
+				return
+			case websocket.OpText, websocket.OpBinary, websocket.OpContinuation:
+				message = append(message, frame.Payload...)
+				if !frame.Fin {
+					continue
+				}
+				var s wsSubscription
+				err := json.Unmarshal(message, &s)
+				if err == nil {
+					err = s.check()
+				}
+				message = nil
+				if err != nil {
+					send(apiEvent{Type: "error", Data: err.Error()})
+					continue
+				}
+				subscription.Store(&s)
+				send(apiEvent{Type: "subscribed", Data: &s})
+			}
+		}
+	}()
+
+	for {
+		select {
+		case e := <-events:
+			call, ok := e.Data.(*HTTPCall)
+			if !ok || !subscription.Load().matches(call) {
+				continue
+			}
+			if err := send(e); err != nil {
+				verbosef("error sending event over websocket to the API: %v", err)
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// writeAPIResponse writes a value as JSON
+func writeAPIResponse(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		verbosef("error writing API response: %v", err)
+	}
+}
+
+// writeAPIError writes an error as JSON in the form {"error": "..."}
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIResponse(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maximum number of bytes of each request and response body to keep in memory, or zero for no limit
+var maxBodySize int64
+
+// if not empty, bodies larger than maxBodySize are written in full to files in this directory
+var bodySpillDir string
+
+// if not empty, every body is written in full to a file in this directory named by its SHA-256
+var bodyDir string
+
+// bodyCapture records a request or response body as it streams through the proxy. Only the first
+// maxBodySize bytes are kept in memory. If bodyDir is set, every body is written in full to a file
+// there, and otherwise if bodySpillDir is set, a body that grows beyond the limit is written in full
+// to a file there.
+//
+// A request body may still be being sent by the transport after the response has arrived, so the
+// methods are safe to call while the body is being written.
+type bodyCapture struct {
+	mu     sync.Mutex
+	prefix bytes.Buffer
+	size   int64
+	file   *os.File
+	hash   hash.Hash // the SHA-256 of the whole body, if bodyDir is set
+	err    error     // the first error writing to file, after which the file is abandoned
+	closed bool      // set by Close, after which nothing more is written to disk
+}
+
+func (b *bodyCapture) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.size += int64(len(p))
+
+	keep := p
+	if maxBodySize > 0 {
+		room := max(maxBodySize-int64(b.prefix.Len()), 0)
+		if int64(len(keep)) > room {
+			keep = keep[:room]
+		}
+	}
+	b.prefix.Write(keep)
+
+	// decide what to write to disk, if anything
+	dir, rest := bodySpillDir, p[len(keep):]
+	if bodyDir != "" {
+		if b.hash == nil {
+			b.hash = sha256.New()
+		}
+		b.hash.Write(p)
+		dir, rest = bodyDir, p
+	}
+	if len(rest) == 0 || dir == "" || b.err != nil || b.closed {
+		return len(p), nil
+	}
+
+	// start writing to disk the first time there is something to write, which for bodies spilled
+	// because they exceeded the limit means first writing the part kept in memory
+	if b.file == nil {
+		b.file, b.err = os.CreateTemp(dir, "body-*")
+		if b.err == nil && bodyDir == "" {
+			_, b.err = b.file.Write(b.prefix.Bytes())
+		}
+	}
+	if b.err == nil {
+		_, b.err = b.file.Write(rest)
+	}
+	if b.err != nil {
+		errorf("error writing body to disk, it will be truncated: %v", b.err)
+	}
+
+	// errors writing to disk must not interrupt the proxied stream
+	return len(p), nil
+}
+
+// Bytes returns the part of the body that was kept in memory
+func (b *bodyCapture) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte{}, b.prefix.Bytes()...)
+}
+
+// Len returns the size of the whole body, including any part not kept in memory
+func (b *bodyCapture) Len() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Truncated returns true if only part of the body was kept in memory
+func (b *bodyCapture) Truncated() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size > int64(b.prefix.Len())
+}
+
+// SHA256 returns the hex-encoded SHA-256 of the whole body if it is being saved with --body-dir, or
+// otherwise the empty string
+func (b *bodyCapture) SHA256() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sha256()
+}
+
+func (b *bodyCapture) sha256() string {
+	if b.hash == nil {
+		return ""
+	}
+	return hex.EncodeToString(b.hash.Sum(nil))
+}
+
+// Close finishes writing the body to disk, if it was written there, and returns the path to the file.
+// Files in --body-dir are named by the SHA-256 of the body, so that a body seen more than once is
+// stored just once.
+func (b *bodyCapture) Close() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	if b.file == nil {
+		return "", nil
+	}
+	err := b.file.Close()
+	if err != nil {
+		return "", fmt.Errorf("error closing body file: %w", err)
+	}
+	if b.hash == nil {
+		if b.err != nil {
+			return "", b.err
+		}
+		return b.file.Name(), nil
+	}
+	if b.err != nil {
+		os.Remove(b.file.Name())
+		return "", b.err
+	}
+
+	path := filepath.Join(bodyDir, b.sha256())
+	if err := os.Rename(b.file.Name(), path); err != nil {
+		os.Remove(b.file.Name())
+		return "", fmt.Errorf("error renaming body file: %w", err)
+	}
+	return path, nil
+}
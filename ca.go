@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joemiller/certin"
+)
+
+// how long a certificate authority generated by storedCA remains valid
+const storedCADuration = 5 * 365 * 24 * time.Hour
+
+// the key types that may be chosen for generated certificates, as named by certin
+var keyTypes = []string{"rsa-2048", "rsa-3072", "rsa-4096", "ecdsa-256", "ecdsa-384"}
+
+// the key type used for generated certificates if none is chosen, which all clients accept
+const defaultKeyType = "rsa-2048"
+
+// the key type for certificates generated on the fly
+var leafKeyType = defaultKeyType
+
+// loadCA loads a certificate authority from a PEM-encoded certificate and private key, and checks
+// that it can be used to sign the certificates that we generate on the fly
+func loadCA(certPath, keyPath string) (*certin.KeyAndCert, error) {
+	ca, err := certin.LoadKeyAndCert(keyPath, certPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate authority from %v and %v: %w", certPath, keyPath, err)
+	}
+
+	if !ca.Certificate.IsCA {
+		return nil, fmt.Errorf("the certificate in %v is not a certificate authority", certPath)
+	}
+
+	pub, ok := ca.Certificate.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(ca.PublicKey) {
+		return nil, fmt.Errorf("the private key in %v does not match the certificate in %v", keyPath, certPath)
+	}
+
+	return ca, nil
+}
+
+// stateDir returns the directory in which httptap keeps state between runs, which is
+// $XDG_STATE_HOME/httptap, or ~/.local/state/httptap if XDG_STATE_HOME is not set
+func stateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "httptap"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error finding home directory: %w", err)
+	}
+	return filepath.Join(home, ".local", "state", "httptap"), nil
+}
+
+// storedCA loads the certificate authority with the given key type kept in dir from a previous run,
+// or generates one and stores it there if there is none yet or the stored one has expired. The private
+// key is readable only by the current user.
+func storedCA(dir, keyType string) (*certin.KeyAndCert, error) {
+	// certificate authorities with other key types are kept alongside the default one
+	name := "ca"
+	if keyType != defaultKeyType {
+		name = "ca-" + keyType
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+
+	// the certificate is written after the key, so if it exists then so does the key
+	_, err := os.Stat(certPath)
+	switch {
+	case err == nil:
+		ca, err := loadCA(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if time.Now().Before(ca.Certificate.NotAfter) {
+			// make sure that nobody else has been given access to the key in the meantime
+			st, err := os.Stat(keyPath)
+			if err == nil && st.Mode().Perm()&0077 != 0 {
+				verbosef("restricting permissions on %v", keyPath)
+				if err := os.Chmod(keyPath, 0600); err != nil {
+					return nil, fmt.Errorf("error restricting permissions on %v: %w", keyPath, err)
+				}
+			}
+
+			verbosef("using certificate authority from %v", certPath)
+			return ca, nil
+		}
+		verbosef("certificate authority in %v expired on %v, creating a new one", certPath, ca.Certificate.NotAfter)
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("error checking for certificate authority in %v: %w", dir, err)
+	}
+
+	ca, err := certin.NewCert(nil, certin.Request{
+		CN:       "httptap root CA",
+		IsCA:     true,
+		Duration: storedCADuration,
+		KeyType:  keyType,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating root CA: %w", err)
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating directory for certificate authority: %w", err)
+	}
+
+	// remove any previous files so that they are created afresh with the permissions below
+	os.Remove(certPath)
+	os.Remove(keyPath)
+
+	// the key is written with mode 0600 and the certificate with mode 0600, which we then relax
+	err = certin.ExportKeyAndCert(keyPath, certPath, ca)
+	if err != nil {
+		return nil, fmt.Errorf("error writing certificate authority to %v: %w", dir, err)
+	}
+
+	err = os.Chmod(certPath, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error setting permissions on %v: %w", certPath, err)
+	}
+
+	verbosef("created certificate authority in %v", certPath)
+	return ca, nil
+}
+
+// if not empty, certificates generated on the fly are also stored in this directory so that they can
+// be reused in later runs; this is only set when the certificate authority is itself reused
+var leafCertDir string
+
+// certificates generated on the fly are regenerated when they are this close to expiring
+const leafCertRenewBefore = 24 * time.Hour
+
+// certificates already generated on the fly, keyed by server name and alternate names
+var (
+	leafCerts   = make(map[string]*tls.Certificate)
+	leafCertsMu sync.Mutex
+)
+
+// leafCertificate returns a certificate for serverName and altNames signed by root, reusing one that
+// was generated earlier in this run or stored by an earlier run if possible, since signing is slow
+// compared to the rest of a TLS handshake
+func leafCertificate(root *certin.KeyAndCert, serverName string, altNames []string) (*tls.Certificate, error) {
+	key := leafKeyType + " " + serverName + " " + strings.Join(altNames, " ")
+
+	leafCertsMu.Lock()
+	cert, ok := leafCerts[key]
+	leafCertsMu.Unlock()
+	if ok && usableLeaf(cert.Leaf, root) {
+		return cert, nil
+	}
+
+	var path string
+	if leafCertDir != "" {
+		sum := sha256.Sum256([]byte(key))
+		path = filepath.Join(leafCertDir, hex.EncodeToString(sum[:16])+".pem")
+		cert, err := tls.LoadX509KeyPair(path, path)
+		if err == nil && usableLeaf(cert.Leaf, root) {
+			leafCertsMu.Lock()
+			leafCerts[key] = &cert
+			leafCertsMu.Unlock()
+			return &cert, nil
+		}
+	}
+
+	onthefly, err := certin.NewCert(root, certin.Request{CN: serverName, SANs: altNames, KeyType: leafKeyType})
+	if err != nil {
+		return nil, fmt.Errorf("error creating on-the-fly certificate for %q: %w", serverName, err)
+	}
+
+	tlscert := onthefly.TLSCertificate()
+
+	leafCertsMu.Lock()
+	leafCerts[key] = &tlscert
+	leafCertsMu.Unlock()
+
+	if path != "" {
+		err = storeLeaf(path, onthefly)
+		if err != nil {
+			// the certificate can still be used for this run
+			verbosef("error storing certificate for %q: %v", serverName, err)
+		}
+	}
+	return &tlscert, nil
+}
+
+// usableLeaf checks whether a certificate generated earlier was signed by root and is not about to expire
+func usableLeaf(leaf *x509.Certificate, root *certin.KeyAndCert) bool {
+	if leaf == nil || time.Now().Add(leafCertRenewBefore).After(leaf.NotAfter) {
+		return false
+	}
+	return leaf.CheckSignatureFrom(root.Certificate) == nil
+}
+
+// storeLeaf writes a certificate and its private key to a single PEM file readable only by the current user
+func storeLeaf(path string, cert *certin.KeyAndCert) error {
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("error marshaling private key: %w", err)
+	}
+
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate.Raw})
+	pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+
+	// write to a temporary file first so that a concurrent run never reads a partial file
+	f, err := os.CreateTemp(filepath.Dir(path), ".leaf-*")
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(buf.Bytes())
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("error writing %v: %w", f.Name(), err)
+	}
+	return os.Rename(f.Name(), path)
+}
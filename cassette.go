@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/monasticacademy/httptap/pkg/harlog"
+)
+
+// cassetteTransport answers requests with the responses recorded in a cassette, which is a HAR file,
+// without sending them anywhere. Requests with the same method and URL are answered with each
+// recorded response in turn, repeating the last one.
+type cassetteTransport struct {
+	entries     []*harlog.Entry
+	passthrough http.RoundTripper // where requests without a recorded response go, or nil to fail them
+
+	mu   sync.Mutex
+	used []bool
+}
+
+// openCassette sets up --cassette. In record mode every exchange is recorded in full to the cassette,
+// which is written by the returned function at program termination. In replay mode requests are
+// answered from the cassette, and those without a recorded response are sent to next if passthrough
+// is true and fail otherwise. If neither mode is chosen then the cassette is replayed if it exists and
+// recorded if not.
+func openCassette(path string, record, replay, passthrough bool, next http.RoundTripper) (http.RoundTripper, func(), error) {
+	if !record && !replay {
+		_, err := os.Stat(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			record = true
+		case err != nil:
+			return nil, nil, fmt.Errorf("error opening cassette: %w", err)
+		}
+	}
+
+	if record {
+		recorder := &harlog.Transport{
+			Transport: next,
+			UnusualError: func(err error) error {
+				verbosef("error recording to cassette: %v, ignoring", err)
+				return nil
+			},
+			RedactHeaders: redactHeaders,
+		}
+		verbosef("recording HTTP calls to cassette %v", path)
+		return recorder, func() {
+			if err := writeHAR(path, recorder.HAR()); err != nil {
+				errorf("error writing cassette: %v", err)
+			}
+		}, nil
+	}
+
+	har, err := readHAR(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading cassette: %w", err)
+	}
+	t := &cassetteTransport{entries: har.Log.Entries, used: make([]bool, len(har.Log.Entries))}
+	if passthrough {
+		t.passthrough = next
+	}
+	verbosef("replaying %d HTTP calls from cassette %v", len(t.entries), path)
+	return t, func() {}, nil
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := t.match(req)
+	if entry == nil {
+		if t.passthrough != nil {
+			return t.passthrough.RoundTrip(req)
+		}
+		return nil, fmt.Errorf("the cassette has no response for %v %v", req.Method, req.URL)
+	}
+	if req.Body != nil {
+		// read the request body so that it is captured as it would be if it had been sent
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	return cassetteResponse(req, entry)
+}
+
+// match finds the first unused entry with the method and URL of a request, or else the last used one
+func (t *cassetteTransport) match(req *http.Request) *harlog.Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last := -1
+	for i, e := range t.entries {
+		if e.Request == nil || e.Response == nil || e.Request.Method != req.Method || e.Request.URL != req.URL.String() {
+			continue
+		}
+		if !t.used[i] {
+			t.used[i] = true
+			return e
+		}
+		last = i
+	}
+	if last < 0 {
+		return nil
+	}
+	return t.entries[last]
+}
+
+// cassetteResponse makes a response to a request from a recorded HAR entry
+func cassetteResponse(req *http.Request, entry *harlog.Entry) (*http.Response, error) {
+	body, err := harResponseBody(entry.Response)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response from cassette: %w", err)
+	}
+
+	header := make(http.Header)
+	for _, h := range entry.Response.Headers {
+		if !strings.HasPrefix(h.Name, ":") {
+			header.Add(h.Name, h.Value)
+		}
+	}
+	// the body is sent as it was stored, so the length may have changed, and if the content encoding
+	// was removed before storing it then the header no longer applies
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	if entry.Response.Content != nil && entry.Response.Content.ContentEncoding != "" {
+		header.Del("Content-Encoding")
+	}
+
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Status:        fmt.Sprintf("%d %s", entry.Response.Status, entry.Response.StatusText),
+		StatusCode:    entry.Response.Status,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		Request:       req,
+	}, nil
+}
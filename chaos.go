@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chaosStatuses are the status codes that --chaos answers requests with
+var chaosStatuses = []int{500, 502, 503, 504}
+
+// chaosDelay is how long --chaos holds back a request that it delays
+var chaosDelay = delayRange{min: time.Second, max: 5 * time.Second}
+
+// errChaosDNS is returned for DNS queries that --chaos makes fail, which are answered with SERVFAIL
+var errChaosDNS = errors.New("failed by --chaos")
+
+// chaosMode brings about faults at random across all traffic: delays, error statuses, and resets for
+// HTTP requests, and failures for DNS queries. Its decisions come from a random number generator with a
+// known seed, so that a run can be repeated with the same decisions in the same order.
+type chaosMode struct {
+	probability float64 // fraction of requests and queries to bring about a fault for
+	seed        uint64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// the chaos given with --chaos, or nil if it was not given
+var chaos *chaosMode
+
+// parseChaosFlag parses a --chaos value, which is p=PROBABILITY with an optional seed, such as p=0.05 or
+// p=0.05,seed=42. A seed is chosen at random if none is given.
+func parseChaosFlag(s string) (*chaosMode, error) {
+	c := chaosMode{probability: -1, seed: rand.Uint64()}
+	for _, part := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		var err error
+		switch key {
+		case "p":
+			c.probability, err = strconv.ParseFloat(value, 64)
+			if err == nil && (c.probability < 0 || c.probability > 1) {
+				err = fmt.Errorf("p must be between 0 and 1")
+			}
+		case "seed":
+			c.seed, err = strconv.ParseUint(value, 10, 64)
+		default:
+			err = fmt.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error in --chaos %q: %w", s, err)
+		}
+	}
+	if c.probability < 0 {
+		return nil, fmt.Errorf("error in --chaos %q: expected p=PROBABILITY, such as p=0.05 or p=0.05,seed=42", s)
+	}
+	c.rng = rand.New(rand.NewPCG(c.seed, 0))
+	return &c, nil
+}
+
+// the kinds of fault that --chaos brings about for HTTP requests
+const (
+	chaosDelayed = iota
+	chaosStatus
+	chaosReset
+)
+
+// roll decides whether to bring about a fault, and if so returns a number below n to choose which kind,
+// or else -1
+func (c *chaosMode) roll(n int) int {
+	if c == nil {
+		return -1
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rng.Float64() >= c.probability {
+		return -1
+	}
+	return c.rng.IntN(n)
+}
+
+// pickStatus chooses a status code to answer a request with
+func (c *chaosMode) pickStatus() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return chaosStatuses[c.rng.IntN(len(chaosStatuses))]
+}
+
+// pickDelay chooses how long to hold back a request
+func (c *chaosMode) pickDelay() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return chaosDelay.min + time.Duration(c.rng.Int64N(int64(chaosDelay.max-chaosDelay.min)))
+}
+
+// failsDNS decides whether to make a DNS query fail
+func (c *chaosMode) failsDNS() bool {
+	return c.roll(1) == 0
+}
+
+// chaosTransport brings about faults at random for the HTTP requests that pass through it
+type chaosTransport struct {
+	chaos *chaosMode
+	next  http.RoundTripper
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch t.chaos.roll(3) {
+	case chaosDelayed:
+		d := t.chaos.pickDelay()
+		verbosef("chaos: holding back %v %v for %v", req.Method, req.URL, d)
+		if err := (&delayRange{min: d, max: d}).wait(req.Context()); err != nil {
+			return nil, err
+		}
+	case chaosStatus:
+		status := t.chaos.pickStatus()
+		verbosef("chaos: answering %v %v with %d", req.Method, req.URL, status)
+		return (&ruleFault{Status: status}).respond(req)
+	case chaosReset:
+		verbosef("chaos: resetting the connection for %v %v", req.Method, req.URL)
+		return (&ruleFault{Reset: true}).respond(req)
+	}
+	return t.next.RoundTrip(req)
+}
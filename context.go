@@ -7,3 +7,27 @@ type contextKey string
 // in the DialContext function associated with http transports to dial the same hostname that
 // the subprocess was dialing, regardless of what hostname is in HTTP request.
 var dialToContextKey contextKey = "httptap.dialTo"
+
+// a value for this context key is set on all HTTP requests intercepted by httptap, and contains the
+// name of the server that the request is for, which is used to choose a client certificate
+var serverNameContextKey contextKey = "httptap.serverName"
+
+// a value for this context key is set on HTTP requests received over intercepted TLS connections, and
+// contains the fingerprint of the ClientHello sent by the subprocess
+var tlsFingerprintContextKey contextKey = "httptap.tlsFingerprint"
+
+// a value for this context key is set on HTTP requests received over intercepted TLS connections on
+// which the subprocess presented a client certificate that can be forwarded to the world
+var clientCertContextKey contextKey = "httptap.clientCert"
+
+// a value for this context key is set on all HTTP requests intercepted by httptap, and contains the
+// time at which the request was received from the subprocess
+var startTimeContextKey contextKey = "httptap.startTime"
+
+// a value for this context key is set on the request of a response made up by a --rules mock, so that
+// the call can be marked as mocked wherever it is reported
+var mockedContextKey contextKey = "httptap.mocked"
+
+// a value for this context key is set on requests that were held back or rejected by --rate-limit, and is
+// "queued" or "rejected" accordingly
+var rateLimitedContextKey contextKey = "httptap.rateLimited"
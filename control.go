@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/monasticacademy/httptap/pkg/control"
+	"github.com/monasticacademy/httptap/pkg/harlog"
+)
+
+// controller changes how a running httptap behaves, on behalf of the control socket and the API served
+// with --webui
+type controller struct {
+	rules   *rulesTransport   // where rules are added
+	har     *harlog.Transport // what HAR exports come from, or nil if no HAR file is being written
+	rotator *harRotator       // what rotating HAR files rotates, or nil if HAR files are not being rotated
+}
+
+// setPaused pauses or resumes capture. Traffic is proxied either way.
+func (c *controller) setPaused(paused bool) {
+	capturePaused.Store(paused)
+}
+
+// setFilter replaces the expression given with --filter, or shows every call if expr is empty
+func (c *controller) setFilter(expr string) error {
+	if expr == "" {
+		callFilter.Store(nil)
+		return nil
+	}
+	f, err := parseFilter(expr)
+	if err != nil {
+		return fmt.Errorf("error in filter: %w", err)
+	}
+	callFilter.Store(f)
+	return nil
+}
+
+// filter returns the expression that calls are shown for, or the empty string if all calls are shown
+func (c *controller) filter() string {
+	if f := callFilter.Load(); f != nil {
+		return f.String()
+	}
+	return ""
+}
+
+// rotateHAR starts a new HAR file now
+func (c *controller) rotateHAR() error {
+	if c.rotator == nil {
+		return fmt.Errorf("HAR files are only rotated with --dump-har-rotate-size or --dump-har-rotate-interval")
+	}
+	c.rotator.rotate(true)
+	return nil
+}
+
+// exportHAR returns the HAR log of the calls made so far, or since the last rotation if HAR files are
+// being rotated
+func (c *controller) exportHAR() (*harlog.HARContainer, error) {
+	if c.har == nil {
+		return nil, fmt.Errorf("HAR logs are only kept with --dump-har")
+	}
+	return c.har.Snapshot(), nil
+}
+
+// runCommand carries out a command sent to the control socket by "httptap ctl"
+func (c *controller) runCommand(command string, args []string) (string, error) {
+	switch command {
+	case "pause":
+		c.setPaused(true)
+		return "capture paused", nil
+
+	case "resume":
+		c.setPaused(false)
+		return "capture resumed", nil
+
+	case "filter":
+		if err := c.setFilter(strings.Join(args, " ")); err != nil {
+			return "", err
+		}
+		if expr := c.filter(); expr != "" {
+			return "showing HTTP calls for which " + expr, nil
+		}
+		return "showing every HTTP call", nil
+
+	case "add-rules":
+		if len(args) != 1 {
+			return "", fmt.Errorf("add-rules takes the path of a rules file")
+		}
+		rules, err := loadRules(args[0])
+		if err != nil {
+			return "", fmt.Errorf("error loading rules: %w", err)
+		}
+		c.rules.add(rules...)
+		return fmt.Sprintf("added %d rules", len(rules)), nil
+
+	case "rotate":
+		if err := c.rotateHAR(); err != nil {
+			return "", err
+		}
+		return "rotated HAR file", nil
+
+	case "stats":
+		return summaryText(), nil
+
+	default:
+		return "", fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// ctlMain implements "httptap ctl", which sends a command to the control socket of a running httptap
+func ctlMain(argv []string) error {
+	var args struct {
+		Socket  string   `arg:"--socket,env:HTTPTAP_CONTROL_SOCKET" help:"control socket of the httptap to send the command to, if there is more than one"`
+		Command string   `arg:"positional,required" help:"pause, resume, filter [EXPR], add-rules FILE, rotate, or stats"`
+		Args    []string `arg:"positional" help:"arguments of the command"`
+	}
+	if err := parseSubcommand("ctl", argv, &args); err != nil {
+		return err
+	}
+
+	output, err := control.Run(args.Socket, args.Command, args.Args)
+	if output != "" {
+		log.Print(output)
+	}
+	return err
+}
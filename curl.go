@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/monasticacademy/httptap/pkg/shellquote"
+)
+
+// headers that curl works out for itself from the command line, so they are left out of --curl output
+var curlOmitHeaders = []string{"Content-Length", "Transfer-Encoding", "Connection"}
+
+// curlCommand makes a curl command line that repeats the request in an HTTP call. A request body that
+// is plain text is given on the command line with --data-raw, and any other body is piped to curl with
+// printf, so that nothing is left behind in temporary files.
+func curlCommand(call *HTTPCall) string {
+	req := &call.Request
+	args := []string{"curl"}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodHead:
+		args = append(args, "--head")
+	default:
+		args = append(args, "-X", req.Method)
+	}
+	args = append(args, shellquote.Quote(req.URL))
+
+	// Body has had any content encoding removed, whereas File (if any) is the body as it was sent
+	var stdin string
+	omit := curlOmitHeaders
+	if req.File == "" && len(req.Body) > 0 {
+		omit = append(slices.Clip(omit), "Content-Encoding")
+		if req.Truncated {
+			errorf("the request body for %v %v in the curl command is truncated to %d of %d bytes, use --body-spill-dir or --body-dir to keep it in full",
+				req.Method, req.URL, len(req.Body), req.Size)
+		}
+	}
+
+	if u, err := url.Parse(req.URL); err == nil && req.Host != "" && req.Host != u.Host {
+		args = append(args, "-H", shellquote.Quote("Host: "+req.Host))
+	}
+	for _, k := range sortedKeys(req.Header) {
+		if slices.Contains(omit, k) {
+			continue
+		}
+		for _, v := range req.Header[k] {
+			args = append(args, "-H", shellquote.Quote(k+": "+v))
+		}
+	}
+	switch {
+	case req.File != "":
+		args = append(args, "--data-binary", shellquote.Quote("@"+req.File))
+	case len(req.Body) == 0:
+	case shellquote.IsPlainText(req.Body):
+		args = append(args, "--data-raw", shellquote.Quote(string(req.Body)))
+	default:
+		stdin = "printf " + shellquote.Printf(req.Body) + " | "
+		args = append(args, "--data-binary", "@-")
+	}
+	return stdin + strings.Join(args, " ")
+}
+
+// sortedKeys returns the keys of a header in order, so that the output is the same from run to run
+func sortedKeys(h http.Header) []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/monasticacademy/httptap/pkg/reqmatch"
+)
+
+// delayRange is how long to hold back a response, chosen at random between min and max
+type delayRange struct {
+	min, max time.Duration
+}
+
+// parseDelay parses a delay such as "300ms", or a jittered delay such as "200ms-400ms"
+func parseDelay(s string) (*delayRange, error) {
+	lo, hi, jittered := strings.Cut(s, "-")
+	min, err := time.ParseDuration(strings.TrimSpace(lo))
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a delay such as 300ms or 200ms-400ms", s)
+	}
+	max := min
+	if jittered {
+		max, err = time.ParseDuration(strings.TrimSpace(hi))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a delay such as 300ms or 200ms-400ms", s)
+		}
+	}
+	if min < 0 || max < min {
+		return nil, fmt.Errorf("%q is not a delay such as 300ms or 200ms-400ms", s)
+	}
+	return &delayRange{min: min, max: max}, nil
+}
+
+// pick chooses a delay
+func (d *delayRange) pick() time.Duration {
+	if d.max == d.min {
+		return d.min
+	}
+	return d.min + rand.N(d.max-d.min)
+}
+
+// wait sleeps for a delay, returning early with an error if the context is done first
+func (d *delayRange) wait(ctx context.Context) error {
+	t := time.NewTimer(d.pick())
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseDelayFlag makes a rule from a --delay value, which is either HOST=DELAY to hold back the
+// responses from matching hosts, or DELAY to hold back all responses
+func parseDelayFlag(s string) (*compiledRule, error) {
+	host, delay, ok := strings.Cut(s, "=")
+	if !ok {
+		host, delay = "", s
+	}
+	rule, err := compileRule(rewriteRule{Match: reqmatch.Match{Host: host}, Delay: delay}, "")
+	if err != nil {
+		return nil, fmt.Errorf("error in --delay %q: %w", s, err)
+	}
+	return rule, nil
+}
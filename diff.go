@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/monasticacademy/httptap/pkg/harlog"
+)
+
+// diffResult describes how one call differs between two HAR files
+type diffResult struct {
+	Change      string   `json:"change"` // "added", "removed", or "changed"
+	Method      string   `json:"method"`
+	URL         string   `json:"url"`
+	OldStatus   int      `json:"oldStatus,omitempty"`
+	NewStatus   int      `json:"newStatus,omitempty"`
+	Differences []string `json:"differences,omitempty"`
+}
+
+// diffSummary is the output of "httptap diff --json"
+type diffSummary struct {
+	Same    int           `json:"same"`
+	Changed int           `json:"changed"`
+	Added   int           `json:"added"`
+	Removed int           `json:"removed"`
+	Calls   []*diffResult `json:"calls"`
+}
+
+// diffMain implements "httptap diff", which compares the calls in two HAR files, such as those recorded
+// from two versions of a program
+func diffMain(argv []string) error {
+	var args struct {
+		Old          string   `arg:"positional,required" help:"HAR file recorded first"`
+		New          string   `arg:"positional,required" help:"HAR file to compare with it"`
+		IgnoreHeader []string `arg:"--ignore-header" help:"do not compare these headers, in addition to those that change on every request such as Date"`
+		JSON         bool     `arg:"--json" help:"print the differences as a JSON document rather than as text"`
+	}
+	if err := parseSubcommand("diff", argv, &args); err != nil {
+		return err
+	}
+
+	oldHAR, err := readHAR(args.Old)
+	if err != nil {
+		return err
+	}
+	newHAR, err := readHAR(args.New)
+	if err != nil {
+		return err
+	}
+	summary, err := diffHAR(oldHAR.Log.Entries, newHAR.Log.Entries, args.IgnoreHeader)
+	if err != nil {
+		return err
+	}
+
+	if args.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(summary); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range summary.Calls {
+			printDiffResult(r)
+		}
+		log.Printf("\ncompared %d calls: %d the same, %d changed, %d added, %d removed",
+			summary.Same+summary.Changed+summary.Added+summary.Removed, summary.Same, summary.Changed, summary.Added, summary.Removed)
+	}
+
+	// like diff(1), exit with code 1 if anything differed, without another message since the output
+	// already says what differed
+	if len(summary.Calls) > 0 {
+		return exitCode(1)
+	}
+	return nil
+}
+
+// diffKey identifies a call for matching it between two HAR files
+func diffKey(e *harlog.Entry) string {
+	return e.Request.Method + " " + normalizeURL(e.Request.URL)
+}
+
+// normalizeURL puts a URL in a form in which URLs that mean the same thing are equal: the scheme and
+// host in lower case, without a default port, with the query parameters sorted, and without a fragment
+func normalizeURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if u.Scheme == "http" && u.Port() == "80" || u.Scheme == "https" && u.Port() == "443" {
+		u.Host = u.Hostname()
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery = u.Query().Encode()
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
+
+// diffHAR matches the entries of two HAR files by method and URL and compares the matched pairs. When
+// the same call was made more than once, the first call in one file is matched with the first in the
+// other, and so on.
+func diffHAR(oldEntries, newEntries []*harlog.Entry, ignoreHeaders []string) (*diffSummary, error) {
+	unmatched := make(map[string][]*harlog.Entry)
+	for _, e := range newEntries {
+		if e.Request != nil {
+			unmatched[diffKey(e)] = append(unmatched[diffKey(e)], e)
+		}
+	}
+
+	summary := &diffSummary{Calls: []*diffResult{}}
+	for _, a := range oldEntries {
+		if a.Request == nil {
+			continue
+		}
+		key := diffKey(a)
+		r := &diffResult{Method: a.Request.Method, URL: a.Request.URL, OldStatus: harStatus(a)}
+		if len(unmatched[key]) == 0 {
+			r.Change = "removed"
+			summary.Removed++
+			summary.Calls = append(summary.Calls, r)
+			continue
+		}
+		b := unmatched[key][0]
+		unmatched[key] = unmatched[key][1:]
+
+		r.NewStatus = harStatus(b)
+		diffs, err := diffEntries(a, b, ignoreHeaders)
+		if err != nil {
+			return nil, fmt.Errorf("error comparing %v %v: %w", a.Request.Method, a.Request.URL, err)
+		}
+		if len(diffs) == 0 {
+			summary.Same++
+			continue
+		}
+		r.Change = "changed"
+		r.Differences = diffs
+		summary.Changed++
+		summary.Calls = append(summary.Calls, r)
+	}
+
+	// whatever was not matched in the new file was added, and is reported in the order it was made
+	for _, b := range newEntries {
+		if b.Request == nil {
+			continue
+		}
+		key := diffKey(b)
+		if len(unmatched[key]) == 0 || unmatched[key][0] != b {
+			continue
+		}
+		unmatched[key] = unmatched[key][1:]
+		summary.Added++
+		summary.Calls = append(summary.Calls, &diffResult{Change: "added", Method: b.Request.Method, URL: b.Request.URL, NewStatus: harStatus(b)})
+	}
+	return summary, nil
+}
+
+// diffEntries lists the differences between the responses in two HAR entries
+func diffEntries(a, b *harlog.Entry, ignoreHeaders []string) ([]string, error) {
+	switch {
+	case a.Response == nil && b.Response == nil:
+		return nil, nil
+	case a.Response == nil:
+		return []string{"no response was recorded in the old file"}, nil
+	case b.Response == nil:
+		return []string{"no response was recorded in the new file"}, nil
+	}
+
+	oldBody, err := harResponseBody(a.Response)
+	if err != nil {
+		return nil, err
+	}
+	newBody, err := harResponseBody(b.Response)
+	if err != nil {
+		return nil, err
+	}
+
+	old := *a.Response
+	old.Headers = nil
+	for _, h := range a.Response.Headers {
+		if !strings.HasPrefix(h.Name, ":") && !containsHeader(ignoreHeaders, h.Name) {
+			old.Headers = append(old.Headers, h)
+		}
+	}
+	header := make(http.Header)
+	for _, h := range b.Response.Headers {
+		if !strings.HasPrefix(h.Name, ":") && !containsHeader(ignoreHeaders, h.Name) {
+			header.Add(h.Name, h.Value)
+		}
+	}
+
+	diffs := compareResponses(&old, oldBody, header, newBody)
+	if a.Response.Status != b.Response.Status {
+		diffs = append([]string{fmt.Sprintf("status %d became %d", a.Response.Status, b.Response.Status)}, diffs...)
+	}
+	return diffs, nil
+}
+
+// containsHeader reports whether a list of header names contains a name, ignoring case
+func containsHeader(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// harStatus is the status code of the response in a HAR entry, or zero if there was none
+func harStatus(e *harlog.Entry) int {
+	if e.Response == nil {
+		return 0
+	}
+	return e.Response.Status
+}
+
+// printDiffResult prints one line for a call that differs, followed by its differences
+func printDiffResult(r *diffResult) {
+	switch r.Change {
+	case "added":
+		log.Printf("added    %v %v (%d)", r.Method, r.URL, r.NewStatus)
+	case "removed":
+		log.Printf("removed  %v %v (%d)", r.Method, r.URL, r.OldStatus)
+	default:
+		log.Printf("changed  %v %v (%d)", r.Method, r.URL, r.NewStatus)
+		for _, d := range r.Differences {
+			log.Printf("  %s", d)
+		}
+	}
+}
@@ -1,52 +1,53 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/monasticacademy/httptap/pkg/reqmatch"
 )
 
-// dnsCall is a summary of a dns request/response exposed to the application level observers
-type dnsCall struct {
-	queries []dnsQuery
+// DNSCall models a DNS question from the subprocess together with the answer that we gave, and is
+// exposed over the API and serialized to disk
+type DNSCall struct {
+	Time     time.Time     `json:"time"`
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Answers  []string      `json:"answers"`
+	Error    string        `json:"error,omitempty"`   // why resolution failed, in which case the answer was empty
+	Blocked  bool          `json:"blocked,omitempty"` // whether the name matched --dns-block
+	Duration time.Duration `json:"duration"`
 }
 
-// a dnsQuery is a query/response pair
-type dnsQuery interface {
-	Type() string
-	Query() string
-	Answers() []string
-}
-
-// dnsPairA is an A or AAAA query together with responses
-type dnsPairA struct {
-	typ     uint16
-	query   string
-	answers []net.IP
-}
-
-func (p dnsPairA) Type() string {
-	return dnsTypeCode(p.typ)
-}
-
-func (p dnsPairA) Query() string {
-	return p.query
-}
-
-func (p dnsPairA) Answers() []string {
-	var answers []string
-	for _, a := range p.answers {
-		answers = append(answers, a.String())
+// dnsAnswer formats the data of a resource record, for example an IP address for an A record
+func dnsAnswer(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A.String()
+	case *dns.AAAA:
+		return rr.AAAA.String()
+	case *dns.CNAME:
+		return rr.Target
+	default:
+		return strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
 	}
-	return answers
 }
 
 // dnsWatcher receives information about each intercepted DNS query, and the response provided
-type dnsWatcher func(*dnsCall)
+type dnsWatcher func(*DNSCall)
 
 // the listeners waiting for HTTPCalls
 var dnsWatchers []dnsWatcher
@@ -63,11 +64,15 @@ func watchDNS(w dnsWatcher) {
 }
 
 // call each DNS watcher
-func notifyDNSWatchers(call *dnsCall) {
+func notifyDNSWatchers(call *DNSCall) {
+	if !isCapturedHost(call.Name) {
+		return
+	}
+
 	dnsMu.Lock()
 	defer dnsMu.Unlock()
 
-	verbosef("notifying DNS watchers (%d query/response pairs)", len(call.queries))
+	verbosef("notifying DNS watchers (%v %v)", call.Name, call.Type)
 
 	for _, w := range dnsWatchers {
 		w(call)
@@ -76,43 +81,144 @@ func notifyDNSWatchers(call *dnsCall) {
 
 // handle a DNS query payload here is the application-level UDP payload
 func handleDNS(ctx context.Context, w io.Writer, payload []byte) {
+	buf := respondDNS(ctx, payload, true)
+	if buf == nil {
+		return
+	}
+
+	// always send the entire buffer in a single Write() since UDP writes one packet per call to Write()
+	verbosef("responding to DNS request with %d bytes...", len(buf))
+	_, err := w.Write(buf)
+	if err != nil {
+		errorf("error writing dns response: %v, abandoning...", err)
+		return
+	}
+}
+
+// handleDNSOverTCP answers DNS queries sent over a TCP connection, which clients use when a response
+// over UDP was truncated. Each message is preceded by its length as a 16-bit integer.
+func handleDNSOverTCP(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		payload := make([]byte, int(length[0])<<8|int(length[1]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			verbosef("error reading DNS query over TCP: %v", err)
+			return
+		}
+
+		buf := respondDNS(ctx, payload, false)
+		if buf == nil {
+			return
+		}
+		_, err := conn.Write(append([]byte{byte(len(buf) >> 8), byte(len(buf))}, buf...))
+		if err != nil {
+			errorf("error writing dns response over TCP: %v, abandoning...", err)
+			return
+		}
+	}
+}
+
+// respondDNS resolves a DNS query and returns the serialized response, or nil if there should be no
+// response. Responses sent over UDP are truncated to the size that the client can accept.
+func respondDNS(ctx context.Context, payload []byte, overUDP bool) []byte {
 	var req dns.Msg
 	err := req.Unpack(payload)
 	if err != nil {
 		errorf("error unpacking dns packet: %v, ignoring", err)
-		return
+		return nil
 	}
 
 	if req.Opcode != dns.OpcodeQuery {
 		errorf("ignoring a dns query with non-query opcode (%v)", req.Opcode)
-		return
+		return nil
 	}
 
 	// resolve the query
-	rrs, err := handleDNSQuery(ctx, &req)
+	start := time.Now()
+	var rrs []dns.RR
+	if len(req.Question) > 0 {
+		err = checkPolicyDNS(req.Question[0])
+	}
+	if err == nil && chaos.failsDNS() {
+		err = errChaosDNS
+	}
+	if err == nil {
+		rrs, err = handleDNSQuery(ctx, &req)
+	}
+	if err == nil && len(req.Question) > 0 {
+		if err = checkEgressDNS(req.Question[0], rrs); err != nil {
+			rrs = nil
+		}
+	}
 	if err != nil {
 		verbosef("DNS query returned: %v, sending a response with empty answer", err)
 		// do not abort here, continue on and send a reply with no answer
 	}
 
+	// notify DNS watchers of the question and the answer, including failures
+	if len(req.Question) > 0 {
+		call := DNSCall{
+			Time:     start,
+			Name:     req.Question[0].Name,
+			Type:     dnsTypeCode(req.Question[0].Qtype),
+			Answers:  []string{},
+			Duration: time.Since(start),
+		}
+		for _, rr := range rrs {
+			call.Answers = append(call.Answers, dnsAnswer(rr))
+		}
+		if err != nil {
+			call.Error = err.Error()
+		}
+		call.Blocked = errors.Is(err, errDNSBlocked)
+		notifyDNSWatchers(&call)
+	}
+
 	resp := new(dns.Msg)
 	resp.SetReply(&req)
 	resp.Answer = rrs
+	if (errors.Is(err, errDNSBlocked) && !dnsBlockZero) || errors.Is(err, errNotAllowed) || errors.Is(err, errDeniedByPolicy) {
+		resp.Rcode = dns.RcodeNameError
+	}
+	if errors.Is(err, errChaosDNS) {
+		resp.Rcode = dns.RcodeServerFailure
+	}
+
+	// pass on errors from upstream servers together with their authority section, which holds the SOA
+	// record that says how long the error may be cached, and any additional records other than the
+	// upstream's own EDNS options
+	var upstreamErr *upstreamDNSError
+	if errors.As(err, &upstreamErr) {
+		resp.Rcode = upstreamErr.response.Rcode
+		resp.Ns = upstreamErr.response.Ns
+		for _, rr := range upstreamErr.response.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				resp.Extra = append(resp.Extra, rr)
+			}
+		}
+	}
+
+	// large answers such as TXT records may not fit in a UDP packet, in which case the truncated flag
+	// tells the client to ask again over TCP
+	if overUDP {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
 
 	// serialize the response
 	buf, err := resp.Pack()
 	if err != nil {
 		errorf("error serializing dns response: %v, abandoning...", err)
-		return
-	}
-
-	// always send the entire buffer in a single Write() since UDP writes one packet per call to Write()
-	verbosef("responding to DNS request with %d bytes...", len(buf))
-	_, err = w.Write(buf)
-	if err != nil {
-		errorf("error writing dns response: %v, abandoning...", err)
-		return
+		return nil
 	}
+	return buf
 }
 
 func dnsTypeCode(t uint16) string {
@@ -307,17 +413,210 @@ var specialAddresses = map[string]net.IP{
 	specialHostName + ".": {169, 254, 77, 65},
 }
 
+// the DNS servers given with --dns-upstream, as host:port; if not empty then every query other than for
+// the special host name is forwarded to these servers in order until one of them answers
+var dnsUpstreams []string
+
+// host patterns such as "telemetry.example.com" or "*.doubleclick.net" for which DNS queries are blocked
+var dnsBlockHosts []string
+
+// if true then blocked names resolve to 0.0.0.0 and :: rather than not existing
+var dnsBlockZero bool
+
+// errDNSBlocked is returned by handleDNSQuery for names that match --dns-block
+var errDNSBlocked = errors.New("blocked by --dns-block")
+
+// isDNSBlocked checks whether DNS queries for a name should be blocked
+func isDNSBlocked(name string) bool {
+	for _, pattern := range dnsBlockHosts {
+		if reqmatch.Host(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// the nameservers listed in the host's resolv.conf, as host:port, which queries other than A and AAAA
+// are forwarded to when no upstream servers are given
+var hostNameservers = []string{"1.1.1.1:53"}
+
+// parseDNSUpstream parses a DNS server given as an IP address or host with an optional port, as a
+// DNS-over-TLS server such as tls://9.9.9.9, or as a DNS-over-HTTPS URL such as
+// https://cloudflare-dns.com/dns-query
+func parseDNSUpstream(s string) (string, error) {
+	if strings.HasPrefix(s, "https://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", fmt.Errorf("error parsing DNS-over-HTTPS URL: %w", err)
+		}
+		if u.Host == "" {
+			return "", fmt.Errorf("DNS-over-HTTPS URL %q has no host", s)
+		}
+		return s, nil
+	}
+
+	addr, isTLS := strings.CutPrefix(s, "tls://")
+	defaultPort := "53"
+	if isTLS {
+		defaultPort = "853"
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		if host == "" {
+			return "", fmt.Errorf("empty DNS server address in %q", s)
+		}
+		addr = net.JoinHostPort(host, defaultPort)
+	}
+	if isTLS {
+		return "tls://" + addr, nil
+	}
+	return addr, nil
+}
+
+// readResolvConf reads the nameservers from a resolv.conf file on the host, which must happen before
+// /etc is overlaid
+func readResolvConf(path string) ([]string, error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	for _, server := range conf.Servers {
+		servers = append(servers, net.JoinHostPort(server, conf.Port))
+	}
+	return servers, nil
+}
+
+// overlayResolvConf returns the contents of the resolv.conf seen by the subprocess, which is the host's
+// resolv.conf with its nameservers replaced by ours. Everything else, such as search domains, ndots, and
+// other options, is kept so that short names resolve as they do on the host.
+func overlayResolvConf(original []byte, nameservers ...string) []byte {
+	var buf bytes.Buffer
+	for _, nameserver := range nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", nameserver)
+	}
+	for _, line := range strings.SplitAfter(string(original), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "nameserver" {
+			continue
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 && buf.Bytes()[buf.Len()-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// exchangeDNS sends a query to each of the given servers in turn and returns the first response
+func exchangeDNS(ctx context.Context, req *dns.Msg, servers []string) (*dns.Msg, error) {
+	var errs []error
+	for _, server := range servers {
+		response, err := exchangeDNSWith(ctx, req, server)
+		if err != nil {
+			verbosef("error querying DNS server %v: %v", server, err)
+			errs = append(errs, fmt.Errorf("%v: %w", server, err))
+			continue
+		}
+		return response, nil
+	}
+	return nil, fmt.Errorf("error in DNS message exchange: %w", errors.Join(errs...))
+}
+
+// exchangeDNSWith sends a query to a server as returned by parseDNSUpstream, retrying plain DNS over
+// TCP if the response is truncated
+func exchangeDNSWith(ctx context.Context, req *dns.Msg, server string) (*dns.Msg, error) {
+	if strings.HasPrefix(server, "https://") {
+		return exchangeDoH(ctx, req, server)
+	}
+
+	if addr, ok := strings.CutPrefix(server, "tls://"); ok {
+		host, _, _ := net.SplitHostPort(addr)
+		dnsClient := dns.Client{
+			Net:       "tcp-tls",
+			TLSConfig: &tls.Config{ServerName: host, RootCAs: upstreamRoots},
+		}
+		response, _, err := dnsClient.ExchangeContext(ctx, req, addr)
+		return response, err
+	}
+
+	dnsClient := dns.Client{Net: "udp", UDPSize: dns.DefaultMsgSize}
+	response, _, err := dnsClient.ExchangeContext(ctx, req, server)
+	if err == nil && response.Truncated {
+		dnsClient.Net = "tcp"
+		response, _, err = dnsClient.ExchangeContext(ctx, req, server)
+	}
+	return response, err
+}
+
+// the HTTP client used for DNS-over-HTTPS, which verifies servers against the system certificate
+// authorities loaded before they were overlaid
+var dohClient = sync.OnceValue(func() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   &tls.Config{RootCAs: upstreamRoots},
+			ForceAttemptHTTP2: true,
+		},
+	}
+})
+
+// the largest DNS-over-HTTPS response that we read
+const maxDoHResponse = 64 << 10
+
+// exchangeDoH sends a query to a DNS-over-HTTPS server as specified by RFC 8484
+func exchangeDoH(ctx context.Context, req *dns.Msg, url string) (*dns.Msg, error) {
+	// the ID is zero so that responses can be cached by HTTP caches
+	query := req.Copy()
+	query.Id = 0
+	payload, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("error packing DNS query: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("error constructing DNS-over-HTTPS request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+
+	httpResp, err := dohClient().Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server returned %v", httpResp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, maxDoHResponse))
+	if err != nil {
+		return nil, fmt.Errorf("error reading DNS-over-HTTPS response: %w", err)
+	}
+
+	var response dns.Msg
+	err = response.Unpack(body)
+	if err != nil {
+		return nil, fmt.Errorf("error unpacking DNS-over-HTTPS response: %w", err)
+	}
+	response.Id = req.Id
+	return &response, nil
+}
+
 // handleDNSQuery answers DNS queries according to:
 //
+//	the addresses given with --resolve and --hosts-file
+//	the fake IPs handed out in fake-IP mode, for A and AAAA requests and reverse lookups
+//	the resolvers given with --dns-upstream, for requests of any type
 //	net.DefaultResolver if the DNS request is A or AAAA
-//	cloudflare DNS for other DNS requests
+//	the nameservers in the host's resolv.conf for other DNS requests, such as CNAME, SRV, TXT, MX, and PTR
 //
 // It always returns the special IP 169.254.77.65 for the special name host.httptap.local.
 // Traffic sent to this address is routed to the loopback interface on the host (different
 // from the loopback device seen by the subprocess)
 func handleDNSQuery(ctx context.Context, req *dns.Msg) ([]dns.RR, error) {
-	const upstreamDNS = "1.1.1.1:53" // TODO: get from resolv.conf and nsswitch.conf
-
 	if len(req.Question) == 0 {
 		return nil, nil // this means no answer, no error, which is fine
 	}
@@ -326,8 +625,88 @@ func handleDNSQuery(ctx context.Context, req *dns.Msg) ([]dns.RR, error) {
 	questionType := dnsTypeCode(question.Qtype)
 	verbosef("got dns request for %v (%v)", question.Name, questionType)
 
-	// the DNS call will be sent to watchers later
-	var call dnsCall
+	_, special := specialAddresses[question.Name]
+
+	// names given with --resolve or --hosts-file resolve to the chosen addresses
+	if question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA {
+		if rrs, ok := staticHostRecords(question.Name, question.Qtype); ok {
+			verbosef("resolved %v to %v from static hosts", question.Name, rrs)
+			return rrs, nil
+		}
+	}
+
+	// names given with --dns-block do not exist, or resolve to unroutable addresses
+	if !special && isDNSBlocked(question.Name) {
+		verbosef("blocked DNS query for %v (%v)", question.Name, questionType)
+		var rrs []dns.RR
+		if dnsBlockZero {
+			hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 60}
+			switch question.Qtype {
+			case dns.TypeA:
+				rrs = append(rrs, &dns.A{Hdr: hdr, A: net.IPv4zero})
+			case dns.TypeAAAA:
+				rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+			}
+		}
+		return rrs, errDNSBlocked
+	}
+
+	// in fake-IP mode, answer A queries with an address that identifies the name
+	if fakeIPs != nil && !special {
+		switch question.Qtype {
+		case dns.TypeA:
+			ip := fakeIPs.ipFor(question.Name)
+			verbosef("assigned fake IP %v to %v", ip, question.Name)
+			return []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: fakeIPTTL},
+				A:   ip.AsSlice(),
+			}}, nil
+		case dns.TypeAAAA:
+			// there are no fake IPv6 addresses, so an empty answer makes clients fall back to IPv4
+			return nil, nil
+		}
+	}
+
+	// reverse lookups of addresses that we chose are answered with the names they were chosen for
+	if question.Qtype == dns.TypePTR {
+		if name, ok := localReverseName(question.Name); ok {
+			verbosef("resolved %v to %v locally", question.Name, name)
+			return []dns.RR{&dns.PTR{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
+				Ptr: dns.Fqdn(name),
+			}}, nil
+		}
+	}
+
+	// answers from resolvers are cached according to their TTLs
+	if rrs, ok := dnsAnswers.get(question); ok {
+		verbosef("answered %v (%v) from cache", question.Name, questionType)
+		recordResolvedNames(question, rrs)
+		return rrs, nil
+	}
+
+	rrs, err := resolveDNSQuery(ctx, req, special)
+	if err == nil {
+		dnsAnswers.put(question, rrs)
+		recordResolvedNames(question, rrs)
+	}
+	return rrs, err
+}
+
+// the TTL in seconds of answers from the default resolver, which does not say how long its answers are
+// valid for. It is short so that neither the subprocess nor our cache holds on to addresses that have
+// changed, which is how many services fail over.
+const defaultResolverTTL = 30
+
+// resolveDNSQuery resolves the first question in a request with the resolvers given on the command line,
+// or else with the host's resolver and nameservers
+func resolveDNSQuery(ctx context.Context, req *dns.Msg, special bool) ([]dns.RR, error) {
+	question := req.Question[0]
+
+	// forward everything to the resolvers given on the command line, if any
+	if len(dnsUpstreams) > 0 && !special {
+		return forwardDNSQuery(ctx, req, dnsUpstreams)
+	}
 
 	// handle the request ourselves
 	switch question.Qtype {
@@ -343,69 +722,119 @@ func handleDNSQuery(ctx context.Context, req *dns.Msg) ([]dns.RR, error) {
 			}
 		}
 
-		call.queries = append(call.queries, dnsPairA{
-			typ:     dns.TypeA,
-			query:   question.Name,
-			answers: ips,
-		})
-
 		verbosef("resolved %v to %v with default resolver", question.Name, ips)
 
 		var rrs []dns.RR
 		for _, ip := range ips {
-			rr, err := dns.NewRR(fmt.Sprintf("%s A %s", question.Name, ip))
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d A %s", question.Name, defaultResolverTTL, ip))
 			if err != nil {
 				return nil, fmt.Errorf("error constructing rr: %w", err)
 			}
 			rrs = append(rrs, rr)
 		}
 
-		// notify DNS watchers of the request/response pairs
-		notifyDNSWatchers(&call)
-
 		return rrs, nil
 
 	case dns.TypeAAAA:
+		// the special name has only an IPv4 address
+		if special {
+			return nil, nil
+		}
+
 		ips, err := net.DefaultResolver.LookupIP(ctx, "ip6", question.Name)
 		if err != nil {
 			return nil, fmt.Errorf("for an AAAA record the default resolver said (AAAA record): %w", err)
 		}
 
-		call.queries = append(call.queries, dnsPairA{
-			typ:     dns.TypeAAAA,
-			query:   question.Name,
-			answers: ips,
-		})
-
 		verbosef("resolved %v to %v with default resolver", question.Name, ips)
 
 		var rrs []dns.RR
 		for _, ip := range ips {
-			rr, err := dns.NewRR(fmt.Sprintf("%s AAAA %s", question.Name, ip))
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d AAAA %s", question.Name, defaultResolverTTL, ip))
 			if err != nil {
 				return nil, fmt.Errorf("error constructing rr: %w", err)
 			}
 			rrs = append(rrs, rr)
 		}
 
-		// notify DNS watchers of the request/response pairs
-		notifyDNSWatchers(&call)
-
 		return rrs, nil
 	}
 
-	verbosef("proxying %s request to upstream DNS server...", questionType)
+	verbosef("proxying %s request to upstream DNS server...", dnsTypeCode(question.Qtype))
+	return forwardDNSQuery(ctx, req, hostNameservers)
+}
+
+// reverseLookupIP parses the IP address from a name used for reverse lookups, such as
+// 4.3.2.1.in-addr.arpa. or the nibble form under ip6.arpa.
+func reverseLookupIP(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		parts := strings.Split(labels, ".")
+		if len(parts) != 4 {
+			return nil
+		}
+		slices.Reverse(parts)
+		return net.ParseIP(strings.Join(parts, ".")).To4()
+	}
+	if nibbles, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		parts := strings.Split(nibbles, ".")
+		if len(parts) != 32 {
+			return nil
+		}
+		slices.Reverse(parts)
+		b, err := hex.DecodeString(strings.Join(parts, ""))
+		if err != nil {
+			return nil
+		}
+		return net.IP(b)
+	}
+	return nil
+}
+
+// localReverseName returns the name for a reverse lookup of the special address, a fake IP, or an
+// address given with --resolve or --hosts-file
+func localReverseName(name string) (string, bool) {
+	ip := reverseLookupIP(name)
+	if ip == nil {
+		return "", false
+	}
+	if ip.Equal(net.ParseIP(specialHostIP)) {
+		return specialHostName, true
+	}
+	if host, ok := fakeIPName(ip); ok {
+		return host, true
+	}
+	return staticHostName(ip)
+}
+
+// upstreamDNSError is returned when an upstream DNS server answers with an error code, such as NXDOMAIN,
+// so that the code and the records that come with it can be passed on to the subprocess
+type upstreamDNSError struct {
+	response *dns.Msg
+}
 
-	// proxy the request to another server
+func (e *upstreamDNSError) Error() string {
+	return fmt.Sprintf("upstream DNS server said %v", dns.RcodeToString[e.response.Rcode])
+}
+
+// forwardDNSQuery forwards the first question in a request to the given servers and returns the answers
+func forwardDNSQuery(ctx context.Context, req *dns.Msg, servers []string) ([]dns.RR, error) {
 	request := new(dns.Msg)
 	req.CopyTo(request)
-	request.Question = []dns.Question{question}
+	request.Question = req.Question[:1]
 
-	dnsClient := new(dns.Client)
-	dnsClient.Net = "udp"
-	response, _, err := dnsClient.Exchange(request, upstreamDNS)
+	// ask for responses larger than 512 bytes over UDP, since answers such as TXT records are often
+	// larger, and otherwise fall back to TCP for them
+	if request.IsEdns0() == nil {
+		request.SetEdns0(dns.DefaultMsgSize, false)
+	}
+
+	response, err := exchangeDNS(ctx, request, servers)
 	if err != nil {
-		return nil, fmt.Errorf("error in DNS message exchange: %w", err)
+		return nil, err
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return nil, &upstreamDNSError{response}
 	}
 
 	verbosef("got answer from upstream dns server with %d answers", len(response.Answer))
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// the most answers kept in the DNS cache, beyond which new answers are not cached until old ones expire
+const maxDNSCacheEntries = 10000
+
+// dnsCacheKey identifies a DNS question in the cache
+type dnsCacheKey struct {
+	name  string // lowercase
+	qtype uint16
+}
+
+// dnsCacheEntry is a cached answer together with when it was stored and when it expires
+type dnsCacheEntry struct {
+	rrs     []dns.RR
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache keeps the answers given by resolvers for as long as their TTLs allow, clamped to a range
+type dnsCache struct {
+	minTTL  time.Duration
+	maxTTL  time.Duration
+	mu      sync.Mutex
+	entries map[dnsCacheKey]dnsCacheEntry
+}
+
+// the cache of answers from resolvers, or nil if caching is disabled
+var dnsAnswers *dnsCache
+
+// newDNSCache creates a cache that keeps each answer for its smallest TTL, clamped between minTTL and maxTTL
+func newDNSCache(minTTL, maxTTL time.Duration) *dnsCache {
+	return &dnsCache{
+		minTTL:  minTTL,
+		maxTTL:  maxTTL,
+		entries: make(map[dnsCacheKey]dnsCacheEntry),
+	}
+}
+
+// get returns a cached answer to a question, with TTLs reduced by the time since it was stored. It
+// can be called on a nil cache, which never contains anything.
+func (c *dnsCache) get(q dns.Question) ([]dns.RR, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	key := dnsCacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype}
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	// the records are copied so that the TTLs of the cached records are unchanged
+	elapsed := uint32(time.Since(entry.stored).Seconds())
+	var rrs []dns.RR
+	for _, rr := range entry.rrs {
+		rr = dns.Copy(rr)
+		if strings.EqualFold(rr.Header().Name, q.Name) {
+			rr.Header().Name = q.Name // answer in the case that was asked
+		}
+		if ttl := rr.Header().Ttl; ttl > elapsed {
+			rr.Header().Ttl = ttl - elapsed
+		} else {
+			rr.Header().Ttl = 1
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, true
+}
+
+// put stores the answer to a question. Empty answers are not cached because they carry no TTL. It can
+// be called on a nil cache, which does nothing.
+func (c *dnsCache) put(q dns.Question, rrs []dns.RR) {
+	if c == nil || len(rrs) == 0 {
+		return
+	}
+
+	ttl := time.Duration(rrs[0].Header().Ttl) * time.Second
+	for _, rr := range rrs[1:] {
+		ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	ttl = max(ttl, c.minTTL)
+	if c.maxTTL > 0 {
+		ttl = min(ttl, c.maxTTL)
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	key := dnsCacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// make room by removing expired answers
+	if len(c.entries) >= maxDNSCacheEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxDNSCacheEntries {
+			return
+		}
+	}
+
+	c.entries[key] = dnsCacheEntry{rrs: rrs, stored: now, expires: now.Add(ttl)}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/monasticacademy/httptap/pkg/reqmatch"
+)
+
+// host patterns such as "api.example.com" or "*.example.com", and networks such as 10.0.0.0/8, given
+// with --allow and --allow-file. If both are empty then all traffic is allowed.
+var (
+	allowHosts    []string
+	allowNetworks []*net.IPNet
+)
+
+// whether to refuse traffic that is not allowed, rather than only report it
+var enforceAllow bool
+
+// errNotAllowed is returned by checkEgressDNS for names that are not allowed when --enforce is given
+var errNotAllowed = errors.New("not allowed by --allow")
+
+// addAllow adds an entry given with --allow or in a file given with --allow-file, which is either a host
+// pattern or a network in CIDR notation. A bare IP address is taken as a network of one address.
+func addAllow(entry string) error {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return nil
+	}
+	if _, network, err := net.ParseCIDR(entry); err == nil {
+		allowNetworks = append(allowNetworks, network)
+		return nil
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		allowNetworks = append(allowNetworks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+	if strings.ContainsAny(entry, "/: ") {
+		return fmt.Errorf("%q is neither a host pattern nor a network such as 10.0.0.0/8", entry)
+	}
+	allowHosts = append(allowHosts, entry)
+	return nil
+}
+
+// allowing reports whether --allow or --allow-file were given
+func allowing() bool {
+	return len(allowHosts) > 0 || len(allowNetworks) > 0
+}
+
+// isAllowedHost checks whether a name matches a pattern given with --allow
+func isAllowedHost(host string) bool {
+	for _, pattern := range allowHosts {
+		if reqmatch.Host(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedIP checks whether an address is in a network given with --allow
+func isAllowedIP(ip net.IP) bool {
+	return slices.ContainsFunc(allowNetworks, func(n *net.IPNet) bool { return n.Contains(ip) })
+}
+
+// EgressViolation describes a DNS query or connection from the subprocess to something that is not
+// allowed by --allow, which was refused if --enforce was given and otherwise only reported
+type EgressViolation struct {
+	Kind    string    `json:"kind"` // "dns", "tcp", or "udp"
+	Host    string    `json:"host"`
+	Addr    string    `json:"addr,omitempty"`
+	Refused bool      `json:"refused"`
+	Time    time.Time `json:"time"`
+}
+
+// egressViolationWatcher receives information about each violation of --allow
+type egressViolationWatcher func(*EgressViolation)
+
+// the watchers waiting for violations of --allow, and the violations so far
+var (
+	egressViolationWatchers []egressViolationWatcher
+	egressViolations        []*EgressViolation
+)
+
+// the mutex that protects the above slices
+var egressViolationMu sync.Mutex
+
+// add a watcher that will be called for each violation of --allow
+func watchEgressViolations(w egressViolationWatcher) {
+	egressViolationMu.Lock()
+	defer egressViolationMu.Unlock()
+
+	egressViolationWatchers = append(egressViolationWatchers, w)
+}
+
+// record a violation of --allow and call each watcher
+func notifyEgressViolationWatchers(v *EgressViolation) {
+	egressViolationMu.Lock()
+	defer egressViolationMu.Unlock()
+
+	egressViolations = append(egressViolations, v)
+	for _, w := range egressViolationWatchers {
+		w(v)
+	}
+}
+
+// checkEgressConn checks whether the subprocess may connect to an address, reporting a violation if not.
+// It returns false if the connection should be refused.
+func checkEgressConn(kind string, addr net.Addr) bool {
+	if !allowing() {
+		return true
+	}
+
+	// DNS queries are answered by httptap and checked by name, in checkEgressDNS
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil || port == "53" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && isAllowedIP(ip) {
+		return true
+	}
+	name := destinationHost(addr.String())
+	if isAllowedHost(name) {
+		return true
+	}
+
+	notifyEgressViolationWatchers(&EgressViolation{
+		Kind:    kind,
+		Host:    name,
+		Addr:    addr.String(),
+		Refused: enforceAllow,
+		Time:    time.Now(),
+	})
+	return !enforceAllow
+}
+
+// checkEgressDNS checks whether the subprocess may look up a name, reporting a violation if not. Names
+// that match a host pattern are allowed, as are names whose addresses are all in allowed networks.
+// Reverse lookups are always allowed, since they do not reach the address looked up. If --enforce was
+// given then errNotAllowed is returned for names that are not allowed.
+func checkEgressDNS(question dns.Question, rrs []dns.RR) error {
+	if !allowing() || question.Qtype == dns.TypePTR || isAllowedHost(question.Name) {
+		return nil
+	}
+
+	var addrs int
+	allowed := true
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs++
+			allowed = allowed && isAllowedIP(rr.A)
+		case *dns.AAAA:
+			addrs++
+			allowed = allowed && isAllowedIP(rr.AAAA)
+		}
+	}
+	if addrs > 0 && allowed {
+		return nil
+	}
+
+	notifyEgressViolationWatchers(&EgressViolation{
+		Kind:    "dns",
+		Host:    normalizeHost(question.Name),
+		Refused: enforceAllow,
+		Time:    time.Now(),
+	})
+	if enforceAllow {
+		return errNotAllowed
+	}
+	return nil
+}
+
+// reportEgressViolations prints the hosts and addresses that the subprocess tried to reach that are not
+// allowed by --allow, once each
+func reportEgressViolations() {
+	egressViolationMu.Lock()
+	defer egressViolationMu.Unlock()
+	if len(egressViolations) == 0 {
+		return
+	}
+
+	var destinations []string
+	for _, v := range egressViolations {
+		d := v.Host
+		if v.Addr != "" {
+			d = fmt.Sprintf("%s (%s %s)", v.Host, v.Kind, v.Addr)
+		}
+		if !slices.Contains(destinations, d) {
+			destinations = append(destinations, d)
+		}
+	}
+
+	var b strings.Builder
+	verb := "contacted"
+	if enforceAllow {
+		verb = "refused"
+	}
+	fmt.Fprintf(&b, "\n%d destinations not allowed by --allow were %s:\n\n", len(destinations), verb)
+	for _, d := range destinations {
+		fmt.Fprintln(&b, d)
+	}
+	log.Print(b.String())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/monasticacademy/httptap/pkg/filter"
+	"github.com/monasticacademy/httptap/pkg/reqmatch"
+)
+
+// failRule is a rule given with --fail-on. HTTP calls for which check returns true are violations,
+// which make httptap exit with an error.
+type failRule struct {
+	text  string
+	check func(*HTTPCall) (bool, error)
+}
+
+// the rules given with --fail-on
+var failRules []*failRule
+
+// failure is an HTTP call that violated a --fail-on rule
+type failure struct {
+	rule   string
+	method string
+	url    string
+	status int
+}
+
+// the violations of --fail-on rules so far, and the mutex that protects them
+var (
+	failures  []failure
+	failureMu sync.Mutex
+)
+
+// parseFailRule parses a rule for --fail-on, which is one of
+//
+//	insecure-http            requests sent without TLS
+//	host not in FILE         requests to hosts that do not match any pattern in FILE, one per line
+//	EXPRESSION               calls for which a --filter expression is true
+//
+// where expressions can also use the shorthands status, host, method, and url
+func parseFailRule(text string) (*failRule, error) {
+	if text == "insecure-http" {
+		return &failRule{text: text, check: func(c *HTTPCall) (bool, error) {
+			return strings.HasPrefix(c.Request.URL, "http:"), nil
+		}}, nil
+	}
+
+	if path, ok := strings.CutPrefix(text, "host not in "); ok {
+		patterns, err := loadHostPatterns(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		return &failRule{text: text, check: func(c *HTTPCall) (bool, error) {
+			u, err := url.Parse(c.Request.URL)
+			if err != nil {
+				return false, err
+			}
+			for _, pattern := range patterns {
+				if reqmatch.Host(pattern, u.Hostname()) {
+					return false, nil
+				}
+			}
+			return true, nil
+		}}, nil
+	}
+
+	f, err := filter.Compile(text, "req", "resp", "status", "host", "method", "url")
+	if err != nil {
+		return nil, err
+	}
+	return &failRule{text: text, check: func(c *HTTPCall) (bool, error) {
+		vars := filterVariables(c)
+		vars["status"] = vars["resp"].(map[string]any)["status"]
+		vars["host"] = vars["req"].(map[string]any)["host"]
+		vars["method"] = c.Request.Method
+		vars["url"] = c.Request.URL
+		return f.Match(vars)
+	}}, nil
+}
+
+// loadHostPatterns reads host patterns such as "api.example.com" or "*.example.com" from a file, one per
+// line, ignoring blank lines and comments that start with #
+func loadHostPatterns(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening host list: %w", err)
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			patterns = append(patterns, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %v: %w", path, err)
+	}
+	return patterns, nil
+}
+
+// checkFailRules records the --fail-on rules that an HTTP call violates. Rules that cannot be evaluated
+// for a call, such as rules that look up a header that the call lacks, are not violated.
+func checkFailRules(c *HTTPCall) {
+	for _, rule := range failRules {
+		violated, err := rule.check(c)
+		if err != nil {
+			verbosef("could not evaluate --fail-on %q for %v %v: %v", rule.text, c.Request.Method, c.Request.URL, err)
+			continue
+		}
+		if violated {
+			failureMu.Lock()
+			failures = append(failures, failure{
+				rule:   rule.text,
+				method: c.Request.Method,
+				url:    c.Request.URL,
+				status: c.Response.StatusCode,
+			})
+			failureMu.Unlock()
+		}
+	}
+}
+
+// reportFailures prints the violations of --fail-on rules, and returns an error if there were any
+func reportFailures() error {
+	failureMu.Lock()
+	defer failureMu.Unlock()
+	if len(failures) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n%d violations of --fail-on:\n\n", len(failures))
+	for _, f := range failures {
+		fmt.Fprintf(&b, "%s: %v %v (%d)\n", f.rule, f.method, f.url, f.status)
+	}
+	log.Print(b.String())
+	return fmt.Errorf("HTTP calls violated --fail-on")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// the addresses handed out in fake-IP mode, which are reserved for benchmarking (RFC 2544) and so are
+// never used by real servers
+const fakeIPRange = "198.18.0.0/15"
+
+// the TTL of fake A records, which is short so that nothing caches an address after it has been reused
+const fakeIPTTL = 1
+
+// if not nil, A queries from the subprocess are answered with addresses from this pool, so that every
+// connection can be attributed to the name that was looked up even without SNI or a Host header
+var fakeIPs *fakeIPPool
+
+// fakeIPPool assigns a distinct address to each name looked up, and remembers which name each address
+// stands for. Once the pool is exhausted, addresses are reused starting from the oldest.
+type fakeIPPool struct {
+	mu     sync.Mutex
+	prefix netip.Prefix
+	next   netip.Addr
+	byName map[string]netip.Addr
+	byIP   map[netip.Addr]string
+}
+
+// newFakeIPPool creates a pool that hands out the addresses in prefix, other than the first
+func newFakeIPPool(prefix netip.Prefix) *fakeIPPool {
+	return &fakeIPPool{
+		prefix: prefix.Masked(),
+		next:   prefix.Masked().Addr().Next(),
+		byName: make(map[string]netip.Addr),
+		byIP:   make(map[netip.Addr]string),
+	}
+}
+
+// ipFor returns the address assigned to a name, assigning one if necessary
+func (p *fakeIPPool) ipFor(name string) netip.Addr {
+	name = normalizeHost(name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ip, ok := p.byName[name]; ok {
+		return ip
+	}
+
+	ip := p.next
+	p.next = ip.Next()
+	if !p.prefix.Contains(p.next) {
+		p.next = p.prefix.Addr().Next()
+	}
+
+	// the address may have been assigned to another name before the pool wrapped around
+	if old, ok := p.byIP[ip]; ok {
+		delete(p.byName, old)
+	}
+
+	p.byName[name] = ip
+	p.byIP[ip] = name
+	return ip
+}
+
+// nameFor returns the name that an address was assigned to
+func (p *fakeIPPool) nameFor(ip netip.Addr) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name, ok := p.byIP[ip.Unmap()]
+	return name, ok
+}
+
+// fakeIPName returns the name that a fake IP was handed out for, if fake-IP mode is enabled
+func fakeIPName(ip net.IP) (string, bool) {
+	if fakeIPs == nil {
+		return "", false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return "", false
+	}
+	return fakeIPs.nameFor(addr)
+}
+
+// fakeIPHost replaces a fake IP in a host:port address with the name that it was handed out for, and
+// leaves other addresses unchanged
+func fakeIPHost(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if name, ok := fakeIPName(net.ParseIP(host)); ok {
+		return net.JoinHostPort(name, port)
+	}
+	return addr
+}
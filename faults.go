@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+)
+
+// ruleFault is a failure that a rule brings about, for testing how the subprocess copes with it. Exactly
+// one of Status, Reset, Truncate, and Corrupt is set.
+type ruleFault struct {
+	Status      int     `json:"status" yaml:"status"`           // answer with this status code instead of sending the request
+	Reset       bool    `json:"reset" yaml:"reset"`             // reset the connection from the subprocess instead of sending the request
+	Truncate    int     `json:"truncate" yaml:"truncate"`       // deliver only this many bytes of the response body, then break off
+	Corrupt     int     `json:"corrupt" yaml:"corrupt"`         // change this many bytes of the response body at random
+	Probability float64 `json:"probability" yaml:"probability"` // fraction of matching requests to bring about the fault for, or 0 for all
+}
+
+// errResetConnection is returned by the round tripper to ask the proxy to reset the connection from
+// the subprocess on which a request arrived, rather than reply to it
+var errResetConnection = errors.New("connection reset by a --rules fault")
+
+// errTruncated is where the body of a response cut short by a fault ends
+var errTruncated = errors.New("response truncated by a --rules fault")
+
+// check checks that a fault says exactly one thing to do
+func (f *ruleFault) check() error {
+	var n int
+	for _, set := range []bool{f.Status != 0, f.Reset, f.Truncate != 0, f.Corrupt != 0} {
+		if set {
+			n++
+		}
+	}
+	switch {
+	case n != 1:
+		return fmt.Errorf("a fault must have exactly one of status, reset, truncate, and corrupt")
+	case f.Status != 0 && (f.Status < 100 || f.Status > 999):
+		return fmt.Errorf("%d is not a status code", f.Status)
+	case f.Truncate < 0 || f.Corrupt < 0:
+		return fmt.Errorf("truncate and corrupt must be numbers of bytes")
+	case f.Probability < 0 || f.Probability > 1:
+		return fmt.Errorf("the probability of a fault must be between 0 and 1")
+	}
+	return nil
+}
+
+// fires decides whether to bring about a fault for one request
+func (f *ruleFault) fires() bool {
+	return f.Probability == 0 || rand.Float64() < f.Probability
+}
+
+// replaces reports whether a fault takes the place of sending the request, rather than changing the
+// response to it
+func (f *ruleFault) replaces() bool {
+	return f.Status != 0 || f.Reset
+}
+
+// respond brings about a fault that takes the place of sending a request
+func (f *ruleFault) respond(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		// read the request body so that it is captured as it would be if it had been sent
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	if f.Reset {
+		return nil, errResetConnection
+	}
+	body := []byte(http.StatusText(f.Status) + "\n")
+	header := make(http.Header)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Status:        fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+		StatusCode:    f.Status,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		Request:       req.WithContext(context.WithValue(req.Context(), mockedContextKey, true)),
+	}, nil
+}
+
+// damage brings about a fault that changes a response
+func (f *ruleFault) damage(resp *http.Response) error {
+	switch {
+	case f.Truncate > 0:
+		// the length of the response is left as it was, so the subprocess sees it break off early
+		resp.Body = &truncatedBody{r: io.LimitReader(resp.Body, int64(f.Truncate)), c: resp.Body}
+	case f.Corrupt > 0:
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("error reading response body to corrupt it: %w", err)
+		}
+		for range min(f.Corrupt, len(body)) {
+			i := rand.IntN(len(body))
+			body[i] ^= byte(1 + rand.IntN(255))
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return nil
+}
+
+// truncatedBody is a response body that fails with errTruncated where a fault cut it short
+type truncatedBody struct {
+	r io.Reader
+	c io.Closer
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		err = errTruncated
+	}
+	return n, err
+}
+
+func (b *truncatedBody) Close() error {
+	return b.c.Close()
+}
+
+// resetConn resets a connection from the subprocess, for a fault that asks for it. Connections are
+// unwrapped until one is found that can be reset with a TCP RST, and otherwise the connection is closed.
+func resetConn(conn net.Conn) {
+	for c := conn; c != nil; {
+		if r, ok := c.(interface{ Reset() }); ok {
+			r.Reset()
+			return
+		}
+		u, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		c = u.NetConn()
+	}
+	conn.Close()
+}
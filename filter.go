@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/monasticacademy/httptap/pkg/filter"
+	"github.com/monasticacademy/httptap/pkg/harlog"
+	"github.com/monasticacademy/httptap/pkg/reqmatch"
+)
+
+// the expression given with --filter or set with "httptap ctl filter", or nil to show every HTTP call
+var callFilter atomic.Pointer[filter.Filter]
+
+// whether capture was paused with "httptap ctl pause", in which case traffic is proxied but not shown
+var capturePaused atomic.Bool
+
+// host patterns such as "api.example.com" or "*.example.com" given with --capture-host, which if not
+// empty are the only hosts whose traffic is shown
+var captureHosts []string
+
+// host patterns given with --ignore-host, whose traffic is never shown
+var ignoreHosts []string
+
+// isCapturedHost checks whether traffic to a host should be shown, according to --capture-host and
+// --ignore-host, and whether capture is paused. The host may include a port. Traffic is proxied either
+// way.
+func isCapturedHost(host string) bool {
+	if capturePaused.Load() {
+		return false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, pattern := range ignoreHosts {
+		if reqmatch.Host(pattern, host) {
+			return false
+		}
+	}
+	if len(captureHosts) == 0 {
+		return true
+	}
+	for _, pattern := range captureHosts {
+		if reqmatch.Host(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFilter compiles an expression for --filter, which can refer to the request as "req" and the
+// response as "resp"
+func parseFilter(expr string) (*filter.Filter, error) {
+	return filter.Compile(expr, "req", "resp")
+}
+
+// filterVariables makes the variables that a --filter expression is evaluated with from an HTTP call
+func filterVariables(call *HTTPCall) map[string]any {
+	u, err := url.Parse(call.Request.URL)
+	if err != nil {
+		u = new(url.URL)
+	}
+	return map[string]any{
+		"req": map[string]any{
+			"method":  call.Request.Method,
+			"url":     call.Request.URL,
+			"scheme":  u.Scheme,
+			"host":    u.Hostname(),
+			"path":    u.Path,
+			"query":   u.RawQuery,
+			"headers": headerVariables(call.Request.Header),
+			"body":    string(call.Request.Body),
+			"size":    call.Request.Size,
+		},
+		"resp": map[string]any{
+			"status":  int64(call.Response.StatusCode),
+			"headers": headerVariables(call.Response.Header),
+			"body":    string(call.Response.Body),
+			"size":    call.Response.Size,
+		},
+	}
+}
+
+// headerVariables makes a map from lowercase header names to their values, where headers that appear
+// more than once are joined with commas
+func headerVariables(header http.Header) map[string]any {
+	m := make(map[string]any, len(header))
+	for k, vs := range header {
+		m[strings.ToLower(k)] = strings.Join(vs, ", ")
+	}
+	return m
+}
+
+// showCall reports whether an HTTP call is to a host chosen with --capture-host and --ignore-host and
+// matches --filter, leaving out calls for which the expression cannot be evaluated, such as calls that
+// lack a header that the expression looks up
+func showCall(call *HTTPCall) bool {
+	if u, err := url.Parse(call.Request.URL); err == nil && !isCapturedHost(u.Hostname()) {
+		return false
+	}
+	f := callFilter.Load()
+	if f == nil {
+		return true
+	}
+	show, err := f.Match(filterVariables(call))
+	if err != nil {
+		verbosef("leaving out %v %v because --filter could not be evaluated: %v", call.Request.Method, call.Request.URL, err)
+		return false
+	}
+	return show
+}
+
+// filterHAR applies --filter, --capture-host, and --ignore-host to the entries written to HAR files
+func filterHAR(entry *harlog.Entry, req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) bool {
+	if callFilter.Load() == nil {
+		return isCapturedHost(req.URL.Hostname())
+	}
+
+	call := HTTPCall{
+		Request: HTTPRequest{
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Host:   req.Host,
+			Header: req.Header,
+			Body:   decodeFilterBody(reqBody, req.Header),
+			Size:   int64(len(reqBody)),
+		},
+	}
+	if entry.Request != nil && entry.Request.BodySize > 0 {
+		call.Request.Size = int64(entry.Request.BodySize)
+	}
+	if resp != nil {
+		call.Response = HTTPResponse{
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       decodeFilterBody(respBody, resp.Header),
+			Size:       int64(len(respBody)),
+		}
+		if entry.Response != nil && entry.Response.Content != nil {
+			call.Response.Size = entry.Response.Content.Size
+		}
+	}
+	return showCall(&call)
+}
+
+// decodeFilterBody removes the content encoding from a body for --filter, or returns it unchanged if it
+// cannot be decoded, which is the case for bodies that were truncated
+func decodeFilterBody(body []byte, header http.Header) []byte {
+	decoded, _, err := decodeContent(bytes.NewReader(body), header["Content-Encoding"])
+	if err != nil {
+		return body
+	}
+	return decoded
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"github.com/monasticacademy/httptap/pkg/tlsfingerprint"
+)
+
+// helloRecorder is a net.Conn that keeps a copy of everything read from it until stop is called,
+// in order to capture the raw ClientHello during a TLS handshake
+type helloRecorder struct {
+	net.Conn
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	stopped bool
+}
+
+// NetConn returns the connection whose ClientHello is recorded
+func (r *helloRecorder) NetConn() net.Conn {
+	return r.Conn
+}
+
+func (c *helloRecorder) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	if !c.stopped {
+		c.buf.Write(b[:n])
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// stop ends recording and returns what was read so far
+func (c *helloRecorder) stop() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	return c.buf.Bytes()
+}
+
+// fingerprintedConn is an intercepted TLS connection together with the fingerprint of the ClientHello
+// that the subprocess sent on it, which is nil if the ClientHello could not be parsed
+type fingerprintedConn struct {
+	*tls.Conn
+	fingerprint *tlsfingerprint.Fingerprint
+}
+
+// withFingerprint adds the fingerprint of conn to a context under tlsFingerprintContextKey, if conn
+// is an intercepted TLS connection with a fingerprint
+func withFingerprint(ctx context.Context, conn net.Conn) context.Context {
+	if fc, ok := conn.(*fingerprintedConn); ok && fc.fingerprint != nil {
+		return context.WithValue(ctx, tlsFingerprintContextKey, fc.fingerprint)
+	}
+	return ctx
+}
+
+// fingerprintFromContext gets the fingerprint added by withFingerprint, or nil
+func fingerprintFromContext(ctx context.Context) *tlsfingerprint.Fingerprint {
+	fp, _ := ctx.Value(tlsFingerprintContextKey).(*tlsfingerprint.Fingerprint)
+	return fp
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// headers that test doubles work out for themselves, or that no longer apply since bodies are stored
+// decompressed, so they are left out of fixtures
+var fixtureOmitHeaders = []string{"Content-Length", "Transfer-Encoding", "Connection", "Content-Encoding", "Date"}
+
+// fixtureRoute is a method and path together with the responses recorded for it, in order
+type fixtureRoute struct {
+	Method    string
+	Path      string
+	Responses []fixtureResponse
+}
+
+type fixtureResponse struct {
+	URL    string // the URL that was requested, including the query, for the Python fixtures
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// fixtureHost holds the routes recorded for one host
+type fixtureHost struct {
+	Host   string
+	Func   string // the name of the Go function that starts a server for this host
+	Routes []*fixtureRoute
+}
+
+// collectFixtures groups the HTTP calls made so far by host, and then by method and path
+func collectFixtures() []*fixtureHost {
+	httpMu.Lock()
+	calls := slices.Clone(httpCalls)
+	httpMu.Unlock()
+
+	var hosts []*fixtureHost
+	for _, c := range calls {
+		u, err := url.Parse(c.Request.URL)
+		if err != nil {
+			continue
+		}
+		i := slices.IndexFunc(hosts, func(h *fixtureHost) bool { return h.Host == u.Host })
+		if i < 0 {
+			hosts = append(hosts, &fixtureHost{Host: u.Host, Func: "New" + goIdentifier(u.Hostname()) + "Server"})
+			i = len(hosts) - 1
+		}
+		h := hosts[i]
+
+		path := u.Path
+		if path == "" {
+			path = "/"
+		}
+		j := slices.IndexFunc(h.Routes, func(r *fixtureRoute) bool { return r.Method == c.Request.Method && r.Path == path })
+		if j < 0 {
+			h.Routes = append(h.Routes, &fixtureRoute{Method: c.Request.Method, Path: path})
+			j = len(h.Routes) - 1
+		}
+		header := make(http.Header)
+		for k, vs := range c.Response.Header {
+			if !slices.Contains(fixtureOmitHeaders, k) {
+				header[k] = vs
+			}
+		}
+		if c.Response.Truncated {
+			errorf("the response body for %v %v in the fixtures is truncated to %d of %d bytes, use --max-body-size to keep more",
+				c.Request.Method, c.Request.URL, len(c.Response.Body), c.Response.Size)
+		}
+		h.Routes[j].Responses = append(h.Routes[j].Responses, fixtureResponse{
+			URL:    c.Request.URL,
+			Status: c.Response.StatusCode,
+			Header: header,
+			Body:   c.Response.Body,
+		})
+	}
+	return hosts
+}
+
+// goIdentifier turns a host name into an exported Go identifier, such as APIExampleCom for
+// api.example.com
+func goIdentifier(s string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if part == "api" {
+			part = "API"
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+// writeFixtures writes the HTTP calls made so far as test doubles, in Go or Python according to the
+// extension of the file
+func writeFixtures(path string) error {
+	hosts := collectFixtures()
+	var src []byte
+	var err error
+	switch filepath.Ext(path) {
+	case ".go":
+		src, err = goFixtures(hosts, goPackageName(path))
+	case ".py":
+		src, err = pythonFixtures(hosts)
+	default:
+		return fmt.Errorf("cannot tell which language to write fixtures in from %v, use a name ending in .go or .py", path)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, src, 0644); err != nil {
+		return fmt.Errorf("error writing fixtures: %w", err)
+	}
+	return nil
+}
+
+// goPackageName picks the package for Go fixtures from the name of the directory they are written to,
+// or "fixtures" if that is not a valid package name
+func goPackageName(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "fixtures"
+	}
+	name := filepath.Base(filepath.Dir(abs))
+	if !token.IsIdentifier(name) || token.IsKeyword(name) {
+		return "fixtures"
+	}
+	return name
+}
+
+var goFixturesTemplate = template.Must(template.New("go").Funcs(template.FuncMap{
+	"pattern": goMuxPattern,
+	"header":  goHeaderLiteral,
+	"body":    func(b []byte) string { return strconv.Quote(string(b)) },
+}).Parse(`// Code generated by httptap from recorded HTTP calls. Edit as needed.
+
+package {{.Package}}
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// response is a response recorded by httptap
+type response struct {
+	status int
+	header http.Header
+	body   string
+}
+
+// replay answers requests with each of the recorded responses in turn, repeating the last one
+func replay(responses ...response) http.HandlerFunc {
+	var mu sync.Mutex
+	var n int
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		resp := responses[min(n, len(responses)-1)]
+		n++
+		mu.Unlock()
+
+		for k, vs := range resp.header {
+			w.Header()[k] = vs
+		}
+		w.WriteHeader(resp.status)
+		io.WriteString(w, resp.body)
+	}
+}
+{{range .Hosts}}
+// {{.Func}} starts a server that answers like {{.Host}} did when httptap recorded it. Requests for
+// paths that were not recorded get 404.
+func {{.Func}}() *httptest.Server {
+	mux := http.NewServeMux()
+{{- range .Routes}}
+	mux.HandleFunc({{pattern .Method .Path}}, replay(
+{{- range .Responses}}
+		response{ {{- .Status}}, {{header .Header}}, {{body .Body}}},
+{{- end}}
+	))
+{{- end}}
+	return httptest.NewServer(mux)
+}
+{{end}}`))
+
+// goMuxPattern makes an http.ServeMux pattern that matches exactly one method and path, rather than
+// every path under it as a pattern ending in a slash would
+func goMuxPattern(method, path string) string {
+	if strings.HasSuffix(path, "/") {
+		path += "{$}"
+	}
+	return strconv.Quote(method + " " + path)
+}
+
+// goHeaderLiteral writes a header as a Go composite literal
+func goHeaderLiteral(h http.Header) string {
+	if len(h) == 0 {
+		return "nil"
+	}
+	var parts []string
+	for _, k := range sortedKeys(h) {
+		var values []string
+		for _, v := range h[k] {
+			values = append(values, strconv.Quote(v))
+		}
+		parts = append(parts, strconv.Quote(k)+": {"+strings.Join(values, ", ")+"}")
+	}
+	return "http.Header{" + strings.Join(parts, ", ") + "}"
+}
+
+// goFixtures writes Go functions that start an httptest.Server for each host
+func goFixtures(hosts []*fixtureHost, pkg string) ([]byte, error) {
+	var b bytes.Buffer
+	err := goFixturesTemplate.Execute(&b, map[string]any{"Package": pkg, "Hosts": hosts})
+	if err != nil {
+		return nil, fmt.Errorf("error generating Go fixtures: %w", err)
+	}
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error formatting Go fixtures: %w", err)
+	}
+	return src, nil
+}
+
+var pythonFixturesTemplate = template.Must(template.New("python").Funcs(template.FuncMap{
+	"pystr":   pythonString,
+	"pybytes": pythonBytes,
+	"pydict":  pythonHeaders,
+}).Parse(`# Generated by httptap from recorded HTTP calls. Edit as needed.
+import responses
+
+
+def add_recorded_responses(rsps=responses):
+    """Register the responses recorded by httptap with the responses library.
+
+    Use it inside a test decorated with @responses.activate, or pass a
+    responses.RequestsMock. Repeated requests get each recorded response in turn.
+    """
+{{- range .}}{{range .Routes}}{{$route := .}}{{range .Responses}}
+    rsps.add(
+        {{pystr $route.Method}},
+        {{pystr .URL}},
+        status={{.Status}},
+        headers={{pydict .Header}},
+        body={{pybytes .Body}},
+    )
+{{- end}}{{end}}{{end}}
+`))
+
+// pythonFixtures writes a Python function that registers the recorded responses with the responses
+// library, for tests of code that uses requests
+func pythonFixtures(hosts []*fixtureHost) ([]byte, error) {
+	var b bytes.Buffer
+	if err := pythonFixturesTemplate.Execute(&b, hosts); err != nil {
+		return nil, fmt.Errorf("error generating Python fixtures: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// pythonString writes a Python string literal
+func pythonString(s string) string {
+	return string(pythonLiteral([]byte(s), false))
+}
+
+// pythonBytes writes a Python bytes literal
+func pythonBytes(b []byte) string {
+	return "b" + string(pythonLiteral(b, true))
+}
+
+// pythonLiteral quotes a string or bytes for Python, escaping everything outside printable ASCII
+func pythonLiteral(b []byte, isBytes bool) []byte {
+	out := []byte{'"'}
+	if isBytes {
+		// escape byte by byte so that invalid UTF-8 survives
+		for _, c := range b {
+			out = appendPythonChar(out, rune(c))
+		}
+	} else {
+		for _, r := range string(b) {
+			out = appendPythonChar(out, r)
+		}
+	}
+	return append(out, '"')
+}
+
+// appendPythonChar appends a character to a Python string or bytes literal, where bytes are always
+// below 0x100 and so are never written with \u
+func appendPythonChar(out []byte, r rune) []byte {
+	switch {
+	case r == '"' || r == '\\':
+		return append(out, '\\', byte(r))
+	case r == '\n':
+		return append(out, `\n`...)
+	case r == '\r':
+		return append(out, `\r`...)
+	case r == '\t':
+		return append(out, `\t`...)
+	case r >= 0x20 && r < 0x7f:
+		return append(out, byte(r))
+	case r < 0x100:
+		return fmt.Appendf(out, `\x%02x`, r)
+	case r < 0x10000:
+		return fmt.Appendf(out, `\u%04x`, r)
+	default:
+		return fmt.Appendf(out, `\U%08x`, r)
+	}
+}
+
+// pythonHeaders writes a header as a Python dict, joining repeated headers with commas
+func pythonHeaders(h http.Header) string {
+	var parts []string
+	for _, k := range sortedKeys(h) {
+		parts = append(parts, pythonString(k)+": "+pythonString(strings.Join(h[k], ", ")))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
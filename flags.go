@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a number of bytes that can be parsed from command line arguments like "64k" or "10MB"
+type byteSize int64
+
+// UnmarshalText parses a byte size such as "1024", "64k", "10MB", or "2GiB"
+func (b *byteSize) UnmarshalText(text []byte) error {
+	s := strings.ToLower(strings.TrimSpace(string(text)))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "b"), "i")
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid byte size %q (examples of valid sizes are 1024, 64k, 10MB)", string(text))
+	}
+
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+// String formats a byte size for display in the units that UnmarshalText accepts, such as "512B",
+// "64.0kB", or "10.0MB"
+func (b byteSize) String() string {
+	switch {
+	case b >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(b)/(1<<30))
+	case b >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(b)/(1<<20))
+	case b >= 1<<10:
+		return fmt.Sprintf("%.1fkB", float64(b)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", int64(b))
+	}
+}
+
+// percentage is a fraction that can be parsed from command line arguments like "1%" or "0.5"
+type percentage float64
+
+// UnmarshalText parses a percentage such as "1%", "0.5%", or "5", which are all in percent
+func (p *percentage) UnmarshalText(text []byte) error {
+	s := strings.TrimSuffix(strings.TrimSpace(string(text)), "%")
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 || n > 100 {
+		return fmt.Errorf("invalid percentage %q (examples of valid percentages are 1%%, 0.5%%, 20)", string(text))
+	}
+	*p = percentage(n / 100)
+	return nil
+}
+
+// String formats a percentage for display in the form that UnmarshalText accepts, such as "1%"
+func (p percentage) String() string {
+	return strconv.FormatFloat(float64(p)*100, 'g', -1, 64) + "%"
+}
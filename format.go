@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// the template given with --format, or nil to print HTTP calls as arrows
+var formatTemplate *template.Template
+
+// parseFormat parses a template for --format, which is executed with an *HTTPCall
+func parseFormat(format string) (*template.Template, error) {
+	return template.New("format").Parse(format)
+}
+
+// formatCall executes --format for an HTTP call, adding a newline at the end if there is not one
+// already
+func formatCall(call *HTTPCall) (string, error) {
+	var b strings.Builder
+	if err := formatTemplate.Execute(&b, call); err != nil {
+		return "", fmt.Errorf("error executing --format: %w", err)
+	}
+	s := b.String()
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return s, nil
+}
+
+// how --timestamps shows the time of each HTTP call: "absolute" for the time of day, "relative" for the
+// time since httptap started, or empty to not show times
+var timestampMode string
+
+// the time at which httptap started, which relative timestamps count from
+var startedAt = time.Now()
+
+// timestamp formats a time for the start of a line of output according to --timestamps, followed by a
+// space, or returns the empty string if times are not shown
+func timestamp(t time.Time) string {
+	switch timestampMode {
+	case "absolute":
+		return t.Format("15:04:05.000") + " "
+	case "relative":
+		return fmt.Sprintf("+%.3fs ", t.Sub(startedAt).Seconds())
+	default:
+		return ""
+	}
+}
+
+// roundDuration rounds a duration for display to a precision that suits its size
+func roundDuration(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(100 * time.Microsecond)
+	default:
+		return d.Round(time.Microsecond)
+	}
+}
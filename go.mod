@@ -3,14 +3,20 @@ module github.com/monasticacademy/httptap
 go 1.23.1
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/ebitengine/purego v0.8.1
 	github.com/fatih/color v1.17.0
 	github.com/gobwas/glob v0.2.3
 	github.com/google/gopacket v1.1.19
 	github.com/joemiller/certin v0.3.5
+	github.com/klauspost/compress v1.17.9
 	github.com/quic-go/quic-go v0.50.0
+	golang.org/x/crypto v0.37.0
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b
+	golang.org/x/net v0.39.0
 	golang.org/x/tools v0.22.0
+	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
 	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
@@ -24,10 +30,8 @@ require (
 	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
 	github.com/quic-go/qpack v0.5.1 // indirect
 	go.uber.org/mock v0.5.0 // indirect
-	golang.org/x/crypto v0.37.0 // indirect
 	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
 	golang.org/x/mod v0.18.0 // indirect
-	golang.org/x/net v0.39.0 // indirect
 	golang.org/x/sync v0.13.0 // indirect
 	golang.org/x/text v0.24.0 // indirect
 )
@@ -42,6 +46,6 @@ require (
 	github.com/vishvananda/netlink v1.3.0
 	github.com/vishvananda/netns v0.0.4
 	golang.org/x/sys v0.32.0
-	golang.org/x/time v0.5.0 // indirect
+	golang.org/x/time v0.5.0
 	gvisor.dev/gvisor v0.0.0-20240928194204-917bbae826a0
 )
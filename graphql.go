@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+
+	"github.com/monasticacademy/httptap/pkg/graphql"
+)
+
+// GraphQLOperation describes a GraphQL operation found in an HTTP request
+type GraphQLOperation struct {
+	Type      string          `json:"type"`                // "query", "mutation", or "subscription"
+	Name      string          `json:"name,omitempty"`      // empty for anonymous operations
+	Variables json.RawMessage `json:"variables,omitempty"` // the variables exactly as sent
+}
+
+// String formats the operation for display, for example "mutation CreateUser"
+func (op *GraphQLOperation) String() string {
+	if op.Name == "" {
+		return op.Type
+	}
+	return op.Type + " " + op.Name
+}
+
+// graphQLRequest is the standard body of a GraphQL request sent over HTTP
+type graphQLRequest struct {
+	Query         string          `json:"query"`
+	OperationName string          `json:"operationName"`
+	Variables     json.RawMessage `json:"variables"`
+}
+
+// parseGraphQL extracts the GraphQL operations from an HTTP request, or returns nil if the request does
+// not look like GraphQL. POST bodies may contain a single request or a batch of requests; GET requests
+// carry the query in the URL.
+func parseGraphQL(method string, u *url.URL, header http.Header, body []byte) []*GraphQLOperation {
+	var reqs []graphQLRequest
+	switch method {
+	case http.MethodGet:
+		q := u.Query()
+		if !q.Has("query") {
+			return nil
+		}
+		reqs = append(reqs, graphQLRequest{
+			Query:         q.Get("query"),
+			OperationName: q.Get("operationName"),
+		})
+		if v := q.Get("variables"); json.Valid([]byte(v)) {
+			reqs[0].Variables = json.RawMessage(v)
+		}
+
+	case http.MethodPost:
+		mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		switch mediaType {
+		case "application/graphql":
+			reqs = append(reqs, graphQLRequest{Query: string(body)})
+		case "application/json", "application/graphql+json":
+			var single graphQLRequest
+			if err := json.Unmarshal(body, &single); err == nil {
+				reqs = append(reqs, single)
+			} else if err := json.Unmarshal(body, &reqs); err != nil {
+				return nil
+			}
+		default:
+			return nil
+		}
+
+	default:
+		return nil
+	}
+
+	var ops []*GraphQLOperation
+	for _, r := range reqs {
+		if r.Query == "" {
+			// persisted queries send only a hash, so the operation name is all we have
+			if r.OperationName == "" {
+				continue
+			}
+			ops = append(ops, &GraphQLOperation{Type: "query", Name: r.OperationName, Variables: r.Variables})
+			continue
+		}
+		typ, name := graphql.OperationInfo(r.Query, r.OperationName)
+		if typ == "" {
+			continue
+		}
+		ops = append(ops, &GraphQLOperation{Type: typ, Name: name, Variables: r.Variables})
+	}
+	return ops
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"github.com/monasticacademy/httptap/pkg/grpcdecode"
+)
+
+// protoDecoder is set when --proto-descriptor is given, and is used to decode gRPC messages
+var protoDecoder *grpcdecode.Decoder
+
+// isGRPC checks whether a content type indicates a gRPC request or response
+func isGRPC(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/grpc" || mediaType == "application/grpc+proto"
+}
+
+// decodeGRPC decodes the messages in a gRPC request or response body, or returns nil if the body is not
+// gRPC or no proto descriptors were provided. Decoding errors are logged and the messages that could be
+// decoded are returned.
+func decodeGRPC(path string, header http.Header, body []byte, isRequest bool) []json.RawMessage {
+	if protoDecoder == nil || !isGRPC(header.Get("Content-Type")) {
+		return nil
+	}
+
+	messages, err := protoDecoder.Decode(path, body, header.Get("Grpc-Encoding"), isRequest)
+	if err != nil {
+		verbosef("error decoding gRPC messages for %v: %v", path, err)
+	}
+	return messages
+}
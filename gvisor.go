@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// tcpTuning holds the settings for the TCP connections between the gvisor stack and the subprocess,
+// where zero means the gvisor default. The defaults are tuned for low-latency links, which the link
+// to the subprocess is, but large buffers are needed to keep a high-latency upstream link busy.
+type tcpTuning struct {
+	sendBuffer        int
+	receiveBuffer     int
+	keepaliveIdle     time.Duration
+	keepaliveInterval time.Duration
+	keepaliveCount    int
+	noSACK            bool
+}
+
+// isSet reports whether any setting differs from the gvisor defaults
+func (t *tcpTuning) isSet() bool {
+	return *t != tcpTuning{}
+}
+
+// keepalive reports whether keepalives should be sent, which gvisor does not do by default
+func (t *tcpTuning) keepalive() bool {
+	return t.keepaliveIdle > 0 || t.keepaliveInterval > 0 || t.keepaliveCount > 0
+}
+
+// configureStack sets the stack-wide TCP options. The buffer size ranges are widened so that gvisor
+// does not clamp the buffer sizes that are set on each endpoint.
+func (t *tcpTuning) configureStack(s *stack.Stack) error {
+	if t.sendBuffer > 0 {
+		opt := tcpip.TCPSendBufferSizeRangeOption{
+			Min:     tcp.MinBufferSize,
+			Default: t.sendBuffer,
+			Max:     max(t.sendBuffer, tcp.MaxBufferSize),
+		}
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("error setting TCP send buffer size: %v", err)
+		}
+	}
+
+	if t.receiveBuffer > 0 {
+		opt := tcpip.TCPReceiveBufferSizeRangeOption{
+			Min:     tcp.MinBufferSize,
+			Default: t.receiveBuffer,
+			Max:     max(t.receiveBuffer, tcp.MaxBufferSize),
+		}
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("error setting TCP receive buffer size: %v", err)
+		}
+	}
+
+	if t.noSACK {
+		opt := tcpip.TCPSACKEnabled(false)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("error disabling TCP selective acknowledgements: %v", err)
+		}
+	}
+	return nil
+}
+
+// configureEndpoint sets the options for one TCP endpoint created by the forwarder, in the same way as
+// https://github.com/xjasonlyu/tun2socks/blob/main/core/tcp.go
+func (t *tcpTuning) configureEndpoint(ep tcpip.Endpoint) error {
+	if t.sendBuffer > 0 {
+		ep.SocketOptions().SetSendBufferSize(int64(t.sendBuffer), true)
+	}
+	if t.receiveBuffer > 0 {
+		ep.SocketOptions().SetReceiveBufferSize(int64(t.receiveBuffer), true)
+	}
+
+	if !t.keepalive() {
+		return nil
+	}
+	ep.SocketOptions().SetKeepAlive(true)
+	if t.keepaliveIdle > 0 {
+		opt := tcpip.KeepaliveIdleOption(t.keepaliveIdle)
+		if err := ep.SetSockOpt(&opt); err != nil {
+			return fmt.Errorf("error setting keepalive idle time: %v", err)
+		}
+	}
+	if t.keepaliveInterval > 0 {
+		opt := tcpip.KeepaliveIntervalOption(t.keepaliveInterval)
+		if err := ep.SetSockOpt(&opt); err != nil {
+			return fmt.Errorf("error setting keepalive interval: %v", err)
+		}
+	}
+	if t.keepaliveCount > 0 {
+		if err := ep.SetSockOptInt(tcpip.KeepaliveCountOption, t.keepaliveCount); err != nil {
+			return fmt.Errorf("error setting keepalive count: %v", err)
+		}
+	}
+	return nil
+}
+
+// tcpForwarderStats counts what happens to the connection attempts that the subprocess makes through
+// the gvisor TCP forwarder, which silently drops SYNs once too many connections are being set up, so
+// that the subprocess only sees connections that are slow to open or that time out
+type tcpForwarderStats struct {
+	inFlight    atomic.Int64 // connection attempts waiting to be accepted or rejected
+	maxInFlight atomic.Int64 // the most connection attempts that were waiting at once
+	accepted    atomic.Int64
+	rejected    atomic.Int64
+	dropped     *tcpip.StatCounter // SYNs dropped by the forwarder, counted by gvisor
+	warned      atomic.Bool
+	limit       int
+}
+
+// started records a connection attempt that the forwarder has passed on to us
+func (s *tcpForwarderStats) started() {
+	n := s.inFlight.Add(1)
+	for {
+		peak := s.maxInFlight.Load()
+		if n <= peak || s.maxInFlight.CompareAndSwap(peak, n) {
+			return
+		}
+	}
+}
+
+// finished records that a connection attempt was accepted or rejected, which frees its place in the
+// forwarder for another
+func (s *tcpForwarderStats) finished(accepted bool) {
+	s.inFlight.Add(-1)
+	if accepted {
+		s.accepted.Add(1)
+	} else {
+		s.rejected.Add(1)
+	}
+}
+
+// checkDropped warns the first time that the forwarder drops a connection attempt, which it does
+// without telling anyone
+func (s *tcpForwarderStats) checkDropped() {
+	if s.dropped.Value() > 0 && s.warned.CompareAndSwap(false, true) {
+		errorf("the subprocess is opening TCP connections faster than they can be set up, so attempts beyond "+
+			"%d at once are being dropped and will be retried by the subprocess (raise --tcp-max-in-flight "+
+			"to allow more)", s.limit)
+	}
+}
+
+// report logs the totals, which is an error if connection attempts were dropped
+func (s *tcpForwarderStats) report() {
+	if s.dropped == nil {
+		return // not using the gvisor stack
+	}
+	summary := fmt.Sprintf("TCP connections from the subprocess: %d accepted, %d rejected, %d attempts "+
+		"dropped at the limit of %d being set up at once (at most %d were)",
+		s.accepted.Load(), s.rejected.Load(), s.dropped.Value(), s.limit, s.maxInFlight.Load())
+	if s.dropped.Value() > 0 {
+		errorf("%s", summary)
+	} else {
+		verbose(summary)
+	}
+}
+
+// tcpRequest is a connection from the subprocess that the gvisor stack has received a SYN for, which
+// is accepted or rejected by the handler that the mux dispatches it to
+type tcpRequest struct {
+	fr     *tcp.ForwarderRequest
+	wq     *waiter.Queue
+	tuning *tcpTuning
+	stats  *tcpForwarderStats
+}
+
+func (r *tcpRequest) RemoteAddr() net.Addr {
+	addr := r.fr.ID().RemoteAddress
+	return &net.TCPAddr{IP: addr.AsSlice(), Port: int(r.fr.ID().RemotePort)}
+}
+
+func (r *tcpRequest) LocalAddr() net.Addr {
+	addr := r.fr.ID().LocalAddress
+	return &net.TCPAddr{IP: addr.AsSlice(), Port: int(r.fr.ID().LocalPort)}
+}
+
+func (r *tcpRequest) Accept() (net.Conn, error) {
+	ep, err := r.fr.CreateEndpoint(r.wq)
+	if err != nil {
+		r.fr.Complete(true)
+		r.stats.finished(false)
+		return nil, fmt.Errorf("CreateEndpoint: %v", err)
+	}
+
+	if err := r.tuning.configureEndpoint(ep); err != nil {
+		ep.Close()
+		r.fr.Complete(true)
+		r.stats.finished(false)
+		return nil, err
+	}
+
+	// create an adapter that makes a gvisor endpoint into a net.Conn
+	conn := &gvisorConn{TCPConn: gonet.NewTCPConn(r.wq, ep), ep: ep}
+	r.fr.Complete(false)
+	r.stats.finished(true)
+	return conn, nil
+}
+
+// gvisorConn is a connection from the subprocess that can be reset
+type gvisorConn struct {
+	*gonet.TCPConn
+	ep tcpip.Endpoint
+}
+
+// Reset aborts the connection with a RST rather than closing it gracefully
+func (c *gvisorConn) Reset() {
+	c.ep.Abort()
+}
+
+func (r *tcpRequest) Reject() {
+	r.fr.Complete(true)
+	r.stats.finished(false)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monasticacademy/httptap/pkg/harlog"
+)
+
+// harPiece describes one of the files written by a harRotator
+type harPiece struct {
+	Path    string    `json:"path"`
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended"`
+	Entries int       `json:"entries"`
+}
+
+// harIndex is the content of the index file that lists all the pieces written by a harRotator
+type harIndex struct {
+	Pieces []harPiece `json:"pieces"`
+}
+
+// harRotator writes the HAR log collected by a harlog.Transport to a series of files, starting a new
+// file whenever the current one grows beyond a size limit or becomes older than an age limit. Each
+// time a file is written, an index file listing all the files written so far is updated.
+type harRotator struct {
+	transport *harlog.Transport
+	path      string        // the path passed to --dump-har, from which the names of the pieces are derived
+	maxSize   int64         // start a new piece when the current one reaches this many bytes (zero means no limit)
+	maxAge    time.Duration // start a new piece when the current one reaches this age (zero means no limit)
+	done      chan struct{} // closed when the rotator is closed
+
+	mu      sync.Mutex // protects the fields below
+	size    int64      // approximate size of the entries in the current piece
+	started time.Time  // the time at which the current piece was started
+	pieces  []harPiece // the pieces written so far
+}
+
+func newHARRotator(transport *harlog.Transport, path string, maxSize int64, maxAge time.Duration) *harRotator {
+	return &harRotator{
+		transport: transport,
+		path:      path,
+		maxSize:   maxSize,
+		maxAge:    maxAge,
+		done:      make(chan struct{}),
+		started:   time.Now(),
+	}
+}
+
+// indexPath returns the path of the index file, for example "out.index.json" for "out.har"
+func (r *harRotator) indexPath() string {
+	ext := filepath.Ext(r.path)
+	return strings.TrimSuffix(r.path, ext) + ".index.json"
+}
+
+// piecePath returns the path of the n-th piece, for example "out.3.har" for "out.har"
+func (r *harRotator) piecePath(n int) string {
+	ext := filepath.Ext(r.path)
+	base := strings.TrimSuffix(r.path, ext)
+	if ext == "" {
+		ext = ".har"
+	}
+	return fmt.Sprintf("%s.%d%s", base, n, ext)
+}
+
+// start writes an empty index file, so that filesystem errors are surfaced right away, and then
+// starts rotating periodically if a maximum age was given
+func (r *harRotator) start() error {
+	err := r.writeIndex()
+	if err != nil {
+		return err
+	}
+
+	if r.maxAge > 0 {
+		go func() {
+			ticker := time.NewTicker(r.maxAge)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					r.rotate(false)
+				case <-r.done:
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// entryAdded is called by the HAR transport each time an entry is added to the log
+func (r *harRotator) entryAdded(entry *harlog.Entry) {
+	if r.maxSize <= 0 {
+		return
+	}
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		verbosef("error serializing HAR entry to measure its size: %v, ignoring", err)
+		return
+	}
+
+	r.mu.Lock()
+	r.size += int64(len(buf))
+	full := r.size >= r.maxSize
+	r.mu.Unlock()
+
+	if full {
+		r.rotate(false)
+	}
+}
+
+// rotate writes the entries collected so far to a new piece and updates the index. Empty pieces are
+// skipped unless force is true.
+func (r *harRotator) rotate(force bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	har := r.transport.Rotate()
+	if len(har.Log.Entries) == 0 && len(har.Log.DNS) == 0 && !force {
+		return
+	}
+
+	piece := harPiece{
+		Path:    r.piecePath(len(r.pieces) + 1),
+		Started: r.started,
+		Ended:   time.Now(),
+		Entries: len(har.Log.Entries),
+	}
+
+	r.size = 0
+	r.started = piece.Ended
+
+	verbosef("writing %d HAR entries to %v", piece.Entries, piece.Path)
+
+	err := writeHAR(piece.Path, har)
+	if err != nil {
+		errorf("error writing HAR file: %v", err)
+		return
+	}
+
+	r.pieces = append(r.pieces, piece)
+
+	err = r.writeIndexLocked()
+	if err != nil {
+		errorf("error writing HAR index: %v", err)
+	}
+}
+
+// Close writes the last piece and stops periodic rotation
+func (r *harRotator) Close() {
+	close(r.done)
+
+	r.mu.Lock()
+	force := len(r.pieces) == 0
+	r.mu.Unlock()
+
+	// always write at least one piece so that there is something to look at
+	r.rotate(force)
+}
+
+func (r *harRotator) writeIndex() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeIndexLocked()
+}
+
+// writeIndexLocked writes the index file; the caller must hold the mutex
+func (r *harRotator) writeIndexLocked() error {
+	// paths in the index are relative to the index itself so that the files can be moved together
+	index := harIndex{Pieces: []harPiece{}}
+	for _, piece := range r.pieces {
+		piece.Path = filepath.Base(piece.Path)
+		index.Pieces = append(index.Pieces, piece)
+	}
+
+	buf, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializing HAR index: %w", err)
+	}
+
+	err = os.WriteFile(r.indexPath(), buf, 0666)
+	if err != nil {
+		return fmt.Errorf("error writing HAR index to %v: %w", r.indexPath(), err)
+	}
+	return nil
+}
+
+// writeHAR writes a HAR log to a file
+func writeHAR(path string, har *harlog.HARContainer) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = json.NewEncoder(f).Encode(har)
+	if err != nil {
+		return fmt.Errorf("error serializing HAR output: %w", err)
+	}
+	return f.Close()
+}
+
+// readHAR reads a HAR log from a file
+func readHAR(path string) (*harlog.HARContainer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var har harlog.HARContainer
+	if err := json.NewDecoder(f).Decode(&har); err != nil {
+		return nil, fmt.Errorf("error parsing HAR file %v: %w", path, err)
+	}
+	if har.Log == nil {
+		return nil, fmt.Errorf("%v is not a HAR file: it has no log", path)
+	}
+	return &har, nil
+}
+
+// harRequestBody returns the body of a request in a HAR entry with any content encoding removed,
+// reading it from its file if it was saved with --body-dir
+func harRequestBody(req *harlog.Request) ([]byte, error) {
+	if req.PostData == nil {
+		return nil, nil
+	}
+	if req.PostData.File != "" {
+		body, err := os.ReadFile(req.PostData.File)
+		if err != nil {
+			return nil, err
+		}
+		body, _, err = decodeContent(bytes.NewReader(body), []string{req.PostData.ContentEncoding})
+		return body, err
+	}
+	return []byte(req.PostData.Text), nil
+}
+
+// harResponseBody returns the body of a response in a HAR entry with any content encoding removed,
+// reading it from its file if it was saved with --body-dir
+func harResponseBody(resp *harlog.Response) ([]byte, error) {
+	c := resp.Content
+	switch {
+	case c == nil:
+		return nil, nil
+	case c.File != "":
+		body, err := os.ReadFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		body, _, err = decodeContent(bytes.NewReader(body), []string{c.ContentEncoding})
+		return body, err
+	case c.Encoding == "base64":
+		return base64.StdEncoding.DecodeString(c.Text)
+	default:
+		return []byte(c.Text), nil
+	}
+}
+
+// annotateHAR adds information to HAR entries beyond what the HAR middleware records by itself
+func annotateHAR(entry *harlog.Entry, req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) {
+	// store decompressed request bodies, noting the original encoding, and look inside them below
+	if encodings := req.Header.Values("Content-Encoding"); len(encodings) > 0 && entry.Request.PostData != nil {
+		decoded, truncated, err := decodeContent(bytes.NewReader(reqBody), encodings)
+		if err != nil {
+			verbosef("error decoding request body for HAR, storing raw bytes: %v", err)
+		} else {
+			var decodedEntry harlog.Entry
+			if err := harlog.UpdateEntryWithRequest(&decodedEntry, req, decoded); err == nil {
+				decodedEntry.Request.PostData.Comment = entry.Request.PostData.Comment
+				if truncated {
+					decodedEntry.Request.PostData.Comment = fmt.Sprintf("body truncated to %d bytes after decoding", len(decoded))
+				}
+				entry.Request.PostData = decodedEntry.Request.PostData
+				entry.Request.PostData.ContentEncoding = strings.Join(encodings, ", ")
+			}
+			reqBody = decoded
+		}
+	}
+
+	// store decompressed response content, noting the original encoding
+	if encodings := resp.Header.Values("Content-Encoding"); len(encodings) > 0 && entry.Response.Content != nil {
+		decoded, truncated, err := decodeContent(bytes.NewReader(respBody), encodings)
+		if err != nil {
+			verbosef("error decoding response content for HAR, storing raw bytes: %v", err)
+		} else {
+			trailers := entry.Response.Trailers
+			harlog.UpdateEntryWithResponse(entry, resp, decoded)
+			entry.Response.Trailers = trailers
+			entry.Response.Content.Size = int64(len(decoded))
+			entry.Response.Content.Compression = int64(len(decoded) - len(respBody))
+			entry.Response.Content.ContentEncoding = strings.Join(encodings, ", ")
+			entry.Response.BodySize = int64(len(respBody))
+			if truncated {
+				entry.Response.Content.Compression = 0
+				entry.Response.Content.Comment = fmt.Sprintf("body truncated to %d bytes after decoding", len(decoded))
+			}
+		}
+	}
+
+	// mark responses that were made up by --rules mocks, and requests that were sent elsewhere, with other
+	// headers, or not at once
+	entry.Response.Mocked = mockedResponse(resp)
+	entry.Request.EffectiveURL = effectiveURL(req, resp)
+	entry.Request.RateLimited = rateLimited(resp)
+	for name, values := range injectedHeaders(req, resp) {
+		for _, value := range values {
+			entry.Request.InjectedHeaders = append(entry.Request.InjectedHeaders, &harlog.NVP{Name: name, Value: value})
+		}
+	}
+
+	// record decoded gRPC messages as comments
+	if messages := scrubMessages(decodeGRPC(req.URL.Path, req.Header, reqBody, true)); len(messages) > 0 && entry.Request.PostData != nil {
+		entry.Request.PostData.Comment = joinJSON(messages)
+	}
+	if messages := scrubMessages(decodeGRPC(req.URL.Path, resp.Header, respBody, false)); len(messages) > 0 && entry.Response.Content != nil {
+		entry.Response.Content.Comment = joinJSON(messages)
+	}
+
+	// record GraphQL operations in a custom field
+	for _, op := range parseGraphQL(req.Method, req.URL, req.Header, bodyScrubber.Scrub(reqBody)) {
+		entry.GraphQL = append(entry.GraphQL, &harlog.GraphQLOperation{
+			Type:      op.Type,
+			Name:      op.Name,
+			Variables: op.Variables,
+		})
+	}
+
+	// record the fingerprint of the ClientHello sent by the subprocess
+	if fp := fingerprintFromContext(req.Context()); fp != nil && entry.Request.TLS != nil {
+		entry.Request.TLS.JA3 = fp.JA3
+		entry.Request.TLS.JA4 = fp.JA4
+	}
+}
+
+// recordDNSInHAR adds each DNS question and answer to the log collected by a HAR transport
+func recordDNSInHAR(t *harlog.Transport) {
+	watchDNS(func(c *DNSCall) {
+		t.AddDNSQuery(&harlog.DNSQuery{
+			StartedDateTime: harlog.Time(c.Time),
+			Time:            harlog.Duration(c.Duration),
+			Name:            c.Name,
+			Type:            c.Type,
+			Answers:         c.Answers,
+			Error:           c.Error,
+			Blocked:         c.Blocked,
+		})
+	})
+}
+
+// joinJSON joins JSON documents with newlines
+func joinJSON(docs []json.RawMessage) string {
+	var parts []string
+	for _, doc := range docs {
+		parts = append(parts, string(doc))
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// names that resolve to fixed addresses, as given with --resolve and --hosts-file, keyed by lowercase
+// name without a trailing dot
+var staticHosts = make(map[string][]net.IP)
+
+// normalizeHost lowercases a name and removes any trailing dot
+func normalizeHost(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// addStaticHost makes a name resolve to an address, in addition to any addresses added before
+func addStaticHost(name string, ip net.IP) {
+	name = normalizeHost(name)
+	staticHosts[name] = append(staticHosts[name], ip)
+}
+
+// parseResolve parses an override in the form used by curl's --resolve, which is HOST:PORT:ADDR[,ADDR]...
+// where IPv6 addresses may be in brackets. The port is accepted for compatibility with curl but ignored,
+// since the override applies to DNS, which has no notion of ports.
+func parseResolve(s string) (string, []net.IP, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return "", nil, fmt.Errorf("expected HOST:PORT:ADDRESS but got %q", s)
+	}
+
+	var ips []net.IP
+	for _, addr := range strings.Split(parts[2], ",") {
+		ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+		if ip == nil {
+			return "", nil, fmt.Errorf("invalid IP address %q in %q", addr, s)
+		}
+		ips = append(ips, ip)
+	}
+	return parts[0], ips, nil
+}
+
+// parseAddHost parses a mapping in the form used by docker's --add-host, which is HOST:ADDRESS
+func parseAddHost(s string) (string, net.IP, error) {
+	name, addr, ok := strings.Cut(s, ":")
+	if !ok || name == "" {
+		return "", nil, fmt.Errorf("expected HOST:ADDRESS but got %q", s)
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+	if ip == nil {
+		return "", nil, fmt.Errorf("invalid IP address %q in %q", addr, s)
+	}
+	return name, ip, nil
+}
+
+// loadHostsFile adds the names in a file in the format of /etc/hosts as static hosts
+func loadHostsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening hosts file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return fmt.Errorf("error on line %d of %v: expected an IP address followed by names", n, path)
+		}
+		for _, name := range fields[1:] {
+			addStaticHost(name, ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %v: %w", path, err)
+	}
+	return nil
+}
+
+// staticHostRecords returns the A or AAAA records for a name given with --resolve or --hosts-file, and
+// false if the name was not given
+func staticHostRecords(name string, qtype uint16) ([]dns.RR, bool) {
+	ips, ok := staticHosts[normalizeHost(name)]
+	if !ok {
+		return nil, false
+	}
+
+	var rrs []dns.RR
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: 60}
+		switch {
+		case qtype == dns.TypeA && ip.To4() != nil:
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip.To4()})
+		case qtype == dns.TypeAAAA && ip.To4() == nil:
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rrs, true
+}
+
+// staticHostName returns a name given with --resolve or --hosts-file for an address, choosing the first
+// in alphabetical order if there are several so that the answer is stable
+func staticHostName(ip net.IP) (string, bool) {
+	var names []string
+	for name, ips := range staticHosts {
+		if slices.ContainsFunc(ips, ip.Equal) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	return slices.Min(names), true
+}
+
+// staticHostAddr replaces a name given with --resolve or --hosts-file in a host:port address with the
+// first address it was given, for connections that we dial by name
+func staticHostAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ips := staticHosts[normalizeHost(host)]; len(ips) > 0 {
+		return net.JoinHostPort(ips[0].String(), port)
+	}
+	return addr
+}
+
+// names that DNS answers sent to the subprocess gave for each address, so that connections made to an
+// address can be matched against patterns for the host that they were meant for
+var (
+	resolvedNames   = make(map[string]string)
+	resolvedNamesMu sync.Mutex
+)
+
+// recordResolvedNames remembers the name that was looked up for each address in the answer to a DNS query
+// from the subprocess, if any throttles or --allow patterns are for particular hosts. The name asked
+// about is recorded rather than the names in the answer, which may be the targets of CNAME records.
+func recordResolvedNames(question dns.Question, rrs []dns.RR) {
+	if !throttlesByHost() && len(allowHosts) == 0 {
+		return
+	}
+	resolvedNamesMu.Lock()
+	defer resolvedNamesMu.Unlock()
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			resolvedNames[rr.A.String()] = normalizeHost(question.Name)
+		case *dns.AAAA:
+			resolvedNames[rr.AAAA.String()] = normalizeHost(question.Name)
+		}
+	}
+}
+
+// destinationHost finds the name of the host that the subprocess connected to at an address, from fake
+// IPs, static hosts, and the answers to its DNS queries, or else returns the IP address
+func destinationHost(addr string) string {
+	host, _, err := net.SplitHostPort(worldAddr(addr))
+	if err != nil {
+		return addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if name, ok := staticHostName(ip); ok {
+		return name
+	}
+	resolvedNamesMu.Lock()
+	defer resolvedNamesMu.Unlock()
+	if name, ok := resolvedNames[host]; ok {
+		return name
+	}
+	return host
+}
+
+// overlayHosts returns the contents of the /etc/hosts seen by the subprocess, which begins with the
+// special host name and the names given with --add-host, --resolve, and --hosts-file, followed by the
+// host's own /etc/hosts, so that programs that read the file directly agree with our DNS answers
+func overlayHosts(original []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# added by httptap\n")
+	fmt.Fprintf(&buf, "%s\t%s\n", specialHostIP, specialHostName)
+	for _, name := range slices.Sorted(maps.Keys(staticHosts)) {
+		for _, ip := range staticHosts[name] {
+			fmt.Fprintf(&buf, "%s\t%s\n", ip, name)
+		}
+	}
+	if len(original) > 0 {
+		buf.WriteString("\n")
+		buf.Write(original)
+	}
+	return buf.Bytes()
+}
@@ -3,41 +3,155 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/joemiller/certin"
+	"github.com/monasticacademy/httptap/pkg/contentcoding"
+	"github.com/monasticacademy/httptap/pkg/tlsfingerprint"
 )
 
 // HTTPCall models the information about an HTTP request/response that is exposed over the API and serialized to disk
 type HTTPCall struct {
-	Request    HTTPRequest  `json:"request"`
-	Response   HTTPResponse `json:"response"`
-	TotalBytes int64        `json:"total_bytes"`
+	Request    HTTPRequest   `json:"request"`
+	Response   HTTPResponse  `json:"response"`
+	TotalBytes int64         `json:"total_bytes"`
+	Start      time.Time     `json:"start"`    // when the request was received from the subprocess
+	Duration   time.Duration `json:"duration"` // from Start until the response was sent to the subprocess
+
+	// the headers and body of the request as the subprocess sent them, for replaying it from the web UI,
+	// which are only kept when --redact-header or --scrub-rules changed them
+	sent *sentRequest
+}
+
+// sentRequest is the part of a request that --redact-header and --scrub-rules hide
+type sentRequest struct {
+	header http.Header
+	body   []byte
 }
 
 // HTTPRequest models the information about an HTTP request that is exposed over the API and serialized to disk
 type HTTPRequest struct {
-	Method string      `json:"method"`
-	URL    string      `json:"url"`
-	Host   string      `json:"host"`
-	Header http.Header `json:"header"`
-	Body   []byte      `json:"body"`
+	Method    string              `json:"method"`
+	URL       string              `json:"url"`
+	Host      string              `json:"host"`
+	Header    http.Header         `json:"header"`
+	Body      []byte              `json:"body"`
+	Size      int64               `json:"size"`                // size of the whole body, which may be more than len(Body)
+	Truncated bool                `json:"truncated,omitempty"` // whether Body is only the first part of the body, as limited by --max-body-size
+	File      string              `json:"file,omitempty"`      // file containing the whole body, if it was spilled to disk or saved with --body-dir
+	SHA256    string              `json:"sha256,omitempty"`    // SHA-256 of the whole body, if it was saved with --body-dir
+	GRPC      []json.RawMessage   `json:"grpc,omitempty"`      // gRPC messages decoded to JSON, if proto descriptors were given
+	GraphQL   []*GraphQLOperation `json:"graphql,omitempty"`   // GraphQL operations found in the request
+	Multipart []*MultipartPart    `json:"multipart,omitempty"` // the parts of a multipart/form-data body
+	Trailer   http.Header         `json:"trailer,omitempty"`   // trailers sent after the body
+	TLS       *TLSInfo            `json:"tls,omitempty"`       // the handshake between the subprocess and us
+
+	EffectiveURL   string      `json:"effective_url,omitempty"`   // the URL that the request was sent to, if --rules or --map-remote sent it elsewhere
+	InjectedHeader http.Header `json:"injected_header,omitempty"` // headers that --set-header, --rules, or --policy added or changed before the request was sent
+	RateLimited    string      `json:"rate_limited,omitempty"`    // "queued" or "rejected" if the request was over --rate-limit
 }
 
 // HTTPResponse models the information about an HTTP request that is exposed over the API and serialized to disk
 type HTTPResponse struct {
-	StatusCode int         `json:"status_code"`
-	Status     string      `json:"status"`
-	Header     http.Header `json:"header"`
-	Body       []byte      `json:"body"`
+	StatusCode int               `json:"status_code"`
+	Status     string            `json:"status"`
+	Header     http.Header       `json:"header"`
+	Body       []byte            `json:"body"`
+	Size       int64             `json:"size"`                // size of the whole body, which may be more than len(Body)
+	Truncated  bool              `json:"truncated,omitempty"` // whether Body is only the first part of the body, as limited by --max-body-size
+	File       string            `json:"file,omitempty"`      // file containing the whole body, if it was spilled to disk or saved with --body-dir
+	SHA256     string            `json:"sha256,omitempty"`    // SHA-256 of the whole body, if it was saved with --body-dir
+	GRPC       []json.RawMessage `json:"grpc,omitempty"`      // gRPC messages decoded to JSON, if proto descriptors were given
+	Trailer    http.Header       `json:"trailer,omitempty"`   // trailers sent after the body, such as grpc-status
+	TLS        *TLSInfo          `json:"tls,omitempty"`       // the handshake between us and the server
+	Mocked     bool              `json:"mocked,omitempty"`    // whether the response was made up by a --rules mock rather than sent by a server
+}
+
+// whether the subprocess is asked for a client certificate when we intercept its TLS connections
+var clientAuth = tls.NoClientCert
+
+// TLSInfo describes the handshake of a TLS connection
+type TLSInfo struct {
+	Version         string           `json:"version"`
+	CipherSuite     string           `json:"cipher_suite"`
+	ALPN            string           `json:"alpn,omitempty"`
+	ServerName      string           `json:"server_name,omitempty"`
+	JA3             string           `json:"ja3,omitempty"` // fingerprints of the ClientHello, for connections from the subprocess
+	JA4             string           `json:"ja4,omitempty"`
+	PeerCertificate *CertificateInfo `json:"peer_certificate,omitempty"` // the certificate of the client or server, if it sent one
+}
+
+// CertificateInfo describes an x509 certificate
+type CertificateInfo struct {
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+	SHA256   string    `json:"sha256"`
+}
+
+// newCertificateInfo describes the first of a list of certificates, or returns nil if there are none
+func newCertificateInfo(certs []*x509.Certificate) *CertificateInfo {
+	if len(certs) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	return &CertificateInfo{
+		Subject:  certs[0].Subject.String(),
+		Issuer:   certs[0].Issuer.String(),
+		NotAfter: certs[0].NotAfter,
+		SHA256:   hex.EncodeToString(sum[:]),
+	}
+}
+
+// newTLSInfo describes a TLS connection, or returns nil for connections without TLS. The fingerprint
+// of the ClientHello may be nil.
+func newTLSInfo(state *tls.ConnectionState, fingerprint *tlsfingerprint.Fingerprint) *TLSInfo {
+	if state == nil {
+		return nil
+	}
+	info := TLSInfo{
+		Version:         tls.VersionName(state.Version),
+		CipherSuite:     tls.CipherSuiteName(state.CipherSuite),
+		ALPN:            state.NegotiatedProtocol,
+		ServerName:      state.ServerName,
+		PeerCertificate: newCertificateInfo(state.PeerCertificates),
+	}
+	if fingerprint != nil {
+		info.JA3 = fingerprint.JA3
+		info.JA4 = fingerprint.JA4
+	}
+	return &info
+}
+
+// String formats the handshake for display, for example "TLS 1.3, TLS_AES_128_GCM_SHA256, alpn h2, sni example.com"
+func (t *TLSInfo) String() string {
+	s := t.Version + ", " + t.CipherSuite
+	if t.ALPN != "" {
+		s += ", alpn " + t.ALPN
+	}
+	if t.ServerName != "" {
+		s += ", sni " + t.ServerName
+	}
+	if t.JA4 != "" {
+		s += ", ja3 " + t.JA3 + ", ja4 " + t.JA4
+	}
+	if t.PeerCertificate != nil {
+		s += ", certificate " + t.PeerCertificate.Subject
+	}
+	return s
 }
 
 // httpListener receives HTTPCalls each time a request/response is completed
@@ -46,6 +160,9 @@ type httpListener chan *HTTPCall
 // the listeners waiting for HTTPCalls
 var httpListeners []httpListener
 
+// the listeners added by followHTTP, which are dropped rather than waited for
+var httpFollowers = make(map[httpListener]struct{})
+
 // the complete set of HTTP calls up to the present moment
 var httpCalls []*HTTPCall
 
@@ -53,7 +170,8 @@ var httpCalls []*HTTPCall
 var httpMu sync.Mutex
 
 // add a listener that will receive events for each next HTTP call; the set of historical
-// HTTP calls is returned in a way that guarantees none are missed
+// HTTP calls is returned in a way that guarantees none are missed. Calls wait for the listener,
+// so it must keep up and must live as long as the proxy; other listeners use followHTTP.
 func listenHTTP() (httpListener, []*HTTPCall) {
 	httpMu.Lock()
 	defer httpMu.Unlock()
@@ -63,15 +181,60 @@ func listenHTTP() (httpListener, []*HTTPCall) {
 	return l, httpCalls
 }
 
-// add an HTTP call and notify listeners
-func notifyHTTP(call *HTTPCall) {
+// followHTTP is like listenHTTP for listeners that may fall behind or go away, such as clients of the
+// web UI. Calls never wait for such a listener: if it falls more than 128 calls behind then its channel is
+// closed and it receives no more. The returned function stops listening.
+func followHTTP() (httpListener, []*HTTPCall, func()) {
+	httpMu.Lock()
+	defer httpMu.Unlock()
+
+	l := make(httpListener, 128)
+	httpFollowers[l] = struct{}{}
+	stop := func() {
+		httpMu.Lock()
+		defer httpMu.Unlock()
+		if _, ok := httpFollowers[l]; ok {
+			delete(httpFollowers, l)
+			close(l)
+		}
+	}
+	return l, httpCalls, stop
+}
+
+// httpHistory returns the HTTP calls made so far, without listening for more
+func httpHistory() []*HTTPCall {
+	httpMu.Lock()
+	defer httpMu.Unlock()
+	return httpCalls[:len(httpCalls):len(httpCalls)]
+}
+
+// add an HTTP call and notify listeners, unless it is left out by --filter, with the headers given by
+// --redact-header replaced. Calls are checked against --fail-on whether or not they are left out. The call
+// as it was added is returned with its position in the history, or nil and -1 if it was left out.
+func notifyHTTP(call *HTTPCall) (*HTTPCall, int) {
+	checkFailRules(call)
+	if !showCall(call) {
+		return nil, -1
+	}
+	call = redactCall(call)
+
 	httpMu.Lock()
 	defer httpMu.Unlock()
 
 	httpCalls = append(httpCalls, call)
 	for _, l := range httpListeners {
-		l <- call // TODO: make non-block if necessary
+		l <- call
 	}
+	for l := range httpFollowers {
+		select {
+		case l <- call:
+		default:
+			verbosef("dropping a listener for HTTP calls that fell behind")
+			delete(httpFollowers, l)
+			close(l)
+		}
+	}
+	return call, len(httpCalls) - 1
 }
 
 // close all HTTP listeners so that the receiving end can exit
@@ -82,6 +245,10 @@ func finishHTTP() {
 	for _, l := range httpListeners {
 		close(l)
 	}
+	for l := range httpFollowers {
+		delete(httpFollowers, l)
+		close(l)
+	}
 }
 
 // TeeReadCloser returns a Reader that writes to w what it reads from r,
@@ -115,6 +282,11 @@ type countBytesConn struct {
 	read, written int64
 }
 
+// NetConn returns the connection that bytes are counted on
+func (conn *countBytesConn) NetConn() net.Conn {
+	return conn.Conn
+}
+
 func (conn *countBytesConn) Read(b []byte) (int, error) {
 	n, err := conn.Conn.Read(b)
 	conn.read += int64(n)
@@ -145,119 +317,226 @@ func proxyHTTPS(dst http.RoundTripper, conn net.Conn, root *certin.KeyAndCert) {
 
 	verbosef("intercepted a connection to %v", conn.LocalAddr())
 
+	// connections to hosts listed with --passthrough are relayed without interception
+	if len(passthroughHosts) > 0 {
+		serverName, replay, err := peekServerName(conn)
+		if err != nil {
+			errorf("error reading TLS client hello sent to %v: %v, aborting", conn.LocalAddr(), err)
+			return
+		}
+		if isPassthrough(serverName) {
+			verbosef("relaying TLS connection to %v (%v) without interception", conn.LocalAddr(), serverName)
+			proxyPassthrough(serverName, replay)
+			return
+		}
+		conn = replay
+	}
+
 	// wrap the connection with a byte counter
 	counts := countBytesConn{Conn: conn}
 	conn = &counts
 
+	// keep a copy of the raw ClientHello in order to fingerprint it
+	recorder := &helloRecorder{Conn: conn}
+
 	// create a tls server with certificates generated on-the-fly from our root CA
 	var serverName string
-	tlsconn := tls.Server(conn, &tls.Config{
+	var fingerprint *tlsfingerprint.Fingerprint
+	tlsconn := tls.Server(recorder, &tls.Config{
 		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			verbosef("got challenge for %q", hello.ServerName)
 			serverName = hello.ServerName
 
-			altNames := []string{ipFromAddr(conn.LocalAddr()).String()}
-			onthefly, err := certin.NewCert(root, certin.Request{CN: hello.ServerName, SANs: altNames})
+			// reject handshakes that cannot meet the policy given by --min-tls and --forbid-ciphers
+			if reason := checkHelloPolicy(hello); reason != "" {
+				return nil, reportTLSViolation(serverName, conn.LocalAddr().String(), reason)
+			}
+
+			var err error
+			fingerprint, err = tlsfingerprint.Parse(recorder.stop())
 			if err != nil {
-				errorf("error creating cert: %v", err)
-				return nil, fmt.Errorf("error creating on-the-fly certificate for %q: %w", hello.ServerName, err)
+				verbosef("error fingerprinting TLS client hello sent to %v: %v", conn.LocalAddr(), err)
 			}
 
-			tlscert := onthefly.TLSCertificate()
-			return &tlscert, nil
+			// connections inside a CONNECT tunnel have a host name rather than an IP as their local address
+			var altNames []string
+			if ip := ipFromAddr(conn.LocalAddr()); ip != nil {
+				altNames = append(altNames, ip.String())
+				// in fake-IP mode the name looked up is known even if the subprocess did not send SNI
+				if name, ok := fakeIPName(ip); ok {
+					altNames = append(altNames, name)
+					if serverName == "" {
+						serverName = name
+					}
+				}
+			} else if host, _, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+				altNames = append(altNames, host)
+				if serverName == "" {
+					serverName = host
+				}
+			}
+
+			tlscert, err := leafCertificate(root, serverName, altNames)
+			if err != nil {
+				errorf("error creating cert: %v", err)
+				return nil, err
+			}
+			return tlscert, nil
 		},
+		// offer HTTP/2 as well as HTTP/1.1 since many clients prefer HTTP/2 when it is available
+		NextProtos:   []string{"h2", "http/1.1"},
+		ClientAuth:   clientAuth,
+		MinVersion:   serverMinVersion(),
+		CipherSuites: allowedCipherSuites(),
 	})
 	defer tlsconn.Close()
 
+	err := tlsconn.Handshake()
+	if err != nil {
+		errorf("error in TLS handshake with subprocess for %v: %v, aborting", conn.LocalAddr(), err)
+		return
+	}
+
+	// TLS 1.3 cipher suites cannot be configured, so check the one that was chosen
+	if reason := checkTLSPolicy(tlsconn.ConnectionState()); reason != "" {
+		err := reportTLSViolation(serverName, conn.LocalAddr().String(), reason)
+		errorf("%v, closing connection to %v", err, conn.LocalAddr())
+		return
+	}
+
+	fconn := &fingerprintedConn{Conn: tlsconn, fingerprint: fingerprint}
+	if tlsconn.ConnectionState().NegotiatedProtocol == "h2" {
+		proxyHTTP2(dst, fconn, "https")
+		return
+	}
+
 	verbosef("reading request sent to %v (%v) ...", conn.LocalAddr(), serverName)
 
-	proxyHTTPScheme(dst, tlsconn, "https")
+	proxyHTTPScheme(dst, fconn, "https", root)
 }
 
 // Service an incoming HTTP connection on conn by sending a request out to the world through dst.
 // All HTTP requests sent to dst will have a context containing a value for the key dialToContextKey.
-func proxyHTTP(dst http.RoundTripper, conn net.Conn) {
-	proxyHTTPScheme(dst, conn, "http")
+func proxyHTTP(dst http.RoundTripper, conn net.Conn, root *certin.KeyAndCert) {
+	proxyHTTPScheme(dst, conn, "http", root)
 }
 
 // Service an incoming HTTP connection on conn by sending a request out to the world through dst.
 // If the URL in the request does not contain a scheme, use the specified scheme for the proxied request.
-func proxyHTTPScheme(dst http.RoundTripper, conn net.Conn, outgoingScheme string) {
+// The root CA is used to intercept TLS inside CONNECT tunnels.
+func proxyHTTPScheme(dst http.RoundTripper, conn net.Conn, outgoingScheme string, root *certin.KeyAndCert) {
 	defer handlePanic()
 	defer conn.Close()
 
 	verbosef("intercepted a connection to %v", conn.LocalAddr())
 
+	// remember the handshake and fingerprint if this connection was intercepted from TLS
+	var tlsState *tls.ConnectionState
+	if tlsconn, ok := conn.(*fingerprintedConn); ok {
+		state := tlsconn.ConnectionState()
+		tlsState = &state
+	}
+	ctx := withClientCert(withFingerprint(context.Background(), conn), conn)
+
 	// wrap the connection with a byte counter
 	counts := countBytesConn{Conn: conn}
 	conn = &counts
 
-	// read the HTTP request (TODO: support HTTP/2 using golang.org/x/net/http2)
-	req, err := http.ReadRequest(bufio.NewReader(conn))
+	// if the subprocess sent the HTTP/2 connection preface then it is speaking HTTP/2 with prior
+	// knowledge (h2c), which is common for gRPC
+	br := bufio.NewReader(conn)
+	if isHTTP2Preface(br) {
+		proxyHTTP2(dst, &bufferedConn{Conn: conn, r: br}, outgoingScheme)
+		return
+	}
+
+	// read the HTTP request
+	req, err := http.ReadRequest(br)
 	if err != nil {
 		errorf("error reading http request over tls server conn: %v, aborting", err)
 		return
 	}
 	defer req.Body.Close()
+	req.TLS = tlsState
+	req = req.WithContext(ctx)
 
-	verbosef("decoded an HTTP request for %v sent to %v", req.URL, conn.LocalAddr())
-
-	// the request may contain a relative URL but we need an absolute URL for call to RoundTrip
-	if req.URL.Host == "" {
-		req.URL.Host = req.Host
-		if req.URL.Host == "" {
-			req.URL.Host = conn.LocalAddr().String()
-		}
-	}
-	if req.URL.Scheme == "" {
-		req.URL.Scheme = outgoingScheme
+	// a subprocess configured to use an HTTP proxy opens a tunnel with CONNECT
+	if req.Method == http.MethodConnect {
+		proxyConnect(dst, req, conn, br, root)
+		return
 	}
 
-	// add the IP to which we intercepted packets as a context variable
-	req = req.WithContext(context.WithValue(req.Context(), dialToContextKey, conn.LocalAddr().String()))
+	// a client that sent "Expect: 100-continue" waits for permission before sending the body, which
+	// we give as soon as the body is needed, just as net/http does for servers
+	var expect *continueReader
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		expect = &continueReader{ReadCloser: req.Body, conn: conn}
+		req.Body = expect
+	}
 
-	// capture the request body into memory for inspection later
-	var reqbody bytes.Buffer
-	req.Body = TeeReadCloser(req.Body, &reqbody)
+	verbosef("decoded an HTTP request for %v sent to %v", req.URL, conn.LocalAddr())
 
-	// it seems that harlog assumes that request.GetBody will be non-nil whenever request.Body is non-nil
-	req.GetBody = func() (io.ReadCloser, error) { return req.Body, nil }
+	// make the URL absolute, set the dialTo context key, and capture the request body
+	req, reqbody := prepareRequest(req, conn.LocalAddr(), outgoingScheme)
 
 	// do roundtrip to the actual server in the world -- we use RoundTrip here because
 	// we do not want to follow redirects or accumulate our own cookies
 	resp, err := dst.RoundTrip(req)
+	if errors.Is(err, errResetConnection) {
+		verbosef("resetting connection to %v for %v %v, as a --rules fault asks", conn.LocalAddr(), req.Method, req.URL)
+		resetConn(conn)
+		return
+	}
+	if isUpstreamCertError(err) {
+		// the subprocess would have failed to connect without httptap, so it gets no response at all
+		errorf("error verifying certificate of %v for %v %v: %v, resetting connection (use --insecure-upstream to skip verification)", conn.LocalAddr(), req.Method, req.URL, err)
+		resetConn(conn)
+		return
+	}
 	if err != nil {
 		// error here means the server hostname could not be resolved, or a TCP connection could not be made,
 		// or TLS could not be negotiated, or something like that
-		errbody := []byte(err.Error())
-		resp = &http.Response{
-			Proto:         "HTTP/1.1",
-			ProtoMajor:    1,
-			ProtoMinor:    1,
-			Status:        http.StatusText(http.StatusBadGateway),
-			StatusCode:    http.StatusBadGateway,
-			Header:        make(http.Header),
-			ContentLength: int64(len(errbody)),
-			Body:          io.NopCloser(bytes.NewReader(errbody)),
-		}
-
+		resp = badGatewayResponse(err)
 		errorf("error proxying request to %v: %v, returning %v", conn.LocalAddr(), err, resp.Status)
 	}
 	defer resp.Body.Close()
 
-	// capture the response body into memory for later inspection
-	var respbody bytes.Buffer
+	// if the world agreed to switch protocols then relay the connection in both directions
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		proxyUpgrade(req, resp, br, conn, &counts)
+		return
+	}
+
+	// capture the response body for later inspection
+	var respbody bodyCapture
 	resp.Body = TeeReadCloser(resp.Body, &respbody)
 
-	// we are currently limited to talking HTTP/1.1 with the subprocess, even if the request we made
-	// to the world was done in HTTP/2
+	// we talk HTTP/1.1 on this connection, even if the request we made to the world was done in HTTP/2
 	resp.Proto = "HTTP/1.1"
 	resp.ProtoMajor = 1
 	resp.ProtoMinor = 1
 
+	// trailers can only be sent with chunked encoding, so use that whenever the length is unknown. The
+	// trailer map must exist before the body is read so that the transport fills in this same map.
+	if resp.ContentLength < 0 && req.ProtoAtLeast(1, 1) && req.Method != http.MethodHead {
+		resp.TransferEncoding = []string{"chunked"}
+		if resp.Trailer == nil {
+			resp.Trailer = make(http.Header)
+		}
+	}
+
 	// proxy the response from the world back to the subprocess
 	verbosef("replying to %v %v %v with %v (content length %d) ...", req.Method, req.URL, req.Proto, resp.Status, resp.ContentLength)
+	if expect != nil {
+		expect.responding()
+	}
 	err = resp.Write(conn)
+	if errors.Is(err, errTruncated) {
+		// the connection is closed on return, so the subprocess sees the response break off
+		verbosef("broke off response to %v %v after %d bytes, as a --rules fault asks", req.Method, req.URL, respbody.Len())
+		notifyCall(req, reqbody, resp, &respbody, counts.read+counts.written)
+		return
+	}
 	if err != nil {
 		errorf("error writing response to tls server conn: %v", err)
 		return
@@ -266,53 +545,316 @@ func proxyHTTPScheme(dst http.RoundTripper, conn net.Conn, outgoingScheme string
 	verbosef("finished replying to %v %v %v (%d bytes) with %v %v (%d bytes)",
 		req.Method, req.URL, req.Proto, reqbody.Len(), resp.Status, resp.Proto, respbody.Len())
 
-	// deal with content compression
-	requestbody, err := decodeContent(&reqbody, req.Header["Content-Encoding"])
+	notifyCall(req, reqbody, resp, &respbody, counts.read+counts.written)
+}
+
+// continueReader wraps the body of a request that carries "Expect: 100-continue" and sends "100 Continue"
+// to the subprocess the first time the body is read. The outgoing transport only reads the body once the
+// server has itself agreed to continue, so this forwards the server's decision to the subprocess.
+type continueReader struct {
+	io.ReadCloser
+	conn io.Writer
+	mu   sync.Mutex
+	done bool // true once 100 Continue has been sent or the final response has begun
+}
+
+func (r *continueReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	if !r.done {
+		r.done = true
+		verbosef("sending 100 Continue to subprocess")
+		_, err := io.WriteString(r.conn, "HTTP/1.1 100 Continue\r\n\r\n")
+		if err != nil {
+			r.mu.Unlock()
+			return 0, fmt.Errorf("error sending 100 Continue: %w", err)
+		}
+	}
+	r.mu.Unlock()
+	return r.ReadCloser.Read(p)
+}
+
+// responding is called before the final response is written, after which 100 Continue is never sent
+func (r *continueReader) responding() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done = true
+}
+
+// proxyConnect handles a CONNECT request from a subprocess that believes it is talking to an HTTP proxy.
+// It acknowledges the tunnel and then intercepts the traffic inside it just as if the subprocess had
+// connected to the destination directly, treating it as HTTPS if it begins with a TLS handshake and
+// as HTTP otherwise.
+func proxyConnect(dst http.RoundTripper, req *http.Request, conn net.Conn, br *bufio.Reader, root *certin.KeyAndCert) {
+	dest := req.Host
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		dest = net.JoinHostPort(dest, "443")
+	}
+
+	verbosef("subprocess opened a CONNECT tunnel to %v via %v", dest, conn.LocalAddr())
+
+	_, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	if err != nil {
+		errorf("error replying to CONNECT request for %v: %v, aborting", dest, err)
+		return
+	}
+
+	// peek at the first byte sent through the tunnel; 0x16 begins a TLS handshake
+	first, err := br.Peek(1)
 	if err != nil {
-		errorf("error decoding request body as %v, will return raw bytes", req.Header["Content-Encoding"])
-		requestbody = reqbody.Bytes()
+		verbosef("CONNECT tunnel to %v closed before any data was sent: %v", dest, err)
+		return
+	}
+
+	tunnel := &tunnelConn{bufferedConn: bufferedConn{Conn: conn, r: br}, dest: tunnelAddr(dest)}
+	if first[0] == 0x16 {
+		proxyHTTPS(dst, tunnel, root)
+	} else {
+		proxyHTTPScheme(dst, tunnel, "http", root)
+	}
+}
+
+// tunnelAddr is the destination of a CONNECT tunnel, which is a host and port rather than an IP address
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tcp" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// tunnelConn is the connection inside a CONNECT tunnel. Its local address is the destination of the
+// tunnel, so that requests sent through it are proxied to that destination.
+type tunnelConn struct {
+	bufferedConn
+	dest tunnelAddr
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr {
+	return c.dest
+}
+
+// prepareRequest gets a request read from the subprocess ready to be sent to the world. It makes the URL
+// absolute, adds the address to dial to the context under dialToContextKey (normally the address to which
+// we intercepted packets), and captures the request body as it is read.
+func prepareRequest(req *http.Request, localAddr net.Addr, outgoingScheme string) (*http.Request, *bodyCapture) {
+	// clients that think they are talking to a forward proxy send the whole URL in the request line
+	// (absolute form). In that case the URL rather than the intercepted address is the destination,
+	// and the URL takes precedence over the Host header.
+	dialTo := localAddr.String()
+	if req.URL.IsAbs() && req.URL.Host != "" {
+		req.Host = req.URL.Host
+		dialTo = req.URL.Host
+		if req.URL.Port() == "" {
+			port := "80"
+			if req.URL.Scheme == "https" {
+				port = "443"
+			}
+			dialTo = net.JoinHostPort(req.URL.Hostname(), port)
+		}
+
+		// these headers are meant for the proxy, which in this case is us
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+	}
+
+	// the request may contain a relative URL but we need an absolute URL for call to RoundTrip
+	if req.URL.Host == "" {
+		req.URL.Host = req.Host
+		if req.URL.Host == "" {
+			req.URL.Host = fakeIPHost(localAddr.String())
+		}
+	}
+	if req.URL.Scheme == "" {
+		req.URL.Scheme = outgoingScheme
+	}
+
+	// add the address to which the request should be sent, the name of the server, and the time at which
+	// the request was received, as context variables
+	ctx := context.WithValue(req.Context(), dialToContextKey, dialTo)
+	ctx = context.WithValue(ctx, startTimeContextKey, time.Now())
+	ctx = context.WithValue(ctx, serverNameContextKey, req.URL.Hostname())
+	req = req.WithContext(ctx)
+
+	// capture the request body for inspection later
+	var reqbody bodyCapture
+	req.Body = TeeReadCloser(req.Body, &reqbody)
+
+	return req, &reqbody
+}
+
+// badGatewayResponse creates the response that we send to the subprocess when we could not get any
+// response from the world
+func badGatewayResponse(err error) *http.Response {
+	errbody := []byte(err.Error())
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Status:        fmt.Sprintf("%d %s", http.StatusBadGateway, http.StatusText(http.StatusBadGateway)),
+		StatusCode:    http.StatusBadGateway,
+		Header:        make(http.Header),
+		ContentLength: int64(len(errbody)),
+		Body:          io.NopCloser(bytes.NewReader(errbody)),
 	}
+}
+
+// notifyCall makes the summary of a completed request/response that we log to disk and expose via
+// the API, and sends it to HTTP listeners
+func notifyCall(req *http.Request, reqbody *bodyCapture, resp *http.Response, respbody *bodyCapture, totalBytes int64) {
+	call := newHTTPCall(req, reqbody, resp, respbody, totalBytes)
+	verbosef("notifying http watchers %v %v %v (%d bytes)...", req.Method, req.URL, resp.Status, resp.ContentLength)
+	notifyHTTP(call)
+}
 
-	responsebody, err := decodeContent(&respbody, resp.Header["Content-Encoding"])
+// newHTTPCall makes the summary of a completed request/response, decoding and scrubbing the bodies
+func newHTTPCall(req *http.Request, reqbody *bodyCapture, resp *http.Response, respbody *bodyCapture, totalBytes int64) *HTTPCall {
+	reqfile, err := reqbody.Close()
 	if err != nil {
-		errorf("error decoding response body as %v, will return raw bytes", resp.Header["Content-Encoding"])
-		requestbody = reqbody.Bytes()
+		errorf("error writing request body to disk: %v", err)
+	}
+	respfile, err := respbody.Close()
+	if err != nil {
+		errorf("error writing response body to disk: %v", err)
+	}
+
+	// deal with content compression, except for bodies that were truncated, which cannot be decompressed,
+	// and treat bodies that decompress to more than --max-body-size as truncated
+	requestbody, requestTruncated := reqbody.Bytes(), reqbody.Truncated()
+	if !requestTruncated {
+		decoded, truncated, err := decodeContent(bytes.NewReader(requestbody), req.Header["Content-Encoding"])
+		if err != nil {
+			errorf("error decoding request body as %v, will return raw bytes", req.Header["Content-Encoding"])
+		} else {
+			requestbody, requestTruncated = decoded, truncated
+		}
 	}
 
-	// make the summary the we will log to disk and expose via the API
+	responsebody, responseTruncated := respbody.Bytes(), respbody.Truncated()
+	if !responseTruncated {
+		decoded, truncated, err := decodeContent(bytes.NewReader(responsebody), resp.Header["Content-Encoding"])
+		if err != nil {
+			errorf("error decoding response body as %v, will return raw bytes", resp.Header["Content-Encoding"])
+		} else {
+			responsebody, responseTruncated = decoded, truncated
+		}
+	}
+
+	start, _ := req.Context().Value(startTimeContextKey).(time.Time)
+
+	// apply --scrub-rules before the bodies are parsed or shown anywhere, except that gRPC messages are
+	// decoded first and then scrubbed as JSON, since scrubbing the protobuf encoding could corrupt it
+	requestGRPC := scrubMessages(decodeGRPC(req.URL.Path, req.Header, requestbody, true))
+	responseGRPC := scrubMessages(decodeGRPC(req.URL.Path, resp.Header, responsebody, false))
+	unscrubbed := requestbody
+	requestbody = bodyScrubber.Scrub(requestbody)
+	responsebody = bodyScrubber.Scrub(responsebody)
+
 	call := HTTPCall{
+		Request: HTTPRequest{
+			Method:    req.Method,
+			URL:       req.URL.String(),
+			Host:      req.Host,
+			Header:    req.Header,
+			Body:      requestbody,
+			Size:      reqbody.Len(),
+			Truncated: requestTruncated,
+			File:      reqfile,
+			SHA256:    reqbody.SHA256(),
+			GRPC:      requestGRPC,
+			GraphQL:   parseGraphQL(req.Method, req.URL, req.Header, requestbody),
+			Multipart: parseMultipart(req.Header, requestbody),
+			Trailer:   req.Trailer,
+			TLS:       newTLSInfo(req.TLS, fingerprintFromContext(req.Context())),
+
+			EffectiveURL:   effectiveURL(req, resp),
+			InjectedHeader: injectedHeaders(req, resp),
+			RateLimited:    rateLimited(resp),
+		},
+		Response: HTTPResponse{
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       responsebody,
+			Size:       respbody.Len(),
+			Truncated:  responseTruncated,
+			File:       respfile,
+			SHA256:     respbody.SHA256(),
+			GRPC:       responseGRPC,
+			Trailer:    resp.Trailer,
+			TLS:        newTLSInfo(resp.TLS, nil),
+			Mocked:     mockedResponse(resp),
+		},
+		TotalBytes: totalBytes,
+		Start:      start,
+		Duration:   time.Since(start),
+	}
+
+	if !bytes.Equal(requestbody, unscrubbed) {
+		call.sent = &sentRequest{header: req.Header, body: unscrubbed}
+	}
+	return &call
+}
+
+// proxyUpgrade handles a response that switched protocols, for example to websocket. It writes the response
+// header to the subprocess, notifies HTTP listeners right away, then relays bytes until either side is done.
+func proxyUpgrade(req *http.Request, resp *http.Response, fromSubprocess io.Reader, toSubprocess net.Conn, counts *countBytesConn) {
+	// the http transport provides the upgraded connection as the response body
+	world, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		errorf("got %v for %v but the response body was not writable, aborting", resp.Status, req.URL)
+		return
+	}
+
+	// write the status line and headers but no body
+	verbosef("replying to %v %v %v with %v, relaying %v", req.Method, req.URL, req.Proto, resp.Status, resp.Header.Get("Upgrade"))
+	_, err := fmt.Fprintf(toSubprocess, "HTTP/1.1 %s\r\n", resp.Status)
+	if err == nil {
+		err = resp.Header.Write(toSubprocess)
+	}
+	if err == nil {
+		_, err = io.WriteString(toSubprocess, "\r\n")
+	}
+	if err != nil {
+		errorf("error writing response to subprocess: %v", err)
+		return
+	}
+
+	// notify listeners now since the connection may stay open for a long time
+	start, _ := req.Context().Value(startTimeContextKey).(time.Time)
+	notifyHTTP(&HTTPCall{
 		Request: HTTPRequest{
 			Method: req.Method,
 			URL:    req.URL.String(),
 			Host:   req.Host,
 			Header: req.Header,
-			Body:   requestbody,
 		},
 		Response: HTTPResponse{
 			Status:     resp.Status,
 			StatusCode: resp.StatusCode,
 			Header:     resp.Header,
-			Body:       responsebody,
 		},
 		TotalBytes: counts.read + counts.written,
+		Start:      start,
+		Duration:   time.Since(start),
+	})
+
+	if strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		proxyWebSocket(fromSubprocess, toSubprocess, world, req.URL)
+		return
 	}
 
-	verbosef("notifying http watchers %v %v %v (%d bytes)...", req.Method, req.URL, resp.Status, resp.ContentLength)
-	notifyHTTP(&call)
+	// for other protocols just relay bytes
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(world, fromSubprocess)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(toSubprocess, world)
+		done <- struct{}{}
+	}()
+	<-done
 }
 
-func decodeContent(r io.Reader, encodings []string) ([]byte, error) {
-	var err error
-	for i := len(encodings) - 1; i >= 0; i-- {
-		switch strings.ToLower(encodings[i]) {
-		case "gzip":
-			r, err = gzip.NewReader(r)
-			if err != nil {
-				return nil, fmt.Errorf("error gzip-decoding: %w", err)
-			}
-		default:
-			return nil, fmt.Errorf("unsupported content encoding: %q", encodings[i])
-		}
-	}
-	return io.ReadAll(r)
+// decodeContent reads r and undoes each of the given content encodings, keeping at most maxBodySize bytes
+// of the result, and reports whether there was more
+func decodeContent(r io.Reader, encodings []string) ([]byte, bool, error) {
+	return contentcoding.Decode(r, encodings, maxBodySize)
 }
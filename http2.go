@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// the first bytes sent by an HTTP/2 client on a new connection
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// isHTTP2Preface checks whether the next bytes to be read from r are the HTTP/2 connection preface,
+// without consuming them
+func isHTTP2Preface(r *bufio.Reader) bool {
+	// check the first few bytes first so that we never block waiting for bytes that an HTTP/1 client
+	// is not going to send
+	if b, err := r.Peek(3); err != nil || string(b) != http2Preface[:3] {
+		return false
+	}
+	b, err := r.Peek(len(http2Preface))
+	return err == nil && string(b) == http2Preface
+}
+
+// bufferedConn is a net.Conn that reads through a buffered reader, so that bytes that were peeked
+// at are not lost
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+// NetConn returns the connection that is read from once the buffered bytes run out
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// hop-by-hop headers are specific to one connection and must not be sent over HTTP/2
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// proxyHTTP2 serves HTTP/2 requests sent by the subprocess over conn, sending each one out to the
+// world through dst. Each request is handled concurrently, as HTTP/2 requires.
+func proxyHTTP2(dst http.RoundTripper, conn net.Conn, outgoingScheme string) {
+	verbosef("serving HTTP/2 to subprocess on connection to %v", conn.LocalAddr())
+
+	var server http2.Server
+	server.ServeConn(conn, &http2.ServeConnOpts{
+		Context: withClientCert(withFingerprint(context.Background(), conn), conn),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if reset := proxyHTTP2Request(dst, w, r, conn.LocalAddr(), outgoingScheme); reset {
+				// this makes the server reset the stream, which is the HTTP/2 analogue of resetting
+				// the connection
+				panic(http.ErrAbortHandler)
+			}
+		}),
+	})
+}
+
+// proxyHTTP2Request sends a single request received over HTTP/2 out to the world through dst, and
+// writes the response back to the subprocess. It reports whether the stream should be reset instead,
+// as a --rules fault can ask.
+func proxyHTTP2Request(dst http.RoundTripper, w http.ResponseWriter, req *http.Request, localAddr net.Addr, outgoingScheme string) (reset bool) {
+	defer handlePanic()
+
+	verbosef("decoded an HTTP/2 request for %v sent to %v", req.URL, localAddr)
+
+	// make the URL absolute, set the dialTo context key, and capture the request body
+	req, reqbody := prepareRequest(req, localAddr, outgoingScheme)
+
+	resp, err := dst.RoundTrip(req)
+	if errors.Is(err, errResetConnection) {
+		verbosef("resetting HTTP/2 stream for %v %v, as a --rules fault asks", req.Method, req.URL)
+		return true
+	}
+	if isUpstreamCertError(err) {
+		errorf("error verifying certificate of %v for %v %v: %v, resetting stream (use --insecure-upstream to skip verification)", localAddr, req.Method, req.URL, err)
+		return true
+	}
+	if err != nil {
+		resp = badGatewayResponse(err)
+		errorf("error proxying request to %v: %v, returning %v", localAddr, err, resp.Status)
+	}
+	defer resp.Body.Close()
+
+	// capture the response body for later inspection
+	var respbody bodyCapture
+	resp.Body = TeeReadCloser(resp.Body, &respbody)
+
+	// proxy the response from the world back to the subprocess
+	verbosef("replying to %v %v %v with %v (content length %d) ...", req.Method, req.URL, req.Proto, resp.Status, resp.ContentLength)
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	for _, k := range hopByHopHeaders {
+		w.Header().Del(k)
+	}
+
+	// trailers are sent below once they are known, so do not declare them up front
+	w.Header().Del("Trailer")
+	w.WriteHeader(resp.StatusCode)
+
+	// flush after each write so that streaming responses such as server-sent events are delivered
+	// to the subprocess as they arrive
+	_, err = io.Copy(flushWriter{w}, resp.Body)
+	if errors.Is(err, errTruncated) {
+		verbosef("breaking off HTTP/2 response to %v %v after %d bytes, as a --rules fault asks", req.Method, req.URL, respbody.Len())
+		notifyCall(req, reqbody, resp, &respbody, reqbody.Len()+respbody.Len())
+		return true
+	}
+	if err != nil {
+		errorf("error writing HTTP/2 response to subprocess: %v", err)
+		return false
+	}
+
+	// forward trailers, which gRPC uses for its status codes
+	for k, vs := range resp.Trailer {
+		for _, v := range vs {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+
+	verbosef("finished replying to %v %v %v (%d bytes) with %v (%d bytes)",
+		req.Method, req.URL, req.Proto, reqbody.Len(), resp.Status, respbody.Len())
+
+	notifyCall(req, reqbody, resp, &respbody, reqbody.Len()+respbody.Len())
+	return false
+}
+
+// flushWriter flushes an HTTP response after each write
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
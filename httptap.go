@@ -3,18 +3,23 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -27,9 +32,14 @@ import (
 	"github.com/joemiller/certin"
 	"github.com/mdlayher/packet"
 	"github.com/monasticacademy/httptap/pkg/certfile"
+	"github.com/monasticacademy/httptap/pkg/control"
+	"github.com/monasticacademy/httptap/pkg/grpcdecode"
 	"github.com/monasticacademy/httptap/pkg/harlog"
+	"github.com/monasticacademy/httptap/pkg/netstack"
 	"github.com/monasticacademy/httptap/pkg/opensslpaths"
 	"github.com/monasticacademy/httptap/pkg/overlay"
+	"github.com/monasticacademy/httptap/pkg/policy"
+	"github.com/monasticacademy/httptap/pkg/scrub"
 	"github.com/songgao/water"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
@@ -46,33 +56,30 @@ import (
 	"gvisor.dev/gvisor/pkg/waiter"
 )
 
-const (
-	dumpPacketsToSubprocess   = false
-	dumpPacketsFromSubprocess = false
-	ttl                       = 10
-)
-
-var isVerbose bool
+const ttl = 10
 
+// verbose logs a message at debug level, which is shown with --verbose or --log-level debug
 func verbose(msg string) {
-	if isVerbose {
-		log.Print(msg)
-	}
+	logger.Debug(msg)
 }
 
-func verbosef(fmt string, parts ...interface{}) {
-	if isVerbose {
-		log.Printf(fmt, parts...)
+// verbosef logs a formatted message at debug level, formatting it only if it will be shown
+func verbosef(format string, parts ...interface{}) {
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		logger.Debug(fmt.Sprintf(format, parts...))
 	}
 }
 
+// infof logs a formatted message at info level
+func infof(format string, parts ...interface{}) {
+	logger.Info(fmt.Sprintf(format, parts...))
+}
+
 var errorColor = color.New(color.FgRed, color.Bold)
 
-func errorf(fmt string, parts ...interface{}) {
-	if !strings.HasSuffix(fmt, "\n") {
-		fmt += "\n"
-	}
-	errorColor.Printf(fmt, parts...)
+// errorf logs a formatted message at error level
+func errorf(format string, parts ...interface{}) {
+	logger.Error(strings.TrimSuffix(fmt.Sprintf(format, parts...), "\n"))
 }
 
 func printVersion() {
@@ -92,27 +99,128 @@ func Main() error {
 		Verbose            bool   `arg:"-v,--verbose,env:HTTPTAP_VERBOSE"`
 		Version            bool   `arg:"-V,--version" help:"print version information"`
 		NoNewUserNamespace bool   `arg:"--no-new-user-namespace,env:HTTPTAP_NO_NEW_USER_NAMESPACE" help:"do not create a new user namespace (must be run as root)"`
-		Stderr             bool   `arg:"env:HTTPTAP_LOG_TO_STDERR" help:"log to standard error (default is standard out)"`
+		Stderr             bool   `arg:"env:HTTPTAP_LOG_TO_STDERR" help:"print HTTP calls and other events to standard error (default is standard out)"`
+		LogLevel           string `arg:"--log-level,env:HTTPTAP_LOG_LEVEL" default:"info" help:"the least severe of httptap's own messages to log: debug, info, warn, or error (--verbose is the same as debug)"`
+		LogFormat          string `arg:"--log-format,env:HTTPTAP_LOG_FORMAT" default:"console" help:"how to format httptap's own messages: console for bare messages, or text or json for structured records with times and levels"`
+		LogFile            string `arg:"--log-file,env:HTTPTAP_LOG_FILE" help:"append httptap's own messages to this file instead of writing them to standard error"`
 		Tun                string `default:"httptap" help:"name of the TUN device that will be created"`
+		MTU                int    `arg:"--mtu,env:HTTPTAP_MTU" default:"1500" help:"MTU of the TUN device, where larger values mean fewer packets for bulk transfers"`
+		TunQueues          int    `arg:"--tun-queues,env:HTTPTAP_TUN_QUEUES" default:"1" help:"number of queues on the TUN device, whose packets are processed in parallel (gvisor stack only)"`
+
+		TCPSendBuffer        byteSize      `arg:"--tcp-send-buffer,env:HTTPTAP_TCP_SEND_BUFFER" help:"send buffer size for each TCP connection from the subprocess, where larger buffers help on high-latency links (gvisor stack only, default 1MB)"`
+		TCPReceiveBuffer     byteSize      `arg:"--tcp-receive-buffer,env:HTTPTAP_TCP_RECEIVE_BUFFER" help:"receive buffer size for each TCP connection from the subprocess, which is also the window offered to it (gvisor stack only, default 1MB)"`
+		TCPKeepaliveIdle     time.Duration `arg:"--tcp-keepalive-idle,env:HTTPTAP_TCP_KEEPALIVE_IDLE" help:"send keepalives on TCP connections from the subprocess that have been idle this long (gvisor stack only, e.g. 30s)"`
+		TCPKeepaliveInterval time.Duration `arg:"--tcp-keepalive-interval,env:HTTPTAP_TCP_KEEPALIVE_INTERVAL" help:"time between keepalives that the subprocess does not answer (gvisor stack only)"`
+		TCPKeepaliveCount    int           `arg:"--tcp-keepalive-count,env:HTTPTAP_TCP_KEEPALIVE_COUNT" help:"number of unanswered keepalives after which a TCP connection is dropped (gvisor stack only)"`
+		NoTCPSACK            bool          `arg:"--no-tcp-sack,env:HTTPTAP_NO_TCP_SACK" help:"do not agree to selective acknowledgements on TCP connections from the subprocess (gvisor stack only)"`
+		TCPMaxInFlight       int           `arg:"--tcp-max-in-flight,env:HTTPTAP_TCP_MAX_IN_FLIGHT" default:"100" help:"maximum number of TCP connections from the subprocess that can be waiting to be set up at once, beyond which new connection attempts are dropped (gvisor stack only)"`
+		Loss                 percentage    `arg:"--loss,env:HTTPTAP_LOSS" help:"drop this percentage of the packets exchanged with the subprocess, in both directions (gvisor stack only, e.g. 1%)"`
+		Duplicate            percentage    `arg:"--duplicate,env:HTTPTAP_DUPLICATE" help:"deliver this percentage of the packets exchanged with the subprocess twice (gvisor stack only)"`
+		Reorder              percentage    `arg:"--reorder,env:HTTPTAP_REORDER" help:"hold back this percentage of the packets exchanged with the subprocess so that later packets overtake them (gvisor stack only)"`
+		Jitter               time.Duration `arg:"--jitter,env:HTTPTAP_JITTER" help:"hold back each packet exchanged with the subprocess by a random time up to this long, which also reorders them (gvisor stack only, e.g. 20ms)"`
+
 		Subnet             string `default:"10.1.1.100/24" help:"IP address of the network interface that the subprocess will see"`
 		Gateway            string `default:"10.1.1.1" help:"IP address of the gateway that intercepts and proxies network packets"`
+		Subnet6            string `default:"fd68:7474:7000::100/64" help:"IPv6 address of the network interface that the subprocess will see, or empty to disable IPv6"`
+		Gateway6           string `default:"fd68:7474:7000::1" help:"IPv6 address of the gateway that intercepts and proxies network packets"`
 		UID                int
 		GID                int
-		User               string   `help:"run command as this user (username or id)"`
-		NoOverlay          bool     `arg:"--no-overlay,env:HTTPTAP_NO_OVERLAY" help:"do not mount any overlay filesystems"`
-		Stack              string   `arg:"env:HTTPTAP_STACK" default:"gvisor" help:"which tcp implementation to use: 'gvisor' or 'homegrown'"`
-		DumpTCP            bool     `arg:"--dump-tcp,env:HTTPTAP_DUMP_TCP" help:"dump all TCP packets sent and received to standard out"`
-		DumpHAR            string   `arg:"--dump-har,env:HTTPTAP_DUMP_HAR" help:"path to dump HAR capture to"`
-		HTTPPorts          []int    `arg:"--http" help:"list of TCP ports to intercept HTTP traffic on"`
-		HTTPSPorts         []int    `arg:"--https" help:"list of TCP ports to intercept HTTPS traffic on"`
-		Head               bool     `help:"whether to include HTTP headers in terminal output"`
-		Body               bool     `help:"whether to include HTTP payloads in terminal output"`
-		PrintDNS           bool     `arg:"--print-dns" help:"whether to print DNS queries and responses"`
-		NoExit             bool     `arg:"--no-exit" help:"do not exit when the launched subprocess exits; instead keep proxying forever"`
-		Command            []string `arg:"positional"`
+		User               string        `help:"run command as this user (username or id)"`
+		NoOverlay          bool          `arg:"--no-overlay,env:HTTPTAP_NO_OVERLAY" help:"do not mount any overlay filesystems"`
+		Stack              string        `arg:"env:HTTPTAP_STACK" default:"gvisor" help:"which tcp implementation to use: 'gvisor' or 'homegrown'"`
+		DumpTCP            bool          `arg:"--dump-tcp,env:HTTPTAP_DUMP_TCP" help:"dump all TCP packets sent and received to standard out"`
+		DumpHAR            string        `arg:"--dump-har,env:HTTPTAP_DUMP_HAR" help:"path to dump HAR capture to"`
+		DumpOpenAPI        string        `arg:"--dump-openapi,env:HTTPTAP_DUMP_OPENAPI" help:"path to write an OpenAPI 3 document to, with the paths, parameters, and JSON schemas inferred from the HTTP calls"`
+		DumpPostman        string        `arg:"--dump-postman,env:HTTPTAP_DUMP_POSTMAN" help:"path to write the HTTP calls to as a Postman collection, with an environment that sets the base URL of each host next to it"`
+		DumpFixtures       string        `arg:"--dump-fixtures,env:HTTPTAP_DUMP_FIXTURES" help:"path to write the HTTP calls to as test doubles: a Go file with httptest servers, or a Python file for the responses library"`
+		Cassette           string        `arg:"--cassette,env:HTTPTAP_CASSETTE" help:"HAR file to record HTTP calls to in full, or to answer requests from without using the network (replayed if it exists, otherwise recorded)"`
+		Record             bool          `arg:"--record,env:HTTPTAP_RECORD" help:"record to --cassette even if it exists, replacing it"`
+		Replay             bool          `arg:"--replay,env:HTTPTAP_REPLAY" help:"answer requests from --cassette, failing if it does not exist"`
+		CassetteFallback   bool          `arg:"--cassette-passthrough,env:HTTPTAP_CASSETTE_PASSTHROUGH" help:"send requests that have no response in --cassette to the network rather than failing them"`
+		DumpHARRotateSize  byteSize      `arg:"--dump-har-rotate-size,env:HTTPTAP_DUMP_HAR_ROTATE_SIZE" help:"start a new HAR file when the current one reaches this size (e.g. 10MB)"`
+		DumpHARRotateEvery time.Duration `arg:"--dump-har-rotate-interval,env:HTTPTAP_DUMP_HAR_ROTATE_INTERVAL" help:"start a new HAR file at this interval (e.g. 10m)"`
+		HTTPPorts          []int         `arg:"--http" help:"list of TCP ports to intercept HTTP traffic on"`
+		HTTPSPorts         []int         `arg:"--https" help:"list of TCP ports to intercept HTTPS traffic on"`
+		Passthrough        []string      `arg:"--passthrough,env:HTTPTAP_PASSTHROUGH" help:"relay TLS to these hosts without interception (e.g. example.com,*.bank.com)"`
+		CACert             string        `arg:"--ca-cert,env:HTTPTAP_CA_CERT" help:"PEM file containing a certificate authority to use for interception instead of generating one (requires --ca-key)"`
+		CAKey              string        `arg:"--ca-key,env:HTTPTAP_CA_KEY" help:"PEM file containing the private key for --ca-cert"`
+		CAKeyType          string        `arg:"--ca-key-type,env:HTTPTAP_CA_KEY_TYPE" default:"rsa-2048" help:"key type for the generated certificate authority: rsa-2048, rsa-3072, rsa-4096, ecdsa-256, or ecdsa-384"`
+		KeyType            string        `arg:"--key-type,env:HTTPTAP_KEY_TYPE" default:"rsa-2048" help:"key type for certificates generated for each server (ecdsa-256 is fastest; see --ca-key-type for choices)"`
+		EphemeralCA        bool          `arg:"--ephemeral-ca,env:HTTPTAP_EPHEMERAL_CA" help:"generate a new certificate authority for this run instead of reusing the one stored in $XDG_STATE_HOME/httptap"`
+		ClientCert         string        `arg:"--client-cert,env:HTTPTAP_CLIENT_CERT" help:"PEM file containing a client certificate to present to servers that ask for one (requires --client-key)"`
+		ClientKey          string        `arg:"--client-key,env:HTTPTAP_CLIENT_KEY" help:"PEM file containing the private key for --client-cert"`
+		ClientCertFor      []string      `arg:"--client-cert-for" help:"present a client certificate only to matching servers, as PATTERN=CERTFILE,KEYFILE (e.g. *.corp.example=client.crt,client.key)"`
+		RequestClientCert  bool          `arg:"--request-client-cert,env:HTTPTAP_REQUEST_CLIENT_CERT" help:"ask the subprocess for a client certificate when intercepting TLS, and record any that it presents"`
+		ForwardClientKeys  []string      `arg:"--forward-client-cert-key,env:HTTPTAP_FORWARD_CLIENT_CERT_KEY" help:"PEM files containing private keys for client certificates that the subprocess presents, which are then presented to servers too"`
+		MinTLS             string        `arg:"--min-tls,env:HTTPTAP_MIN_TLS" help:"reject TLS handshakes from the subprocess below this version (1.0, 1.1, 1.2, or 1.3) and report them"`
+		ForbidCiphers      []string      `arg:"--forbid-ciphers,env:HTTPTAP_FORBID_CIPHERS" help:"reject TLS handshakes from the subprocess that negotiate these cipher suites (e.g. TLS_RSA_WITH_AES_128_CBC_SHA) and report them"`
+		InsecureUpstream   bool          `arg:"--insecure-upstream,env:HTTPTAP_INSECURE_UPSTREAM" help:"do not verify the certificates of servers that intercepted TLS connections are forwarded to"`
+		BlockQUIC          bool          `arg:"--block-quic,env:HTTPTAP_BLOCK_QUIC" help:"reject UDP to port 443 so that browsers and gRPC clients fall back from QUIC to TCP, where httptap can intercept them"`
+		NoDetectTLS        bool          `arg:"--no-detect-tls,env:HTTPTAP_NO_DETECT_TLS" help:"do not intercept TLS connections on ports other than those given with --https"`
+		NoDetectHTTP       bool          `arg:"--no-detect-http,env:HTTPTAP_NO_DETECT_HTTP" help:"do not intercept plaintext HTTP connections on ports other than those given with --http"`
+		ServerFirstPorts   []int         `arg:"--server-first-ports,env:HTTPTAP_SERVER_FIRST_PORTS" help:"ports of protocols in which the server speaks first, on which TLS and HTTP are not detected so that connections are not delayed"`
+		Head               bool          `help:"whether to include HTTP headers in terminal output"`
+		Body               bool          `help:"whether to include HTTP payloads in terminal output"`
+		Curl               bool          `help:"whether to print a curl command that repeats each request"`
+		WebUI              string        `arg:"--webui,env:HTTPTAP_WEBUI" help:"serve the web UI and an API to query and control httptap on this address (e.g. localhost:8040)"`
+		WebUIToken         string        `arg:"--webui-token,env:HTTPTAP_WEBUI_TOKEN" help:"require this token for the web UI, as a bearer token or as the password of basic auth"`
+		WebUITLSCert       string        `arg:"--webui-tls-cert,env:HTTPTAP_WEBUI_TLS_CERT" help:"serve the web UI over HTTPS with the certificate in this PEM file"`
+		WebUITLSKey        string        `arg:"--webui-tls-key,env:HTTPTAP_WEBUI_TLS_KEY" help:"private key in PEM format for --webui-tls-cert"`
+		WebUICORS          []string      `arg:"--webui-cors,env:HTTPTAP_WEBUI_CORS" help:"let pages from this origin, such as http://localhost:3000, or from any origin with *, use the API served with --webui"`
+		Control            bool          `arg:"--control,env:HTTPTAP_CONTROL" help:"listen on a control socket for commands from httptap ctl, which can pause and resume capture, change --filter, add --rules, rotate HAR files, and print statistics"`
+		ControlSocket      string        `arg:"--control-socket,env:HTTPTAP_CONTROL_SOCKET" help:"path of the control socket, which implies --control (default: $XDG_RUNTIME_DIR/httptap/PID.sock)"`
+		Summary            bool          `help:"whether to print statistics about the HTTP calls by host and status code when the subprocess exits"`
+		NoColor            bool          `arg:"--no-color,env:HTTPTAP_NO_COLOR" help:"do not color the output, which is also the case when NO_COLOR is set or standard output is not a terminal"`
+		Quiet              bool          `arg:"--quiet,env:HTTPTAP_QUIET" help:"do not print anything for each HTTP call, DNS query, or other event, only errors and --summary, for when HAR files are the output"`
+		Plain              bool          `arg:"--plain,env:HTTPTAP_PLAIN" help:"print each HTTP call, DNS query, and other event on a single uncolored line with fields in a fixed order, for grep and awk"`
+		TUI                bool          `arg:"--tui,env:HTTPTAP_TUI" help:"browse HTTP calls as they happen in an interactive terminal UI instead of printing them"`
+		AddHost            []string      `arg:"--add-host,env:HTTPTAP_ADD_HOST" help:"add a line to /etc/hosts inside the namespace, as HOST:ADDRESS (e.g. db.local:10.0.0.7)"`
+		Resolve            []string      `arg:"--resolve,env:HTTPTAP_RESOLVE" help:"make a name resolve to a chosen address inside the namespace, as HOST:PORT:ADDRESS like curl (the port is ignored)"`
+		HostsFile          []string      `arg:"--hosts-file,env:HTTPTAP_HOSTS_FILE" help:"make the names in a file in the format of /etc/hosts resolve to the addresses given there"`
+		DNSBlock           []string      `arg:"--dns-block,env:HTTPTAP_DNS_BLOCK" help:"answer DNS queries for these hosts with NXDOMAIN, and report them (e.g. *.doubleclick.net,telemetry.example.com)"`
+		DNSBlockZero       bool          `arg:"--dns-block-zero,env:HTTPTAP_DNS_BLOCK_ZERO" help:"answer DNS queries for blocked hosts with 0.0.0.0 and :: rather than NXDOMAIN"`
+		Allow              []string      `arg:"--allow,env:HTTPTAP_ALLOW" help:"report DNS queries and connections to anything other than these hosts and networks, and refuse them if --enforce is given (e.g. *.github.com,10.0.0.0/8)"`
+		AllowFile          []string      `arg:"--allow-file,env:HTTPTAP_ALLOW_FILE" help:"read hosts and networks for --allow from a file, one per line"`
+		Enforce            bool          `arg:"--enforce,env:HTTPTAP_ENFORCE" help:"refuse DNS queries (with NXDOMAIN) and connections (with a TCP reset) to anything not given with --allow or --allow-file"`
+		NoDNSCache         bool          `arg:"--no-dns-cache,env:HTTPTAP_NO_DNS_CACHE" help:"resolve every DNS query from the subprocess rather than answering repeated queries from a cache"`
+		DNSCacheMinTTL     time.Duration `arg:"--dns-cache-min-ttl,env:HTTPTAP_DNS_CACHE_MIN_TTL" help:"cache DNS answers for at least this long, even if their TTL is shorter (e.g. 30s)"`
+		DNSCacheMaxTTL     time.Duration `arg:"--dns-cache-max-ttl,env:HTTPTAP_DNS_CACHE_MAX_TTL" default:"1h" help:"cache DNS answers for at most this long, even if their TTL is longer"`
+		FakeIP             bool          `arg:"--fake-ip,env:HTTPTAP_FAKE_IP" help:"answer DNS queries with addresses from 198.18.0.0/15 that identify the name looked up, so that every connection can be attributed to a host name"`
+		DNSUpstream        []string      `arg:"--dns-upstream,env:HTTPTAP_DNS_UPSTREAM" help:"forward DNS queries from the subprocess to these servers (e.g. 1.1.1.1:53, tls://9.9.9.9, or https://cloudflare-dns.com/dns-query) instead of resolving them with the host's resolver"`
+		PrintDNS           bool          `arg:"--print-dns" help:"whether to print DNS queries and responses"`
+		PrintTLS           bool          `arg:"--print-tls" help:"whether to print the TLS version, cipher suite, ALPN protocol, and SNI negotiated with the subprocess and with each server"`
+		CaptureHost        []string      `arg:"--capture-host,env:HTTPTAP_CAPTURE_HOST" help:"only print and record traffic to these hosts, which are still proxied either way (e.g. api.example.com,*.example.org)"`
+		IgnoreHost         []string      `arg:"--ignore-host,env:HTTPTAP_IGNORE_HOST" help:"do not print or record traffic to these hosts, which are still proxied (e.g. *.telemetry.example.com)"`
+		Timestamps         string        `arg:"--timestamps,env:HTTPTAP_TIMESTAMPS" help:"show the time of each request and response, and how long each call took, as \"absolute\" times of day or times \"relative\" to when httptap started"`
+		Format             string        `arg:"--format,env:HTTPTAP_FORMAT" help:"print each HTTP call with this Go template instead of as arrows, such as '{{.Response.StatusCode}} {{.Duration}} {{.Request.URL}}'"`
+		FailOn             []string      `arg:"--fail-on,separate,env:HTTPTAP_FAIL_ON" help:"exit with an error and list the violations if any HTTP call matches this rule: insecure-http, 'host not in FILE', or a --filter expression such as 'status >= 500' (may be repeated)"`
+		Filter             string        `arg:"--filter,env:HTTPTAP_FILTER" help:"only print and record the HTTP calls for which this expression is true, such as 'req.host.endsWith(\"github.com\") && resp.status >= 400'"`
+		RedactHeader       []string      `arg:"--redact-header,env:HTTPTAP_REDACT_HEADER" help:"replace the values of these headers with [REDACTED] in everything that is printed and recorded (e.g. Authorization,Cookie,X-Api-Key)"`
+		RedactDefault      bool          `arg:"--redact-default,env:HTTPTAP_REDACT_DEFAULT" help:"redact headers that commonly carry credentials: Authorization, Proxy-Authorization, Cookie, Set-Cookie, X-Api-Key, and X-Auth-Token"`
+		ScrubRules         string        `arg:"--scrub-rules,env:HTTPTAP_SCRUB_RULES" help:"apply the regex and JSONPath rules in this JSON file to request and response bodies before they are printed or recorded"`
+		Throttle           []string      `arg:"--throttle,env:HTTPTAP_THROTTLE" help:"limit the bandwidth of TCP connections in both directions, as HOST=RATE for matching hosts or RATE for all, where the rate is in bits per second such as 1mbps, DOWN/UP such as 2mbps/500kbps, or one of gprs, 2g, 3g, 4g, dsl, and cable"`
+		Delay              []string      `arg:"--delay,env:HTTPTAP_DELAY" help:"hold back responses before delivering them to the subprocess, as HOST=DELAY for matching hosts or DELAY for all, where the delay is a duration such as 300ms or a range such as 200ms-400ms"`
+		MapRemote          []string      `arg:"--map-remote,env:HTTPTAP_MAP_REMOTE" help:"send HTTP requests for one host to another instead, with the Host header and SNI to match, as FROM=TO (e.g. api.example.com=staging.example.com or *.example.com=localhost:8080)"`
+		SetHeader          []string      `arg:"--set-header,separate,env:HTTPTAP_SET_HEADER" help:"set a header on every HTTP request before it is sent, replacing any value that it had, which is recorded as injected (e.g. 'Authorization: Bearer abc')"`
+		SetRespHeader      []string      `arg:"--set-response-header,separate,env:HTTPTAP_SET_RESPONSE_HEADER" help:"set a header on every HTTP response before it is delivered to the subprocess, replacing any value that it had (e.g. 'Cache-Control: no-store')"`
+		RemoveRespHeader   []string      `arg:"--remove-response-header,env:HTTPTAP_REMOVE_RESPONSE_HEADER" help:"remove these headers from every HTTP response before it is delivered to the subprocess (e.g. Strict-Transport-Security,Content-Security-Policy)"`
+		RateLimit          []string      `arg:"--rate-limit,env:HTTPTAP_RATE_LIMIT" help:"hold back HTTP requests that exceed a budget, as HOST=N/PERIOD for matching hosts or N/PERIOD for all, where the period is s, min, or h (e.g. api.github.com=10/min)"`
+		RateLimitReject    bool          `arg:"--rate-limit-reject,env:HTTPTAP_RATE_LIMIT_REJECT" help:"answer HTTP requests that exceed --rate-limit with 429 Too Many Requests rather than holding them back"`
+		Chaos              string        `arg:"--chaos,env:HTTPTAP_CHAOS" help:"bring about delays, 5xx responses, and connection resets for this fraction of HTTP requests, and failures for this fraction of DNS queries, as p=PROBABILITY with an optional seed to repeat a run (e.g. p=0.05 or p=0.05,seed=42)"`
+		Intercept          string        `arg:"--intercept,env:HTTPTAP_INTERCEPT" help:"pause HTTP requests for which this expression is true, such as 'host == \"api.example.com\"' or true for all, and ask on the terminal whether to forward, edit, or drop each one"`
+		Rules              string        `arg:"--rules,env:HTTPTAP_RULES" help:"change requests and responses that match the rules in this JSON or YAML file, by rewriting URLs, setting or removing headers, replacing bodies, or changing status codes"`
+		Policy             string        `arg:"--policy,env:HTTPTAP_POLICY" help:"allow, deny, or modify DNS queries, connections, and HTTP requests according to the rules in this JSON or YAML file, which is reloaded when it changes"`
+		MaxBodySize        byteSize      `arg:"--max-body-size,env:HTTPTAP_MAX_BODY_SIZE" default:"10MB" help:"keep at most this much of each request and response body in memory (0 for no limit)"`
+		SaveUploads        string        `arg:"--save-uploads,env:HTTPTAP_SAVE_UPLOADS" help:"save files uploaded in multipart/form-data requests to this directory"`
+		BodySpillDir       string        `arg:"--body-spill-dir,env:HTTPTAP_BODY_SPILL_DIR" help:"write bodies larger than --max-body-size in full to files in this directory"`
+		BodyDir            string        `arg:"--body-dir,env:HTTPTAP_BODY_DIR" help:"write every body in full to a file in this directory named by its SHA-256, and refer to it from HAR files instead of including the body"`
+		ProtoDescriptors   []string      `arg:"--proto-descriptor,env:HTTPTAP_PROTO_DESCRIPTOR" help:"protobuf descriptor set used to decode gRPC messages (from protoc --include_imports --descriptor_set_out)"`
+		NoExit             bool          `arg:"--no-exit" help:"do not exit when the launched subprocess exits; instead keep proxying forever"`
+		Command            []string      `arg:"positional"`
 	}
 	args.HTTPPorts = []int{80}
 	args.HTTPSPorts = []int{443}
+	args.ServerFirstPorts = defaultServerFirstPorts
 	arg.MustParse(&args)
 
 	if args.Version {
@@ -120,6 +228,22 @@ func Main() error {
 		return nil
 	}
 
+	if (args.CACert == "") != (args.CAKey == "") {
+		return fmt.Errorf("--ca-cert and --ca-key must be given together")
+	}
+	if (args.ClientCert == "") != (args.ClientKey == "") {
+		return fmt.Errorf("--client-cert and --client-key must be given together")
+	}
+	if (args.WebUITLSCert == "") != (args.WebUITLSKey == "") {
+		return fmt.Errorf("--webui-tls-cert and --webui-tls-key must be given together")
+	}
+	if !slices.Contains(keyTypes, args.CAKeyType) {
+		return fmt.Errorf("unknown --ca-key-type %q (choose from %v)", args.CAKeyType, strings.Join(keyTypes, ", "))
+	}
+	if !slices.Contains(keyTypes, args.KeyType) {
+		return fmt.Errorf("unknown --key-type %q (choose from %v)", args.KeyType, strings.Join(keyTypes, ", "))
+	}
+
 	if len(args.Command) == 0 {
 		args.Command = []string{"/bin/sh"}
 	}
@@ -127,7 +251,242 @@ func Main() error {
 		log.SetOutput(os.Stderr)
 	}
 
-	isVerbose = args.Verbose
+	if err := setupLogging(args.LogLevel, args.LogFormat, args.LogFile, args.Verbose); err != nil {
+		return err
+	}
+	netstack.Verbosef = verbosef
+	netstack.Errorf = errorf
+	control.Verbosef = verbosef
+	policy.Verbosef = verbosef
+	for _, hosts := range args.CaptureHost {
+		captureHosts = append(captureHosts, strings.Split(hosts, ",")...)
+	}
+	for _, hosts := range args.IgnoreHost {
+		ignoreHosts = append(ignoreHosts, strings.Split(hosts, ",")...)
+	}
+	switch args.Timestamps {
+	case "", "absolute", "relative":
+		timestampMode = args.Timestamps
+	default:
+		return fmt.Errorf("unknown --timestamps %q (choose from absolute, relative)", args.Timestamps)
+	}
+	if args.NoColor || args.Plain {
+		color.NoColor = true
+	}
+	if args.Plain && (args.Format != "" || args.Head || args.Body || args.Curl || args.PrintTLS || args.TUI) {
+		return fmt.Errorf("--plain cannot be combined with --format, --head, --body, --curl, --print-tls, or --tui, which print more than one line per event")
+	}
+	plainOutput = args.Plain
+	if args.Intercept != "" && args.TUI {
+		return fmt.Errorf("--intercept cannot be combined with --tui, which takes over the terminal")
+	}
+	if args.Quiet && (args.Plain || args.Format != "" || args.Head || args.Body || args.Curl || args.PrintTLS || args.PrintDNS || args.TUI) {
+		return fmt.Errorf("--quiet cannot be combined with options that print HTTP calls or other events")
+	}
+	if args.Format != "" {
+		t, err := parseFormat(args.Format)
+		if err != nil {
+			return fmt.Errorf("error in --format: %w", err)
+		}
+		formatTemplate = t
+	}
+	if args.Filter != "" {
+		f, err := parseFilter(args.Filter)
+		if err != nil {
+			return fmt.Errorf("error in --filter: %w", err)
+		}
+		callFilter.Store(f)
+	}
+	for _, text := range args.FailOn {
+		rule, err := parseFailRule(text)
+		if err != nil {
+			return fmt.Errorf("error in --fail-on %q: %w", text, err)
+		}
+		failRules = append(failRules, rule)
+	}
+	for _, headers := range args.RedactHeader {
+		redactHeaders = append(redactHeaders, strings.Split(headers, ",")...)
+	}
+	if args.RedactDefault {
+		redactHeaders = append(redactHeaders, defaultRedactHeaders...)
+	}
+	if args.Record && args.Replay {
+		return fmt.Errorf("--record and --replay cannot be combined")
+	}
+	if (args.Record || args.Replay || args.CassetteFallback) && args.Cassette == "" {
+		return fmt.Errorf("--record, --replay, and --cassette-passthrough require --cassette")
+	}
+	if args.BodyDir != "" && args.BodySpillDir != "" {
+		return fmt.Errorf("--body-dir and --body-spill-dir cannot be combined, since --body-dir already writes every body to disk")
+	}
+	if args.ScrubRules != "" {
+		if args.BodySpillDir != "" || args.BodyDir != "" {
+			return fmt.Errorf("--scrub-rules cannot be combined with --body-spill-dir or --body-dir, which write bodies to disk before they can be scrubbed")
+		}
+		s, err := scrub.Load(args.ScrubRules)
+		if err != nil {
+			return fmt.Errorf("error loading --scrub-rules: %w", err)
+		}
+		bodyScrubber = s
+	}
+	maxBodySize = int64(args.MaxBodySize)
+	bodySpillDir = args.BodySpillDir
+	bodyDir = args.BodyDir
+	uploadDir = args.SaveUploads
+	insecureUpstream = args.InsecureUpstream
+	blockQUIC = args.BlockQUIC
+	leafKeyType = args.KeyType
+	for _, hosts := range args.Passthrough {
+		passthroughHosts = append(passthroughHosts, strings.Split(hosts, ",")...)
+	}
+
+	for _, hosts := range args.DNSBlock {
+		dnsBlockHosts = append(dnsBlockHosts, strings.Split(hosts, ",")...)
+	}
+	dnsBlockZero = args.DNSBlockZero
+	for _, entries := range args.Allow {
+		for _, entry := range strings.Split(entries, ",") {
+			if err := addAllow(entry); err != nil {
+				return fmt.Errorf("error in --allow: %w", err)
+			}
+		}
+	}
+	for _, path := range args.AllowFile {
+		entries, err := loadHostPatterns(path)
+		if err != nil {
+			return fmt.Errorf("error in --allow-file: %w", err)
+		}
+		for _, entry := range entries {
+			if err := addAllow(entry); err != nil {
+				return fmt.Errorf("error in %v: %w", path, err)
+			}
+		}
+	}
+	if args.Enforce && !allowing() {
+		return fmt.Errorf("--enforce requires --allow or --allow-file")
+	}
+	enforceAllow = args.Enforce
+	if args.Policy != "" {
+		rules, err := loadPolicy(args.Policy)
+		if err != nil {
+			return fmt.Errorf("error loading --policy: %w", err)
+		}
+		policyRules.Store(rules)
+		go watchPolicy(ctx, args.Policy)
+	}
+	if args.Chaos != "" {
+		c, err := parseChaosFlag(args.Chaos)
+		if err != nil {
+			return err
+		}
+		infof("chaos: bringing about faults for %v%% of traffic with seed %d", c.probability*100, c.seed)
+		chaos = c
+	}
+	for _, s := range args.Throttle {
+		t, err := parseThrottleFlag(s)
+		if err != nil {
+			return err
+		}
+		throttles = append(throttles, t)
+	}
+	for _, path := range args.HostsFile {
+		if err := loadHostsFile(path); err != nil {
+			return err
+		}
+	}
+	for _, mapping := range args.AddHost {
+		name, ip, err := parseAddHost(mapping)
+		if err != nil {
+			return fmt.Errorf("error in --add-host: %w", err)
+		}
+		addStaticHost(name, ip)
+	}
+	for _, override := range args.Resolve {
+		name, ips, err := parseResolve(override)
+		if err != nil {
+			return fmt.Errorf("error in --resolve: %w", err)
+		}
+		for _, ip := range ips {
+			addStaticHost(name, ip)
+		}
+	}
+	if !args.NoDNSCache {
+		dnsAnswers = newDNSCache(args.DNSCacheMinTTL, args.DNSCacheMaxTTL)
+	}
+	if args.FakeIP {
+		fakeIPs = newFakeIPPool(netip.MustParsePrefix(fakeIPRange))
+	}
+	for _, servers := range args.DNSUpstream {
+		for _, server := range strings.Split(servers, ",") {
+			addr, err := parseDNSUpstream(server)
+			if err != nil {
+				return fmt.Errorf("error in --dns-upstream: %w", err)
+			}
+			dnsUpstreams = append(dnsUpstreams, addr)
+		}
+	}
+
+	// load the client certificates to present to servers that ask for one
+	if args.ClientCert != "" {
+		cert, err := loadClientCert(args.ClientCert, args.ClientKey)
+		if err != nil {
+			return err
+		}
+		clientCert = cert
+	}
+	// load the TLS policy for connections from the subprocess
+	if args.MinTLS != "" {
+		version, err := parseTLSVersion(args.MinTLS)
+		if err != nil {
+			return fmt.Errorf("error in --min-tls: %w", err)
+		}
+		minTLSVersion = version
+	}
+	for _, names := range args.ForbidCiphers {
+		for _, name := range strings.Split(names, ",") {
+			id, err := parseCipherSuite(name)
+			if err != nil {
+				return fmt.Errorf("error in --forbid-ciphers: %w", err)
+			}
+			forbiddenCiphers = append(forbiddenCiphers, id)
+		}
+	}
+
+	for _, path := range args.ForwardClientKeys {
+		key, err := certin.LoadKey(path)
+		if err != nil {
+			return fmt.Errorf("error loading private key from %v: %w", path, err)
+		}
+		forwardKeys = append(forwardKeys, key)
+	}
+	if args.RequestClientCert || len(forwardKeys) > 0 {
+		clientAuth = tls.RequestClientCert
+	}
+	for _, s := range args.ClientCertFor {
+		rule, err := parseClientCertRule(s)
+		if err != nil {
+			return fmt.Errorf("error in --client-cert-for: %w", err)
+		}
+		clientCertRules = append(clientCertRules, rule)
+	}
+
+	// create the directories in which bodies and uploads are saved
+	for _, dir := range []string{args.BodySpillDir, args.BodyDir, args.SaveUploads} {
+		if dir != "" {
+			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+				return fmt.Errorf("error creating directory %v: %w", dir, err)
+			}
+		}
+	}
+
+	// load protobuf descriptors for decoding gRPC messages
+	if len(args.ProtoDescriptors) > 0 {
+		var err error
+		protoDecoder, err = grpcdecode.Load(args.ProtoDescriptors...)
+		if err != nil {
+			return err
+		}
+	}
 
 	// first we re-exec ourselves in a new user namespace
 	if !strings.HasPrefix(os.Args[0], "httptap.stage.") && !args.NoNewUserNamespace {
@@ -238,10 +597,30 @@ func Main() error {
 
 	verbosef("at second stage, creating certificate authority...")
 
-	// generate a root certificate authority
-	ca, err := certin.NewCert(nil, certin.Request{CN: "root CA", IsCA: true})
-	if err != nil {
-		return fmt.Errorf("error creating root CA: %w", err)
+	// use the certificate authority given on the command line, or else the one stored from previous
+	// runs, or else generate one just for this run
+	var ca *certin.KeyAndCert
+	var err error
+	if args.CACert != "" {
+		ca, err = loadCA(args.CACert, args.CAKey)
+		if err != nil {
+			return err
+		}
+	} else if !args.EphemeralCA {
+		dir, err := stateDir()
+		if err != nil {
+			return err
+		}
+		ca, err = storedCA(dir, args.CAKeyType)
+		if err != nil {
+			return err
+		}
+		leafCertDir = filepath.Join(dir, "certs")
+	} else {
+		ca, err = certin.NewCert(nil, certin.Request{CN: "root CA", IsCA: true, KeyType: args.CAKeyType})
+		if err != nil {
+			return fmt.Errorf("error creating root CA: %w", err)
+		}
 	}
 
 	// create a temporary directory
@@ -291,16 +670,70 @@ func Main() error {
 		return fmt.Errorf("error creating network namespace: %w", err)
 	}
 
-	// create a tun device in the new namespace
-	tun, err := water.New(water.Config{
-		DeviceType: water.TUN,
-		PlatformSpecificParams: water.PlatformSpecificParams{
-			Name: args.Tun,
-		},
-	})
-	if err != nil {
-		return fmt.Errorf("error creating tun device: %w", err)
+	// the homegrown stack reads packets from a single queue
+	if args.TunQueues < 1 {
+		return fmt.Errorf("--tun-queues must be at least 1 but got %d", args.TunQueues)
+	}
+	if args.TunQueues > 1 && strings.ToLower(args.Stack) != "gvisor" {
+		return fmt.Errorf("--tun-queues requires the gvisor stack")
+	}
+
+	// settings for the TCP connections from the subprocess
+	if args.TCPKeepaliveIdle < 0 || args.TCPKeepaliveInterval < 0 || args.TCPKeepaliveCount < 0 {
+		return fmt.Errorf("--tcp-keepalive-idle, --tcp-keepalive-interval, and --tcp-keepalive-count cannot be negative")
+	}
+	tuning := tcpTuning{
+		sendBuffer:        int(args.TCPSendBuffer),
+		receiveBuffer:     int(args.TCPReceiveBuffer),
+		keepaliveIdle:     args.TCPKeepaliveIdle,
+		keepaliveInterval: args.TCPKeepaliveInterval,
+		keepaliveCount:    args.TCPKeepaliveCount,
+		noSACK:            args.NoTCPSACK,
+	}
+	if args.TCPMaxInFlight < 1 {
+		return fmt.Errorf("--tcp-max-in-flight must be at least 1 but got %d", args.TCPMaxInFlight)
+	}
+	tcpStats := tcpForwarderStats{limit: args.TCPMaxInFlight}
+
+	// the homegrown stack has fixed TCP settings
+	if tuning.isSet() && strings.ToLower(args.Stack) != "gvisor" {
+		return fmt.Errorf("the --tcp-* flags require the gvisor stack")
+	}
+
+	// packets exchanged with the subprocess can be disturbed only by the gvisor stack
+	if args.Jitter < 0 {
+		return fmt.Errorf("--jitter cannot be negative")
+	}
+	netem := impairments{
+		loss:      float64(args.Loss),
+		duplicate: float64(args.Duplicate),
+		reorder:   float64(args.Reorder),
+		jitter:    args.Jitter,
+	}
+	if netem.isSet() && strings.ToLower(args.Stack) != "gvisor" {
+		return fmt.Errorf("--loss, --duplicate, --reorder, and --jitter require the gvisor stack")
+	}
+
+	// create a tun device in the new namespace, with more than one queue if requested, in which case the
+	// kernel spreads the packets from the subprocess across the queues by flow
+	var tunQueues []*water.Interface
+	for range args.TunQueues {
+		queue, err := water.New(water.Config{
+			DeviceType: water.TUN,
+			PlatformSpecificParams: water.PlatformSpecificParams{
+				Name:       args.Tun,
+				MultiQueue: args.TunQueues > 1,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error creating tun device: %w", err)
+		}
+		// closing the queues when we are done also keeps them from being closed by the garbage
+		// collector while the stack is reading from their file descriptors
+		defer queue.Close()
+		tunQueues = append(tunQueues, queue)
 	}
+	tun := tunQueues[0]
 
 	// find the link for the device we just created
 	link, err := netlink.LinkByName(args.Tun)
@@ -308,7 +741,20 @@ func Main() error {
 		return fmt.Errorf("error finding link for new tun device %q: %w", args.Tun, err)
 	}
 
+	// set the MTU, then look up the link again so that its attributes reflect the change
+	if link.Attrs().MTU != args.MTU {
+		err = netlink.LinkSetMTU(link, args.MTU)
+		if err != nil {
+			return fmt.Errorf("error setting MTU of tun device to %d: %w", args.MTU, err)
+		}
+		link, err = netlink.LinkByName(args.Tun)
+		if err != nil {
+			return fmt.Errorf("error finding link for new tun device %q: %w", args.Tun, err)
+		}
+	}
+
 	verbosef("tun device has MTU %d", link.Attrs().MTU)
+	netstack.SetMTU(link.Attrs().MTU)
 
 	// bring the link up
 	err = netlink.LinkSetUp(link)
@@ -336,12 +782,6 @@ func Main() error {
 		return fmt.Errorf("error parsing global subnet: %w", err)
 	}
 
-	// parse the subnet corresponding to all globally routable ipv6 addresses
-	ip6Routable, err := netlink.ParseIPNet("2000::/3")
-	if err != nil {
-		return fmt.Errorf("error parsing global subnet: %w", err)
-	}
-
 	// add a route that sends all ipv4 traffic going anywhere to the tun device
 	err = netlink.RouteAdd(&netlink.Route{
 		Dst:       ip4Routable,
@@ -351,13 +791,21 @@ func Main() error {
 		return fmt.Errorf("error creating default ipv4 route: %w", err)
 	}
 
-	// add a route that sends all ipv6 traffic going anywhere to the tun device
-	err = netlink.RouteAdd(&netlink.Route{
-		Dst:       ip6Routable,
-		LinkIndex: link.Attrs().Index,
-	})
+	// the subprocess is told about our ipv6 nameserver only if it can reach it
+	nameservers := []string{args.Gateway}
+	if args.Subnet6 != "" {
+		err = setupIPv6(link, args.Subnet6)
+		if err != nil {
+			verbosef("error setting up ipv6 on tun device: %v, continuing with ipv4 only", err)
+		} else {
+			nameservers = append(nameservers, args.Gateway6)
+		}
+	}
+
+	// let the subprocess use ping, which sends echo requests with an unprivileged ICMP socket
+	err = allowPings()
 	if err != nil {
-		verbosef("error creating default ipv6 route: %v, ignoring", err)
+		verbosef("error allowing unprivileged ICMP sockets in the network namespace: %v, ignoring", err)
 	}
 
 	// find the loopback device
@@ -412,12 +860,39 @@ func Main() error {
 		}()
 	}
 
+	// load the system certificate authorities now, before they are overlaid with our own
+	upstreamRoots, err = x509.SystemCertPool()
+	if err != nil {
+		return fmt.Errorf("error loading system certificate authorities: %w", err)
+	}
+
+	// read the host's nameservers and options now, before resolv.conf is overlaid
+	resolvConf, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		verbosef("error reading /etc/resolv.conf, overlaying it without the host's options: %v", err)
+	}
+	if servers, err := readResolvConf("/etc/resolv.conf"); err == nil {
+		if len(servers) > 0 {
+			hostNameservers = servers
+		}
+	} else {
+		verbosef("error reading /etc/resolv.conf, using %v for DNS: %v", hostNameservers, err)
+	}
+
+	// read the host's /etc/hosts now too, so that its entries are kept in the overlaid one
+	hostsFile, err := os.ReadFile("/etc/hosts")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		verbosef("error reading /etc/hosts, overlaying it without the host's entries: %v", err)
+	}
+
 	// if /etc/ is a directory then set up an overlay
 	if st, err := os.Lstat("/etc"); err == nil && st.IsDir() && !args.NoOverlay {
 		verbose("overlaying /etc ...")
 
-		// overlay resolv.conf
-		mount, err := overlay.Mount("/etc", overlay.File("resolv.conf", []byte("nameserver "+args.Gateway+"\n")))
+		// overlay resolv.conf and hosts
+		mount, err := overlay.Mount("/etc",
+			overlay.File("resolv.conf", overlayResolvConf(resolvConf, nameservers...)),
+			overlay.File("hosts", overlayHosts(hostsFile)))
 		if err != nil {
 			return fmt.Errorf("error setting up overlay: %w", err)
 		}
@@ -437,6 +912,48 @@ func Main() error {
 		}
 	}
 
+	// with --tui, take over the terminal so that HTTP calls can be browsed as they happen, and collect
+	// everything printed below for its output view
+	var ui *tui
+	if args.TUI {
+		ui, err = newTUI(os.Stdin, os.Stdout)
+		if err != nil {
+			return fmt.Errorf("error starting --tui: %w", err)
+		}
+		defer ui.close()
+	}
+
+	// infer an OpenAPI document from the HTTP calls at program termination
+	if args.DumpOpenAPI != "" {
+		defer func() {
+			if err := writeOpenAPI(args.DumpOpenAPI); err != nil {
+				errorf("%v", err)
+			}
+		}()
+	}
+
+	// convert the HTTP calls to a Postman collection at program termination
+	if args.DumpPostman != "" {
+		defer func() {
+			if err := writePostman(args.DumpPostman); err != nil {
+				errorf("%v", err)
+			}
+		}()
+	}
+
+	// write the HTTP calls as test doubles at program termination
+	if args.DumpFixtures != "" {
+		ext := filepath.Ext(args.DumpFixtures)
+		if ext != ".go" && ext != ".py" {
+			return fmt.Errorf("--dump-fixtures must end in .go or .py to choose the language to write fixtures in")
+		}
+		defer func() {
+			if err := writeFixtures(args.DumpFixtures); err != nil {
+				errorf("%v", err)
+			}
+		}()
+	}
+
 	// start printing HTTP calls to standard output
 	httpcalls, _ := listenHTTP()
 	go func() {
@@ -446,8 +963,37 @@ func Main() error {
 		resp4xx := color.New(color.FgYellow)
 		resp5xx := color.New(color.FgRed)
 		for c := range httpcalls {
+			if args.Quiet {
+				continue
+			}
+			if plainOutput {
+				fmt.Fprint(color.Output, plainHTTP(c))
+				continue
+			}
+
 			// log the request (do not do this earlier since reqbody may not be compete until now)
-			reqcolor.Printf("---> %v %v\n", c.Request.Method, c.Request.URL)
+			if formatTemplate != nil {
+				line, err := formatCall(c)
+				if err != nil {
+					errorf("%v", err)
+				} else {
+					fmt.Fprint(color.Output, line)
+				}
+			} else if len(c.Request.GraphQL) > 0 {
+				var ops []string
+				for _, op := range c.Request.GraphQL {
+					ops = append(ops, op.String())
+				}
+				reqcolor.Printf("---> %s%v %v (%s)\n", timestamp(c.Start), c.Request.Method, c.Request.URL, strings.Join(ops, ", "))
+			} else {
+				reqcolor.Printf("---> %s%v %v\n", timestamp(c.Start), c.Request.Method, c.Request.URL)
+			}
+			if args.Curl {
+				log.Println(curlCommand(c))
+			}
+			if args.PrintTLS && c.Request.TLS != nil {
+				log.Printf("> tls: %v", c.Request.TLS)
+			}
 			if args.Head {
 				for k, vs := range c.Request.Header {
 					for _, v := range vs {
@@ -455,8 +1001,35 @@ func Main() error {
 					}
 				}
 			}
-			if args.Body && len(c.Request.Body) > 0 {
-				log.Println(string(c.Request.Body))
+			if args.Body && len(c.Request.GRPC) > 0 {
+				for _, msg := range c.Request.GRPC {
+					log.Println(string(msg))
+				}
+			} else if args.Body && len(c.Request.Multipart) > 0 {
+				for _, part := range c.Request.Multipart {
+					log.Printf("> part %v", part)
+				}
+			} else if args.Body && len(c.Request.Body) > 0 {
+				desc, lines := renderBody(c.Request.Header, c.Request.Body, c.Request.Size)
+				log.Printf("> %s", desc)
+				for _, line := range lines {
+					log.Println(line)
+				}
+				if c.Request.Truncated {
+					log.Printf("> body truncated to %d of %d bytes", len(c.Request.Body), c.Request.Size)
+				}
+			}
+			if args.Head {
+				for k, vs := range c.Request.Trailer {
+					for _, v := range vs {
+						log.Printf("> %s: %s (trailer)", k, v)
+					}
+				}
+				for k, vs := range c.Request.InjectedHeader {
+					for _, v := range vs {
+						log.Printf("> %s: %s (injected)", k, v)
+					}
+				}
 			}
 
 			// log the response
@@ -471,7 +1044,24 @@ func Main() error {
 			default:
 				respcolor = resp5xx
 			}
-			respcolor.Printf("<--- %v %v (%d bytes)\n", c.Response.StatusCode, c.Request.URL, len(c.Response.Body))
+			var notes string
+			if c.Response.Mocked {
+				notes += ", mocked"
+			}
+			if c.Request.EffectiveURL != "" {
+				notes += ", sent to " + c.Request.EffectiveURL
+			}
+			if c.Request.RateLimited != "" {
+				notes += ", " + c.Request.RateLimited + " by --rate-limit"
+			}
+			if formatTemplate == nil && timestampMode != "" {
+				respcolor.Printf("<--- %s%v %v (%d bytes, %v%s)\n", timestamp(c.Start.Add(c.Duration)), c.Response.StatusCode, c.Request.URL, c.Response.Size, roundDuration(c.Duration), notes)
+			} else if formatTemplate == nil {
+				respcolor.Printf("<--- %v %v (%d bytes%s)\n", c.Response.StatusCode, c.Request.URL, c.Response.Size, notes)
+			}
+			if args.PrintTLS && c.Response.TLS != nil {
+				log.Printf("< tls: %v", c.Response.TLS)
+			}
 			if args.Head {
 				for k, vs := range c.Response.Header {
 					for _, v := range vs {
@@ -479,8 +1069,26 @@ func Main() error {
 					}
 				}
 			}
-			if args.Body && len(c.Response.Body) > 0 {
-				log.Println(string(c.Response.Body))
+			if args.Body && len(c.Response.GRPC) > 0 {
+				for _, msg := range c.Response.GRPC {
+					log.Println(string(msg))
+				}
+			} else if args.Body && len(c.Response.Body) > 0 {
+				desc, lines := renderBody(c.Response.Header, c.Response.Body, c.Response.Size)
+				log.Printf("< %s", desc)
+				for _, line := range lines {
+					log.Println(line)
+				}
+				if c.Response.Truncated {
+					log.Printf("< body truncated to %d of %d bytes", len(c.Response.Body), c.Response.Size)
+				}
+			}
+			if args.Head {
+				for k, vs := range c.Response.Trailer {
+					for _, v := range vs {
+						log.Printf("< %s: %s (trailer)", k, v)
+					}
+				}
 			}
 		}
 	}()
@@ -489,14 +1097,119 @@ func Main() error {
 	if args.PrintDNS {
 		dnsReqColor := color.New(color.FgBlue)
 		dnsRespColor := color.New(color.FgMagenta)
-		watchDNS(func(c *dnsCall) {
-			for _, q := range c.queries {
-				dnsReqColor.Printf("---> DNS %s (%s)\n", q.Query(), q.Type())
-				dnsRespColor.Printf("<--- %s\n", strings.Join(q.Answers(), ", "))
+		watchDNS(func(c *DNSCall) {
+			if c.Blocked {
+				return // printed below
+			}
+			if plainOutput {
+				fmt.Fprint(color.Output, plainDNS(c))
+				return
+			}
+			dnsReqColor.Printf("---> DNS %s (%s)\n", c.Name, c.Type)
+			if c.Error != "" {
+				dnsRespColor.Printf("<--- error: %s\n", c.Error)
+			} else {
+				dnsRespColor.Printf("<--- %s\n", strings.Join(c.Answers, ", "))
 			}
 		})
 	}
 
+	// start printing DNS queries that were blocked
+	blockedColor := color.New(color.FgRed)
+	watchDNS(func(c *DNSCall) {
+		if args.Quiet {
+			return
+		}
+		if c.Blocked && plainOutput {
+			fmt.Fprint(color.Output, plainDNS(c))
+		} else if c.Blocked {
+			blockedColor.Printf("<!> DNS %s (%s) blocked\n", c.Name, c.Type)
+		}
+	})
+
+	// start printing TLS connections that were relayed without interception
+	passthroughColor := color.New(color.FgCyan)
+	watchPassthrough(func(p *TLSPassthrough) {
+		if args.Quiet {
+			return
+		}
+		if plainOutput {
+			fmt.Fprint(color.Output, plainPassthrough(p))
+			return
+		}
+		passthroughColor.Printf("<-> TLS %v (%v) passed through, %d bytes sent, %d bytes received\n", p.ServerName, p.Addr, p.Sent, p.Received)
+	})
+
+	// start printing TLS handshakes that were rejected by the policy
+	violationColor := color.New(color.FgRed)
+	watchTLSViolations(func(v *TLSViolation) {
+		if args.Quiet {
+			return
+		}
+		if plainOutput {
+			fmt.Fprint(color.Output, plainViolation(v))
+			return
+		}
+		violationColor.Printf("<!> TLS %v (%v) rejected: %v\n", v.ServerName, v.Addr, v.Reason)
+	})
+
+	// start printing DNS queries and connections that were not allowed by --allow
+	watchEgressViolations(func(v *EgressViolation) {
+		if args.Quiet {
+			return
+		}
+		if plainOutput {
+			fmt.Fprint(color.Output, plainEgress(v))
+			return
+		}
+		outcome := "not allowed"
+		if v.Refused {
+			outcome = "refused"
+		}
+		if v.Addr != "" {
+			violationColor.Printf("<!> %s %v (%v) %s by --allow\n", strings.ToUpper(v.Kind), v.Host, v.Addr, outcome)
+		} else {
+			violationColor.Printf("<!> %s %v %s by --allow\n", strings.ToUpper(v.Kind), v.Host, outcome)
+		}
+	})
+
+	// start printing DNS queries, connections, and HTTP requests that --policy denied or modified
+	watchPolicyDecisions(func(d *PolicyDecision) {
+		if args.Quiet {
+			return
+		}
+		if plainOutput {
+			fmt.Fprint(color.Output, plainPolicy(d))
+			return
+		}
+		outcome := "denied"
+		if d.Action == "modify" {
+			outcome = "modified"
+		}
+		violationColor.Printf("<!> %s %v %s by policy %q\n", strings.ToUpper(d.On), d.Subject, outcome, d.Rule)
+	})
+
+	// start printing websocket frames to standard output
+	wsSendColor := color.New(color.FgBlue)
+	wsReceiveColor := color.New(color.FgMagenta)
+	watchWebSocket(func(m *WebSocketMessage) {
+		if args.Quiet {
+			return
+		}
+		if plainOutput {
+			fmt.Fprint(color.Output, plainWebSocket(m))
+			return
+		}
+		if m.Direction == "send" {
+			wsSendColor.Printf("---> WS %s %v (%d bytes)\n", m.Opcode, m.URL, m.Length)
+		} else {
+			wsReceiveColor.Printf("<--- WS %s %v (%d bytes)\n", m.Opcode, m.URL, m.Length)
+		}
+		if args.Body && m.Opcode == "text" && len(m.Payload) > 0 {
+			log.Println(string(m.Payload))
+		}
+	})
+
 	// set up environment variables for the subprocess
 	env := append(
 		os.Environ(),
@@ -529,39 +1242,53 @@ func Main() error {
 
 	// start sending packets to the process
 	toSubprocess := make(chan []byte, 1000)
-	go copyToDevice(ctx, tun, toSubprocess)
+	go netstack.WritePackets(ctx, tun, toSubprocess)
 
 	verbosef("listening on %v", args.Tun)
 
 	// the application-level thing is the mux, which distributes new connections according to patterns
-	var mux mux
+	var mux netstack.Mux
+
+	// check connections against --allow and --policy before they are dispatched
+	mux.AllowTCP = func(addr net.Addr) bool { return checkEgressConn("tcp", addr) && checkPolicyConn("tcp", addr) }
+	mux.AllowUDP = func(addr net.Addr) bool { return checkEgressConn("udp", addr) && checkPolicyConn("udp", addr) }
 
 	// handle DNS queries by calling net.Resolve
 	mux.HandleUDP(":53", func(conn net.Conn) {
 		defer conn.Close()
 		for {
-			// allocate new buffer on each iteration for now because different handlers for each packet
-			// are started asynchronously
-			payload := make([]byte, link.Attrs().MTU)
+			// take a new buffer from the pool on each iteration because the handlers for each packet
+			// are started asynchronously, and each handler returns its buffer when it is done
+			payload := netstack.GetBuffer(link.Attrs().MTU)
 			n, err := conn.Read(payload)
 			if err == net.ErrClosed {
 				verbose("UDP connection closed, exiting the read loop")
+				netstack.PutBuffer(payload)
 				break
 			}
 			if err != nil {
 				verbosef("error reading udp packet with conn.ReadFrom: %v, ignoring", err)
+				netstack.PutBuffer(payload)
 				continue
 			}
 
 			verbosef("read a UDP packet with %d bytes", n)
 
 			// handle the DNS query asynchronously
-			go handleDNS(context.Background(), conn, payload)
+			go func() {
+				defer netstack.PutBuffer(payload)
+				handleDNS(context.Background(), conn, payload[:n])
+			}()
 		}
 	})
 
+	// clients ask again over TCP when a DNS response over UDP was truncated
+	mux.HandleTCP(":53", func(conn net.Conn) {
+		handleDNSOverTCP(context.Background(), conn)
+	})
+
 	// create the transport that will proxy intercepted connections out to the world
-	var roundTripper http.RoundTripper = &http.Transport{
+	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
 			if network != "tcp" {
@@ -573,119 +1300,340 @@ func Main() error {
 				return nil, fmt.Errorf("context on proxied request was missing dialTo key")
 			}
 
-			// In order for processes in the network namespace to reach "localhost" in the host's
-			// network they use "host.httptap.local" or 169.254.77.65. Here we route request to
-			// those addresses to 127.0.0.1.
-			dialTo = strings.Replace(dialTo, specialHostName, "127.0.0.1", 1)
-			dialTo = strings.Replace(dialTo, specialHostIP, "127.0.0.1", 1)
+			// route requests to host.httptap.local to 127.0.0.1, and requests to fake IPs to their names
+			dialTo = worldAddr(dialTo)
 
+			// dial with the context so that connection timings are reported to the client trace
 			verbosef("pinned dialer ignoring %q and dialing %v", address, dialTo)
-			return net.Dial("tcp", dialTo)
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "tcp", dialTo)
 		},
 		ForceAttemptHTTP2:     true,
 		MaxIdleConns:          5,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig:       upstreamTLSConfig(),
 	}
 
-	// set up middlewares for HAR file logging if requested
-	if args.DumpHAR != "" {
-		// open the file right away so that filesystem errors get surfaced as soon as possible
-		f, err := os.Create(args.DumpHAR)
+	// client certificates presented by the subprocess are forwarded through separate connections
+	var roundTripper http.RoundTripper = transport
+	if len(forwardKeys) > 0 {
+		roundTripper = newClientCertTransport(transport)
+	}
+
+	// with --cassette, either record every exchange in full, or answer requests from the recording
+	if args.Cassette != "" {
+		cassette, closeCassette, err := openCassette(args.Cassette, args.Record, args.Replay, args.CassetteFallback, roundTripper)
 		if err != nil {
-			log.Printf("error opening HAR file for writing: %v", err)
+			return err
 		}
-		defer f.Close()
+		roundTripper = cassette
+		defer closeCassette()
+	}
+
+	// with --chaos, bring about faults at random in place of the network, so that mocks from --rules are
+	// left alone
+	if chaos != nil {
+		roundTripper = &chaosTransport{chaos: chaos, next: roundTripper}
+	}
 
+	// with --rules, --delay, --map-remote, and the flags that set and remove headers, change the requests and
+	// responses that match rules. The rules made from --delay come first so that they also hold back
+	// responses from mocks and faults.
+	var rules []*compiledRule
+	for _, s := range args.Delay {
+		rule, err := parseDelayFlag(s)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	for _, s := range args.MapRemote {
+		rule, err := parseMapRemoteFlag(s)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	for _, s := range args.SetHeader {
+		rule, err := parseSetHeaderFlag(s)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	for _, s := range args.SetRespHeader {
+		rule, err := parseSetResponseHeaderFlag(s)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	for _, s := range args.RemoveRespHeader {
+		rule, err := parseRemoveResponseHeaderFlag(s)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	if args.Rules != "" {
+		fileRules, err := loadRules(args.Rules)
+		if err != nil {
+			return fmt.Errorf("error loading --rules: %w", err)
+		}
+		rules = append(rules, fileRules...)
+	}
+	// with --control or --webui, rules can be added later, so the rules transport is needed even if there are none yet
+	controlled := args.Control || args.ControlSocket != ""
+	var rulesRoundTripper *rulesTransport
+	if len(rules) > 0 || controlled || args.WebUI != "" {
+		rulesRoundTripper = &rulesTransport{rules: rules, next: roundTripper}
+		roundTripper = rulesRoundTripper
+	}
+
+	// with --rate-limit, hold back or reject requests that exceed a budget, counting requests to the hosts
+	// that the subprocess asked for, before --rules send them elsewhere
+	var rateLimits []*rateLimit
+	for _, s := range args.RateLimit {
+		limit, err := parseRateLimitFlag(s)
+		if err != nil {
+			return err
+		}
+		rateLimits = append(rateLimits, limit)
+	}
+	if len(rateLimits) > 0 {
+		roundTripper = &rateLimitTransport{limits: rateLimits, reject: args.RateLimitReject, next: roundTripper}
+	}
+
+	// with --intercept, pause requests and ask on the terminal what to do with them, after --policy has
+	// denied or modified them and before anything else changes them
+	if args.Intercept != "" {
+		interceptor, err := newInterceptor(args.Intercept)
+		if err != nil {
+			return err
+		}
+		roundTripper = &interceptTransport{interceptor: interceptor, next: roundTripper}
+	}
+
+	// with --policy, allow, deny, or modify requests according to the rules in the policy file, which
+	// see requests as the subprocess sent them, before --rules apply
+	if args.Policy != "" {
+		roundTripper = &policyTransport{next: roundTripper}
+	}
+
+	// set up middlewares for HAR file logging if requested
+	var harScrub func(string) string
+	if bodyScrubber != nil {
+		harScrub = scrubText
+	}
+	var harTransport *harlog.Transport
+	var rotator *harRotator
+	if args.DumpHAR != "" {
 		// add the HAR middleware
-		harlogger := harlog.Transport{
+		harlogger := &harlog.Transport{
 			Transport: roundTripper,
 			UnusualError: func(err error) error {
 				verbosef("error in HAR log capture: %v, ignoring", err)
 				return nil
 			},
+			Annotate:      annotateHAR,
+			Filter:        filterHAR,
+			RedactHeaders: redactHeaders,
+			Scrub:         harScrub,
+			MaxBodySize:   int64(args.MaxBodySize),
+			BodyDir:       args.BodyDir,
 		}
 
-		roundTripper = &harlogger
+		roundTripper = harlogger
+		harTransport = harlogger
+		recordDNSInHAR(harlogger)
 
-		// write the HAR log at program termination
-		defer func() {
-			err := json.NewEncoder(f).Encode(harlogger.HAR())
+		if args.DumpHARRotateSize > 0 || args.DumpHARRotateEvery > 0 {
+			// write a series of HAR files plus an index file that lists them
+			rotator = newHARRotator(harlogger, args.DumpHAR, int64(args.DumpHARRotateSize), args.DumpHARRotateEvery)
+			harlogger.EntryAdded = rotator.entryAdded
+
+			// this writes the index file right away so that filesystem errors get surfaced as soon as possible
+			err := rotator.start()
+			if err != nil {
+				return err
+			}
+
+			// write the last HAR file at program termination
+			defer rotator.Close()
+		} else {
+			// open the file right away so that filesystem errors get surfaced as soon as possible
+			f, err := os.Create(args.DumpHAR)
+			if err != nil {
+				log.Printf("error opening HAR file for writing: %v", err)
+			}
+			defer f.Close()
+
+			// write the HAR log at program termination
+			defer func() {
+				err := json.NewEncoder(f).Encode(harlogger.HAR())
+				if err != nil {
+					verbosef("error serializing HAR output: %v, ignoring", err)
+				}
+			}()
+		}
+	}
+
+	// with --control, change how we behave according to commands sent by "httptap ctl"
+	ctrl := &controller{rules: rulesRoundTripper, har: harTransport, rotator: rotator}
+	if controlled {
+		server, err := control.Listen(args.ControlSocket, ctrl.runCommand)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+		go server.Serve()
+		log.Printf("listening for httptap ctl on %v", server.Path)
+	}
+
+	// with --webui, serve the web UI and the API behind it. This listens from another goroutine, since
+	// this one is locked to a thread in the network namespace of the subprocess.
+	if args.WebUI != "" {
+		ui := &webUI{
+			listen:    followHTTP,
+			history:   httpHistory,
+			addr:      args.WebUI,
+			token:     args.WebUIToken,
+			cors:      args.WebUICORS,
+			control:   ctrl,
+			events:    newEventHub(),
+			transport: roundTripper,
+		}
+		var tlsConfig *tls.Config
+		scheme := "http"
+		if args.WebUITLSCert != "" {
+			cert, err := tls.LoadX509KeyPair(args.WebUITLSCert, args.WebUITLSKey)
 			if err != nil {
-				verbosef("error serializing HAR output: %v, ignoring", err)
+				return fmt.Errorf("error loading --webui-tls-cert and --webui-tls-key: %w", err)
+			}
+			tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			scheme = "https"
+		}
+		listening := make(chan error)
+		go func() {
+			l, err := net.Listen("tcp", args.WebUI)
+			listening <- err
+			if err != nil {
+				return
+			}
+			if tlsConfig != nil {
+				l = tls.NewListener(l, tlsConfig)
+			}
+			if err := http.Serve(l, ui.handler()); err != nil {
+				errorf("error serving web UI: %v", err)
 			}
 		}()
+		if err := <-listening; err != nil {
+			return fmt.Errorf("error listening for --webui: %w", err)
+		}
+		log.Printf("serving web UI at %v://%v", scheme, args.WebUI)
+		if args.WebUIToken == "" && !isLoopbackAddr(args.WebUI) {
+			log.Printf("warning: the web UI shows the full contents of HTTP calls to anyone who can reach %v, consider --webui-token", args.WebUI)
+		}
 	}
 
 	// intercept TCP connections on requested HTTP ports and treat as HTTP
 	for _, port := range args.HTTPPorts {
 		mux.HandleTCP(fmt.Sprintf(":%d", port), func(conn net.Conn) {
-			proxyHTTP(roundTripper, conn)
+			proxyHTTP(roundTripper, throttleConn(conn), ca)
 		})
 	}
 
 	// intercept TCP connections on requested HTTPS ports and treat as HTTPS
 	for _, port := range args.HTTPSPorts {
 		mux.HandleTCP(fmt.Sprintf(":%d", port), func(conn net.Conn) {
-			proxyHTTPS(roundTripper, conn, ca)
+			proxyHTTPS(roundTripper, throttleConn(conn), ca)
 		})
 	}
 
 	// listen for other TCP connections and proxy to the world
 	mux.HandleTCP("*", func(conn net.Conn) {
-		dst := conn.LocalAddr().String()
+		conn = throttleConn(conn)
+
+		// intercept connections that begin with a TLS handshake or an HTTP request line even if they
+		// are not on an HTTPS or HTTP port
+		if (!args.NoDetectTLS || !args.NoDetectHTTP) && !isServerFirst(conn.LocalAddr(), args.ServerFirstPorts) {
+			var first []byte
+			conn, first = sniff(conn, sniffTimeout)
+			if !args.NoDetectTLS && looksLikeTLS(first) {
+				verbosef("detected TLS on connection to %v, intercepting as HTTPS", conn.LocalAddr())
+				proxyHTTPS(roundTripper, conn, ca)
+				return
+			}
+			if !args.NoDetectHTTP && looksLikeHTTP(first) {
+				verbosef("detected HTTP on connection to %v, intercepting", conn.LocalAddr())
+				proxyHTTP(roundTripper, conn, ca)
+				return
+			}
+		}
 
-		// In order for processes in the network namespace to reach "localhost" in the host's
-		// network they use "host.httptap.local" or 169.254.77.65. Here we route request to
-		// those addresses to 127.0.0.1.
-		dst = strings.Replace(dst, specialHostName, "127.0.0.1", 1)
-		dst = strings.Replace(dst, specialHostIP, "127.0.0.1", 1)
+		// route connections to host.httptap.local to 127.0.0.1, and connections to fake IPs to their names
+		dst := worldAddr(conn.LocalAddr().String())
+		verbosef("proxying connection to %v", dst)
 
 		proxyConn("tcp", dst, conn)
 	})
 
-	// listen for other UDP connections and proxy to the world
+	// relay other UDP flows to the world
 	mux.HandleUDP("*", func(conn net.Conn) {
-		dst := conn.LocalAddr().String()
-
-		// In order for processes in the network namespace to reach "localhost" in the host's
-		// network they use "host.httptap.local" or 169.254.77.65. Here we route request to
-		// those addresses to 127.0.0.1.
-		dst = strings.Replace(dst, specialHostName, "127.0.0.1", 1)
-		dst = strings.Replace(dst, specialHostIP, "127.0.0.1", 1)
+		// route flows to host.httptap.local to 127.0.0.1, and flows to fake IPs to their names
+		dst := worldAddr(conn.LocalAddr().String())
+		verbosef("relaying UDP flow to %v", dst)
 
-		proxyConn("udp", dst, conn)
+		proxyUDP(dst, conn)
 	})
 
 	switch strings.ToLower(args.Stack) {
 	case "homegrown":
 		// instantiate the tcp and udp stacks
-		tcpstack := newTCPStack(&mux, toSubprocess)
-		udpstack := newUDPStack(&mux, toSubprocess)
+		tcpstack := netstack.NewTCPStack(&mux, toSubprocess, link.Attrs().MTU)
+		udpstack := netstack.NewUDPStack(&mux, toSubprocess)
+		udpstack.DropPort = isQUICBlocked
 
 		// start reading packets from the TUN device
-		go readFromDevice(ctx, tun, tcpstack, udpstack)
+		go netstack.ReadPackets(ctx, tun, link.Attrs().MTU, tcpstack, udpstack)
 	case "gvisor":
 		// create the stack with udp and tcp protocols
 		s := stack.New(stack.Options{
 			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
-			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
 		})
 
-		// create a link endpoint based on the TUN device
+		// create a link endpoint based on the TUN device. The kernel computes full checksums for packets
+		// that it writes to a TUN device, so there is no need to verify them again. Segments from the
+		// subprocess are coalesced by GRO before they reach the TCP stack, which means fewer, larger reads
+		// by the proxy. Segmentation offload (IFF_VNET_HDR) and batched reads and writes are only supported
+		// by gvisor for socket file descriptors, not for TUN devices, so each packet is still read and
+		// written with its own system call.
+		var fds []int
+		for _, queue := range tunQueues {
+			fds = append(fds, int(queue.ReadWriteCloser.(*os.File).Fd()))
+		}
 		endpoint, err := fdbased.New(&fdbased.Options{
-			FDs: []int{int(tun.ReadWriteCloser.(*os.File).Fd())},
-			MTU: uint32(link.Attrs().MTU),
+			FDs:               fds,
+			MTU:               uint32(link.Attrs().MTU),
+			RXChecksumOffload: true,
+			GRO:               true,
 		})
 		if err != nil {
 			return fmt.Errorf("error creating link from tun device file descriptor: %v", err)
 		}
 
-		// create the TCP forwarder, which accepts gvisor connections and notifies the mux
-		const maxInFlight = 100 // maximum simultaneous connections
-		tcpForwarder := tcp.NewForwarder(s, 0, maxInFlight, func(r *tcp.ForwarderRequest) {
+		// apply the buffer sizes and SACK setting from the command line to every TCP connection
+		if err := tuning.configureStack(s); err != nil {
+			return err
+		}
+
+		// create the TCP forwarder, which accepts gvisor connections and notifies the mux. The receive
+		// window that it offers in the SYN+ACK is the receive buffer size, or the gvisor default if zero.
+		tcpStats.dropped = s.Stats().TCP.ForwardMaxInFlightDrop
+		tcpForwarder := tcp.NewForwarder(s, tuning.receiveBuffer, args.TCPMaxInFlight, func(r *tcp.ForwarderRequest) {
 			// remote address is the IP address of the subprocess
 			// local address is IP address that the subprocess was trying to reach
 			verbosef("at TCP forwarder: %v:%v => %v:%v",
@@ -693,7 +1641,8 @@ func Main() error {
 				r.ID().LocalAddress, r.ID().LocalPort)
 
 			// dispatch the request via the mux
-			go mux.notifyTCP(&tcpRequest{r, new(waiter.Queue)})
+			tcpStats.started()
+			go mux.NotifyTCP(&tcpRequest{r, new(waiter.Queue), &tuning, &tcpStats})
 		})
 
 		// TODO: this UDP forwarder sometimes only ever processes one UDP packet, other times it keeps going... :/
@@ -714,12 +1663,24 @@ func Main() error {
 			}
 
 			// dispatch the request via the mux
-			go mux.notifyUDP(gonet.NewUDPConn(&wq, ep))
+			go mux.NotifyUDP(gonet.NewUDPConn(&wq, ep))
 		})
 
 		// register the forwarders with the stack
-		s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
-		s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+		s.SetTransportProtocolHandler(tcp.ProtocolNumber, func(id stack.TransportEndpointID, pb *stack.PacketBuffer) bool {
+			handled := tcpForwarder.HandlePacket(id, pb)
+			tcpStats.checkDropped()
+			return handled
+		})
+		s.SetTransportProtocolHandler(udp.ProtocolNumber, func(id stack.TransportEndpointID, pb *stack.PacketBuffer) bool {
+			// returning false makes the stack reply with ICMP port unreachable, so that clients give up on
+			// QUIC right away rather than after a timeout
+			if isQUICBlocked(int(id.LocalPort)) {
+				verbosef("rejecting QUIC packet to %v:%v", id.LocalAddress, id.LocalPort)
+				return false
+			}
+			return udpForwarder.HandlePacket(id, pb)
+		})
 		s.SetTransportProtocolHandler(icmp.ProtocolNumber4, func(id stack.TransportEndpointID, pb *stack.PacketBuffer) bool {
 			verbosef("got icmp packet %v => %v", id.RemoteAddress, id.LocalAddress)
 			return false // this means the packet was handled and no error handler needs to be invoked
@@ -729,9 +1690,20 @@ func Main() error {
 			return false // this means the packet was handled and no error handler needs to be invoked
 		})
 
+		// drop, duplicate, reorder, and delay packets if requested
+		var linkEndpoint stack.LinkEndpoint = endpoint
+		if netem.isSet() {
+			linkEndpoint = newNetemEndpoint(linkEndpoint, netem)
+		}
+
+		// forward echo requests to the real network if we can, or else let the stack answer them
+		if canForwardPings() {
+			linkEndpoint = newPingEndpoint(linkEndpoint, tun)
+		}
+
 		// create the network interface -- tun2socks says this must happen *after* registering the TCP forwarder
 		nic := s.NextNICID()
-		er := s.CreateNIC(nic, endpoint)
+		er := s.CreateNIC(nic, linkEndpoint)
 		if er != nil {
 			return fmt.Errorf("error creating NIC: %v", er)
 		}
@@ -794,16 +1766,34 @@ func Main() error {
 		}
 	}
 
+	if ui != nil {
+		ui.prepare(cmd)
+	}
+
 	err = cmd.Start()
 	if err != nil {
 		return fmt.Errorf("error starting third stage subprocess: %w", err)
 	}
 
-	// wait for the subprocess to complete
-	err = cmd.Wait()
+	// wait for the subprocess to complete, or with --tui for the user to quit
+	if ui != nil {
+		err = ui.run(cmd)
+		ui.close()
+	} else {
+		err = cmd.Wait()
+	}
+	tcpStats.report()
+	if args.Summary {
+		printSummary()
+	}
+	reportEgressViolations()
+	failErr := reportFailures()
 	if err != nil {
 		return fmt.Errorf("error running subprocess: %w", err)
 	}
+	if failErr != nil {
+		return failErr
+	}
 
 	// If the user requested that we do not exit when the subprocess exits, then stick around.
 	//
@@ -814,17 +1804,60 @@ func Main() error {
 	// Under these circumstances, the subprocess we launch will return, but there will still be
 	// other subprocesses running in the network namespace. If the user wants to monitor their
 	// network activity then they can use "--no-exit"
-	if args.NoExit {
+	if args.NoExit && ui == nil {
 		select {}
 	}
 
 	return nil
 }
 
+// subcommands work with captures rather than running a program under httptap, as in
+// "httptap replay capture.har". They are only chosen when their name is the first argument and there is
+// no "--" among the arguments, so a program with one of these names is run with "httptap -- diff a b".
+var subcommands = map[string]func(args []string) error{
+	"replay": replayMain,
+	"diff":   diffMain,
+	"merge":  mergeMain,
+	"view":   viewMain,
+	"ctl":    ctlMain,
+}
+
+// exitCode is returned by subcommands to exit with a code and no further message, when what went wrong
+// has already been printed
+type exitCode int
+
+func (e exitCode) Error() string {
+	return fmt.Sprintf("exit code %d", int(e))
+}
+
+// parseSubcommand parses the command line arguments of a subcommand into dest, printing help and
+// exiting if it was asked for
+func parseSubcommand(name string, args []string, dest any) error {
+	p, err := arg.NewParser(arg.Config{Program: "httptap " + name}, dest)
+	if err != nil {
+		return err
+	}
+	err = p.Parse(args)
+	if errors.Is(err, arg.ErrHelp) {
+		p.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if err != nil {
+		p.WriteUsage(os.Stderr)
+		return err
+	}
+	return nil
+}
+
 func main() {
 	log.SetOutput(os.Stdout)
 	log.SetFlags(0)
-	err := Main()
+	var err error
+	if len(os.Args) > 1 && subcommands[os.Args[1]] != nil && !slices.Contains(os.Args, "--") {
+		err = subcommands[os.Args[1]](os.Args[2:])
+	} else {
+		err = Main()
+	}
 	if err != nil {
 		// if we exit due to a subprocess returning with non-zero exit code then do not
 		// print any extraneous output but do exit with the same code
@@ -832,6 +1865,10 @@ func main() {
 		if errors.As(err, &exitError) {
 			os.Exit(exitError.ExitCode())
 		}
+		var code exitCode
+		if errors.As(err, &code) {
+			os.Exit(int(code))
+		}
 
 		// for any other kind of error, print the error and exit with code 1
 		log.Fatal(err)
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/monasticacademy/httptap/pkg/filter"
+)
+
+// interceptor pauses the HTTP requests that match the expression given with --intercept, and asks on
+// the terminal whether to forward, edit, or drop each one. Requests are asked about one at a time, and
+// the others wait their turn.
+type interceptor struct {
+	when *filter.Filter
+	tty  *os.File
+
+	mu         sync.Mutex
+	in         *bufio.Reader
+	forwardAll bool // whether the user asked to stop pausing requests
+}
+
+// newInterceptor compiles an --intercept expression, which is written as for --filter and can use req,
+// host, method, url, and path as for http rules in a --policy file, and opens the terminal to ask on
+func newInterceptor(expr string) (*interceptor, error) {
+	when, err := filter.Compile(expr, "req", "host", "method", "url", "path")
+	if err != nil {
+		return nil, fmt.Errorf("error in --intercept: %w", err)
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("--intercept needs a terminal to ask on: %w", err)
+	}
+	return &interceptor{when: when, tty: tty, in: bufio.NewReader(tty)}, nil
+}
+
+// interceptTransport pauses requests that match --intercept before passing them on
+type interceptTransport struct {
+	interceptor *interceptor
+	next        http.RoundTripper
+}
+
+func (t *interceptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ok, err := t.interceptor.when.Match(map[string]any{
+		"req":    policyRequestVariables(req),
+		"host":   req.URL.Hostname(),
+		"method": req.Method,
+		"url":    req.URL.String(),
+		"path":   req.URL.Path,
+	})
+	if err != nil {
+		verbosef("error evaluating --intercept for %v %v: %v, not pausing it", req.Method, req.URL, err)
+	}
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	// the body is read in full so that it can be shown and edited, and it is still captured as the
+	// subprocess sent it
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading request body: %w", err)
+		}
+	}
+	// rules must not change the request they were given, which is still used to report the call
+	req = req.Clone(req.Context())
+	setRequestBody(req, body)
+
+	req, drop, err := t.interceptor.ask(req, body)
+	if err != nil {
+		return nil, err
+	}
+	if drop {
+		return (&ruleFault{Reset: true}).respond(req)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// ask shows a paused request on the terminal and asks what to do with it until the user forwards or
+// drops it, returning the request to forward, which may have been edited
+func (c *interceptor) ask(req *http.Request, body []byte) (*http.Request, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.forwardAll {
+		return req, false, nil
+	}
+
+	c.show(req, body)
+	for {
+		fmt.Fprint(c.tty, "[f]orward, [e]dit, [d]rop, or forward [a]ll? ")
+		line, err := c.in.ReadString('\n')
+		if err != nil {
+			return nil, false, fmt.Errorf("error reading from terminal for --intercept: %w", err)
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "f", "":
+			return req, false, nil
+		case "a":
+			c.forwardAll = true
+			return req, false, nil
+		case "d":
+			fmt.Fprintf(c.tty, "dropped %v %v\n", req.Method, req.URL)
+			return req, true, nil
+		case "e":
+			edited, editedBody, err := c.edit(req, body)
+			if err != nil {
+				fmt.Fprintf(c.tty, "%v\n", err)
+				continue
+			}
+			req, body = edited, editedBody
+			c.show(req, body)
+		}
+	}
+}
+
+// show prints a paused request to the terminal
+func (c *interceptor) show(req *http.Request, body []byte) {
+	fmt.Fprintf(c.tty, "paused %v %v\n", req.Method, req.URL)
+	for _, name := range slices.Sorted(maps.Keys(req.Header)) {
+		for _, value := range req.Header[name] {
+			fmt.Fprintf(c.tty, "> %s: %s\n", name, value)
+		}
+	}
+	if len(body) > 0 {
+		desc, lines := renderBody(req.Header, body, int64(len(body)))
+		fmt.Fprintf(c.tty, "> %s\n", desc)
+		for _, line := range lines {
+			fmt.Fprintln(c.tty, line)
+		}
+	}
+}
+
+// edit writes a request to a temporary file in the form of an HTTP request with an absolute URL, opens
+// it in $EDITOR on the terminal, and reads back the edited request. Bodies that are compressed or not
+// text are left out of the file and kept as they are.
+func (c *interceptor) edit(req *http.Request, body []byte) (*http.Request, []byte, error) {
+	editBody := isText(body) && req.Header.Get("Content-Encoding") == ""
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\n", req.Method, req.URL)
+	for _, name := range slices.Sorted(maps.Keys(req.Header)) {
+		for _, value := range req.Header[name] {
+			fmt.Fprintf(&b, "%s: %s\n", name, value)
+		}
+	}
+	b.WriteString("\n")
+	if editBody {
+		b.Write(body)
+	}
+
+	f, err := os.CreateTemp("", "httptap-request-*.http")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating file to edit request in: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b.Bytes())
+	f.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error writing request to edit: %w", err)
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = c.tty, c.tty, c.tty
+	if err := cmd.Run(); err != nil {
+		return nil, nil, fmt.Errorf("error running editor %q: %w, leaving the request as it was", editor, err)
+	}
+	edited, err := os.ReadFile(f.Name())
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading edited request: %w", err)
+	}
+
+	// parse the request line, then the headers, then take the rest as the body
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(edited)))
+	line, err := r.ReadLine()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading edited request: %w", err)
+	}
+	method, rest, _ := strings.Cut(line, " ")
+	target, _, _ := strings.Cut(rest, " ")
+	u, err := url.Parse(target)
+	if err != nil || method == "" || u.Scheme == "" || u.Host == "" {
+		return nil, nil, fmt.Errorf("the edited request must start with a method and an absolute URL, such as GET https://example.com/ HTTP/1.1")
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("error reading headers of edited request: %w", err)
+	}
+	if editBody {
+		editedBody, _ := io.ReadAll(r.R)
+		if !bytes.HasSuffix(body, []byte("\n")) {
+			// editors usually end files with a newline, which the body did not have
+			editedBody = bytes.TrimSuffix(editedBody, []byte("\n"))
+		}
+		body = editedBody
+	}
+
+	req.Method = method
+	if u.String() != req.URL.String() {
+		req = redirectRequest(req, u)
+	}
+	req.Header = http.Header(header)
+	setRequestBody(req, body)
+	return req, body, nil
+}
+
+// setRequestBody gives a request a body that has already been read, with a length to match
+func setRequestBody(req *http.Request, body []byte) {
+	req.Body = http.NoBody
+	if len(body) > 0 {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	req.Header.Del("Content-Length")
+}
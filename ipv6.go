@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// setupIPv6 assigns an IPv6 address to the tun device and routes all IPv6 traffic to it, so that
+// programs that prefer IPv6 connect through us rather than failing or waiting to fall back to IPv4. This
+// must be called from the thread that is in the network namespace.
+func setupIPv6(link netlink.Link, subnet string) error {
+	linksubnet, err := netlink.ParseIPNet(subnet)
+	if err != nil {
+		return fmt.Errorf("error parsing ipv6 subnet: %w", err)
+	}
+	if linksubnet.IP.To4() != nil {
+		return fmt.Errorf("%v is not an ipv6 subnet", subnet)
+	}
+
+	// there are no other hosts on the tun device, so skip duplicate address detection, which would
+	// otherwise leave the address unusable for the first second or two
+	err = netlink.AddrAdd(link, &netlink.Addr{
+		IPNet: linksubnet,
+		Flags: unix.IFA_F_NODAD,
+	})
+	if err != nil {
+		return fmt.Errorf("error assigning ipv6 address to tun device: %w", err)
+	}
+
+	// parse the subnet corresponding to all ipv6 addresses
+	ip6Routable, err := netlink.ParseIPNet("::/0")
+	if err != nil {
+		return fmt.Errorf("error parsing global ipv6 subnet: %w", err)
+	}
+
+	// add a route that sends all ipv6 traffic going anywhere to the tun device
+	err = netlink.RouteAdd(&netlink.Route{
+		Dst:       ip6Routable,
+		LinkIndex: link.Attrs().Index,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating default ipv6 route: %w", err)
+	}
+	return nil
+}
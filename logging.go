@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// the formats that --log-format accepts
+var logFormats = []string{"console", "text", "json"}
+
+// the levels that --log-level accepts, from most to least verbose
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// logOutput is where httptap's own messages go. This is standard error unless --log-file is given, so
+// that they are never mixed into the HTTP calls and other events printed to standard output.
+var logOutput io.Writer = os.Stderr
+
+// logFile is the file given with --log-file, or nil if messages go to standard error
+var logFile *os.File
+
+// the minimum level of messages that are logged, which --log-level and --verbose change
+var logLevel = new(slog.LevelVar)
+
+// logger receives httptap's own messages through verbosef and errorf
+var logger = slog.New(&consoleHandler{level: logLevel})
+
+// setupLogging applies --log-level, --log-format, and --log-file
+func setupLogging(level, format, file string, verbose bool) error {
+	l, ok := logLevels[level]
+	if !ok {
+		return fmt.Errorf("unknown --log-level %q (choose from debug, info, warn, error)", level)
+	}
+	if verbose {
+		l = min(l, slog.LevelDebug)
+	}
+	logLevel.Set(l)
+
+	if file != "" {
+		// append rather than truncate since the first and second stages both open the file
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening --log-file: %w", err)
+		}
+		logFile = f
+		logOutput = f
+	}
+
+	opts := slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "console":
+		logger = slog.New(&consoleHandler{level: logLevel})
+	case "text":
+		logger = slog.New(slog.NewTextHandler(logDestination{}, &opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(logDestination{}, &opts))
+	default:
+		return fmt.Errorf("unknown --log-format %q (choose from %v)", format, strings.Join(logFormats, ", "))
+	}
+	return nil
+}
+
+// logDestination writes to whatever logOutput is at the time, so that --tui can redirect messages
+// after the logger was created
+type logDestination struct{}
+
+func (logDestination) Write(p []byte) (int, error) {
+	return logOutput.Write(p)
+}
+
+// consoleHandler is the default --log-format, which prints just the message of each record, with errors
+// in red
+type consoleHandler struct {
+	level slog.Leveler
+	mu    sync.Mutex
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	msg := r.Message
+	r.Attrs(func(a slog.Attr) bool {
+		msg += " " + a.String()
+		return true
+	})
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var err error
+	if r.Level >= slog.LevelError && logFile == nil {
+		_, err = errorColor.Fprint(logOutput, msg)
+	} else {
+		_, err = io.WriteString(logOutput, msg)
+	}
+	return err
+}
+
+// consoleHandler does not support attributes or groups beyond those of each record, which httptap does
+// not use
+func (h *consoleHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *consoleHandler) WithGroup(string) slog.Handler      { return h }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/monasticacademy/httptap/pkg/harlog"
+)
+
+// mergeMain implements "httptap merge", which combines several HAR files, such as the pieces written by
+// --dump-har-rotate-size or captures of separate services, into one
+func mergeMain(argv []string) error {
+	var args struct {
+		Output string   `arg:"positional,required" help:"HAR file to write"`
+		Inputs []string `arg:"positional,required" help:"HAR files to combine"`
+	}
+	if err := parseSubcommand("merge", argv, &args); err != nil {
+		return err
+	}
+
+	var hars []*harlog.HARContainer
+	for _, path := range args.Inputs {
+		har, err := readHAR(path)
+		if err != nil {
+			return err
+		}
+		hars = append(hars, har)
+	}
+	merged, duplicates := mergeHAR(hars)
+	if err := writeHAR(args.Output, merged); err != nil {
+		return fmt.Errorf("error writing merged HAR file: %w", err)
+	}
+	log.Printf("merged %d entries from %d files into %v, leaving out %d duplicates",
+		len(merged.Log.Entries), len(args.Inputs), args.Output, duplicates)
+	return nil
+}
+
+// mergeHAR combines HAR logs into one whose entries and DNS queries are in chronological order. Pages
+// that appear in more than one log are kept once, and pages from different logs that happen to have
+// the same ID are renamed apart. Entries that appear in more than one log, as when a rotated piece is
+// merged with the full capture, are kept once, and their number is returned.
+func mergeHAR(hars []*harlog.HARContainer) (*harlog.HARContainer, int) {
+	merged := &harlog.HARContainer{Log: &harlog.Log{Version: "1.2", Entries: []*harlog.Entry{}}}
+	if len(hars) > 0 {
+		merged.Log.Version = hars[0].Log.Version
+		merged.Log.Creator = hars[0].Log.Creator
+		merged.Log.Browser = hars[0].Log.Browser
+	}
+
+	pages := make(map[string]*harlog.Page) // pages kept so far, by ID
+	seen := make(map[string]bool)          // entries and DNS queries kept so far, by their JSON encoding
+	var duplicates int
+	for _, har := range hars {
+		// renamed maps the ID of a page in this log to the ID under which it was kept
+		renamed := make(map[string]string)
+		for _, p := range har.Log.Pages {
+			id := p.ID
+			for n := 2; pages[id] != nil && !samePage(pages[id], p); n++ {
+				id = fmt.Sprintf("%s_%d", p.ID, n)
+			}
+			renamed[p.ID] = id
+			if pages[id] == nil {
+				page := *p
+				page.ID = id
+				pages[id] = &page
+				merged.Log.Pages = append(merged.Log.Pages, &page)
+			}
+		}
+
+		for _, e := range har.Log.Entries {
+			if e.Pageref != "" && renamed[e.Pageref] != "" && renamed[e.Pageref] != e.Pageref {
+				entry := *e
+				entry.Pageref = renamed[e.Pageref]
+				e = &entry
+			}
+			key, err := json.Marshal(e)
+			if err == nil && seen["entry "+string(key)] {
+				duplicates++
+				continue
+			}
+			seen["entry "+string(key)] = true
+			merged.Log.Entries = append(merged.Log.Entries, e)
+		}
+
+		for _, q := range har.Log.DNS {
+			key, err := json.Marshal(q)
+			if err == nil && seen["dns "+string(key)] {
+				continue
+			}
+			seen["dns "+string(key)] = true
+			merged.Log.DNS = append(merged.Log.DNS, q)
+		}
+	}
+
+	slices.SortStableFunc(merged.Log.Pages, func(a, b *harlog.Page) int {
+		return time.Time(a.StartedDateTime).Compare(time.Time(b.StartedDateTime))
+	})
+	slices.SortStableFunc(merged.Log.Entries, func(a, b *harlog.Entry) int {
+		return time.Time(a.StartedDateTime).Compare(time.Time(b.StartedDateTime))
+	})
+	slices.SortStableFunc(merged.Log.DNS, func(a, b *harlog.DNSQuery) int {
+		return time.Time(a.StartedDateTime).Compare(time.Time(b.StartedDateTime))
+	})
+	return merged, duplicates
+}
+
+// samePage reports whether two pages from different logs are the same page
+func samePage(a, b *harlog.Page) bool {
+	return a.Title == b.Title && time.Time(a.StartedDateTime).Equal(time.Time(b.StartedDateTime))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// if not empty, file parts of multipart/form-data requests are saved to this directory
+var uploadDir string
+
+// MultipartPart describes one part of a multipart/form-data request body
+type MultipartPart struct {
+	Name        string `json:"name"`
+	FileName    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size"`
+	Value       string `json:"value,omitempty"` // the value of parts that are not files
+	File        string `json:"file,omitempty"`  // where the part was saved, if uploads are being saved
+}
+
+// String formats the part for display, for example `avatar filename="me.png" (image/png, 1234 bytes)`
+func (p *MultipartPart) String() string {
+	var b strings.Builder
+	b.WriteString(p.Name)
+	if p.FileName != "" {
+		fmt.Fprintf(&b, " filename=%q", p.FileName)
+	}
+	if p.ContentType != "" {
+		fmt.Fprintf(&b, " (%s, %d bytes)", p.ContentType, p.Size)
+	} else {
+		fmt.Fprintf(&b, " (%d bytes)", p.Size)
+	}
+	if p.FileName == "" && p.Value != "" {
+		fmt.Fprintf(&b, " = %q", p.Value)
+	}
+	if p.File != "" {
+		fmt.Fprintf(&b, " saved to %s", p.File)
+	}
+	return b.String()
+}
+
+// parseMultipart lists the parts of a multipart/form-data request body, or returns nil if the request
+// is not multipart/form-data. If uploadDir is set then file parts are saved there. Parse errors, which
+// happen for example when the body was truncated, are logged and the parts found so far are returned.
+func parseMultipart(header http.Header, body []byte) []*MultipartPart {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil
+	}
+
+	var parts []*MultipartPart
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			verbosef("error parsing multipart body: %v", err)
+			break
+		}
+
+		part := MultipartPart{
+			Name:        p.FormName(),
+			FileName:    p.FileName(),
+			ContentType: p.Header.Get("Content-Type"),
+		}
+
+		var content bytes.Buffer
+		part.Size, err = io.Copy(&content, p)
+		if err != nil {
+			verbosef("error reading multipart part %q: %v", part.Name, err)
+		}
+
+		if part.FileName == "" {
+			part.Value = content.String()
+		} else if uploadDir != "" {
+			part.File, err = saveUpload(part.FileName, content.Bytes())
+			if err != nil {
+				errorf("error saving uploaded file %q: %v", part.FileName, err)
+			}
+		}
+
+		parts = append(parts, &part)
+	}
+	return parts
+}
+
+// saveUpload writes the content of an uploaded file to uploadDir under a unique name that ends with
+// the original filename
+func saveUpload(filename string, content []byte) (string, error) {
+	f, err := os.CreateTemp(uploadDir, "*-"+strings.ReplaceAll(filepath.Base(filename), "*", "_"))
+	if err != nil {
+		return "", fmt.Errorf("error creating file: %w", err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(content)
+	if err != nil {
+		return "", fmt.Errorf("error writing %v: %w", f.Name(), err)
+	}
+	return f.Name(), nil
+}
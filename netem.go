@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// how long a packet picked by --reorder is held back, so that packets sent after it overtake it
+const reorderDelay = 10 * time.Millisecond
+
+// impairments are the ways in which packets exchanged with the subprocess are disturbed, in the manner
+// of the Linux netem queueing discipline, for testing how the subprocess copes with a poor network
+type impairments struct {
+	loss      float64       // fraction of packets that are dropped
+	duplicate float64       // fraction of packets that are delivered twice
+	reorder   float64       // fraction of packets that are held back so that later packets overtake them
+	jitter    time.Duration // each packet is held back by a random time up to this long
+}
+
+// isSet reports whether any packets are to be disturbed
+func (m *impairments) isSet() bool {
+	return *m != impairments{}
+}
+
+// delay chooses how long to hold back a packet, or zero to send it right away
+func (m *impairments) delay() time.Duration {
+	var d time.Duration
+	if m.jitter > 0 {
+		d = rand.N(m.jitter)
+	}
+	if m.reorder > 0 && rand.Float64() < m.reorder {
+		d += reorderDelay
+	}
+	return d
+}
+
+// copies decides how many times to deliver a packet: zero if it is lost, two if it is duplicated, and
+// otherwise one
+func (m *impairments) copies() int {
+	switch {
+	case m.loss > 0 && rand.Float64() < m.loss:
+		return 0
+	case m.duplicate > 0 && rand.Float64() < m.duplicate:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// netemEndpoint is a link endpoint that drops, duplicates, reorders, and delays packets in both
+// directions between the subprocess and the stack
+type netemEndpoint struct {
+	nested.Endpoint
+	impairments impairments
+}
+
+// newNetemEndpoint wraps a link endpoint so that the packets that pass through it are disturbed
+func newNetemEndpoint(child stack.LinkEndpoint, m impairments) *netemEndpoint {
+	e := &netemEndpoint{impairments: m}
+	e.Endpoint.Init(child, e)
+	return e
+}
+
+// WritePackets implements stack.LinkEndpoint for packets on their way to the subprocess. Packets that
+// are lost are reported as written, as they would be by a real network interface.
+func (e *netemEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	var now stack.PacketBufferList
+	for _, pkt := range pkts.AsSlice() {
+		for range e.impairments.copies() {
+			d := e.impairments.delay()
+			if d == 0 {
+				now.PushBack(pkt)
+				continue
+			}
+
+			// the stack releases the packet once this returns, so hold a reference until it is written
+			pkt.IncRef()
+			time.AfterFunc(d, func() {
+				var later stack.PacketBufferList
+				later.PushBack(pkt)
+				e.Endpoint.WritePackets(later)
+				pkt.DecRef()
+			})
+		}
+	}
+	if now.Len() > 0 {
+		if _, err := e.Endpoint.WritePackets(now); err != nil {
+			return 0, err
+		}
+	}
+	return pkts.Len(), nil
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher for packets from the subprocess
+func (e *netemEndpoint) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	copies := e.impairments.copies()
+	if copies == 0 {
+		return
+	}
+
+	// the stack consumes the headers of a packet that it is given, so a duplicate is cloned beforehand
+	pkts := []*stack.PacketBuffer{pkt}
+	if copies == 2 {
+		dup := pkt.Clone()
+		defer dup.DecRef()
+		pkts = append(pkts, dup)
+	}
+
+	for _, p := range pkts {
+		d := e.impairments.delay()
+		if d == 0 {
+			e.Endpoint.DeliverNetworkPacket(protocol, p)
+			continue
+		}
+
+		// the link endpoint releases the packet once this returns, so hold a reference until it is delivered
+		p.IncRef()
+		time.AfterFunc(d, func() {
+			e.Endpoint.DeliverNetworkPacket(protocol, p)
+			p.DecRef()
+		})
+	}
+}
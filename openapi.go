@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// openAPIDocument is the part of an OpenAPI 3 document that --dump-openapi writes
+type openAPIDocument struct {
+	OpenAPI string                                  `json:"openapi"`
+	Info    openAPIInfo                             `json:"info"`
+	Servers []openAPIServer                         `json:"servers"`
+	Paths   map[string]map[string]*openAPIOperation `json:"paths"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIOperation struct {
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+
+	calls int // the number of calls seen, for deciding which query parameters are required
+}
+
+type openAPIParameter struct {
+	Name     string      `json:"name"`
+	In       string      `json:"in"`
+	Required bool        `json:"required"`
+	Schema   *jsonSchema `json:"schema"`
+
+	seen int // the number of calls that had this parameter
+}
+
+type openAPIRequestBody struct {
+	Content map[string]*openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *jsonSchema `json:"schema,omitempty"`
+}
+
+// jsonSchema is the subset of JSON Schema that is inferred from example values
+type jsonSchema struct {
+	Type       string                 `json:"type,omitempty"`
+	Nullable   bool                   `json:"nullable,omitempty"`
+	Properties map[string]*jsonSchema `json:"properties,omitempty"`
+	Required   []string               `json:"required,omitempty"`
+	Items      *jsonSchema            `json:"items,omitempty"`
+
+	onlyNull bool // whether the only value seen was null, so that the type is still unknown
+}
+
+// MarshalJSON gives arrays whose items were never seen a schema that allows any item, since OpenAPI
+// requires one
+func (s *jsonSchema) MarshalJSON() ([]byte, error) {
+	type plain jsonSchema
+	if s.Type == "array" && s.Items == nil {
+		c := *s
+		c.Items = &jsonSchema{}
+		return json.Marshal((*plain)(&c))
+	}
+	return json.Marshal((*plain)(s))
+}
+
+// openAPIBuilder infers an OpenAPI document from HTTP calls, for --dump-openapi
+type openAPIBuilder struct {
+	servers []string
+	paths   map[string]map[string]*openAPIOperation
+}
+
+func newOpenAPIBuilder() *openAPIBuilder {
+	return &openAPIBuilder{paths: make(map[string]map[string]*openAPIOperation)}
+}
+
+// matches path segments that are probably identifiers rather than fixed parts of the path: numbers,
+// UUIDs, and long hex strings
+var idSegment = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+// templatePath replaces the segments of a path that look like identifiers with parameters named after
+// the segment before them, such as /users/42/posts/7 to /users/{usersId}/posts/{postsId}, and returns
+// the templated path together with the parameters and the values they had
+func templatePath(path string) (string, []*openAPIParameter, []string) {
+	segments := strings.Split(path, "/")
+	var params []*openAPIParameter
+	var values []string
+	for i, seg := range segments {
+		if !idSegment.MatchString(seg) {
+			continue
+		}
+		name := "id"
+		if i > 0 && segments[i-1] != "" && !strings.HasPrefix(segments[i-1], "{") {
+			name = segments[i-1] + "Id"
+		}
+		for n := 2; slices.ContainsFunc(params, func(p *openAPIParameter) bool { return p.Name == name }); n++ {
+			name = strings.TrimRight(name, "0123456789") + strconv.Itoa(n)
+		}
+		params = append(params, &openAPIParameter{Name: name, In: "path", Required: true})
+		values = append(values, seg)
+		segments[i] = "{" + name + "}"
+	}
+	return strings.Join(segments, "/"), params, values
+}
+
+// add records an HTTP call in the document
+func (b *openAPIBuilder) add(c *HTTPCall) {
+	u, err := url.Parse(c.Request.URL)
+	if err != nil {
+		return
+	}
+	path, pathParams, pathValues := templatePath(u.EscapedPath())
+	if path == "" {
+		path = "/"
+	}
+	method := strings.ToLower(c.Request.Method)
+
+	if server := u.Scheme + "://" + u.Host; !slices.Contains(b.servers, server) {
+		b.servers = append(b.servers, server)
+	}
+
+	if b.paths[path] == nil {
+		b.paths[path] = make(map[string]*openAPIOperation)
+	}
+	op := b.paths[path][method]
+	if op == nil {
+		op = &openAPIOperation{Responses: make(map[string]*openAPIResponse)}
+		b.paths[path][method] = op
+	}
+	op.calls++
+
+	for i, p := range pathParams {
+		op.parameter(p.Name, "path").observe(pathValues[i])
+	}
+	query := u.Query()
+	for _, name := range slices.Sorted(maps.Keys(query)) {
+		for _, v := range query[name] {
+			op.parameter(name, "query").observe(v)
+		}
+	}
+	for _, p := range op.Parameters {
+		if p.In == "query" {
+			p.Required = p.seen == op.calls
+		}
+	}
+
+	if len(c.Request.Body) > 0 && !c.Request.Truncated {
+		if op.RequestBody == nil {
+			op.RequestBody = &openAPIRequestBody{Content: make(map[string]*openAPIMediaType)}
+		}
+		addMediaType(op.RequestBody.Content, c.Request.Header, c.Request.Body)
+	}
+
+	status := strconv.Itoa(c.Response.StatusCode)
+	resp := op.Responses[status]
+	if resp == nil {
+		resp = &openAPIResponse{Description: http.StatusText(c.Response.StatusCode)}
+		if resp.Description == "" {
+			resp.Description = "status " + status
+		}
+		op.Responses[status] = resp
+	}
+	if len(c.Response.Body) > 0 && !c.Response.Truncated {
+		if resp.Content == nil {
+			resp.Content = make(map[string]*openAPIMediaType)
+		}
+		addMediaType(resp.Content, c.Response.Header, c.Response.Body)
+	}
+}
+
+// parameter finds or adds a parameter of an operation, counting that it was seen in one more call
+func (op *openAPIOperation) parameter(name, in string) *openAPIParameter {
+	for _, p := range op.Parameters {
+		if p.Name == name && p.In == in {
+			return p
+		}
+	}
+	p := &openAPIParameter{Name: name, In: in, Required: in == "path"}
+	op.Parameters = append(op.Parameters, p)
+	return p
+}
+
+// observe counts a value of a parameter, widening its schema to fit the value
+func (p *openAPIParameter) observe(value string) {
+	p.seen++
+	p.Schema = mergeSchemas(p.Schema, &jsonSchema{Type: scalarType(value)})
+}
+
+// scalarType guesses the JSON Schema type of a value from a path or query string
+func scalarType(s string) string {
+	if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return "integer"
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return "number"
+	}
+	if s == "true" || s == "false" {
+		return "boolean"
+	}
+	return "string"
+}
+
+// addMediaType records a body under its media type, inferring a schema for JSON bodies
+func addMediaType(content map[string]*openAPIMediaType, header http.Header, body []byte) {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+	m := content[mediaType]
+	if m == nil {
+		m = &openAPIMediaType{}
+		content[mediaType] = m
+	}
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return
+	}
+	m.Schema = mergeSchemas(m.Schema, inferSchema(v))
+}
+
+// inferSchema makes a schema that describes a JSON value, where every property of an object is required
+// until an object without it is seen
+func inferSchema(v any) *jsonSchema {
+	switch v := v.(type) {
+	case nil:
+		return &jsonSchema{Nullable: true, onlyNull: true}
+	case bool:
+		return &jsonSchema{Type: "boolean"}
+	case float64:
+		if v == float64(int64(v)) {
+			return &jsonSchema{Type: "integer"}
+		}
+		return &jsonSchema{Type: "number"}
+	case string:
+		return &jsonSchema{Type: "string"}
+	case []any:
+		s := &jsonSchema{Type: "array"}
+		for _, item := range v {
+			s.Items = mergeSchemas(s.Items, inferSchema(item))
+		}
+		return s
+	case map[string]any:
+		s := &jsonSchema{Type: "object", Properties: make(map[string]*jsonSchema)}
+		for k, item := range v {
+			s.Properties[k] = inferSchema(item)
+			s.Required = append(s.Required, k)
+		}
+		slices.Sort(s.Required)
+		return s
+	}
+	return &jsonSchema{}
+}
+
+// mergeSchemas widens a schema so that it also describes the values described by another. Schemas of
+// different types merge into a schema without a type, which allows any value.
+func mergeSchemas(a, b *jsonSchema) *jsonSchema {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.onlyNull:
+		s := *b
+		s.Nullable = true
+		return &s
+	case b.onlyNull:
+		s := *a
+		s.Nullable = true
+		return &s
+	}
+
+	s := &jsonSchema{Nullable: a.Nullable || b.Nullable}
+	switch {
+	case a.Type == b.Type:
+		s.Type = a.Type
+	case a.Type == "integer" && b.Type == "number" || a.Type == "number" && b.Type == "integer":
+		s.Type = "number"
+	}
+
+	switch s.Type {
+	case "array":
+		s.Items = mergeSchemas(a.Items, b.Items)
+	case "object":
+		s.Properties = make(map[string]*jsonSchema)
+		for k, p := range a.Properties {
+			s.Properties[k] = p
+		}
+		for k, p := range b.Properties {
+			s.Properties[k] = mergeSchemas(s.Properties[k], p)
+		}
+		// only properties that every example had are required
+		for _, k := range a.Required {
+			if slices.Contains(b.Required, k) {
+				s.Required = append(s.Required, k)
+			}
+		}
+	}
+	return s
+}
+
+// writeOpenAPI infers an OpenAPI document from the HTTP calls made so far and writes it to a file as JSON
+func writeOpenAPI(path string) error {
+	httpMu.Lock()
+	calls := slices.Clone(httpCalls)
+	httpMu.Unlock()
+
+	b := newOpenAPIBuilder()
+	for _, c := range calls {
+		b.add(c)
+	}
+	doc := openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "API observed by httptap", Version: "1.0.0"},
+		Paths:   b.paths,
+	}
+	for _, server := range b.servers {
+		doc.Servers = append(doc.Servers, openAPIServer{URL: server})
+	}
+
+	if err := writeJSONFile(path, doc); err != nil {
+		return fmt.Errorf("error writing OpenAPI document: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// how long to wait for an echo reply from the real network before giving up on an echo request
+const pingTimeout = 5 * time.Second
+
+// allowPings lets processes in the current network namespace send echo requests with unprivileged ICMP
+// sockets, as the ping command does, which new network namespaces do not allow by default. The ends of
+// the range of groups must be mapped in the current user namespace, so if the full range is not then
+// only the group that we are mapped to is allowed. This must be called from the thread that is in the
+// network namespace.
+func allowPings() error {
+	const path = "/proc/sys/net/ipv4/ping_group_range"
+	err := os.WriteFile(path, []byte("0 2147483647"), 0644)
+	if err != nil {
+		err = os.WriteFile(path, []byte("0 0"), 0644)
+	}
+	return err
+}
+
+// canForwardPings checks whether we can send echo requests to the real network with an unprivileged
+// ICMP socket, which Linux allows only for the groups in net.ipv4.ping_group_range on the host
+func canForwardPings() bool {
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		verbosef("cannot forward pings to the real network, answering them locally instead: %v", err)
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// pingEndpoint is a link endpoint that takes echo requests from the subprocess out of the stack and
+// forwards them to the real network, so that ping reports whether a host is really reachable. Replies
+// are written straight back to the subprocess through w. All other packets go to the stack, which
+// answers echo requests itself if they are not taken out here.
+type pingEndpoint struct {
+	nested.Endpoint
+	w io.Writer // the TUN device
+}
+
+// newPingEndpoint wraps a link endpoint so that echo requests are forwarded to the real network
+func newPingEndpoint(child stack.LinkEndpoint, w io.Writer) *pingEndpoint {
+	e := &pingEndpoint{w: w}
+	e.Endpoint.Init(child, e)
+	return e
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher
+func (e *pingEndpoint) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	if protocol == header.IPv4ProtocolNumber && isEchoRequest(pkt) {
+		v := pkt.ToView()
+		packet := gopacket.NewPacket(v.AsSlice(), layers.LayerTypeIPv4, gopacket.Default)
+		v.Release()
+
+		ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		echo, _ := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+		if ip != nil && echo != nil {
+			go e.forward(ip, echo)
+			return
+		}
+	}
+	e.Endpoint.DeliverNetworkPacket(protocol, pkt)
+}
+
+// isEchoRequest checks whether an IPv4 packet is an ICMP echo request without copying it
+func isEchoRequest(pkt *stack.PacketBuffer) bool {
+	b, ok := pkt.Data().PullUp(header.IPv4MinimumSize)
+	if !ok || header.IPv4(b).Protocol() != uint8(header.ICMPv4ProtocolNumber) {
+		return false
+	}
+	ihl := int(header.IPv4(b).HeaderLength())
+	b, ok = pkt.Data().PullUp(ihl + 1)
+	return ok && header.ICMPv4Type(b[ihl]) == header.ICMPv4Echo
+}
+
+// forward sends an echo request to the real network and writes the reply, if there is one, back to the
+// subprocess
+func (e *pingEndpoint) forward(ip *layers.IPv4, echo *layers.ICMPv4) {
+	dst, err := pingTarget(ip.DstIP)
+	if err != nil {
+		verbosef("error finding where to forward ping to %v: %v", ip.DstIP, err)
+		return
+	}
+
+	// the kernel replaces the ID with one of its own and matches replies to the socket by it
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		verbosef("error opening ICMP socket to forward ping to %v: %v", dst, err)
+		return
+	}
+	defer conn.Close()
+
+	request := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: int(echo.Id), Seq: int(echo.Seq), Data: echo.Payload},
+	}
+	wb, err := request.Marshal(nil)
+	if err != nil {
+		verbosef("error marshaling echo request: %v", err)
+		return
+	}
+
+	start := time.Now()
+	_, err = conn.WriteTo(wb, &net.UDPAddr{IP: dst})
+	if err != nil {
+		verbosef("error forwarding ping to %v: %v", dst, err)
+		return
+	}
+
+	conn.SetReadDeadline(start.Add(pingTimeout))
+	rb := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(rb)
+		if err != nil {
+			verbosef("no reply to ping to %v: %v", dst, err)
+			return
+		}
+		m, err := icmp.ParseMessage(1, rb[:n])
+		if err != nil || m.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if body, ok := m.Body.(*icmp.Echo); ok && body.Seq == int(echo.Seq) {
+			break
+		}
+	}
+	verbosef("got reply to ping to %v after %v", dst, time.Since(start))
+
+	err = e.reply(ip, echo)
+	if err != nil {
+		verbosef("error writing echo reply to subprocess: %v", err)
+	}
+}
+
+// reply writes an echo reply to the subprocess for an echo request, as if from the address it was sent to
+func (e *pingEndpoint) reply(ip *layers.IPv4, echo *layers.ICMPv4) error {
+	replyipv4 := layers.IPv4{
+		Version:  4,
+		TTL:      ttl,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    ip.DstIP,
+		DstIP:    ip.SrcIP,
+	}
+	replyicmp := layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0),
+		Id:       echo.Id,
+		Seq:      echo.Seq,
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, &replyipv4, &replyicmp, gopacket.Payload(echo.Payload))
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(buf.Bytes())
+	return err
+}
+
+// pingTarget finds the address on the real network to forward an echo request to, translating the
+// special address and fake IPs as for connections
+func pingTarget(ip net.IP) (net.IP, error) {
+	host, _, err := net.SplitHostPort(worldAddr(net.JoinHostPort(ip.String(), "0")))
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	return addr.IP, nil
+}
@@ -0,0 +1,330 @@
+// Code generated by gen.go from webui/openapi.json. DO NOT EDIT.
+
+package apiclient
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+)
+
+// History is the History schema of the API
+type History struct {
+	// HTTP calls with their requests and responses, in which bodies are encoded in base64
+	Calls []json.RawMessage `json:"calls,omitempty"`
+	// The position of the first call in this page among those that matched
+	Offset int `json:"offset,omitempty"`
+	// The number of calls that matched, across all pages
+	Total int `json:"total,omitempty"`
+}
+
+// Replay is the Replay schema of the API
+type Replay struct {
+	// The new HTTP call, in which bodies are encoded in base64
+	Call json.RawMessage `json:"call,omitempty"`
+	// The position of the new call in the history, or -1 if it was not captured because it is left out by the filter or capture is paused
+	ID int `json:"id,omitempty"`
+}
+
+// RuleFault is the fault of a Rule
+type RuleFault struct {
+	Corrupt     int     `json:"corrupt,omitempty"`
+	Probability float64 `json:"probability,omitempty"`
+	Reset       bool    `json:"reset,omitempty"`
+	Status      int     `json:"status,omitempty"`
+	Truncate    int     `json:"truncate,omitempty"`
+}
+
+// RuleMatch is the match of a Rule
+type RuleMatch struct {
+	Headers map[string]string `json:"headers,omitempty"`
+	Host    string            `json:"host,omitempty"`
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path,omitempty"`
+}
+
+// RuleMock is the mock of a Rule
+type RuleMock struct {
+	Body     string            `json:"body,omitempty"`
+	BodyFile string            `json:"bodyFile,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Status   int               `json:"status,omitempty"`
+	Template bool              `json:"template,omitempty"`
+}
+
+// RuleRequest is the request of a Rule
+type RuleRequest struct {
+	Body          *string           `json:"body,omitempty"`
+	Host          string            `json:"host,omitempty"`
+	RemoveHeaders []string          `json:"removeHeaders,omitempty"`
+	SetHeaders    map[string]string `json:"setHeaders,omitempty"`
+	URL           string            `json:"url,omitempty"`
+}
+
+// RuleResponse is the response of a Rule
+type RuleResponse struct {
+	Body          *string           `json:"body,omitempty"`
+	RemoveHeaders []string          `json:"removeHeaders,omitempty"`
+	SetHeaders    map[string]string `json:"setHeaders,omitempty"`
+	Status        int               `json:"status,omitempty"`
+}
+
+// Rule is a rule as written in a --rules file
+type Rule struct {
+	Delay    string        `json:"delay,omitempty"`
+	Fault    *RuleFault    `json:"fault,omitempty"`
+	Match    *RuleMatch    `json:"match,omitempty"`
+	Mock     *RuleMock     `json:"mock,omitempty"`
+	Request  *RuleRequest  `json:"request,omitempty"`
+	Response *RuleResponse `json:"response,omitempty"`
+}
+
+// State is the State schema of the API
+type State struct {
+	// The number of HTTP calls captured so far
+	Calls int `json:"calls,omitempty"`
+	// The expression that calls are shown for, if any
+	Filter string `json:"filter,omitempty"`
+	// Whether capture is paused
+	Paused bool `json:"paused,omitempty"`
+	// The number of rules that apply to requests
+	Rules int `json:"rules,omitempty"`
+}
+
+// Subscription is a message sent over /api/ws to choose which calls are sent
+type Subscription struct {
+	// Patterns such as *.example.com
+	Hosts []string `json:"hosts,omitempty"`
+	// Status classes such as 4xx, or codes such as 404
+	Status []string `json:"status,omitempty"`
+}
+
+// StreamCallsParams are the query parameters of StreamCalls, which are left out when they are zero
+type StreamCallsParams struct {
+	// Only calls to hosts that match this pattern, such as *.example.com
+	Host string
+	// Only calls with this method
+	Method string
+	// Only calls with this status code, such as 404, class, such as 4xx, or range, such as 400-499
+	Status string
+	// Only calls whose path contains a match for this regular expression
+	Path string
+}
+
+// SetFilterRequest is the body of a request to SetFilter
+type SetFilterRequest struct {
+	Filter string `json:"filter,omitempty"`
+}
+
+// GetHistoryParams are the query parameters of GetHistory, which are left out when they are zero
+type GetHistoryParams struct {
+	// The position of the first call to return among those that match
+	Offset int
+	// The most calls to return
+	Limit int
+	// Only calls to hosts that match this pattern, such as *.example.com
+	Host string
+	// Only calls with this method
+	Method string
+	// Only calls with this status code, such as 404, class, such as 4xx, or range, such as 400-499
+	Status string
+	// Only calls whose path contains a match for this regular expression
+	Path string
+}
+
+// AddRulesResponse is the response to AddRules
+type AddRulesResponse struct {
+	Added int `json:"added,omitempty"`
+}
+
+// StreamCalls sends GET /api/calls: stream the HTTP calls made so far and then each new call, as server-sent events whose IDs are the positions of the calls among all calls
+func (c *Client) StreamCalls(ctx context.Context, params *StreamCallsParams) (io.ReadCloser, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Host != "" {
+			query.Set("host", params.Host)
+		}
+		if params.Method != "" {
+			query.Set("method", params.Method)
+		}
+		if params.Status != "" {
+			query.Set("status", params.Status)
+		}
+		if params.Path != "" {
+			query.Set("path", params.Path)
+		}
+	}
+	resp, err := c.do(ctx, "GET", "/api/calls", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// StreamEvents sends GET /api/events: stream new HTTP calls, DNS queries, and policy decisions as server-sent events named call, dns, and policy
+func (c *Client) StreamEvents(ctx context.Context) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, "GET", "/api/events", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// SetFilter sends PUT /api/filter: replace the --filter expression, or show every call if it is empty
+func (c *Client) SetFilter(ctx context.Context, body *SetFilterRequest) (*State, error) {
+	resp, err := c.do(ctx, "PUT", "/api/filter", nil, body)
+	if err != nil {
+		return nil, err
+	}
+	var out State
+	if err := decodeJSON(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ExportHAR sends GET /api/har: export the HAR log of the calls captured so far, or since the last rotation
+func (c *Client) ExportHAR(ctx context.Context) (json.RawMessage, error) {
+	resp, err := c.do(ctx, "GET", "/api/har", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var out json.RawMessage
+	if err := decodeJSON(resp, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RotateHAR sends POST /api/har/rotate: start a new HAR file now
+func (c *Client) RotateHAR(ctx context.Context) error {
+	resp, err := c.do(ctx, "POST", "/api/har/rotate", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetHistory sends GET /api/history: get the HTTP calls made so far, oldest first, a page at a time
+func (c *Client) GetHistory(ctx context.Context, params *GetHistoryParams) (*History, error) {
+	query := url.Values{}
+	if params != nil {
+		if params.Offset != 0 {
+			query.Set("offset", strconv.Itoa(params.Offset))
+		}
+		if params.Limit != 0 {
+			query.Set("limit", strconv.Itoa(params.Limit))
+		}
+		if params.Host != "" {
+			query.Set("host", params.Host)
+		}
+		if params.Method != "" {
+			query.Set("method", params.Method)
+		}
+		if params.Status != "" {
+			query.Set("status", params.Status)
+		}
+		if params.Path != "" {
+			query.Set("path", params.Path)
+		}
+	}
+	resp, err := c.do(ctx, "GET", "/api/history", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var out History
+	if err := decodeJSON(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Pause sends POST /api/pause: pause capture, still proxying traffic
+func (c *Client) Pause(ctx context.Context) (*State, error) {
+	resp, err := c.do(ctx, "POST", "/api/pause", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var out State
+	if err := decodeJSON(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ReplayCall sends POST /api/replay/{id}: send the request of a captured call again through the same rules, rate limits, and HAR log, and capture it as a new call
+func (c *Client) ReplayCall(ctx context.Context, id int) (*Replay, error) {
+	resp, err := c.do(ctx, "POST", "/api/replay/"+strconv.Itoa(id), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var out Replay
+	if err := decodeJSON(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Resume sends POST /api/resume: resume capture
+func (c *Client) Resume(ctx context.Context) (*State, error) {
+	resp, err := c.do(ctx, "POST", "/api/resume", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var out State
+	if err := decodeJSON(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListRules sends GET /api/rules: list the rules that apply to requests, in order
+func (c *Client) ListRules(ctx context.Context) ([]Rule, error) {
+	resp, err := c.do(ctx, "GET", "/api/rules", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var out []Rule
+	if err := decodeJSON(resp, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AddRules sends POST /api/rules: add rules after those already in effect
+func (c *Client) AddRules(ctx context.Context, body []Rule) (*AddRulesResponse, error) {
+	resp, err := c.do(ctx, "POST", "/api/rules", nil, body)
+	if err != nil {
+		return nil, err
+	}
+	var out AddRulesResponse
+	if err := decodeJSON(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetState sends GET /api/state: get the state of capture
+func (c *Client) GetState(ctx context.Context) (*State, error) {
+	resp, err := c.do(ctx, "GET", "/api/state", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var out State
+	if err := decodeJSON(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetStats sends GET /api/stats: get statistics by host and status code, as printed by --summary
+func (c *Client) GetStats(ctx context.Context) (string, error) {
+	resp, err := c.do(ctx, "GET", "/api/stats", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	return readText(resp)
+}
@@ -0,0 +1,166 @@
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// the generated client must be regenerated whenever webui/openapi.json changes
+func TestGenerated(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+	out := filepath.Join(t.TempDir(), "apiclient_gen.go")
+	cmd := exec.Command("go", "run", "gen.go", "-o", out)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile("apiclient_gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("apiclient_gen.go is out of date with webui/openapi.json, run go generate")
+	}
+}
+
+// request is what the test server saw of a request
+type request struct {
+	method, uri, contentType, auth, body string
+}
+
+// newTestServer serves each path with a status code and body, and records the requests it receives
+func newTestServer(t *testing.T, routes map[string]func(w http.ResponseWriter)) (*Client, *[]request) {
+	var seen []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen = append(seen, request{r.Method, r.RequestURI, r.Header.Get("Content-Type"), r.Header.Get("Authorization"), string(body)})
+		route, ok := routes[r.Method+" "+r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		route(w)
+	}))
+	t.Cleanup(srv.Close)
+	return New(srv.URL+"/", "s3cret"), &seen
+}
+
+func reply(status int, body string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c, seen := newTestServer(t, map[string]func(w http.ResponseWriter){
+		"GET /api/state":     reply(200, `{"paused": true, "filter": "resp.status >= 400", "calls": 3, "rules": 1}`),
+		"PUT /api/filter":    reply(200, `{"filter": "resp.status >= 500"}`),
+		"POST /api/rules":    reply(200, `{"added": 1}`),
+		"GET /api/history":   reply(200, `{"total": 5, "offset": 2, "calls": [{"id": 2}]}`),
+		"POST /api/replay/7": reply(200, `{"id": 8, "call": {"request": {}}}`),
+		"GET /api/stats":     reply(200, "example.com 200 3\n"),
+		"POST /api/har/rotate": func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusNoContent)
+		},
+		"GET /api/har": reply(409, `{"error": "HAR files are not being written"}`),
+	})
+
+	state, err := c.GetState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Paused || state.Filter != "resp.status >= 400" || state.Calls != 3 || state.Rules != 1 {
+		t.Errorf("GetState() got = %+v", state)
+	}
+
+	state, err = c.SetFilter(ctx, &SetFilterRequest{Filter: "resp.status >= 500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Filter != "resp.status >= 500" {
+		t.Errorf("SetFilter() got = %+v", state)
+	}
+
+	body := "mocked"
+	added, err := c.AddRules(ctx, []Rule{{
+		Match:    &RuleMatch{Host: "*.example.com", Method: "GET"},
+		Response: &RuleResponse{Status: 503, Body: &body},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Added != 1 {
+		t.Errorf("AddRules() got = %+v", added)
+	}
+
+	history, err := c.GetHistory(ctx, &GetHistoryParams{Offset: 2, Limit: 1, Status: "2xx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Total != 5 || history.Offset != 2 || len(history.Calls) != 1 {
+		t.Errorf("GetHistory() got = %+v", history)
+	}
+
+	replay, err := c.ReplayCall(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.ID != 8 || !json.Valid(replay.Call) {
+		t.Errorf("ReplayCall() got = %+v", replay)
+	}
+
+	stats, err := c.GetStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != "example.com 200 3\n" {
+		t.Errorf("GetStats() got = %q", stats)
+	}
+
+	if err := c.RotateHAR(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.ExportHAR(ctx)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 409 || apiErr.Message != "HAR files are not being written" {
+		t.Errorf("ExportHAR() error got = %v, want the 409 from the server", err)
+	}
+
+	want := []request{
+		{method: "GET", uri: "/api/state"},
+		{method: "PUT", uri: "/api/filter", contentType: "application/json", body: `{"filter":"resp.status >= 500"}` + "\n"},
+		{method: "POST", uri: "/api/rules", contentType: "application/json", body: `[{"match":{"host":"*.example.com","method":"GET"},"response":{"body":"mocked","status":503}}]` + "\n"},
+		{method: "GET", uri: "/api/history?limit=1&offset=2&status=2xx"},
+		{method: "POST", uri: "/api/replay/7"},
+		{method: "GET", uri: "/api/stats"},
+		{method: "POST", uri: "/api/har/rotate"},
+		{method: "GET", uri: "/api/har"},
+	}
+	if len(*seen) != len(want) {
+		t.Fatalf("server got %d requests, want %d", len(*seen), len(want))
+	}
+	for i, got := range *seen {
+		want[i].auth = "Bearer s3cret"
+		if got != want[i] {
+			t.Errorf("request %d got = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
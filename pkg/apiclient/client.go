@@ -0,0 +1,117 @@
+// package apiclient is a client for the API that httptap serves with --webui, for programs and test
+// frameworks that query and control a running httptap. The methods of Client and the types that they
+// take and return are generated by gen.go from the OpenAPI document in webui/openapi.json, so that they
+// stay in step with it. Websockets are not covered.
+
+package apiclient
+
+//go:generate go run gen.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client sends requests to the API of one httptap
+type Client struct {
+	BaseURL    string       // such as "http://localhost:8040"
+	Token      string       // the token given with --webui-token, if any
+	HTTPClient *http.Client // if nil, http.DefaultClient is used
+}
+
+// New creates a client for the API served at baseURL, such as "http://localhost:8040", sending token as
+// a bearer token if it is not empty
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: baseURL, Token: token}
+}
+
+// Error is returned for responses with a status code of 400 or above, with the message that httptap gave
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("httptap API returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("httptap API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// do sends a request with body encoded as JSON if it is not nil, and returns the response if its status
+// code is below 400, in which case the caller must close its body
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body any) (*http.Response, error) {
+	u := strings.TrimSuffix(c.BaseURL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	// filters such as "resp.status >= 400" read better without HTML escaping
+	var r io.Reader
+	if body != nil {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(body); err != nil {
+			return nil, fmt.Errorf("error encoding request to %v %v: %w", method, path, err)
+		}
+		r = &buf
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		var payload struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&payload) == nil {
+			apiErr.Message = payload.Error
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// decodeJSON decodes the body of a response into out and closes it
+func decodeJSON(resp *http.Response, out any) error {
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding response to %v %v: %w", resp.Request.Method, resp.Request.URL.Path, err)
+	}
+	return nil
+}
+
+// readText reads the body of a response as text and closes it
+func readText(resp *http.Response) (string, error) {
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response to %v %v: %w", resp.Request.Method, resp.Request.URL.Path, err)
+	}
+	return string(buf), nil
+}
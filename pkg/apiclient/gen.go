@@ -0,0 +1,381 @@
+//go:build ignore
+
+// gen.go generates the methods of Client and the types of the API from the OpenAPI document of the web
+// UI. It only understands the parts of OpenAPI that the document uses. Run it with "go generate".
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Description          string             `json:"description"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Nullable             bool               `json:"nullable"`
+}
+
+type parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description"`
+	Schema      *schema `json:"schema"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type response struct {
+	Ref     string                `json:"$ref"`
+	Content map[string]*mediaType `json:"content"`
+}
+
+type operation struct {
+	OperationID string       `json:"operationId"`
+	Summary     string       `json:"summary"`
+	Parameters  []*parameter `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]*mediaType `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]*response `json:"responses"`
+}
+
+type document struct {
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+// generator accumulates the generated types and methods
+type generator struct {
+	doc     *document
+	types   bytes.Buffer
+	methods bytes.Buffer
+	defined map[string]bool
+	imports map[string]bool
+}
+
+// initialisms are written in upper case in Go names
+var initialisms = map[string]string{"id": "ID", "url": "URL", "har": "HAR"}
+
+// exported turns a name such as "bodyFile" or "id" into an exported Go name such as "BodyFile" or "ID"
+func exported(name string) string {
+	if s, ok := initialisms[name]; ok {
+		return s
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// comment writes text as a comment, if there is any
+func comment(w *bytes.Buffer, indent, text string) {
+	if text == "" {
+		return
+	}
+	fmt.Fprintf(w, "%s// %s\n", indent, text)
+}
+
+// lowerFirst lowers the first letter of a sentence so that it can follow another
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// isStruct checks whether the Go type of a schema is a struct, which is then referred to by pointer
+func (g *generator) isStruct(s *schema) bool {
+	if s.Ref != "" {
+		return g.isStruct(g.resolve(s.Ref))
+	}
+	return s.Type == "object" && len(s.Properties) > 0
+}
+
+// resolve finds the schema that a reference such as "#/components/schemas/Rule" refers to
+func (g *generator) resolve(ref string) *schema {
+	name := strings.TrimPrefix(ref, "#/components/schemas/")
+	s, ok := g.doc.Components.Schemas[name]
+	if !ok {
+		log.Fatalf("unknown schema %v", ref)
+	}
+	return s
+}
+
+// goType returns the Go type of a schema, defining a struct named name if it is an object with properties,
+// which is described as what if the schema has no description
+func (g *generator) goType(s *schema, name, what string) string {
+	if s.Ref != "" {
+		return strings.TrimPrefix(s.Ref, "#/components/schemas/")
+	}
+	switch s.Type {
+	case "object":
+		if len(s.Properties) > 0 {
+			g.defineStruct(name, s, what)
+			return name
+		}
+		if s.AdditionalProperties != nil {
+			return "map[string]" + g.goType(s.AdditionalProperties, name+"Value", what)
+		}
+		g.imports["encoding/json"] = true
+		return "json.RawMessage"
+	case "array":
+		return "[]" + g.goType(s.Items, name+"Item", what)
+	case "string":
+		return "string"
+	case "integer":
+		return "int"
+	case "number":
+		return "float64"
+	case "boolean":
+		return "bool"
+	}
+	log.Fatalf("unsupported schema type %q for %v", s.Type, name)
+	return ""
+}
+
+// fieldType returns the Go type of a property, which is a pointer for structs and nullable values
+func (g *generator) fieldType(s *schema, name, what string) string {
+	typ := g.goType(s, name, what)
+	if g.isStruct(s) || (s.Nullable && !strings.HasPrefix(typ, "[]") && !strings.HasPrefix(typ, "map[")) {
+		return "*" + typ
+	}
+	return typ
+}
+
+// defineStruct defines a struct for an object schema, once, described as what if the schema has no
+// description
+func (g *generator) defineStruct(name string, s *schema, what string) {
+	if g.defined[name] {
+		return
+	}
+	g.defined[name] = true
+
+	// fields are generated first, since they may define further types
+	var fields bytes.Buffer
+	for _, prop := range slices.Sorted(maps.Keys(s.Properties)) {
+		p := s.Properties[prop]
+		field := exported(prop)
+		comment(&fields, "\t", p.Description)
+		fmt.Fprintf(&fields, "\t%s %s `json:\"%s,omitempty\"`\n", field, g.fieldType(p, name+field, "the "+prop+" of a "+name), prop)
+	}
+
+	if s.Description != "" {
+		what = lowerFirst(s.Description)
+	}
+	fmt.Fprintln(&g.types)
+	comment(&g.types, "", name+" is "+what)
+	fmt.Fprintf(&g.types, "type %s struct {\n%s}\n", name, fields.Bytes())
+}
+
+// queryValue returns the Go expression that formats a value of a query parameter
+func (g *generator) queryValue(s *schema, v string) string {
+	if s.Type == "integer" {
+		g.imports["strconv"] = true
+		return "strconv.Itoa(" + v + ")"
+	}
+	return v
+}
+
+// defineMethod generates the method of Client for an operation
+func (g *generator) defineMethod(path, method string, op *operation) {
+	name := exported(op.OperationID)
+
+	// the first successful response decides what the method returns
+	var code string
+	for _, c := range slices.Sorted(maps.Keys(op.Responses)) {
+		if strings.HasPrefix(c, "2") || c == "101" {
+			code = c
+			break
+		}
+	}
+	if code == "101" {
+		return // websockets are not covered
+	}
+
+	var resultType, resultKind string
+	switch resp := op.Responses[code]; {
+	case code == "204":
+		resultKind = "none"
+	case resp.Content["application/json"] != nil:
+		resultKind = "json"
+		resultType = g.goType(resp.Content["application/json"].Schema, name+"Response", "the response to "+name)
+		if g.isStruct(resp.Content["application/json"].Schema) {
+			resultType = "*" + resultType
+		}
+	case resp.Content["text/event-stream"] != nil:
+		resultKind = "stream"
+		resultType = "io.ReadCloser"
+		g.imports["io"] = true
+	case resp.Content["text/plain"] != nil:
+		resultKind = "text"
+		resultType = "string"
+	default:
+		log.Fatalf("unsupported response to %v", op.OperationID)
+	}
+
+	// arguments are a context, then path parameters, then query parameters as a struct, then the body
+	args := []string{"ctx context.Context"}
+	pathExpr := `"` + path + `"`
+	var query []*parameter
+	for _, p := range op.Parameters {
+		switch p.In {
+		case "path":
+			typ := g.goType(p.Schema, "", "")
+			args = append(args, p.Name+" "+typ)
+			var value string
+			if typ == "int" {
+				value = "strconv.Itoa(" + p.Name + ")"
+				g.imports["strconv"] = true
+			} else {
+				value = "url.PathEscape(" + p.Name + ")"
+				g.imports["net/url"] = true
+			}
+			pathExpr = strings.ReplaceAll(pathExpr, "{"+p.Name+"}", `" + `+value+` + "`)
+		case "query":
+			query = append(query, p)
+		default:
+			log.Fatalf("unsupported parameter in %v of %v", p.In, op.OperationID)
+		}
+	}
+	pathExpr = strings.TrimSuffix(pathExpr, ` + ""`)
+	if len(query) > 0 {
+		params := name + "Params"
+		fmt.Fprintf(&g.types, "\n// %s are the query parameters of %s, which are left out when they are zero\n", params, name)
+		fmt.Fprintf(&g.types, "type %s struct {\n", params)
+		for _, p := range query {
+			comment(&g.types, "\t", p.Description)
+			fmt.Fprintf(&g.types, "\t%s %s\n", exported(p.Name), g.goType(p.Schema, "", ""))
+		}
+		fmt.Fprintf(&g.types, "}\n")
+		args = append(args, "params *"+params)
+	}
+	body := "nil"
+	if op.RequestBody != nil {
+		content := op.RequestBody.Content["application/json"]
+		if content == nil {
+			log.Fatalf("request body of %v is not JSON", op.OperationID)
+		}
+		typ := g.goType(content.Schema, name+"Request", "the body of a request to "+name)
+		if g.isStruct(content.Schema) {
+			typ = "*" + typ
+		}
+		args = append(args, "body "+typ)
+		body = "body"
+	}
+
+	results := "error"
+	fail := "return err"
+	if resultType != "" {
+		results = "(" + resultType + ", error)"
+		zero := "nil"
+		if resultType == "string" {
+			zero = `""`
+		}
+		fail = "return " + zero + ", err"
+	}
+
+	w := &g.methods
+	fmt.Fprintln(w)
+	comment(w, "", fmt.Sprintf("%s sends %s %s: %s", name, strings.ToUpper(method), path, lowerFirst(op.Summary)))
+	fmt.Fprintf(w, "func (c *Client) %s(%s) %s {\n", name, strings.Join(args, ", "), results)
+	queryArg := "nil"
+	if len(query) > 0 {
+		queryArg = "query"
+		g.imports["net/url"] = true
+		fmt.Fprintf(w, "query := url.Values{}\n")
+		fmt.Fprintf(w, "if params != nil {\n")
+		for _, p := range query {
+			field := "params." + exported(p.Name)
+			if p.Schema.Type == "array" {
+				fmt.Fprintf(w, "for _, v := range %s {\nquery.Add(%q, %s)\n}\n", field, p.Name, g.queryValue(p.Schema.Items, "v"))
+				continue
+			}
+			zero := `""`
+			if p.Schema.Type == "integer" {
+				zero = "0"
+			}
+			fmt.Fprintf(w, "if %s != %s {\nquery.Set(%q, %s)\n}\n", field, zero, p.Name, g.queryValue(p.Schema, field))
+		}
+		fmt.Fprintf(w, "}\n")
+	}
+	fmt.Fprintf(w, "resp, err := c.do(ctx, %q, %s, %s, %s)\n", strings.ToUpper(method), pathExpr, queryArg, body)
+	fmt.Fprintf(w, "if err != nil {\n%s\n}\n", fail)
+	switch resultKind {
+	case "none":
+		fmt.Fprintf(w, "resp.Body.Close()\nreturn nil\n")
+	case "json":
+		if strings.HasPrefix(resultType, "*") {
+			fmt.Fprintf(w, "var out %s\n", strings.TrimPrefix(resultType, "*"))
+			fmt.Fprintf(w, "if err := decodeJSON(resp, &out); err != nil {\n%s\n}\nreturn &out, nil\n", fail)
+		} else {
+			fmt.Fprintf(w, "var out %s\n", resultType)
+			fmt.Fprintf(w, "if err := decodeJSON(resp, &out); err != nil {\n%s\n}\nreturn out, nil\n", fail)
+		}
+	case "stream":
+		fmt.Fprintf(w, "return resp.Body, nil\n")
+	case "text":
+		fmt.Fprintf(w, "return readText(resp)\n")
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+func main() {
+	spec := flag.String("spec", "../../webui/openapi.json", "the OpenAPI document to generate from")
+	out := flag.String("o", "apiclient_gen.go", "the file to write")
+	flag.Parse()
+
+	buf, err := os.ReadFile(*spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var doc document
+	if err := json.Unmarshal(buf, &doc); err != nil {
+		log.Fatalf("error parsing %v: %v", *spec, err)
+	}
+
+	g := generator{doc: &doc, defined: make(map[string]bool), imports: map[string]bool{"context": true}}
+	for _, name := range slices.Sorted(maps.Keys(doc.Components.Schemas)) {
+		s := doc.Components.Schemas[name]
+		if s.Type == "object" && len(s.Properties) > 0 {
+			g.defineStruct(name, s, "the "+name+" schema of the API")
+		}
+	}
+	for _, path := range slices.Sorted(maps.Keys(doc.Paths)) {
+		for _, method := range slices.Sorted(maps.Keys(doc.Paths[path])) {
+			g.defineMethod(path, method, doc.Paths[path][method])
+		}
+	}
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by gen.go from webui/openapi.json. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&src, "package apiclient\n\n")
+	fmt.Fprintf(&src, "import (\n")
+	for _, path := range slices.Sorted(maps.Keys(g.imports)) {
+		fmt.Fprintf(&src, "%q\n", path)
+	}
+	fmt.Fprintf(&src, ")\n")
+	src.Write(g.types.Bytes())
+	src.Write(g.methods.Bytes())
+
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		log.Fatalf("error formatting generated code: %v\n%s", err, src.Bytes())
+	}
+	if err := os.WriteFile(*out, formatted, 0666); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,70 @@
+// Package contentcoding removes the content encodings of HTTP bodies, such as gzip and brotli, with a
+// limit on the size of the result so that a small body that decompresses to a huge one cannot exhaust
+// memory
+package contentcoding
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Decode reads r and undoes each of the given content encodings, which are in the order in which they
+// were applied, as in the Content-Encoding header. At most limit bytes of the decoded body are returned
+// if limit is positive, and truncated is true if there was more.
+func Decode(r io.Reader, encodings []string, limit int64) (body []byte, truncated bool, err error) {
+	// each header value may itself be a comma-separated list
+	var all []string
+	for _, v := range encodings {
+		for _, e := range strings.Split(v, ",") {
+			all = append(all, strings.ToLower(strings.TrimSpace(e)))
+		}
+	}
+
+	for i := len(all) - 1; i >= 0; i-- {
+		switch all[i] {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(r)
+			if err != nil {
+				return nil, false, fmt.Errorf("error gzip-decoding: %w", err)
+			}
+		case "deflate":
+			r, err = zlib.NewReader(r)
+			if err != nil {
+				return nil, false, fmt.Errorf("error deflate-decoding: %w", err)
+			}
+		case "br":
+			r = brotli.NewReader(r)
+		case "zstd":
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, false, fmt.Errorf("error zstd-decoding: %w", err)
+			}
+			defer zr.Close()
+			r = zr
+		default:
+			return nil, false, fmt.Errorf("unsupported content encoding: %q", all[i])
+		}
+	}
+
+	if limit <= 0 {
+		body, err = io.ReadAll(r)
+		return body, false, err
+	}
+
+	// read one byte more than the limit to find out whether there is more
+	body, err = io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > limit {
+		return body[:limit], true, nil
+	}
+	return body, false, nil
+}
@@ -0,0 +1,126 @@
+package contentcoding
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func compress(t *testing.T, encoding string, body []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		var err error
+		w, err = zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("unknown encoding %q", encoding)
+	}
+	if _, err := w.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	hello := []byte("hello world")
+	tests := []struct {
+		name          string
+		body          []byte
+		encodings     []string
+		limit         int64
+		want          []byte
+		wantTruncated bool
+		wantErr       bool
+	}{
+		{name: "identity", body: hello, want: hello},
+		{name: "gzip", body: compress(t, "gzip", hello), encodings: []string{"gzip"}, want: hello},
+		{name: "deflate", body: compress(t, "deflate", hello), encodings: []string{"deflate"}, want: hello},
+		{name: "brotli", body: compress(t, "br", hello), encodings: []string{"br"}, want: hello},
+		{name: "zstd", body: compress(t, "zstd", hello), encodings: []string{"zstd"}, want: hello},
+		{
+			name:      "several in one header value",
+			body:      compress(t, "gzip", compress(t, "br", hello)),
+			encodings: []string{"br, GZIP"},
+			want:      hello,
+		},
+		{
+			name:      "exactly at the limit",
+			body:      compress(t, "gzip", hello),
+			encodings: []string{"gzip"},
+			limit:     int64(len(hello)),
+			want:      hello,
+		},
+		{
+			name:          "over the limit",
+			body:          compress(t, "gzip", hello),
+			encodings:     []string{"gzip"},
+			limit:         5,
+			want:          []byte("hello"),
+			wantTruncated: true,
+		},
+		{name: "unsupported", body: hello, encodings: []string{"compress"}, wantErr: true},
+		{name: "corrupt", body: hello, encodings: []string{"gzip"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated, err := Decode(bytes.NewReader(tt.body), tt.encodings, tt.limit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Decode() got = %q, want %q", got, tt.want)
+			}
+			if truncated != tt.wantTruncated {
+				t.Errorf("Decode() truncated got = %v, want %v", truncated, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+// a gzip body of about a hundred kilobytes that decompresses to a hundred megabytes must only ever be
+// decoded up to the limit
+func TestDecodeBomb(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zeros := make([]byte, 1<<20)
+	for range 100 {
+		w.Write(zeros)
+	}
+	w.Close()
+	if buf.Len() > 1<<20 {
+		t.Fatalf("compressed body is %d bytes, expected a high compression ratio", buf.Len())
+	}
+
+	const limit = 1 << 16
+	got, truncated, err := Decode(bytes.NewReader(buf.Bytes()), []string{"gzip"}, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("Decode() truncated got = false, want true")
+	}
+	if len(got) != limit {
+		t.Errorf("len(Decode()) got = %d, want %d", len(got), limit)
+	}
+}
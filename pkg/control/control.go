@@ -0,0 +1,207 @@
+// Package control is the protocol by which "httptap ctl" sends commands to a running httptap over a unix
+// socket. Each connection carries one command, as a JSON Request, and its reply, as a JSON Response.
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Verbosef is called to log the details of commands as they are received. Nothing is logged until it is
+// set.
+var Verbosef = func(format string, args ...any) {}
+
+// Request is a command sent to the control socket, one per connection
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// Response is the reply to a Request
+type Response struct {
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Handler carries out a command and returns the output to print
+type Handler func(command string, args []string) (string, error)
+
+// Dir is the directory in which control sockets are created unless another path is given, and where Run
+// looks for them
+func Dir() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "httptap")
+}
+
+// Server answers the commands sent to a control socket
+type Server struct {
+	Path     string // the path of the socket
+	listener net.Listener
+	handler  Handler
+}
+
+// Listen creates a control socket at path, or at a path in Dir named after our process ID if path is
+// empty, whose commands are carried out by handler once Serve is called
+func Listen(path string, handler Handler) (*Server, error) {
+	if path == "" {
+		dir := Dir()
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("error creating directory for control socket: %w", err)
+		}
+		if err := CheckDir(dir); err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%d.sock", os.Getpid()))
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on control socket: %w", err)
+	}
+	return &Server{Path: path, listener: l, handler: handler}, nil
+}
+
+// CheckDir refuses a directory for control sockets that someone else could have put sockets in, which
+// under a shared temporary directory could be made ahead of time by another user
+func CheckDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("error checking directory for control socket: %w", err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to create control socket in %v because it is a symlink", dir)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("refusing to create control socket in %v because it is not a directory", dir)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("refusing to create control socket in %v because it is owned by uid %d rather than us", dir, st.Uid)
+	}
+	if info.Mode().Perm() != 0700 {
+		return fmt.Errorf("refusing to create control socket in %v because its mode is %#o rather than 0700", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// Serve answers commands until the server is closed
+func (s *Server) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			Verbosef("error accepting connection on control socket: %v", err)
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops listening and removes the socket
+func (s *Server) Close() {
+	s.listener.Close()
+	os.Remove(s.Path)
+}
+
+// handle reads one command from a connection and writes the reply
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		// Run connects without sending anything to check which sockets are live
+		if !errors.Is(err, io.EOF) {
+			Verbosef("error reading command from control socket: %v", err)
+		}
+		return
+	}
+	Verbosef("received %q from control socket", req.Command)
+
+	var resp Response
+	output, err := s.handler(req.Command, req.Args)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Output = output
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil {
+		Verbosef("error writing reply to control socket: %v", err)
+	}
+}
+
+// Run sends a command to the control socket at path, or to the one socket in Dir of an httptap that is
+// still running if path is empty, and returns its output. The error is the one that the command failed
+// with, if any, in which case there may be output too.
+func Run(path, command string, args []string) (string, error) {
+	// rules files are loaded by the httptap that receives them, which may be in another directory
+	if command == "add-rules" {
+		args = slices.Clone(args)
+		for i, arg := range args {
+			abs, err := filepath.Abs(arg)
+			if err != nil {
+				return "", err
+			}
+			args[i] = abs
+		}
+	}
+
+	if path == "" {
+		var err error
+		path, err = FindSocket()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("error connecting to control socket: %w", err)
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(Request{Command: command, Args: args}); err != nil {
+		return "", fmt.Errorf("error sending command: %w", err)
+	}
+	var resp Response
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return "", fmt.Errorf("error reading reply: %w", err)
+	}
+	if resp.Error != "" {
+		return resp.Output, errors.New(resp.Error)
+	}
+	return resp.Output, nil
+}
+
+// FindSocket finds the control socket of the one httptap that is running with --control, leaving out
+// sockets left behind by instances that have exited
+func FindSocket() (string, error) {
+	paths, _ := filepath.Glob(filepath.Join(Dir(), "*.sock"))
+	var live []string
+	for _, path := range paths {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		live = append(live, path)
+	}
+	slices.Sort(live)
+	switch len(live) {
+	case 0:
+		return "", fmt.Errorf("found no httptap running with --control in %v", Dir())
+	case 1:
+		return live[0], nil
+	default:
+		return "", fmt.Errorf("found more than one httptap running with --control, choose one with --socket: %v", strings.Join(live, ", "))
+	}
+}
@@ -0,0 +1,187 @@
+package control
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testState is changed by commands in the way that the controller of httptap is
+type testState struct {
+	mu     sync.Mutex
+	paused bool
+	filter string
+	rules  []string
+}
+
+func (s *testState) handle(command string, args []string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch command {
+	case "pause":
+		s.paused = true
+		return "capture paused", nil
+	case "resume":
+		s.paused = false
+		return "capture resumed", nil
+	case "filter":
+		s.filter = strings.Join(args, " ")
+		if s.filter == "" {
+			return "showing every HTTP call", nil
+		}
+		return "showing HTTP calls for which " + s.filter, nil
+	case "add-rules":
+		if len(args) != 1 {
+			return "", fmt.Errorf("add-rules takes the path of a rules file")
+		}
+		if !filepath.IsAbs(args[0]) {
+			return "", fmt.Errorf("got relative path %q", args[0])
+		}
+		buf, err := os.ReadFile(args[0])
+		if err != nil {
+			return "", fmt.Errorf("error loading rules: %w", err)
+		}
+		s.rules = append(s.rules, string(buf))
+		return "added 1 rules", nil
+	default:
+		return "", fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func TestRun(t *testing.T) {
+	var state testState
+	path := filepath.Join(t.TempDir(), "test.sock")
+	server, err := Listen(path, state.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+
+	// rules files are given relative to the directory that "httptap ctl" is run in
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte("- match: {host: example.com}"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	tests := []struct {
+		command    string
+		args       []string
+		wantOutput string
+		wantErr    string
+	}{
+		{command: "pause", wantOutput: "capture paused"},
+		{command: "filter", args: []string{"resp.status", ">=", "400"}, wantOutput: "showing HTTP calls for which resp.status >= 400"},
+		{command: "add-rules", args: []string{"rules.yaml"}, wantOutput: "added 1 rules"},
+		{command: "add-rules", args: []string{"missing.yaml"}, wantErr: "error loading rules"},
+		{command: "filter", wantOutput: "showing every HTTP call"},
+		{command: "resume", wantOutput: "capture resumed"},
+		{command: "bogus", wantErr: `unknown command "bogus"`},
+	}
+	for _, tt := range tests {
+		output, err := Run(server.Path, tt.command, tt.args)
+		if output != tt.wantOutput {
+			t.Errorf("Run(%q) output got = %q, want %q", tt.command, output, tt.wantOutput)
+		}
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("Run(%q) error got = %v", tt.command, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("Run(%q) error got = %v, want %q", tt.command, err, tt.wantErr)
+		}
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.paused || state.filter != "" || len(state.rules) != 1 || state.rules[0] != "- match: {host: example.com}" {
+		t.Errorf("state after commands got = paused %v, filter %q, rules %q", state.paused, state.filter, state.rules)
+	}
+}
+
+func TestFindSocket(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	if _, err := Run("", "pause", nil); err == nil {
+		t.Error("Run() with no httptap running got no error")
+	}
+
+	var state testState
+	server, err := Listen("", state.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+	if dir := filepath.Dir(server.Path); dir != Dir() {
+		t.Errorf("socket directory got = %v, want %v", dir, Dir())
+	}
+
+	// sockets of instances that have exited are left out
+	if err := os.WriteFile(filepath.Join(Dir(), "1.sock"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Run("", "pause", nil); err != nil {
+		t.Fatal(err)
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if !state.paused {
+		t.Error("paused got = false, want true")
+	}
+}
+
+func TestCheckDir(t *testing.T) {
+	base := t.TempDir()
+	private := filepath.Join(base, "private")
+	if err := os.Mkdir(private, 0700); err != nil {
+		t.Fatal(err)
+	}
+	shared := filepath.Join(base, "shared")
+	if err := os.Mkdir(shared, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// set after creating, so that the umask does not apply
+	if err := os.Chmod(shared, 0777); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(base, "link")
+	if err := os.Symlink(private, link); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(base, "file")
+	if err := os.WriteFile(file, nil, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dir     string
+		wantErr string
+	}{
+		{dir: private},
+		{dir: shared, wantErr: "mode"},
+		{dir: link, wantErr: "symlink"},
+		{dir: file, wantErr: "not a directory"},
+		{dir: filepath.Join(base, "missing"), wantErr: "error checking"},
+	}
+	for _, tt := range tests {
+		err := CheckDir(tt.dir)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("CheckDir(%v) got = %v, want nil", tt.dir, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("CheckDir(%v) got = %v, want an error containing %q", tt.dir, err, tt.wantErr)
+		}
+	}
+}
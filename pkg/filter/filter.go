@@ -0,0 +1,889 @@
+// Package filter implements a small expression language for choosing which HTTP calls to show. It is a
+// subset of the Common Expression Language (CEL), so that expressions like
+//
+//	req.host.endsWith("github.com") && resp.status >= 400
+//
+// mean the same thing here as they would in CEL. Values are strings, int64s, float64s, bools, nil,
+// lists ([]any), and maps with string keys (map[string]any).
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Filter is a compiled expression
+type Filter struct {
+	expr string
+	root node
+}
+
+// Compile parses an expression. If any variable names are given then the expression may only refer to
+// those variables, so that typos are caught before anything is evaluated.
+func Compile(expr string, vars ...string) (*Filter, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{tokens: tokens, vars: vars}
+	root, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// Match evaluates the expression with the given variables, which must produce true or false
+func (f *Filter) Match(vars map[string]any) (bool, error) {
+	v, err := f.root.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression must be true or false but got %s", typeName(v))
+	}
+	return b, nil
+}
+
+// String returns the expression that the filter was compiled from
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// the kinds of token in an expression
+const (
+	tokenEOF = iota
+	tokenIdent
+	tokenInt
+	tokenFloat
+	tokenString
+	tokenOp
+)
+
+type token struct {
+	kind int
+	text string // the operator, the name, or the value of a string literal
+	pos  int
+}
+
+// operators, longest first so that "<=" is not taken for "<"
+var operators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",", ".", "?", ":"}
+
+// lex splits an expression into tokens
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(s) {
+				r, size := utf8.DecodeRuneInString(s[i:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: s[start:i], pos: start})
+		case r >= '0' && r <= '9':
+			start := i
+			kind := tokenInt
+			for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.' || s[i] == 'e' || s[i] == 'E') {
+				if s[i] == '.' || s[i] == 'e' || s[i] == 'E' {
+					kind = tokenFloat
+				}
+				i++
+			}
+			tokens = append(tokens, token{kind: kind, text: s[start:i], pos: start})
+		case r == '"' || r == '\'':
+			text, n, err := lexString(s[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%v at position %d", err, i)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text, pos: i})
+			i += n
+		default:
+			var op string
+			for _, candidate := range operators {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at position %d", r, i)
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, text: "end of expression", pos: len(s)}), nil
+}
+
+// lexString reads a quoted string from the start of s, returning its value and the number of bytes read
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '"', '\'':
+				b.WriteByte(s[i])
+			default:
+				return "", 0, fmt.Errorf("unknown escape sequence \\%c in string", s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// parser builds a tree of nodes from tokens by recursive descent, from the lowest precedence operator
+// to the highest
+type parser struct {
+	tokens []token
+	pos    int
+	vars   []string
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is one of the given operators
+func (p *parser) accept(ops ...string) (string, bool) {
+	tok := p.peek()
+	if tok.kind == tokenOp && slices.Contains(ops, tok.text) {
+		p.pos++
+		return tok.text, true
+	}
+	return "", false
+}
+
+func (p *parser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		tok := p.peek()
+		return fmt.Errorf("expected %q but got %q at position %d", op, tok.text, tok.pos)
+	}
+	return nil
+}
+
+// expr parses a conditional, which has the lowest precedence
+func (p *parser) expr() (node, error) {
+	cond, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept("?"); !ok {
+		return cond, nil
+	}
+	ifTrue, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	ifFalse, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return &conditional{cond, ifTrue, ifFalse}, nil
+}
+
+// the binary operators, from the lowest precedence to the highest
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// binary parses the binary operators at the given level of precedence and above
+func (p *parser) binary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(precedence[level]...)
+		if !ok && slices.Contains(precedence[level], "in") && p.peek().kind == tokenIdent && p.peek().text == "in" {
+			op, ok = p.next().text, true
+		}
+		if !ok {
+			return left, nil
+		}
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op, left, right}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if op, ok := p.accept("!", "-"); ok {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op, x}, nil
+	}
+	return p.postfix()
+}
+
+// postfix parses field selections, indexes, and method calls
+func (p *parser) postfix() (node, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("."); ok {
+			tok := p.next()
+			if tok.kind != tokenIdent {
+				return nil, fmt.Errorf("expected a name after \".\" but got %q at position %d", tok.text, tok.pos)
+			}
+			if _, ok := p.accept("("); ok {
+				args, err := p.list(")")
+				if err != nil {
+					return nil, err
+				}
+				x, err = newCall(tok, x, args)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				x = &member{x, tok.text}
+			}
+		} else if _, ok := p.accept("["); ok {
+			i, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &index{x, i}
+		} else {
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) primary() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenInt:
+		n, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+		return &literal{n}, nil
+	case tokenFloat:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+		return &literal{f}, nil
+	case tokenString:
+		return &literal{tok.text}, nil
+	case tokenIdent:
+		switch tok.text {
+		case "true":
+			return &literal{true}, nil
+		case "false":
+			return &literal{false}, nil
+		case "null":
+			return &literal{nil}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			args, err := p.list(")")
+			if err != nil {
+				return nil, err
+			}
+			return newCall(tok, nil, args)
+		}
+		if len(p.vars) > 0 && !slices.Contains(p.vars, tok.text) {
+			return nil, fmt.Errorf("unknown variable %q at position %d (expected one of %s)", tok.text, tok.pos, strings.Join(p.vars, ", "))
+		}
+		return &variable{tok.text}, nil
+	case tokenOp:
+		switch tok.text {
+		case "(":
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return x, nil
+		case "[":
+			elems, err := p.list("]")
+			if err != nil {
+				return nil, err
+			}
+			return &list{elems}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
+
+// list parses comma-separated expressions up to a closing bracket
+func (p *parser) list(end string) ([]node, error) {
+	var elems []node
+	if _, ok := p.accept(end); ok {
+		return elems, nil
+	}
+	for {
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, x)
+		if _, ok := p.accept(end); ok {
+			return elems, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// node is part of a parsed expression
+type node interface {
+	eval(vars map[string]any) (any, error)
+}
+
+type literal struct {
+	value any
+}
+
+func (n *literal) eval(map[string]any) (any, error) {
+	return n.value, nil
+}
+
+type variable struct {
+	name string
+}
+
+func (n *variable) eval(vars map[string]any) (any, error) {
+	v, ok := vars[n.name]
+	if !ok {
+		return nil, fmt.Errorf("undeclared reference to %q", n.name)
+	}
+	return normalize(v), nil
+}
+
+type list struct {
+	elems []node
+}
+
+func (n *list) eval(vars map[string]any) (any, error) {
+	values := make([]any, len(n.elems))
+	for i, elem := range n.elems {
+		v, err := elem.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+type member struct {
+	x     node
+	field string
+}
+
+func (n *member) eval(vars map[string]any) (any, error) {
+	x, err := n.x.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := x.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("cannot select field %q from %s", n.field, typeName(x))
+	}
+	v, ok := m[n.field]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %q", n.field)
+	}
+	return normalize(v), nil
+}
+
+type index struct {
+	x, i node
+}
+
+func (n *index) eval(vars map[string]any) (any, error) {
+	x, err := n.x.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	i, err := n.i.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch x := x.(type) {
+	case map[string]any:
+		key, ok := i.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot index map with %s", typeName(i))
+		}
+		v, ok := x[key]
+		if !ok {
+			return nil, fmt.Errorf("no such key: %q", key)
+		}
+		return normalize(v), nil
+	case []any:
+		k, ok := i.(int64)
+		if !ok {
+			return nil, fmt.Errorf("cannot index list with %s", typeName(i))
+		}
+		if k < 0 || k >= int64(len(x)) {
+			return nil, fmt.Errorf("index %d out of range for list of size %d", k, len(x))
+		}
+		return normalize(x[k]), nil
+	}
+	return nil, fmt.Errorf("cannot index %s", typeName(x))
+}
+
+type unary struct {
+	op string
+	x  node
+}
+
+func (n *unary) eval(vars map[string]any) (any, error) {
+	x, err := n.x.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch x := x.(type) {
+	case bool:
+		if n.op == "!" {
+			return !x, nil
+		}
+	case int64:
+		if n.op == "-" {
+			return -x, nil
+		}
+	case float64:
+		if n.op == "-" {
+			return -x, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot apply %q to %s", n.op, typeName(x))
+}
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+func (n *binary) eval(vars map[string]any) (any, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	// the logical operators only evaluate their right side if they need to
+	if n.op == "&&" || n.op == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("cannot apply %q to %s", n.op, typeName(left))
+		}
+		if l == (n.op == "||") {
+			return l, nil
+		}
+		right, err := n.right.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("cannot apply %q to %s", n.op, typeName(right))
+		}
+		return r, nil
+	}
+
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		switch r := right.(type) {
+		case []any:
+			return slices.ContainsFunc(r, func(v any) bool { return equal(left, normalize(v)) }), nil
+		case map[string]any:
+			key, ok := left.(string)
+			if !ok {
+				return false, nil
+			}
+			_, ok = r[key]
+			return ok, nil
+		}
+		return nil, fmt.Errorf("cannot apply \"in\" to %s", typeName(right))
+	case "<", "<=", ">", ">=":
+		c, err := compare(left, right)
+		if err != nil {
+			return nil, fmt.Errorf("cannot apply %q to %s and %s", n.op, typeName(left), typeName(right))
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}
+	return arithmetic(n.op, left, right)
+}
+
+type conditional struct {
+	cond, ifTrue, ifFalse node
+}
+
+func (n *conditional) eval(vars map[string]any) (any, error) {
+	cond, err := n.cond.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := cond.(bool)
+	if !ok {
+		return nil, fmt.Errorf("condition must be true or false but got %s", typeName(cond))
+	}
+	if c {
+		return n.ifTrue.eval(vars)
+	}
+	return n.ifFalse.eval(vars)
+}
+
+// call is a function or method call. Regular expressions that are given as literals are compiled once.
+type call struct {
+	name string
+	recv node // nil for functions
+	args []node
+	re   *regexp.Regexp
+}
+
+// the number of arguments taken by each method of strings
+var stringMethods = map[string]int{
+	"contains":   1,
+	"startsWith": 1,
+	"endsWith":   1,
+	"matches":    1,
+	"lowerAscii": 0,
+	"upperAscii": 0,
+	"size":       0,
+}
+
+func newCall(tok token, recv node, args []node) (node, error) {
+	c := call{name: tok.text, recv: recv, args: args}
+	if recv == nil {
+		if c.name != "size" || len(args) != 1 {
+			return nil, fmt.Errorf("unknown function %s with %d arguments at position %d", c.name, len(args), tok.pos)
+		}
+		return &c, nil
+	}
+
+	n, ok := stringMethods[c.name]
+	if !ok || n != len(args) {
+		return nil, fmt.Errorf("unknown method %s with %d arguments at position %d", c.name, len(args), tok.pos)
+	}
+	if c.name == "matches" {
+		if pattern, ok := args[0].(*literal); ok {
+			s, ok := pattern.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("matches needs a string but got %s at position %d", typeName(pattern.value), tok.pos)
+			}
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression at position %d: %w", tok.pos, err)
+			}
+			c.re = re
+		}
+	}
+	return &c, nil
+}
+
+func (n *call) eval(vars map[string]any) (any, error) {
+	var args []any
+	for _, arg := range n.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+
+	// size is both a function and a method, and works for lists and maps as well as strings
+	if n.name == "size" {
+		x := args
+		if n.recv != nil {
+			recv, err := n.recv.eval(vars)
+			if err != nil {
+				return nil, err
+			}
+			x = []any{recv}
+		}
+		switch x := x[0].(type) {
+		case string:
+			return int64(utf8.RuneCountInString(x)), nil
+		case []any:
+			return int64(len(x)), nil
+		case map[string]any:
+			return int64(len(x)), nil
+		}
+		return nil, fmt.Errorf("no size for %s", typeName(x[0]))
+	}
+
+	recv, err := n.recv.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := recv.(string)
+	if !ok {
+		return nil, fmt.Errorf("cannot call %s on %s", n.name, typeName(recv))
+	}
+	switch n.name {
+	case "lowerAscii":
+		return strings.ToLower(s), nil
+	case "upperAscii":
+		return strings.ToUpper(s), nil
+	}
+
+	arg, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s needs a string but got %s", n.name, typeName(args[0]))
+	}
+	switch n.name {
+	case "contains":
+		return strings.Contains(s, arg), nil
+	case "startsWith":
+		return strings.HasPrefix(s, arg), nil
+	case "endsWith":
+		return strings.HasSuffix(s, arg), nil
+	}
+
+	re := n.re
+	if re == nil {
+		re, err = regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression: %w", err)
+		}
+	}
+	return re.MatchString(s), nil
+}
+
+// normalize converts the Go types that callers are likely to use for variables to the types used in
+// expressions
+func normalize(v any) any {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case []string:
+		values := make([]any, len(v))
+		for i, s := range v {
+			values[i] = s
+		}
+		return values
+	case map[string]string:
+		values := make(map[string]any, len(v))
+		for k, s := range v {
+			values[k] = s
+		}
+		return values
+	}
+	return v
+}
+
+// equal compares two values, where integers and floats with the same value are equal
+func equal(a, b any) bool {
+	if c, err := compare(a, b); err == nil {
+		return c == 0
+	}
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case bool:
+		b, ok := b.(bool)
+		return ok && a == b
+	case []any:
+		b, ok := b.([]any)
+		return ok && slices.EqualFunc(a, b, func(x, y any) bool { return equal(normalize(x), normalize(y)) })
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			w, ok := b[k]
+			if !ok || !equal(normalize(v), normalize(w)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compare orders two numbers or two strings
+func compare(a, b any) (int, error) {
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return cmpOrdered(a, b), nil
+		case float64:
+			return cmpOrdered(float64(a), b), nil
+		}
+	case float64:
+		switch b := b.(type) {
+		case int64:
+			return cmpOrdered(a, float64(b)), nil
+		case float64:
+			return cmpOrdered(a, b), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %s and %s", typeName(a), typeName(b))
+}
+
+func cmpOrdered[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// arithmetic applies +, -, *, /, or % to numbers, where + also joins strings and lists
+func arithmetic(op string, a, b any) (any, error) {
+	switch a := a.(type) {
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			switch op {
+			case "+":
+				return a + b, nil
+			case "-":
+				return a - b, nil
+			case "*":
+				return a * b, nil
+			case "/", "%":
+				if b == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				if op == "/" {
+					return a / b, nil
+				}
+				return a % b, nil
+			}
+		case float64:
+			return arithmetic(op, float64(a), b)
+		}
+	case float64:
+		if b, ok := b.(int64); ok {
+			return arithmetic(op, a, float64(b))
+		}
+		if b, ok := b.(float64); ok {
+			switch op {
+			case "+":
+				return a + b, nil
+			case "-":
+				return a - b, nil
+			case "*":
+				return a * b, nil
+			case "/":
+				return a / b, nil
+			}
+		}
+	case string:
+		if b, ok := b.(string); ok && op == "+" {
+			return a + b, nil
+		}
+	case []any:
+		if b, ok := b.([]any); ok && op == "+" {
+			return append(slices.Clip(a), b...), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot apply %q to %s and %s", op, typeName(a), typeName(b))
+}
+
+// typeName names the type of a value as CEL does
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,133 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+var testVars = map[string]any{
+	"req": map[string]any{
+		"method": "GET",
+		"host":   "api.github.com",
+		"path":   "/repos/foo",
+		"headers": map[string]any{
+			"user-agent": "curl/8.0",
+		},
+		"size": int64(0),
+	},
+	"resp": map[string]any{
+		"status": int64(404),
+		"size":   int64(1500),
+		"body":   `{"message": "Not Found"}`,
+	},
+	"tags":  []string{"a", "b"},
+	"ratio": 0.5,
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`req.host.endsWith("github.com") && resp.status >= 400`, true},
+		{`req.host.endsWith("gitlab.com") && resp.status >= 400`, false},
+		{`req.method == "POST" || resp.status == 404`, true},
+		{`req.method in ["GET", "HEAD"]`, true},
+		{`req.method in ['POST']`, false},
+		{`"user-agent" in req.headers`, true},
+		{`"cookie" in req.headers`, false},
+		{`req.headers["user-agent"].startsWith("curl/")`, true},
+		{`req.path.matches("^/repos/[a-z]+$")`, true},
+		{`req.path.matches("^/users/")`, false},
+		{`req.path.matches("^/" + "repos")`, true},
+		{`resp.body.contains("Not Found")`, true},
+		{`!(resp.status < 400)`, true},
+		{`resp.status / 100 == 4`, true},
+		{`resp.status % 100 == 4`, true},
+		{`resp.size > 1e3`, true},
+		{`resp.size - 500 == 1000.0`, true},
+		{`ratio * 2 == 1`, true},
+		{`-ratio < 0`, true},
+		{`size(tags) == 2 && tags[1] == "b"`, true},
+		{`req.host.size() == 14`, true},
+		{`req.method.lowerAscii() == "get" && "x".upperAscii() == "X"`, true},
+		{`resp.status >= 500 ? false : true`, true},
+		{`tags + ["c"] == ["a", "b", "c"]`, true},
+		{`null == null && req != null`, true},
+		{`"abc" < "abd"`, true},
+		{"'it\\'s' == \"it's\"", true},
+
+		// the right side of a logical operator is not evaluated when the left side decides the result
+		{`false && req.nosuchfield == 1`, false},
+		{`true || req.nosuchfield == 1`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := Compile(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := f.Match(testVars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Match() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchError(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{`req.nosuchfield == 1`, `no such key: "nosuchfield"`},
+		{`req.headers["cookie"] == ""`, `no such key: "cookie"`},
+		{`resp.status`, "must be true or false"},
+		{`resp.status && true`, `cannot apply "&&" to int`},
+		{`req.method < 3`, `cannot apply "<" to string and int`},
+		{`resp.status / 0 == 1`, "division by zero"},
+		{`tags[5] == "a"`, "out of range"},
+		{`resp.status.contains("4")`, "cannot call contains on int"},
+		{`other == 1`, `undeclared reference to "other"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := Compile(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Match(testVars)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Match() error got = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{`req.method == "GET`, "unterminated string"},
+		{`req.method == "GET" &&`, `unexpected "end of expression"`},
+		{`(req.method == "GET"`, `expected ")"`},
+		{`req.method # "GET"`, `unexpected '#' at position 11`},
+		{`req.host.endsWith()`, "unknown method endsWith with 0 arguments"},
+		{`lower(req.host)`, "unknown function lower"},
+		{`req.path.matches("[")`, "invalid regular expression"},
+		{`rsp.status == 200`, `unknown variable "rsp"`},
+		{`req.method == "GET" "POST"`, `unexpected "POST"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := Compile(tt.expr, "req", "resp")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Compile() error got = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Package graphql finds the operations in GraphQL documents without fully parsing them
+package graphql
+
+import (
+	"strings"
+	"unicode"
+)
+
+// OperationInfo finds the type and name of the operation in a GraphQL document. When the document
+// contains several operations, the one named by operationName is used. This is a scan of top-level tokens
+// rather than a full parse, which is enough to find operation definitions.
+func OperationInfo(query, operationName string) (typ, name string) {
+	depth := 0
+	var prev string
+	for tok := range tokens(query) {
+		switch tok {
+		case "{", "(":
+			if tok == "{" && depth == 0 && prev == "" && typ == "" {
+				// the shorthand form "{ ... }" is an anonymous query
+				typ = "query"
+			}
+			depth++
+		case "}", ")":
+			depth--
+		case "@":
+			// directives come after the operation name, if any
+		case "query", "mutation", "subscription":
+			if depth == 0 {
+				if typ != "" && (operationName == "" || name == operationName) {
+					return typ, name
+				}
+				typ, name = tok, ""
+			}
+		default:
+			if depth == 0 && name == "" && (prev == "query" || prev == "mutation" || prev == "subscription") {
+				name = tok
+			}
+		}
+		if depth == 0 {
+			prev = tok
+		}
+	}
+	return typ, name
+}
+
+// tokens yields the names, braces, parentheses, and directive markers in a GraphQL document,
+// skipping comments, strings, and all other punctuation
+func tokens(s string) func(yield func(string) bool) {
+	return func(yield func(string) bool) {
+		for i := 0; i < len(s); {
+			c := s[i]
+			switch {
+			case c == '#':
+				for i < len(s) && s[i] != '\n' {
+					i++
+				}
+			case c == '"':
+				// skip over strings, including block strings
+				if strings.HasPrefix(s[i:], `"""`) {
+					end := strings.Index(s[i+3:], `"""`)
+					if end < 0 {
+						return
+					}
+					i += end + 6
+					continue
+				}
+				i++
+				for i < len(s) && s[i] != '"' {
+					if s[i] == '\\' {
+						i++
+					}
+					i++
+				}
+				i++
+			case c == '{' || c == '}' || c == '(' || c == ')' || c == '@':
+				if !yield(string(c)) {
+					return
+				}
+				i++
+			case c == '_' || unicode.IsLetter(rune(c)):
+				start := i
+				for i < len(s) && (s[i] == '_' || unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i]))) {
+					i++
+				}
+				if !yield(s[start:i]) {
+					return
+				}
+			default:
+				i++
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package graphql
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOperationInfo(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		operationName string
+		wantType      string
+		wantName      string
+	}{
+		{
+			name:     "anonymous shorthand",
+			query:    `{ user(id: 1) { name } }`,
+			wantType: "query",
+		},
+		{
+			name:     "anonymous query",
+			query:    `query { user(id: 1) { name } }`,
+			wantType: "query",
+		},
+		{
+			name:     "named query",
+			query:    `query GetUser { user(id: 1) { name } }`,
+			wantType: "query",
+			wantName: "GetUser",
+		},
+		{
+			name:     "named mutation with variables",
+			query:    `mutation CreateUser($name: String!) { createUser(name: $name) { id } }`,
+			wantType: "mutation",
+			wantName: "CreateUser",
+		},
+		{
+			name:     "subscription with directive",
+			query:    `subscription OnEvent @live { event { id } }`,
+			wantType: "subscription",
+			wantName: "OnEvent",
+		},
+		{
+			name:     "anonymous with directive",
+			query:    `query @cached { user { name } }`,
+			wantType: "query",
+		},
+		{
+			name:     "fragment before operation",
+			query:    `fragment UserFields on User { id name } query GetUser { user { ...UserFields } }`,
+			wantType: "query",
+			wantName: "GetUser",
+		},
+		{
+			name:     "fragment after operation",
+			query:    `query GetUser { user { ...UserFields } } fragment UserFields on User { id }`,
+			wantType: "query",
+			wantName: "GetUser",
+		},
+		{
+			name:     "field named like an operation",
+			query:    `query Search { query mutation { subscription } }`,
+			wantType: "query",
+			wantName: "Search",
+		},
+		{
+			name:     "comments",
+			query:    "# mutation Fake { x }\nquery Real { a } # query Other",
+			wantType: "query",
+			wantName: "Real",
+		},
+		{
+			name:     "string containing braces",
+			query:    `query Q { search(text: "} mutation X {") { id } }`,
+			wantType: "query",
+			wantName: "Q",
+		},
+		{
+			name:     "string containing escaped quote",
+			query:    `query Q { search(text: "\"} mutation X {") { id } }`,
+			wantType: "query",
+			wantName: "Q",
+		},
+		{
+			name:     "block string containing braces",
+			query:    `mutation Post { post(body: """ { "a": "}" } """) { id } }`,
+			wantType: "mutation",
+			wantName: "Post",
+		},
+		{
+			name:     "first of several operations",
+			query:    `query A { a } mutation B { b }`,
+			wantType: "query",
+			wantName: "A",
+		},
+		{
+			name:          "chosen by operation name",
+			query:         `query A { a } mutation B { b } query C { c }`,
+			operationName: "B",
+			wantType:      "mutation",
+			wantName:      "B",
+		},
+		{
+			name:          "last chosen by operation name",
+			query:         `query A { a } mutation B { b } query C { c }`,
+			operationName: "C",
+			wantType:      "query",
+			wantName:      "C",
+		},
+		{
+			name:     "unterminated string",
+			query:    `query Q { search(text: "oops`,
+			wantType: "query",
+			wantName: "Q",
+		},
+		{
+			name:  "only a fragment",
+			query: `fragment F on User { id }`,
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, name := OperationInfo(tt.query, tt.operationName)
+			if typ != tt.wantType || name != tt.wantName {
+				t.Errorf("OperationInfo() got = %q %q, want %q %q", typ, name, tt.wantType, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name:  "punctuation other than braces and parentheses is skipped",
+			input: `query Q($id: ID!, $n: Int = 10) { user(id: $id) { ...F } }`,
+			want:  []string{"query", "Q", "(", "id", "ID", "n", "Int", ")", "{", "user", "(", "id", "id", ")", "{", "F", "}", "}"},
+		},
+		{
+			name:  "names with digits and underscores",
+			input: `__typename field_2`,
+			want:  []string{"__typename", "field_2"},
+		},
+		{
+			name:  "directives",
+			input: `a @include(if: true)`,
+			want:  []string{"a", "@", "include", "(", "if", "true", ")"},
+		},
+		{
+			name:  "comments run to the end of the line",
+			input: "a # b { c\nd",
+			want:  []string{"a", "d"},
+		},
+		{
+			name:  "strings are skipped",
+			input: `a("b { c \" d") e`,
+			want:  []string{"a", "(", ")", "e"},
+		},
+		{
+			name:  "block strings are skipped",
+			input: `a(""" b " { """) e`,
+			want:  []string{"a", "(", ")", "e"},
+		},
+		{
+			name:  "unterminated block string",
+			input: `a(""" b { c`,
+			want:  []string{"a", "("},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := slices.Collect(tokens(tt.input))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("tokens() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
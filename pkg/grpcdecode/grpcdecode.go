@@ -0,0 +1,124 @@
+// Package grpcdecode decodes the messages in the bodies of gRPC requests and responses to JSON, given
+// the protobuf descriptors of the services that they were sent to
+package grpcdecode
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Decoder decodes the messages in gRPC requests and responses to JSON, using the message types in
+// protobuf descriptor sets such as those produced by "protoc --include_imports --descriptor_set_out"
+type Decoder struct {
+	files *protoregistry.Files
+	types *dynamicpb.Types
+}
+
+// Load loads one or more files containing serialized FileDescriptorSet messages
+func Load(paths ...string) (*Decoder, error) {
+	var set descriptorpb.FileDescriptorSet
+	for _, path := range paths {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading proto descriptor set: %w", err)
+		}
+
+		var part descriptorpb.FileDescriptorSet
+		err = proto.Unmarshal(buf, &part)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing proto descriptor set from %v: %w", path, err)
+		}
+		set.File = append(set.File, part.File...)
+	}
+
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("error loading proto descriptors (were they generated with --include_imports?): %w", err)
+	}
+
+	return &Decoder{files: files, types: dynamicpb.NewTypes(files)}, nil
+}
+
+// Decode decodes the length-prefixed messages in the body of a gRPC request or response to JSON. The
+// path is the URL path of the request, which has the form /package.Service/Method, and encoding is
+// the value of the grpc-encoding header.
+func (d *Decoder) Decode(path string, body []byte, encoding string, isRequest bool) ([]json.RawMessage, error) {
+	service, method, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok {
+		return nil, fmt.Errorf("gRPC path %q is not of the form /package.Service/Method", path)
+	}
+
+	desc, err := d.files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, fmt.Errorf("service %q not found in proto descriptors: %w", service, err)
+	}
+	serviceDesc, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a service in the proto descriptors", service)
+	}
+	methodDesc := serviceDesc.Methods().ByName(protoreflect.Name(method))
+	if methodDesc == nil {
+		return nil, fmt.Errorf("service %q has no method %q", service, method)
+	}
+
+	msgDesc := methodDesc.Output()
+	if isRequest {
+		msgDesc = methodDesc.Input()
+	}
+
+	// each message is a compression flag, a 4-byte big-endian length, then the message itself
+	var messages []json.RawMessage
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return messages, fmt.Errorf("truncated gRPC message header")
+		}
+		compressed := body[0] == 1
+		size := binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(size) {
+			return messages, fmt.Errorf("truncated gRPC message (expected %d bytes but only %d remain)", size, len(body)-5)
+		}
+		payload := body[5 : 5+size]
+		body = body[5+size:]
+
+		if compressed {
+			if encoding != "gzip" {
+				return messages, fmt.Errorf("unsupported gRPC message encoding %q", encoding)
+			}
+			r, err := gzip.NewReader(bytes.NewReader(payload))
+			if err != nil {
+				return messages, fmt.Errorf("error gzip-decoding gRPC message: %w", err)
+			}
+			payload, err = io.ReadAll(r)
+			if err != nil {
+				return messages, fmt.Errorf("error gzip-decoding gRPC message: %w", err)
+			}
+		}
+
+		msg := dynamicpb.NewMessage(msgDesc)
+		err := proto.UnmarshalOptions{Resolver: d.types}.Unmarshal(payload, msg)
+		if err != nil {
+			return messages, fmt.Errorf("error decoding %v: %w", msgDesc.FullName(), err)
+		}
+
+		js, err := protojson.MarshalOptions{Resolver: d.types}.Marshal(msg)
+		if err != nil {
+			return messages, fmt.Errorf("error converting %v to json: %w", msgDesc.FullName(), err)
+		}
+		messages = append(messages, js)
+	}
+	return messages, nil
+}
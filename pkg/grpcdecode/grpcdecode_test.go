@@ -0,0 +1,223 @@
+package grpcdecode
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// loadTestDecoder writes the descriptors for
+//
+//	package test;
+//	message Ping { string text = 1; }
+//	message Pong { int32 count = 1; }
+//	service Pinger { rpc Ping(Ping) returns (Pong); }
+//
+// to a file and loads them
+func loadTestDecoder(t *testing.T) *Decoder {
+	field := func(name string, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(1),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+	}
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("Ping"), Field: []*descriptorpb.FieldDescriptorProto{field("text", descriptorpb.FieldDescriptorProto_TYPE_STRING)}},
+			{Name: proto.String("Pong"), Field: []*descriptorpb.FieldDescriptorProto{field("count", descriptorpb.FieldDescriptorProto_TYPE_INT32)}},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Pinger"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Ping"),
+				InputType:  proto.String(".test.Ping"),
+				OutputType: proto.String(".test.Pong"),
+			}},
+		}},
+	}}}
+
+	buf, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.pb")
+	if err := os.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// frame prefixes a message with the compressed flag and its length
+func frame(compressed bool, msg []byte) []byte {
+	var flag byte
+	if compressed {
+		flag = 1
+	}
+	return append(binary.BigEndian.AppendUint32([]byte{flag}, uint32(len(msg))), msg...)
+}
+
+func gzipped(b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDecode(t *testing.T) {
+	// field 1 as a string "hi", and field 1 as the varint 7
+	ping := []byte{0x0a, 0x02, 'h', 'i'}
+	pong := []byte{0x08, 0x07}
+
+	tests := []struct {
+		name      string
+		path      string
+		body      []byte
+		encoding  string
+		isRequest bool
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name:      "request",
+			path:      "/test.Pinger/Ping",
+			body:      frame(false, ping),
+			isRequest: true,
+			want:      []string{`{"text":"hi"}`},
+		},
+		{
+			name: "response",
+			path: "/test.Pinger/Ping",
+			body: frame(false, pong),
+			want: []string{`{"count":7}`},
+		},
+		{
+			name:      "several messages",
+			path:      "/test.Pinger/Ping",
+			body:      concat(frame(false, ping), frame(false, []byte{}), frame(false, ping)),
+			isRequest: true,
+			want:      []string{`{"text":"hi"}`, `{}`, `{"text":"hi"}`},
+		},
+		{
+			name:      "empty body",
+			path:      "/test.Pinger/Ping",
+			isRequest: true,
+		},
+		{
+			name:      "compressed",
+			path:      "/test.Pinger/Ping",
+			body:      concat(frame(true, gzipped(ping)), frame(false, ping)),
+			encoding:  "gzip",
+			isRequest: true,
+			want:      []string{`{"text":"hi"}`, `{"text":"hi"}`},
+		},
+		{
+			name:      "compressed with unsupported encoding",
+			path:      "/test.Pinger/Ping",
+			body:      concat(frame(false, ping), frame(true, ping)),
+			encoding:  "snappy",
+			isRequest: true,
+			want:      []string{`{"text":"hi"}`},
+			wantErr:   true,
+		},
+		{
+			name:      "compressed but not gzip",
+			path:      "/test.Pinger/Ping",
+			body:      frame(true, ping),
+			encoding:  "gzip",
+			isRequest: true,
+			wantErr:   true,
+		},
+		{
+			name:      "truncated header",
+			path:      "/test.Pinger/Ping",
+			body:      concat(frame(false, ping), []byte{0, 0, 0}),
+			isRequest: true,
+			want:      []string{`{"text":"hi"}`},
+			wantErr:   true,
+		},
+		{
+			name:      "truncated message",
+			path:      "/test.Pinger/Ping",
+			body:      frame(false, ping)[:7],
+			isRequest: true,
+			wantErr:   true,
+		},
+		{
+			name:      "length beyond body",
+			path:      "/test.Pinger/Ping",
+			body:      []byte{0, 0xff, 0xff, 0xff, 0xff, 0x0a},
+			isRequest: true,
+			wantErr:   true,
+		},
+		{
+			name:      "not a message",
+			path:      "/test.Pinger/Ping",
+			body:      frame(false, []byte{0x0a, 0x05, 'h'}),
+			isRequest: true,
+			wantErr:   true,
+		},
+		{
+			name:    "unknown service",
+			path:    "/test.Other/Ping",
+			body:    frame(false, pong),
+			wantErr: true,
+		},
+		{
+			name:    "unknown method",
+			path:    "/test.Pinger/Pong",
+			body:    frame(false, pong),
+			wantErr: true,
+		},
+		{
+			name:    "malformed path",
+			path:    "/test.Pinger",
+			body:    frame(false, pong),
+			wantErr: true,
+		},
+	}
+
+	d := loadTestDecoder(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := d.Decode(tt.path, tt.body, tt.encoding, tt.isRequest)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(messages) != len(tt.want) {
+				t.Fatalf("Decode() got %d messages, want %d", len(messages), len(tt.want))
+			}
+			for i, msg := range messages {
+				// protojson randomly adds spaces to its output, so compare compacted JSON
+				var got bytes.Buffer
+				if err := json.Compact(&got, msg); err != nil {
+					t.Fatal(err)
+				}
+				if got.String() != tt.want[i] {
+					t.Errorf("Decode() message %d got = %s, want %s", i, got.String(), tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -21,8 +21,8 @@ func NewTimingTrace() (*TimingTrace, *httptrace.ClientTrace) {
 		Got1xxResponse:       nil,
 		DNSStart:             timings.DNSStart,
 		DNSDone:              timings.DNSDone,
-		ConnectStart:         nil,
-		ConnectDone:          nil,
+		ConnectStart:         timings.ConnectStart,
+		ConnectDone:          timings.ConnectDone,
 		TLSHandshakeStart:    timings.TLSHandshakeStart,
 		TLSHandshakeDone:     timings.TLSHandshakeDone,
 		WroteHeaderField:     nil,
@@ -38,9 +38,13 @@ type TimingTrace struct {
 	startAt           time.Time
 	connStart         time.Time
 	connObtained      time.Time
+	connReused        bool
+	remoteAddr        string
 	firstResponseByte time.Time
 	dnsStart          time.Time
 	dnsEnd            time.Time
+	connectStart      time.Time
+	connectEnd        time.Time
 	tlsHandshakeStart time.Time
 	tlsHandshakeEnd   time.Time
 	writeRequest      time.Time
@@ -53,6 +57,10 @@ func (ct *TimingTrace) GetConn(hostPort string) {
 
 func (ct *TimingTrace) GotConn(info httptrace.GotConnInfo) {
 	ct.connObtained = time.Now()
+	ct.connReused = info.Reused
+	if info.Conn != nil {
+		ct.remoteAddr = info.Conn.RemoteAddr().String()
+	}
 }
 
 func (ct *TimingTrace) GotFirstResponseByte() {
@@ -67,6 +75,20 @@ func (ct *TimingTrace) DNSDone(info httptrace.DNSDoneInfo) {
 	ct.dnsEnd = time.Now()
 }
 
+// ConnectStart may be called several times when the dialer races multiple addresses, in which
+// case we keep the earliest
+func (ct *TimingTrace) ConnectStart(network, addr string) {
+	if ct.connectStart.IsZero() {
+		ct.connectStart = time.Now()
+	}
+}
+
+// ConnectDone may be called several times when the dialer races multiple addresses, in which
+// case we keep the latest
+func (ct *TimingTrace) ConnectDone(network, addr string, err error) {
+	ct.connectEnd = time.Now()
+}
+
 func (ct *TimingTrace) TLSHandshakeStart() {
 	ct.tlsHandshakeStart = time.Now()
 }
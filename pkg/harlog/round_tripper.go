@@ -2,10 +2,15 @@ package harlog
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptrace"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -19,6 +24,28 @@ type Transport struct {
 	// unusual (not network oriented) error occurred, handle error by this function.
 	// if nil, emit error log by log package, and ignore it.
 	UnusualError func(err error) error
+	// called after each entry is added to the log. if nil, nothing is called.
+	EntryAdded func(entry *Entry)
+	// called after each round trip with the request and response bodies, so that the caller can add
+	// custom information to the entry. if nil, nothing is called.
+	Annotate func(entry *Entry, req *http.Request, reqBody []byte, resp *http.Response, respBody []byte)
+	// called after each round trip with the same arguments as Annotate, except that resp is nil if the
+	// round trip failed. the entry is left out of the log if it returns false. if nil, every entry is kept.
+	Filter func(entry *Entry, req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) bool
+	// names of headers whose values are replaced with Redacted in the log, such as "Authorization".
+	// the request and response themselves are not changed.
+	RedactHeaders []string
+	// called with the text of each request and response body, form parameter, and websocket message
+	// that is logged, returning the text to log in its place. bodies that are logged as base64 are
+	// not passed to it. if nil, text is logged as is.
+	Scrub func(text string) string
+	// maximum number of bytes of each request and response body to keep in the log. bodies are
+	// streamed through regardless of their size. if zero, bodies are kept in full.
+	MaxBodySize int64
+	// if not empty, bodies are left out of the log and instead referred to by their SHA-256 and the
+	// path of a file in this directory named by it. the transport does not write these files; the
+	// caller is expected to save each body there.
+	BodyDir string
 
 	har   *HARContainer
 	mutex sync.Mutex
@@ -35,7 +62,11 @@ func (h *Transport) init() {
 		return
 	}
 
-	h.har = &HARContainer{
+	h.har = newHARContainer()
+}
+
+func newHARContainer() *HARContainer {
+	return &HARContainer{
 		Log: &Log{
 			Version: "1.2",
 			Creator: &Creator{
@@ -52,8 +83,38 @@ func (h *Transport) HAR() *HARContainer {
 	return h.har
 }
 
+// Snapshot returns a copy of the HAR format log data collected so far, which is safe to use while more
+// entries are added.
+func (h *Transport) Snapshot() *HARContainer {
+	h.init()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	log := *h.har.Log
+	log.Entries = append([]*Entry(nil), log.Entries...)
+	log.DNS = append([]*DNSQuery(nil), log.DNS...)
+	return &HARContainer{Log: &log}
+}
+
+// Rotate returns HAR format log data collected so far, and starts a new empty log.
+func (h *Transport) Rotate() *HARContainer {
+	h.init()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	har := h.har
+	h.har = newHARContainer()
+	return har
+}
+
 // RoundTrip executes a single HTTP transaction, returning
 // a Response for the provided Request.
+//
+// Request and response bodies are recorded as they are read rather than up front, so that streaming
+// responses reach the caller as they arrive. The entry is added to the log when the response body
+// has been read to the end or closed.
 func (h *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 	h.init()
 
@@ -63,24 +124,8 @@ func (h *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 	}
 
 	entry := &Entry{}
-	defer func() {
-		h.mutex.Lock()
-		h.har.Log.Entries = append(h.har.Log.Entries, entry)
-		h.mutex.Unlock()
-	}()
-
-	err := h.preRoundTrip(r, entry)
-	if err != nil {
-		if h.UnusualError != nil {
-			err = h.UnusualError(err)
-		} else {
-			log.Println(err)
-			err = nil
-		}
-		if err != nil {
-			return nil, err
-		}
-	}
+	reqBody := h.preRoundTrip(r)
+	var respBuf *limitedBuffer // set below if there is a response body
 
 	// create a tracer to record timestamps of certain events internal to the HTTP stack
 	timings, tracer := NewTimingTrace()
@@ -89,62 +134,232 @@ func (h *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 	// do the HTTP roundtrip
 	resp, realErr := baseRoundTripper.RoundTrip(r)
 
-	err = nil
-	if resp != nil {
-		err = h.postRoundTrip(resp, entry)
-	}
+	// finish fills in the remaining parts of the entry and adds it to the log
+	finish := func(respBody []byte) {
+		timings.endAt = time.Now()
+		UpdateEntryWithTimings(entry, timings)
 
-	timings.endAt = time.Now()
-	UpdateEntryWithTimings(entry, timings)
+		err := UpdateEntryWithRequest(entry, r, reqBody.Bytes())
+		if err != nil {
+			if h.UnusualError != nil {
+				h.UnusualError(err)
+			} else {
+				log.Println(err)
+			}
+		}
+		if reqBody.Truncated() {
+			entry.Request.BodySize = int(reqBody.Size())
+			if entry.Request.PostData != nil && h.BodyDir == "" {
+				entry.Request.PostData.Comment = fmt.Sprintf("body truncated to %d of %d bytes", len(reqBody.Bytes()), reqBody.Size())
+			}
+		}
+		if len(r.Trailer) > 0 {
+			entry.Request.Trailers = toHARNVP(r.Trailer)
+		}
 
-	if err != nil {
-		if h.UnusualError != nil {
-			err = h.UnusualError(err)
-		} else {
-			log.Println(err)
-			err = nil
+		if h.Annotate != nil && resp != nil {
+			h.Annotate(entry, r, reqBody.Bytes(), resp, respBody)
 		}
-		if err != nil {
-			return nil, err
+		RedactEntry(entry, h.RedactHeaders)
+		if h.Scrub != nil {
+			scrubEntry(entry, h.Scrub)
+		}
+		if h.BodyDir != "" {
+			h.referToBodies(entry, reqBody, respBuf)
+		}
+
+		if h.Filter != nil && !h.Filter(entry, r, reqBody.Bytes(), resp, respBody) {
+			return
 		}
+
+		entry.Cache = &Cache{}
+		h.addEntry(entry)
 	}
 
-	entry.Cache = &Cache{}
+	switch {
+	case resp == nil:
+		finish(nil)
+	case resp.StatusCode == http.StatusSwitchingProtocols:
+		// after a protocol switch the body is a bidirectional connection that must not be read here
+		if conn, ok := resp.Body.(io.ReadWriteCloser); ok {
+			resp.Body = h.newWebSocketRecorder(conn, entry)
+		}
+		UpdateEntryWithResponse(entry, resp, nil)
+		finish(nil)
+	default:
+		recorder := &bodyRecorder{ReadCloser: resp.Body, buf: limitedBuffer{limit: h.MaxBodySize, hash: h.bodyHash()}}
+		respBuf = &recorder.buf
+		recorder.done = func(respBody []byte) {
+			UpdateEntryWithResponse(entry, resp, respBody)
+			if len(resp.Trailer) > 0 {
+				// trailers are only available once the body has been read to the end
+				entry.Response.Trailers = toHARNVP(resp.Trailer)
+			}
+			if recorder.buf.Truncated() && h.BodyDir == "" {
+				entry.Response.Content.Size = recorder.buf.Size()
+				entry.Response.Content.Comment = fmt.Sprintf("body truncated to %d of %d bytes", len(respBody), recorder.buf.Size())
+			}
+			finish(respBody)
+		}
+		resp.Body = recorder
+	}
 
 	return resp, realErr
 }
 
-func (h *Transport) preRoundTrip(r *http.Request, entry *Entry) error {
-	var err error
-	reqBody := r.Body
-	if r.GetBody != nil {
-		reqBody, err = r.GetBody()
-		if err != nil {
-			return err
-		}
+// addEntry appends an entry to the log and notifies EntryAdded
+func (h *Transport) addEntry(entry *Entry) {
+	h.mutex.Lock()
+	h.har.Log.Entries = append(h.har.Log.Entries, entry)
+	h.mutex.Unlock()
+
+	if h.EntryAdded != nil {
+		h.EntryAdded(entry)
+	}
+}
+
+// AddDNSQuery adds a DNS question and its answer to the log.
+func (h *Transport) AddDNSQuery(q *DNSQuery) {
+	h.init()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.har.Log.DNS = append(h.har.Log.DNS, q)
+}
+
+// bodyHash returns the hash with which bodies are identified if BodyDir is set, or otherwise nil
+func (h *Transport) bodyHash() hash.Hash {
+	if h.BodyDir == "" {
+		return nil
 	}
+	return sha256.New()
+}
 
-	var body []byte
-	if reqBody != nil {
-		body, err = io.ReadAll(reqBody)
-		if err != nil {
-			return err
+// referToBodies replaces the text of the request and response bodies in an entry with references
+// to files in BodyDir. The response body is nil if there was none.
+func (h *Transport) referToBodies(entry *Entry, reqBody, respBody *limitedBuffer) {
+	if entry.Request != nil && entry.Request.PostData != nil && reqBody.Size() > 0 {
+		p := entry.Request.PostData
+		p.Text = ""
+		p.SHA256 = reqBody.Sum()
+		p.File = filepath.Join(h.BodyDir, p.SHA256)
+	}
+	if entry.Response == nil || respBody == nil || respBody.Size() == 0 {
+		return
+	}
+	if c := entry.Response.Content; c != nil {
+		c.Text = ""
+		c.Encoding = ""
+		c.SHA256 = respBody.Sum()
+		c.File = filepath.Join(h.BodyDir, c.SHA256)
+	}
+}
+
+// preRoundTrip arranges for the request body to be recorded as it is sent
+func (h *Transport) preRoundTrip(r *http.Request) *limitedBuffer {
+	recorder := &bodyRecorder{buf: limitedBuffer{limit: h.MaxBodySize, hash: h.bodyHash()}}
+	if r.Body != nil {
+		recorder.ReadCloser = r.Body
+		r.Body = recorder
+	} else {
+		// record a nil body so that the HAR entry has no post data
+		recorder.buf.nilBody = true
+	}
+	return &recorder.buf
+}
+
+// bodyRecorder keeps a copy of a body as it is read, and calls done (if not nil) exactly once with
+// the bytes that were kept, either when the end of the body is reached or when it is closed.
+type bodyRecorder struct {
+	io.ReadCloser
+	buf  limitedBuffer
+	done func(body []byte)
+	once sync.Once
+}
+
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *bodyRecorder) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+func (b *bodyRecorder) finish() {
+	b.once.Do(func() {
+		if b.done != nil {
+			b.done(b.buf.Bytes())
 		}
+	})
+}
+
+// limitedBuffer keeps the first limit bytes written to it and counts the rest. It is safe for
+// concurrent use, since a request body may still be being sent when the response is complete.
+type limitedBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	limit   int64 // zero means no limit
+	size    int64
+	nilBody bool
+	hash    hash.Hash // hashes every byte written, including those not kept, if not nil
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.size += int64(len(p))
+	if b.hash != nil {
+		b.hash.Write(p)
 	}
+	keep := p
+	if b.limit > 0 {
+		if room := b.limit - int64(b.buf.Len()); int64(len(keep)) > room {
+			keep = keep[:max(room, 0)]
+		}
+	}
+	b.buf.Write(keep)
+	return len(p), nil
+}
 
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
+// Bytes returns the bytes that were kept, or nil if there was no body at all
+func (b *limitedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	return UpdateEntryWithRequest(entry, r, body)
+	if b.nilBody {
+		return nil
+	}
+	return append([]byte{}, b.buf.Bytes()...)
+}
+
+// Size returns the total number of bytes written, including those that were not kept
+func (b *limitedBuffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
 }
 
-func (h *Transport) postRoundTrip(resp *http.Response, entry *Entry) error {
-	respBodyBytes, err := io.ReadAll(resp.Body)
-	defer resp.Body.Close()
-	if err != nil {
-		return err
+// Sum returns the hex-encoded hash of the bytes written, or the empty string if they were not hashed
+func (b *limitedBuffer) Sum() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.hash == nil {
+		return ""
 	}
-	resp.Body = io.NopCloser(bytes.NewBuffer(respBodyBytes))
+	return hex.EncodeToString(b.hash.Sum(nil))
+}
 
-	UpdateEntryWithResponse(entry, resp, respBodyBytes)
-	return nil
+// Truncated returns true if some of the bytes written were not kept
+func (b *limitedBuffer) Truncated() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size > int64(b.buf.Len())
 }
@@ -0,0 +1,257 @@
+package harlog
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransport_MaxBodySize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.Copy(w, r.Body)
+	}))
+	defer srv.Close()
+
+	added := make(chan *Entry, 1)
+	tr := &Transport{MaxBodySize: 4, EntryAdded: func(entry *Entry) { added <- entry }}
+
+	req, err := http.NewRequest("POST", srv.URL, strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the whole body must reach the caller even though only a prefix is logged
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if string(body) != "hello world" {
+		t.Errorf("body got = %q, want %q", body, "hello world")
+	}
+
+	entry := <-added
+	if entry.Request.PostData.Text != "hell" {
+		t.Errorf("request text got = %q, want %q", entry.Request.PostData.Text, "hell")
+	}
+	if entry.Request.BodySize != 11 {
+		t.Errorf("request body size got = %d, want 11", entry.Request.BodySize)
+	}
+	if entry.Response.Content.Text != "hell" {
+		t.Errorf("response text got = %q, want %q", entry.Response.Content.Text, "hell")
+	}
+	if entry.Response.Content.Size != 11 {
+		t.Errorf("response content size got = %d, want 11", entry.Response.Content.Size)
+	}
+
+	// both bodies are marked as truncated
+	want := "body truncated to 4 of 11 bytes"
+	if entry.Request.PostData.Comment != want {
+		t.Errorf("request comment got = %q, want %q", entry.Request.PostData.Comment, want)
+	}
+	if entry.Response.Content.Comment != want {
+		t.Errorf("response comment got = %q, want %q", entry.Response.Content.Comment, want)
+	}
+}
+
+func TestTransport_Filter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+
+	tr := &Transport{Filter: func(entry *Entry, req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) bool {
+		return resp.StatusCode >= 400 && string(respBody) == "hello"
+	}}
+
+	for _, path := range []string{"/found", "/missing"} {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// only the entry that the filter accepted is logged
+	entries := tr.HAR().Log.Entries
+	if len(entries) != 1 {
+		t.Fatalf("entries got = %d, want 1", len(entries))
+	}
+	if entries[0].Request.URL != srv.URL+"/missing" {
+		t.Errorf("entry URL got = %v, want %v", entries[0].Request.URL, srv.URL+"/missing")
+	}
+}
+
+func TestTransport_RedactHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		w.Header().Set("X-Request-Id", "abc")
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+
+	tr := &Transport{RedactHeaders: []string{"authorization", "Cookie", "Set-Cookie"}}
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Accept", "text/plain")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// the request and response seen by the caller are unchanged
+	if got := req.Header.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("request header got = %v, want %v", got, "Bearer token")
+	}
+	if got := resp.Header.Get("Set-Cookie"); got != "session=secret" {
+		t.Errorf("response header got = %v, want %v", got, "session=secret")
+	}
+
+	entry := tr.HAR().Log.Entries[0]
+	want := map[string]string{
+		"Authorization": Redacted,
+		"Cookie":        Redacted,
+		"Accept":        "text/plain",
+		"Set-Cookie":    Redacted,
+		"X-Request-Id":  "abc",
+	}
+	for _, nvp := range append(entry.Request.Headers, entry.Response.Headers...) {
+		if w, ok := want[nvp.Name]; ok && nvp.Value != w {
+			t.Errorf("header %v got = %v, want %v", nvp.Name, nvp.Value, w)
+		}
+	}
+	for _, cookie := range append(entry.Request.Cookies, entry.Response.Cookies...) {
+		if cookie.Value != Redacted {
+			t.Errorf("cookie %v got = %v, want %v", cookie.Name, cookie.Value, Redacted)
+		}
+	}
+	if len(entry.Request.Cookies) != 1 || len(entry.Response.Cookies) != 1 {
+		t.Errorf("cookies got = %d and %d, want 1 and 1", len(entry.Request.Cookies), len(entry.Response.Cookies))
+	}
+}
+
+func TestTransport_Scrub(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "your password is hunter2")
+	}))
+	defer srv.Close()
+
+	tr := &Transport{Scrub: func(text string) string {
+		return strings.ReplaceAll(text, "hunter2", "*******")
+	}}
+
+	req, err := http.NewRequest("POST", srv.URL, strings.NewReader("password=hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// the response seen by the caller is unchanged
+	if string(body) != "your password is hunter2" {
+		t.Errorf("response body got = %s, want %s", body, "your password is hunter2")
+	}
+
+	entry := tr.HAR().Log.Entries[0]
+	if got := entry.Request.PostData.Text; got != "password=*******" {
+		t.Errorf("request text got = %v, want %v", got, "password=*******")
+	}
+	if got := entry.Request.PostData.Params[0].Value; got != "*******" {
+		t.Errorf("request param got = %v, want %v", got, "*******")
+	}
+	if got := entry.Response.Content.Text; got != "your password is *******" {
+		t.Errorf("response text got = %v, want %v", got, "your password is *******")
+	}
+}
+
+func TestTransport_BodyDir(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer srv.Close()
+
+	tr := &Transport{BodyDir: "/bodies", MaxBodySize: 4}
+
+	req, err := http.NewRequest("POST", srv.URL, strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// the whole body is hashed even though only a prefix is kept in memory
+	const sum = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" // sha256 of "hello world"
+	entry := tr.HAR().Log.Entries[0]
+	if p := entry.Request.PostData; p.Text != "" || p.SHA256 != sum || p.File != "/bodies/"+sum || p.Comment != "" {
+		t.Errorf("request post data got = %+v, want a reference to %v", p, sum)
+	}
+	if c := entry.Response.Content; c.Text != "" || c.SHA256 != sum || c.File != "/bodies/"+sum || c.Comment != "" {
+		t.Errorf("response content got = %+v, want a reference to %v", c, sum)
+	}
+}
+
+func TestTransport_Snapshot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	added := make(chan *Entry, 2)
+	tr := &Transport{EntryAdded: func(entry *Entry) { added <- entry }}
+	get := func() {
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		<-added
+	}
+
+	get()
+	snapshot := tr.Snapshot()
+	get()
+
+	// entries added after the snapshot was taken are not in it
+	if len(snapshot.Log.Entries) != 1 {
+		t.Errorf("snapshot entries got = %d, want 1", len(snapshot.Log.Entries))
+	}
+	if len(tr.HAR().Log.Entries) != 2 {
+		t.Errorf("log entries got = %d, want 2", len(tr.HAR().Log.Entries))
+	}
+}
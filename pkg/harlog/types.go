@@ -47,6 +47,10 @@ func (t *Time) UnmarshalJSON(data []byte) error {
 // Duration provides milliseconds order JSON format.
 type Duration time.Duration
 
+// NotApplicable is the value used in timings for phases that do not apply to a request. It is
+// serialized as -1, as required by the HAR spec.
+const NotApplicable = Duration(-time.Millisecond)
+
 // MarshalJSON to milliseconds order number format from time.Duration.
 func (d Duration) MarshalJSON() ([]byte, error) {
 	v := float64(d) / float64(time.Millisecond)
@@ -91,6 +95,26 @@ type Log struct {
 	Entries []*Entry `json:"entries"`
 	// Optional. A comment provided by the user or the application.
 	Comment string `json:"comment,omitempty"`
+	// Custom field containing the DNS queries answered while the log was collected.
+	DNS []*DNSQuery `json:"_dns,omitempty"`
+}
+
+// DNSQuery is a custom object that describes a DNS question and its answer.
+type DNSQuery struct {
+	// Date and time stamp of the question (ISO 8601 - YYYY-MM-DDThh:mm:ss.sTZD).
+	StartedDateTime Time `json:"startedDateTime"`
+	// Time taken to answer the question in milliseconds.
+	Time Duration `json:"time"`
+	// The name that was asked about, such as "example.com.".
+	Name string `json:"name"`
+	// The type of record that was asked for, such as "A".
+	Type string `json:"type"`
+	// The data of each record in the answer, such as an IP address for an A record.
+	Answers []string `json:"answers"`
+	// Why the question could not be answered, if it could not.
+	Error string `json:"error,omitempty"`
+	// Whether the name was blocked, in which case the answer was NXDOMAIN or an unroutable address.
+	Blocked bool `json:"blocked,omitempty"`
 }
 
 // Creator is ...
@@ -164,6 +188,62 @@ type Entry struct {
 	Connection string `json:"connection,omitempty"`
 	// A comment provided by the user or the application.
 	Comment string `json:"comment,omitempty"`
+	// Custom field containing the messages exchanged over a websocket connection, in the format used by chrome.
+	WebSocketMessages []*WebSocketMessage `json:"_webSocketMessages,omitempty"`
+	// Custom field containing the GraphQL operations found in the request.
+	GraphQL []*GraphQLOperation `json:"_graphql,omitempty"`
+}
+
+// GraphQLOperation is a custom object that describes a GraphQL operation sent in a request.
+type GraphQLOperation struct {
+	// Either "query", "mutation", or "subscription".
+	Type string `json:"type"`
+	// The name of the operation, or empty for anonymous operations.
+	Name string `json:"name,omitempty"`
+	// The variables sent with the operation.
+	Variables json.RawMessage `json:"variables,omitempty"`
+}
+
+// TLS is a custom object that describes the handshake of a TLS connection.
+type TLS struct {
+	// The negotiated protocol version, such as "TLS 1.3".
+	Version string `json:"version"`
+	// The negotiated cipher suite, such as "TLS_AES_128_GCM_SHA256".
+	CipherSuite string `json:"cipherSuite"`
+	// The application protocol negotiated with ALPN, such as "h2", if any.
+	ALPN string `json:"alpn,omitempty"`
+	// The server name sent by the client in the SNI extension, if any.
+	ServerName string `json:"serverName,omitempty"`
+	// The JA3 fingerprint (MD5 hash) of the ClientHello, if known.
+	JA3 string `json:"ja3,omitempty"`
+	// The JA4 fingerprint of the ClientHello, if known.
+	JA4 string `json:"ja4,omitempty"`
+	// The certificate presented by the other side of the connection, if any.
+	PeerCertificate *TLSCertificate `json:"peerCertificate,omitempty"`
+}
+
+// TLSCertificate is a custom object that describes an x509 certificate.
+type TLSCertificate struct {
+	// The distinguished name of the subject.
+	Subject string `json:"subject"`
+	// The distinguished name of the issuer.
+	Issuer string `json:"issuer"`
+	// The end of the validity period.
+	NotAfter Time `json:"notAfter"`
+	// The SHA-256 hash of the DER encoding of the certificate, in hex.
+	SHA256 string `json:"sha256"`
+}
+
+// WebSocketMessage is a custom object, in the format used by chrome, that represents a single websocket frame.
+type WebSocketMessage struct {
+	// Either "send" (from client to server) or "receive" (from server to client).
+	Type string `json:"type"`
+	// Time at which the frame was observed, in seconds since the unix epoch.
+	Time float64 `json:"time"`
+	// The websocket opcode, for example 1 for text and 2 for binary.
+	Opcode int `json:"opcode"`
+	// The payload of the frame; binary payloads are base64-encoded.
+	Data string `json:"data"`
 }
 
 // Request is ...
@@ -189,6 +269,16 @@ type Request struct {
 	BodySize int `json:"bodySize"`
 	// A comment provided by the user or the application.
 	Comment string `json:"comment,omitempty"`
+	// Custom field containing the trailers sent after the request body, if any.
+	Trailers []*NVP `json:"_trailers,omitempty"`
+	// Custom field describing the TLS connection on which the request was received, if any.
+	TLS *TLS `json:"_tls,omitempty"`
+	// Custom field containing the URL that the request was sent to, if httptap sent it somewhere other than the URL above.
+	EffectiveURL string `json:"_effectiveUrl,omitempty"`
+	// Custom field containing the headers that httptap added to the request or changed before sending it, if any.
+	InjectedHeaders []*NVP `json:"_injectedHeaders,omitempty"`
+	// Custom field set to "queued" or "rejected" when httptap held back the request or refused to send it to keep to a rate limit.
+	RateLimited string `json:"_rateLimited,omitempty"`
 }
 
 // Response is ...
@@ -214,6 +304,12 @@ type Response struct {
 	BodySize int64 `json:"bodySize"`
 	// A comment provided by the user or the application.
 	Comment string `json:"comment,omitempty"`
+	// Custom field containing the trailers sent after the response body, if any.
+	Trailers []*NVP `json:"_trailers,omitempty"`
+	// Custom field describing the TLS connection on which the response was received, if any.
+	TLS *TLS `json:"_tls,omitempty"`
+	// Custom field set when the response was made up by httptap rather than received from a server.
+	Mocked bool `json:"_mocked,omitempty"`
 }
 
 // Cookie is ...
@@ -255,6 +351,12 @@ type PostData struct {
 	Text string `json:"text"`
 	// A comment provided by the user or the application.
 	Comment string `json:"comment,omitempty"`
+	// Custom field containing the content encoding (e.g. "gzip") that was removed to produce the text.
+	ContentEncoding string `json:"_contentEncoding,omitempty"`
+	// Custom field containing the hex-encoded SHA-256 of the whole body, when it is stored in a file rather than in text.
+	SHA256 string `json:"_sha256,omitempty"`
+	// Custom field containing the path of the file in which the whole body is stored exactly as it was sent.
+	File string `json:"_file,omitempty"`
 }
 
 // Param is ...
@@ -287,6 +389,13 @@ type Content struct {
 	Encoding string `json:"encoding,omitempty"`
 	// A comment provided by the user or the application.
 	Comment string `json:"comment,omitempty"`
+	// Custom field containing the content encoding (e.g. "gzip") that was removed to produce the text.
+	ContentEncoding string `json:"_contentEncoding,omitempty"`
+	// Custom field containing the hex-encoded SHA-256 of the whole body, when it is stored in a file rather than in text.
+	SHA256 string `json:"_sha256,omitempty"`
+	// Custom field containing the path of the file in which the whole body is stored exactly as it was received,
+	// before any content encoding was removed.
+	File string `json:"_file,omitempty"`
 }
 
 // Cache is ...
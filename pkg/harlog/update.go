@@ -2,37 +2,80 @@ package harlog
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
-// UpdateEntryWithTimings populates a HAR entry with timings from an HTTP round trip
+// UpdateEntryWithTimings populates a HAR entry with timings from an HTTP round trip. Phases that did
+// not happen, such as DNS resolution when dialing an IP address or connecting when an idle connection
+// was re-used, are marked as not applicable.
 func UpdateEntryWithTimings(entry *Entry, trace *TimingTrace) {
 	entry.StartedDateTime = Time(trace.startAt)
 	entry.Time = Duration(trace.endAt.Sub(trace.startAt))
+	entry.ServerIPAddress = hostOnly(trace.remoteAddr)
 	entry.Timings = &Timings{
-		Blocked: Duration(trace.startAt.Sub(trace.connStart)),
-		DNS:     -1,
-		Connect: -1,
-		Send:    Duration(trace.writeRequest.Sub(trace.connObtained)),
-		Wait:    Duration(trace.firstResponseByte.Sub(trace.writeRequest)),
-		Receive: Duration(trace.endAt.Sub(trace.firstResponseByte)),
-		SSL:     -1,
+		Blocked: NotApplicable,
+		DNS:     NotApplicable,
+		Connect: NotApplicable,
+		Send:    phase(trace.connObtained, trace.writeRequest),
+		Wait:    phase(trace.writeRequest, trace.firstResponseByte),
+		Receive: phase(trace.firstResponseByte, trace.endAt),
+		SSL:     NotApplicable,
 	}
-	if !trace.dnsStart.IsZero() {
-		entry.Timings.DNS = Duration(trace.dnsEnd.Sub(trace.dnsStart))
+
+	// time spent waiting before any network activity started is time spent blocked in a queue
+	blockedUntil := firstNonZero(trace.dnsStart, trace.connectStart, trace.tlsHandshakeStart, trace.connObtained)
+	if !trace.connStart.IsZero() && !blockedUntil.IsZero() {
+		entry.Timings.Blocked = phase(trace.connStart, blockedUntil)
+	}
+	if !trace.dnsStart.IsZero() && !trace.dnsEnd.IsZero() {
+		entry.Timings.DNS = phase(trace.dnsStart, trace.dnsEnd)
+	}
+	if !trace.connReused && !trace.connectStart.IsZero() {
+		// per the HAR spec, the connect phase includes the TLS handshake
+		connectEnd := firstNonZero(trace.tlsHandshakeEnd, trace.connectEnd, trace.connObtained)
+		entry.Timings.Connect = phase(trace.connectStart, connectEnd)
 	}
-	if !trace.connStart.IsZero() {
-		entry.Timings.Connect = Duration(trace.connObtained.Sub(trace.connStart))
+	if !trace.connReused && !trace.tlsHandshakeStart.IsZero() && !trace.tlsHandshakeEnd.IsZero() {
+		entry.Timings.SSL = phase(trace.tlsHandshakeStart, trace.tlsHandshakeEnd)
+	}
+}
+
+// phase computes the duration between two events, or zero if either event did not happen
+func phase(start, end time.Time) Duration {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
 	}
-	if !trace.tlsHandshakeStart.IsZero() {
-		entry.Timings.SSL = Duration(trace.tlsHandshakeEnd.Sub(trace.tlsHandshakeStart))
+	return Duration(end.Sub(start))
+}
+
+// firstNonZero returns the first of its arguments that is not the zero time
+func firstNonZero(ts ...time.Time) time.Time {
+	for _, t := range ts {
+		if !t.IsZero() {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// hostOnly strips the port from an address of the form host:port
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
 	}
+	return host
 }
 
 // UpdateEntryWithRequest populates a HAR entry with values from an HTTP request. It treats the provided
@@ -108,6 +151,7 @@ func UpdateEntryWithRequest(entry *Entry, r *http.Request, body []byte) error {
 		PostData:    postData,
 		HeadersSize: -1, // TODO
 		BodySize:    bodySize,
+		TLS:         toHARTLS(r.TLS),
 	}
 
 	return nil
@@ -147,9 +191,34 @@ func UpdateEntryWithResponse(entry *Entry, resp *http.Response, body []byte) {
 		RedirectURL: resp.Header.Get("Location"),
 		HeadersSize: -1,
 		BodySize:    resp.ContentLength,
+		TLS:         toHARTLS(resp.TLS),
 	}
 }
 
+// toHARTLS describes a TLS connection, or returns nil for connections without TLS
+func toHARTLS(state *tls.ConnectionState) *TLS {
+	if state == nil {
+		return nil
+	}
+	t := TLS{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+		ServerName:  state.ServerName,
+	}
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		sum := sha256.Sum256(cert.Raw)
+		t.PeerCertificate = &TLSCertificate{
+			Subject:  cert.Subject.String(),
+			Issuer:   cert.Issuer.String(),
+			NotAfter: Time(cert.NotAfter),
+			SHA256:   hex.EncodeToString(sum[:]),
+		}
+	}
+	return &t
+}
+
 func toHARCookies(cookies []*http.Cookie) []*Cookie {
 	harCookies := make([]*Cookie, 0, len(cookies))
 
@@ -182,3 +251,71 @@ func toHARNVP(vs map[string][]string) []*NVP {
 
 	return nvps
 }
+
+// Redacted is the value that RedactEntry puts in place of header values.
+const Redacted = "[REDACTED]"
+
+// RedactEntry replaces the values of the named headers and trailers in a HAR entry with Redacted.
+// Header names are case-insensitive. Cookie values are also replaced when the Cookie header (for
+// the request) or the Set-Cookie header (for the response) is among the names.
+func RedactEntry(entry *Entry, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	redact := make(map[string]bool, len(names))
+	for _, name := range names {
+		redact[http.CanonicalHeaderKey(name)] = true
+	}
+
+	if r := entry.Request; r != nil {
+		redactNVP(r.Headers, redact)
+		redactNVP(r.Trailers, redact)
+		redactNVP(r.InjectedHeaders, redact)
+		if redact["Cookie"] {
+			redactCookies(r.Cookies)
+		}
+	}
+	if r := entry.Response; r != nil {
+		redactNVP(r.Headers, redact)
+		redactNVP(r.Trailers, redact)
+		if redact["Set-Cookie"] {
+			redactCookies(r.Cookies)
+		}
+	}
+}
+
+func redactNVP(nvps []*NVP, redact map[string]bool) {
+	for _, nvp := range nvps {
+		if redact[http.CanonicalHeaderKey(nvp.Name)] {
+			nvp.Value = Redacted
+		}
+	}
+}
+
+func redactCookies(cookies []*Cookie) {
+	for _, cookie := range cookies {
+		cookie.Value = Redacted
+	}
+}
+
+// scrubEntry replaces the text of the request and response bodies in a HAR entry with the result of
+// a function, leaving out bodies that are encoded as base64
+func scrubEntry(entry *Entry, scrub func(string) string) {
+	if entry.Request != nil && entry.Request.PostData != nil {
+		postData := entry.Request.PostData
+		if postData.Text != "" {
+			postData.Text = scrub(postData.Text)
+		}
+		for _, param := range postData.Params {
+			if param.Value != "" {
+				param.Value = scrub(param.Value)
+			}
+		}
+	}
+	if entry.Response != nil && entry.Response.Content != nil {
+		content := entry.Response.Content
+		if content.Text != "" && content.Encoding == "" {
+			content.Text = scrub(content.Text)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package harlog
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUpdateEntryWithTimings(t *testing.T) {
+	start := time.Date(2024, 12, 24, 18, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	tests := []struct {
+		name  string
+		trace TimingTrace
+		want  Timings
+	}{
+		{
+			name: "new connection with tls",
+			trace: TimingTrace{
+				startAt:           at(0),
+				connStart:         at(0),
+				connectStart:      at(2),
+				connectEnd:        at(10),
+				tlsHandshakeStart: at(10),
+				tlsHandshakeEnd:   at(30),
+				connObtained:      at(30),
+				writeRequest:      at(31),
+				firstResponseByte: at(50),
+				endAt:             at(55),
+			},
+			want: Timings{
+				Blocked: Duration(2 * time.Millisecond),
+				DNS:     NotApplicable,
+				Connect: Duration(28 * time.Millisecond),
+				SSL:     Duration(20 * time.Millisecond),
+				Send:    Duration(1 * time.Millisecond),
+				Wait:    Duration(19 * time.Millisecond),
+				Receive: Duration(5 * time.Millisecond),
+			},
+		},
+		{
+			name: "reused connection",
+			trace: TimingTrace{
+				startAt:           at(0),
+				connStart:         at(0),
+				connObtained:      at(1),
+				connReused:        true,
+				writeRequest:      at(2),
+				firstResponseByte: at(12),
+				endAt:             at(13),
+			},
+			want: Timings{
+				Blocked: Duration(1 * time.Millisecond),
+				DNS:     NotApplicable,
+				Connect: NotApplicable,
+				SSL:     NotApplicable,
+				Send:    Duration(1 * time.Millisecond),
+				Wait:    Duration(10 * time.Millisecond),
+				Receive: Duration(1 * time.Millisecond),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entry Entry
+			UpdateEntryWithTimings(&entry, &tt.trace)
+			if *entry.Timings != tt.want {
+				t.Errorf("UpdateEntryWithTimings() got = %+v, want %+v", *entry.Timings, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateEntryWithResponse_TLS(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     make(http.Header),
+		TLS: &tls.ConnectionState{
+			Version:            tls.VersionTLS13,
+			CipherSuite:        tls.TLS_AES_128_GCM_SHA256,
+			NegotiatedProtocol: "h2",
+			ServerName:         "example.com",
+		},
+	}
+
+	var entry Entry
+	UpdateEntryWithResponse(&entry, resp, nil)
+
+	want := TLS{
+		Version:     "TLS 1.3",
+		CipherSuite: "TLS_AES_128_GCM_SHA256",
+		ALPN:        "h2",
+		ServerName:  "example.com",
+	}
+	if entry.Response.TLS == nil || *entry.Response.TLS != want {
+		t.Errorf("got %+v, want %+v", entry.Response.TLS, want)
+	}
+
+	resp.TLS = nil
+	UpdateEntryWithResponse(&entry, resp, nil)
+	if entry.Response.TLS != nil {
+		t.Errorf("got %+v for a response without TLS, want nil", entry.Response.TLS)
+	}
+}
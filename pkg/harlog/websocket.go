@@ -0,0 +1,68 @@
+package harlog
+
+import (
+	"encoding/base64"
+	"io"
+	"time"
+	"unicode/utf8"
+
+	"github.com/monasticacademy/httptap/pkg/websocket"
+)
+
+// webSocketRecorder wraps the connection returned by a round trip that switched protocols, and
+// records the websocket frames sent and received over it in a HAR entry.
+type webSocketRecorder struct {
+	io.ReadWriteCloser
+	send    io.WriteCloser
+	receive io.WriteCloser
+}
+
+func (h *Transport) newWebSocketRecorder(conn io.ReadWriteCloser, entry *Entry) *webSocketRecorder {
+	record := func(typ string) func(*websocket.Frame) {
+		return func(frame *websocket.Frame) {
+			msg := &WebSocketMessage{
+				Type:   typ,
+				Time:   float64(frame.Time.UnixNano()) / float64(time.Second),
+				Opcode: int(frame.Opcode),
+				Data:   string(frame.Payload),
+			}
+			if frame.Opcode == websocket.OpBinary || frame.Compressed || !utf8.Valid(frame.Payload) {
+				msg.Data = base64.StdEncoding.EncodeToString(frame.Payload)
+			} else if h.Scrub != nil {
+				msg.Data = h.Scrub(msg.Data)
+			}
+
+			h.mutex.Lock()
+			entry.WebSocketMessages = append(entry.WebSocketMessages, msg)
+			h.mutex.Unlock()
+		}
+	}
+
+	return &webSocketRecorder{
+		ReadWriteCloser: conn,
+		send:            websocket.Tap(record("send")),
+		receive:         websocket.Tap(record("receive")),
+	}
+}
+
+// Read reads from the server and records the frames received
+func (r *webSocketRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadWriteCloser.Read(p)
+	if n > 0 {
+		r.receive.Write(p[:n])
+	}
+	return n, err
+}
+
+// Write records the frames sent and then writes them to the server
+func (r *webSocketRecorder) Write(p []byte) (int, error) {
+	r.send.Write(p)
+	return r.ReadWriteCloser.Write(p)
+}
+
+// Close stops recording and closes the underlying connection
+func (r *webSocketRecorder) Close() error {
+	r.send.Close()
+	r.receive.Close()
+	return r.ReadWriteCloser.Close()
+}
@@ -0,0 +1,220 @@
+package netstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	dumpPacketsToSubprocess   = false
+	dumpPacketsFromSubprocess = false
+	ttl                       = 10
+)
+
+// packetPool holds the buffers that packets are copied into when they are sent over a channel, so
+// that the homegrown stack does not allocate for every packet. Whoever receives a packet from a channel
+// owns it, and must return it to the pool with putPacket once it is done with it.
+var packetPool sync.Pool
+
+// the capacity of new buffers in packetPool, so that every buffer can be reused for any packet rather
+// than only for packets as small as the one it was first made for
+var packetSize atomic.Int64
+
+// SetMTU sets the size of the pooled packet buffers to the MTU of the TUN device
+func SetMTU(mtu int) {
+	packetSize.Store(int64(mtu))
+}
+
+// GetBuffer returns a buffer of n bytes from the pool of packet buffers, which the caller must hand
+// back with PutBuffer once it is done with it
+func GetBuffer(n int) []byte {
+	if pp, ok := packetPool.Get().(*[]byte); ok && cap(*pp) >= n {
+		return (*pp)[:n]
+	}
+	return make([]byte, n, max(n, int(packetSize.Load())))
+}
+
+// PutBuffer returns a buffer obtained from GetBuffer to the pool. The buffer must not be used afterwards.
+func PutBuffer(b []byte) {
+	putPacket(b)
+}
+
+// getPacket returns a buffer from the pool that holds a copy of b
+func getPacket(b []byte) []byte {
+	p := GetBuffer(len(b))
+	copy(p, b)
+	return p
+}
+
+// putPacket returns a buffer obtained from getPacket to the pool. The buffer must not be used afterwards.
+func putPacket(p []byte) {
+	packetPool.Put(&p)
+}
+
+// how long to wait for room in the queue of packets to the subprocess before giving up on a packet
+const enqueueTimeout = 5 * time.Second
+
+// enqueuePacket sends a pooled packet to the subprocess, waiting up to enqueueTimeout for room in the
+// queue so that a burst of packets slows down the sender rather than being dropped. If there is still
+// no room then the packet is returned to the pool and an error is returned.
+func enqueuePacket(queue chan<- []byte, packet []byte) error {
+	select {
+	case queue <- packet:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(enqueueTimeout)
+	defer timer.Stop()
+	select {
+	case queue <- packet:
+		return nil
+	case <-timer.C:
+		putPacket(packet)
+		return fmt.Errorf("queue to subprocess still full after %v, dropping %d bytes", enqueueTimeout, len(packet))
+	}
+}
+
+// ipHeader is the IPv4 or IPv6 header of a packet sent to the subprocess
+type ipHeader interface {
+	gopacket.NetworkLayer
+	gopacket.SerializableLayer
+}
+
+// newIPHeader creates the header for a packet sent to the subprocess, which is an IPv6 header if the
+// addresses are IPv6 addresses
+func newIPHeader(src, dst net.IP, protocol layers.IPProtocol) ipHeader {
+	if dst.To4() == nil {
+		return &layers.IPv6{
+			Version:    6,
+			HopLimit:   ttl,
+			NextHeader: protocol,
+			SrcIP:      src,
+			DstIP:      dst,
+		}
+	}
+	return &layers.IPv4{
+		Version:  4,
+		TTL:      ttl,
+		Protocol: protocol,
+		SrcIP:    src,
+		DstIP:    dst,
+	}
+}
+
+// ipAddrs returns copies of the source and destination addresses from an IPv4 or IPv6 header, which
+// may be kept after the buffer that the packet was read into is reused
+func ipAddrs(ip gopacket.NetworkLayer) (src, dst net.IP) {
+	switch ip := ip.(type) {
+	case *layers.IPv4:
+		return slices.Clone(ip.SrcIP), slices.Clone(ip.DstIP)
+	case *layers.IPv6:
+		return slices.Clone(ip.SrcIP), slices.Clone(ip.DstIP)
+	}
+	return nil, nil
+}
+
+// ipLayerType determines whether a raw packet is IPv4 or IPv6 from its version number
+func ipLayerType(packet []byte) gopacket.LayerType {
+	if len(packet) > 0 && packet[0]>>4 == 6 {
+		return layers.LayerTypeIPv6
+	}
+	return layers.LayerTypeIPv4
+}
+
+// WritePackets copies packets from a channel to a TUN device, returning each one to the pool once it
+// has been written. It returns when the context is cancelled or the device is closed.
+func WritePackets(ctx context.Context, dst io.Writer, src <-chan []byte) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case packet := <-src:
+			_, err := dst.Write(packet)
+			if errors.Is(err, os.ErrClosed) {
+				// the device is closed on the way out, and retransmissions may still be pending then
+				putPacket(packet)
+				return nil
+			}
+			if err != nil {
+				errorf("error writing %d bytes to tun: %v, dropping and continuing...", len(packet), err)
+			}
+
+			if dumpPacketsToSubprocess {
+				reply := gopacket.NewPacket(packet, ipLayerType(packet), gopacket.Default)
+				verbose(strings.Repeat("\n", 3))
+				verbose(strings.Repeat("=", 80))
+				verbose("To subprocess:")
+				verbose(reply.Dump())
+			} else {
+				verbosef("transmitting %v raw bytes to subprocess", len(packet))
+			}
+			putPacket(packet)
+		}
+	}
+}
+
+// ReadPackets parses packets from a TUN device and delivers them to the TCP and UDP stacks. It returns
+// when the device is closed.
+func ReadPackets(ctx context.Context, tun io.Reader, mtu int, tcpstack *TCPStack, udpstack *UDPStack) error {
+	// start reading raw bytes from the tunnel device and sending them to the appropriate stack
+	buf := make([]byte, mtu)
+	for {
+		// read a packet (TODO: implement non-blocking read on the file descriptor, check for context cancellation)
+		n, err := tun.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			errorf("error reading a packet from tun: %v, ignoring", err)
+			continue
+		}
+
+		dispatch(buf[:n], tcpstack, udpstack)
+	}
+}
+
+// dispatch parses one raw IP packet from the subprocess and delivers it to the TCP or UDP stack. Other
+// packets, and packets that cannot be parsed, are ignored. The packet is decoded without copying, since
+// the stacks copy whatever they keep.
+func dispatch(buf []byte, tcpstack *TCPStack, udpstack *UDPStack) {
+	packet := gopacket.NewPacket(buf, ipLayerType(buf), gopacket.NoCopy)
+	ip := packet.NetworkLayer()
+	if ip == nil {
+		return
+	}
+
+	tcp, isTCP := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	udp, isUDP := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !isTCP && !isUDP {
+		return
+	}
+
+	if dumpPacketsFromSubprocess {
+		verbose(strings.Repeat("\n", 3))
+		verbose(strings.Repeat("=", 80))
+		verbose("From subprocess:")
+		verbose(packet.Dump())
+	}
+
+	if isTCP {
+		verbosef("received from subprocess: %v", summarizeTCP(ip, tcp, tcp.Payload))
+		tcpstack.handlePacket(ip, tcp, tcp.Payload)
+	}
+	if isUDP {
+		verbosef("received from subprocess: %v", summarizeUDP(ip, udp, udp.Payload))
+		udpstack.handlePacket(ip, udp, udp.Payload)
+	}
+}
@@ -0,0 +1,110 @@
+package netstack
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestIPLayerType(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   string
+	}{
+		{"ipv4", []byte{0x45, 0}, "IPv4"},
+		{"ipv6", []byte{0x60, 0}, "IPv6"},
+		{"empty", nil, "IPv4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ipLayerType(tt.packet).String(); got != tt.want {
+				t.Errorf("ipLayerType() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// FuzzDispatch feeds arbitrary packets to a stack that already has a connection open, which must never
+// panic or hang however malformed the packets are
+func FuzzDispatch(f *testing.F) {
+	tcp := func(tcp layers.TCP, payload string) []byte {
+		tcp.SrcPort = layers.TCPPort(subprocess.Port)
+		tcp.DstPort = layers.TCPPort(world.Port)
+		return serializePacket(f, subprocess, world, &tcp, []byte(payload))
+	}
+
+	syn := tcp(layers.TCP{SYN: true, Seq: 1000, Window: 65535, Options: []layers.TCPOption{
+		mssOption(1460), windowScaleOption(7), sackPermittedOption(),
+	}}, "")
+	ack := tcp(layers.TCP{ACK: true, Seq: 1001, Ack: 1, Window: 65535}, "")
+
+	f.Add(syn)
+	f.Add(ack)
+	f.Add(tcp(layers.TCP{ACK: true, PSH: true, Seq: 1001, Ack: 1, Window: 65535}, "hello"))
+	f.Add(tcp(layers.TCP{ACK: true, Seq: 1006, Ack: 1, Window: 65535}, "world"))
+	f.Add(tcp(layers.TCP{ACK: true, FIN: true, Seq: 1001, Ack: 1, Window: 65535}, ""))
+	f.Add(tcp(layers.TCP{RST: true, Seq: 1001}, ""))
+	f.Add(tcp(layers.TCP{ACK: true, Seq: 1001, Ack: 1, Window: 65535, Options: []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindSACK, OptionData: make([]byte, 8)},
+	}}, ""))
+	f.Add(serializePacket(f, subprocess, world, &layers.UDP{
+		SrcPort: layers.UDPPort(subprocess.Port),
+		DstPort: 53,
+	}, []byte("query")))
+	f.Add(serializePacket(f, AddrPort{Addr: net.ParseIP("fd00::2"), Port: 40000}, AddrPort{Addr: net.ParseIP("2001:db8::1"), Port: 443}, &layers.TCP{
+		SrcPort: 40000,
+		DstPort: 443,
+		SYN:     true,
+		Seq:     1000,
+		Window:  65535,
+	}, nil))
+	f.Add([]byte{})
+	f.Add([]byte{0x45})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		s := newTestStack(1500)
+		s.mux.HandleTCP("*", func(conn net.Conn) {
+			io.Copy(io.Discard, conn)
+			conn.Close()
+		})
+		s.mux.HandleUDP("*", func(conn net.Conn) {
+			conn.Close()
+		})
+
+		// drain the packets to the subprocess so that the stack never waits for room in the queue
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case p := <-s.out:
+					putPacket(p)
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		dispatch(syn, s.tcp, s.udp)
+		dispatch(ack, s.tcp, s.udp)
+		dispatch(packet, s.tcp, s.udp)
+	})
+}
+
+func TestPacketSize(t *testing.T) {
+	SetMTU(1500)
+	defer SetMTU(0)
+
+	// a buffer made for a small packet can be reused for any packet up to the MTU
+	p := getPacket([]byte("small"))
+	if string(p) != "small" {
+		t.Errorf("getPacket() got = %q, want %q", p, "small")
+	}
+	if cap(p) < 1500 {
+		t.Errorf("cap(getPacket()) got = %d, want at least 1500", cap(p))
+	}
+	putPacket(p)
+}
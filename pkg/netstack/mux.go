@@ -1,4 +1,4 @@
-package main
+package netstack
 
 import (
 	"net"
@@ -17,34 +17,42 @@ func patternMatches(pattern string, addr net.Addr) bool {
 	return false
 }
 
-// mux dispatches network connections to listeners according to patterns
-type mux struct {
+// Mux dispatches network connections to listeners according to patterns
+type Mux struct {
 	mu          sync.Mutex
 	tcpHandlers []*tcpMuxEntry
 	udpHandlers []*udpMuxEntry
+
+	// AllowTCP, if set, decides whether connections to an address are dispatched at all. Connections
+	// that it does not allow are rejected with a RST before any handler sees them.
+	AllowTCP func(addr net.Addr) bool
+
+	// AllowUDP, if set, decides whether packets to an address are dispatched at all. Packets that it
+	// does not allow are dropped.
+	AllowUDP func(addr net.Addr) bool
 }
 
-// tcpHandlerFunc is a function that receives TCP connections
-type tcpHandlerFunc func(net.Conn)
+// TCPHandlerFunc is a function that receives TCP connections
+type TCPHandlerFunc func(net.Conn)
 
-// tcpHandlerFunc is a function that receives TCP connection requests and can choose
+// TCPRequestHandlerFunc is a function that receives TCP connection requests and can choose
 // whether to accept or reject them.
-type tcpRequestHandlerFunc func(TCPRequest)
+type TCPRequestHandlerFunc func(TCPRequest)
 
 // tcpMuxEntry is a pattern and corresponding handler, for use in the mux table for the tcp stack
 type tcpMuxEntry struct {
 	pattern string
-	handler tcpRequestHandlerFunc
+	handler TCPRequestHandlerFunc
 }
 
-// udpHandlerFunc is a function that receives UDP connections. We use net.Conn rather than
+// UDPHandlerFunc is a function that receives UDP connections. We use net.Conn rather than
 // net.PacketConn because the former matches io.Write and automatically sends the packet back
 // to the source from which it came.
-type udpHandlerFunc func(net.Conn)
+type UDPHandlerFunc func(net.Conn)
 
 // udpMuxEntry is a pattern and corresponding handler, for use in the mux table for the udp stack
 type udpMuxEntry struct {
-	handler udpHandlerFunc
+	handler UDPHandlerFunc
 	pattern string
 }
 
@@ -57,10 +65,7 @@ type udpMuxEntry struct {
 //   - "*"
 //
 // Later this will be like net.ListenTCP
-func (s *mux) ListenTCP(pattern string) net.Listener {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
+func (s *Mux) ListenTCP(pattern string) net.Listener {
 	listener := tcpListener{pattern: pattern, connections: make(chan net.Conn, 64)}
 	s.HandleTCPRequest(pattern, func(r TCPRequest) {
 		conn, err := r.Accept()
@@ -80,7 +85,7 @@ func (s *mux) ListenTCP(pattern string) net.Listener {
 //   - "example.com:80"
 //   - ":80"
 //   - "*"
-func (s *mux) HandleTCP(pattern string, handler tcpHandlerFunc) {
+func (s *Mux) HandleTCP(pattern string, handler TCPHandlerFunc) {
 	s.HandleTCPRequest(pattern, func(r TCPRequest) {
 		conn, err := r.Accept()
 		if err != nil {
@@ -100,7 +105,7 @@ func (s *mux) HandleTCP(pattern string, handler tcpHandlerFunc) {
 //   - "example.com:80"
 //   - ":80"
 //   - "*"
-func (s *mux) HandleTCPRequest(pattern string, handler tcpRequestHandlerFunc) {
+func (s *Mux) HandleTCPRequest(pattern string, handler TCPRequestHandlerFunc) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -117,16 +122,22 @@ func (s *mux) HandleTCPRequest(pattern string, handler tcpRequestHandlerFunc) {
 //   - "*"
 //
 // Later this will be like net.Listen
-func (s *mux) HandleUDP(pattern string, handler udpHandlerFunc) {
+func (s *Mux) HandleUDP(pattern string, handler UDPHandlerFunc) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.udpHandlers = append(s.udpHandlers, &udpMuxEntry{pattern: pattern, handler: handler})
 }
 
-// notifyTCP is called when a new stream is created. It finds the first listener
+// NotifyTCP is called when a new stream is created. It finds the first listener
 // that will accept the given stream. It never blocks.
-func (s *mux) notifyTCP(req TCPRequest) {
+func (s *Mux) NotifyTCP(req TCPRequest) {
+	if s.AllowTCP != nil && !s.AllowTCP(req.LocalAddr()) {
+		verbosef("rejecting tcp to %v", req.LocalAddr())
+		req.Reject()
+		return
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -140,9 +151,15 @@ func (s *mux) notifyTCP(req TCPRequest) {
 	verbosef("nobody listening for tcp to %v, dropping", req.LocalAddr())
 }
 
-// notifyUDP is called when a new packet arrives. It finds the first handler
+// NotifyUDP is called when a new packet arrives. It finds the first handler
 // with a pattern that matches the packet and delivers the packet to it
-func (s *mux) notifyUDP(conn net.Conn) {
+func (s *Mux) NotifyUDP(conn net.Conn) {
+	if s.AllowUDP != nil && !s.AllowUDP(conn.LocalAddr()) {
+		verbosef("dropping udp to %v", conn.LocalAddr())
+		conn.Close()
+		return
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -172,7 +189,7 @@ type tcpListener struct {
 func (l *tcpListener) Accept() (net.Conn, error) {
 	stream := <-l.connections
 	if stream == nil {
-		// this means the channel is closed, which means the tcpStack was shut down
+		// this means the channel is closed, which means the TCPStack was shut down
 		return nil, net.ErrClosed
 	}
 	return stream, nil
@@ -0,0 +1,27 @@
+package netstack
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		addr    net.Addr
+		want    bool
+	}{
+		{"*", &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 80}, true},
+		{":80", &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 80}, true},
+		{":80", &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 8080}, false},
+		{":443", &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, true},
+		{":53", &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 5353}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.addr.String(), func(t *testing.T) {
+			if got := patternMatches(tt.pattern, tt.addr); got != tt.want {
+				t.Errorf("patternMatches() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
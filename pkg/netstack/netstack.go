@@ -0,0 +1,24 @@
+// Package netstack is the "homegrown" TCP/IP stack that is used with --stack=homegrown. It parses the
+// raw IP packets that the subprocess writes to a TUN device, terminates the TCP connections and UDP
+// flows in them, and hands those to the application through a Mux, to which the gvisor stack also
+// dispatches connections.
+package netstack
+
+// Verbosef and Errorf are called to log the details of packets as they are handled, and errors that
+// cannot be returned to a caller. Nothing is logged until they are set.
+var (
+	Verbosef = func(format string, args ...any) {}
+	Errorf   = func(format string, args ...any) {}
+)
+
+func verbose(msg string) {
+	Verbosef("%s", msg)
+}
+
+func verbosef(format string, args ...any) {
+	Verbosef(format, args...)
+}
+
+func errorf(format string, args ...any) {
+	Errorf(format, args...)
+}
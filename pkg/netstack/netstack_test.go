@@ -0,0 +1,138 @@
+package netstack
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	subprocess = AddrPort{Addr: net.IPv4(10, 1, 1, 100).To4(), Port: 40000}
+	world      = AddrPort{Addr: net.IPv4(93, 184, 216, 34).To4(), Port: 80}
+)
+
+// testStack is a TCP and UDP stack that packets are fed into directly, with the packets that it sends
+// to the subprocess collected from out
+type testStack struct {
+	mux *Mux
+	tcp *TCPStack
+	udp *UDPStack
+	out chan []byte
+}
+
+func newTestStack(mtu int) *testStack {
+	var mux Mux
+	out := make(chan []byte, 1000)
+	return &testStack{
+		mux: &mux,
+		tcp: NewTCPStack(&mux, out, mtu),
+		udp: NewUDPStack(&mux, out),
+		out: out,
+	}
+}
+
+// send serializes a packet as if from the subprocess and delivers it to the stack
+func (s *testStack) send(t *testing.T, src, dst AddrPort, transport gopacket.SerializableLayer, payload []byte) {
+	t.Helper()
+	dispatch(serializePacket(t, src, dst, transport, payload), s.tcp, s.udp)
+}
+
+// sendTCP sends a TCP segment from the subprocess to the world
+func (s *testStack) sendTCP(t *testing.T, tcp layers.TCP, payload []byte) {
+	t.Helper()
+	tcp.SrcPort = layers.TCPPort(subprocess.Port)
+	tcp.DstPort = layers.TCPPort(world.Port)
+	s.send(t, subprocess, world, &tcp, payload)
+}
+
+// receiveTCP waits for the next packet sent to the subprocess and decodes it as a TCP segment
+func (s *testStack) receiveTCP(t *testing.T) (*layers.TCP, []byte) {
+	t.Helper()
+	select {
+	case p := <-s.out:
+		defer putPacket(p)
+		packet := gopacket.NewPacket(p, ipLayerType(p), gopacket.Default)
+		tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok {
+			t.Fatalf("expected a TCP packet but got:\n%v", packet.Dump())
+		}
+		return tcp, append([]byte(nil), tcp.Payload...)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a packet to the subprocess")
+		return nil, nil
+	}
+}
+
+// expectNothing checks that no packet is sent to the subprocess for a little while
+func (s *testStack) expectNothing(t *testing.T) {
+	t.Helper()
+	select {
+	case p := <-s.out:
+		t.Fatalf("expected no packet but got:\n%v", gopacket.NewPacket(p, ipLayerType(p), gopacket.Default).Dump())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// serializePacket builds a raw IPv4 or IPv6 packet containing a TCP or UDP layer
+func serializePacket(t testing.TB, src, dst AddrPort, transport gopacket.SerializableLayer, payload []byte) []byte {
+	t.Helper()
+
+	var protocol layers.IPProtocol
+	switch transport.(type) {
+	case *layers.TCP:
+		protocol = layers.IPProtocolTCP
+	case *layers.UDP:
+		protocol = layers.IPProtocolUDP
+	}
+
+	ip := newIPHeader(src.Addr, dst.Addr, protocol)
+	switch transport := transport.(type) {
+	case *layers.TCP:
+		transport.SetNetworkLayerForChecksum(ip)
+	case *layers.UDP:
+		transport.SetNetworkLayerForChecksum(ip)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, ip, transport, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testConn is a connection from the subprocess that has completed the handshake with the stack
+type testConn struct {
+	conn net.Conn // our side of the connection, as seen by the application
+	seq  uint32   // the next sequence number for the subprocess to send
+	ack  uint32   // the next sequence number that the subprocess expects from us
+}
+
+// handshake connects from the subprocess to the world with the given options in the SYN and returns the
+// SYN+ACK together with the accepted connection
+func (s *testStack) handshake(t *testing.T, window uint16, options ...layers.TCPOption) (*layers.TCP, *testConn) {
+	t.Helper()
+
+	listener := s.mux.ListenTCP("*")
+	s.sendTCP(t, layers.TCP{SYN: true, Seq: 1000, Window: window, Options: options}, nil)
+
+	synack, _ := s.receiveTCP(t)
+	if !synack.SYN || !synack.ACK {
+		t.Fatalf("expected SYN+ACK but got SYN=%v ACK=%v", synack.SYN, synack.ACK)
+	}
+	if synack.Ack != 1001 {
+		t.Fatalf("SYN+ACK acknowledges got = %d, want 1001", synack.Ack)
+	}
+
+	s.sendTCP(t, layers.TCP{ACK: true, Seq: 1001, Ack: synack.Seq + 1, Window: window}, nil)
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return synack, &testConn{conn: conn, seq: 1001, ack: synack.Seq + 1}
+}
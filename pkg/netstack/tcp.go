@@ -0,0 +1,1261 @@
+package netstack
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// TCPState is the state of a TCP connection
+type TCPState int
+
+const (
+	StateInit              TCPState = iota + 1
+	StateSynReceived                // means we have received a SYN, replied with a SYN+ACK, and are awaiting an ACK from other side
+	StateConnected                  // means we have received at least one ACK from other side so can send and receive data
+	StateOtherSideFinished          // means we have received a FIN from other side and have responded with FIN+ACK
+	StateFinished                   // means we have sent our own FIN and must not send any more data
+	StateClosed                     // means both sides have sent a FIN or the connection was reset, so the stream can be forgotten
+)
+
+func (s TCPState) String() string {
+	switch s {
+	case StateInit:
+		return "StateInit"
+	case StateSynReceived:
+		return "StateSynchronizing"
+	case StateConnected:
+		return "StateConnected"
+	case StateOtherSideFinished:
+		return "StateOtherSideFinished"
+	case StateFinished:
+		return "StateFinished"
+	case StateClosed:
+		return "StateClosed"
+	default:
+		return fmt.Sprintf("unknown(%d)", s)
+	}
+}
+
+// AddrPort is an IP address and a port number
+type AddrPort struct {
+	Addr net.IP
+	Port uint16
+}
+
+func (ap AddrPort) String() string {
+	return ap.Addr.String() + ":" + strconv.Itoa(int(ap.Port))
+}
+
+// TCPRequest represents a request by a remote host to initiate a TCP connection. The interface provides
+// a way for the application to decide whether or not to accept the connection.
+type TCPRequest interface {
+	// RemoteAddr is the IP address and port of the subprocess that initiated the connection
+	RemoteAddr() net.Addr
+
+	// LocalAddr is the IP address and port that the subprocess was trying to reach
+	LocalAddr() net.Addr
+
+	// Accept replies with a SYN+ACK back and returns a connection that can be read
+	Accept() (net.Conn, error)
+
+	// Reject replies with a RST and the connection is done
+	Reject()
+}
+
+// TCP stream
+
+// how long a stream may go without a packet from the subprocess before it is forgotten, and how often
+// the streams are checked for this
+const (
+	tcpIdleTimeout   = time.Hour
+	tcpSweepInterval = time.Minute
+)
+
+// the most bytes from the subprocess that are queued for the application at once, which is the largest
+// receive window that we advertise, unless the subprocess agrees to window scaling
+const tcpReceiveWindow = 64240
+
+type tcpStream struct {
+	subprocess     AddrPort                 // address from which we originally intercepted packets generated by subprocess
+	world          AddrPort                 // address to which the intercepted packets were addressed
+	fromSubprocess chan []byte              // the stack sends pooled packets here, we receive and own them
+	unread         []byte                   // the part of the last packet received that Read has not returned yet
+	unreadPacket   []byte                   // the pooled packet that unread is part of, returned to the pool once read
+	toSubprocess   chan []byte              // we send pooled packets here, the stack receives and owns them
+	serializeBuf   gopacket.SerializeBuffer // used to serialize gopacket structs to wire format
+	bufMu          sync.Mutex               // protects serializeBuf
+	mu             sync.Mutex               // protects state and lastActive
+	state          TCPState                 // state of the connection
+	lastActive     time.Time                // when the last packet from the subprocess arrived
+	closed         chan struct{}            // closed when the stream reaches StateClosed, which wakes up writers
+	readDone       bool                     // whether fromSubprocess has been closed, only accessed by the stack
+	seq            uint32                   // sequence number for packets going to the subprocess
+	ack            uint32                   // the next acknowledgement number to send
+	mss            int                      // the largest payload to send in one packet, as agreed with the subprocess
+	synOptions     []layers.TCPOption       // options for our SYN+ACK, which depend on those in the SYN
+	sackOK         bool                     // whether both sides may send selective acknowledgements
+	windowShift    uint8                    // how far our advertised window is scaled down
+	peerShift      uint8                    // how far the window advertised by the subprocess is scaled up
+	receiveBuffer  uint32                   // the most bytes that may be queued for the application at once
+	peerAck        uint32                   // the last acknowledgement number received from the subprocess
+	peerWindow     uint32                   // the receive window last advertised by the subprocess
+	maxPeerWindow  uint32                   // the largest receive window advertised by the subprocess
+	queued         uint32                   // bytes queued for the application but not yet read, accessed atomically
+	advertised     uint32                   // the receive window in the last segment sent, accessed atomically
+	windowUpdates  chan struct{}            // signalled when the subprocess acknowledges bytes or opens its window
+	retx           retransmitQueue          // segments sent to the subprocess but not yet acknowledged
+	pending        []pendingSegment         // data that arrived ahead of s.ack, sorted by seq, only accessed by the stack
+	finSeq         uint32                   // sequence number of the FIN from the subprocess, only accessed by the stack
+	finReceived    bool                     // whether the subprocess has sent a FIN, only accessed by the stack
+}
+
+func newTCPStream(world AddrPort, subprocess AddrPort, out chan []byte, mtu int) *tcpStream {
+	// leave room for the IP and TCP headers, which are 20 bytes each for IPv4 and 40 and 20 bytes for IPv6
+	mss := mtu - 40
+	if subprocess.Addr.To4() == nil {
+		mss = mtu - 60
+	}
+
+	return &tcpStream{
+		world:          world,
+		subprocess:     subprocess,
+		mss:            mss,
+		receiveBuffer:  tcpReceiveWindow,
+		state:          StateInit,
+		lastActive:     time.Now(),
+		closed:         make(chan struct{}),
+		fromSubprocess: make(chan []byte, 1024),
+		toSubprocess:   out,
+		serializeBuf:   gopacket.NewSerializeBuffer(),
+		windowUpdates:  make(chan struct{}, 1),
+		retx:           retransmitQueue{rto: tcpInitialRTO},
+	}
+}
+
+// getState returns the current state of the stream
+func (s *tcpStream) getState() TCPState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// setState changes the state of the stream, which must only move forward
+func (s *tcpStream) setState(state TCPState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setStateLocked(state)
+}
+
+// setStateLocked is setState for when s.mu is already held
+func (s *tcpStream) setStateLocked(state TCPState) {
+	if s.state == StateClosed {
+		return
+	}
+	s.state = state
+	if state == StateClosed {
+		close(s.closed)
+	}
+}
+
+// closeRead tells the application that the subprocess will send nothing more. It must only be called
+// by the stack, which is the only sender on fromSubprocess.
+func (s *tcpStream) closeRead() {
+	if !s.readDone {
+		s.readDone = true
+		close(s.fromSubprocess)
+	}
+	for _, seg := range s.pending {
+		putPacket(seg.payload)
+	}
+	s.pending = nil
+}
+
+// for net.Conn interface
+func (s *tcpStream) SetDeadline(t time.Time) error {
+	verbose("SetDeadline not implemented for TCP streams, ignoring")
+	return nil
+}
+
+// for net.Conn interface
+func (s *tcpStream) SetReadDeadline(t time.Time) error {
+	verbose("SetReadDeadline not implemented for TCP streams, ignoring")
+	return nil
+}
+
+// for net.Conn interface
+func (s *tcpStream) SetWriteDeadline(t time.Time) error {
+	verbose("SetWriteDeadline not implemented for TCP streams, ignoring")
+	return nil
+}
+
+// for net.Conn interface
+func (s *tcpStream) LocalAddr() net.Addr {
+	return &net.TCPAddr{
+		IP:   s.world.Addr,
+		Port: int(s.world.Port),
+	}
+}
+
+// for net.Conn interface
+func (s *tcpStream) RemoteAddr() net.Addr {
+	return &net.TCPAddr{
+		IP:   s.subprocess.Addr,
+		Port: int(s.subprocess.Port),
+	}
+}
+
+// sendSegment sends a TCP packet to the subprocess as if from the address that it was trying to reach,
+// filling in the ports and window, and waits for room in the queue to the subprocess if necessary
+func (s *tcpStream) sendSegment(tcp *layers.TCP, payload []byte) error {
+	tcp.SrcPort = layers.TCPPort(s.world.Port)
+	tcp.DstPort = layers.TCPPort(s.subprocess.Port)
+
+	// advertise the room that is left in the queue to the application, which is never scaled in a SYN
+	var shift uint8
+	if !tcp.SYN {
+		shift = s.windowShift
+	}
+	window := min(s.receiveWindow()>>shift, 0xffff)
+	tcp.Window = uint16(window)
+	atomic.StoreUint32(&s.advertised, window<<shift)
+
+	ip := newIPHeader(s.world.Addr, s.subprocess.Addr, layers.IPProtocolTCP)
+
+	err := tcp.SetNetworkLayerForChecksum(ip)
+	if err != nil {
+		return fmt.Errorf("error setting network-layer TCP checksums: %w", err)
+	}
+
+	// log
+	verbosef("sending tcp packet to subprocess: %s", summarizeTCP(ip, tcp, payload))
+
+	// serialize the packet and copy it into a pooled buffer, which WritePackets returns to the pool,
+	// because the serialization buffer is reused
+	s.bufMu.Lock()
+	serialized, err := serializeTCP(ip, tcp, payload, s.serializeBuf)
+	var packet []byte
+	if err == nil {
+		packet = getPacket(serialized)
+	}
+	s.bufMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error serializing TCP packet: %w", err)
+	}
+
+	return enqueuePacket(s.toSubprocess, packet)
+}
+
+// Accept sends a SYN+ACK packet. It is only valid to call this once, when the stream state is SynReceived
+func (s *tcpStream) Accept() (net.Conn, error) {
+	// reply to the subprocess as if the connection were already good to go
+	err := s.sendReliable(&layers.TCP{
+		SYN:     true,
+		ACK:     true,
+		Options: s.synOptions,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error sending SYN+ACK to subprocess: %w", err)
+	}
+
+	// return the tcp stream, now exposed as a net.Conn
+	return s, nil
+}
+
+// Reject sends a RST packet. It is only valid to call this once, when the stream state is SynReceived
+func (s *tcpStream) Reject() {
+	s.setState(StateClosed)
+
+	err := s.sendSegment(&layers.TCP{
+		RST: true,
+		ACK: true,
+		Seq: atomic.AddUint32(&s.seq, 1) - 1,
+		Ack: atomic.LoadUint32(&s.ack), // the SYN has already been counted
+	}, nil)
+	if err != nil {
+		errorf("error sending RST to subprocess: %v", err)
+	}
+}
+
+// Read reads packets sent by the subprocess and intercepted by us. A packet larger than buf is returned
+// over as many calls as it takes.
+func (s *tcpStream) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	// read packets from the channel until we get a non-empty one
+	for len(s.unread) == 0 {
+		packet, ok := <-s.fromSubprocess
+		if !ok {
+			return 0, io.EOF
+		}
+		if len(packet) == 0 {
+			putPacket(packet)
+			continue // we must not return zero bytes according to io.Reader interface
+		}
+		s.unread, s.unreadPacket = packet, packet
+	}
+
+	// copy what fits into the buffer, and return the packet to the pool once all of it has been read
+	n := copy(buf, s.unread)
+	s.unread = s.unread[n:]
+	s.consumed(n)
+	if len(s.unread) == 0 {
+		putPacket(s.unreadPacket)
+		s.unread, s.unreadPacket = nil, nil
+	}
+	return n, nil
+}
+
+// Write writes payloads to the subprocess as if they came from the address that the subprocess
+// was trying to reach when this stream was first intercepted. Payloads are split across as many packets
+// as the MTU of the TUN device and the receive window of the subprocess require, and Write blocks for as
+// long as the subprocess has no room for more.
+func (s *tcpStream) Write(payload []byte) (int, error) {
+	var written int
+	for len(payload) > 0 {
+		// nothing may be sent after our FIN
+		switch s.getState() {
+		case StateFinished, StateClosed:
+			return written, net.ErrClosed
+		}
+
+		// bytes sent beyond the receive window of the subprocess would be discarded by its kernel
+		n, err := s.waitForWindow(min(len(payload), s.mss))
+		if err != nil {
+			return written, err
+		}
+
+		err = s.sendReliable(&layers.TCP{
+			ACK: true, // this indicates that we are acknolwedging some bytes
+		}, payload[:n])
+		if err != nil {
+			return written, fmt.Errorf("error sending tcp packet to subprocess: %w", err)
+		}
+
+		// count bytes sent to us, not number of bytes written to underlying network
+		written += n
+		payload = payload[n:]
+	}
+	return written, nil
+}
+
+// waitForWindow waits until the subprocess has room in its receive window, so that a writer that is
+// faster than the subprocess is slowed down to its pace, and returns how many of the next n bytes to
+// send. To avoid sending many tiny segments, it waits until either all n bytes fit or half of the
+// largest window that the subprocess has advertised is open, as in RFC 1122. While the window is
+// closed, the subprocess is probed now and then in case the update that opens it again was lost.
+func (s *tcpStream) waitForWindow(n int) (int, error) {
+	var probe *time.Timer
+	interval := tcpInitialRTO
+	for {
+		inflight := atomic.LoadUint32(&s.seq) - atomic.LoadUint32(&s.peerAck)
+		window := atomic.LoadUint32(&s.peerWindow)
+		var available int
+		if window > inflight {
+			available = int(window - inflight)
+		}
+		if available >= n {
+			return n, nil
+		}
+		if available > 0 && available >= int(atomic.LoadUint32(&s.maxPeerWindow)/2) {
+			return available, nil
+		}
+
+		var probeC <-chan time.Time
+		if window == 0 {
+			if probe == nil {
+				probe = time.NewTimer(interval)
+				defer probe.Stop()
+			}
+			probeC = probe.C
+		}
+
+		select {
+		case <-s.windowUpdates:
+		case <-s.closed:
+			return 0, net.ErrClosed
+		case <-probeC:
+			if err := s.sendWindowProbe(); err != nil {
+				errorf("error sending window probe to subprocess: %v", err)
+			}
+			interval = min(2*interval, tcpMaxRTO)
+			probe.Reset(interval)
+		}
+	}
+}
+
+// sendWindowProbe sends a segment that the subprocess has already acknowledged, which it answers with
+// an acknowledgement that carries its current receive window
+func (s *tcpStream) sendWindowProbe() error {
+	return s.sendSegment(&layers.TCP{
+		Seq: atomic.LoadUint32(&s.peerAck) - 1,
+		Ack: atomic.LoadUint32(&s.ack),
+		ACK: true,
+	}, nil)
+}
+
+// receiveWindow returns how many more bytes from the subprocess may be queued for the application
+func (s *tcpStream) receiveWindow() uint32 {
+	queued := atomic.LoadUint32(&s.queued)
+	if queued >= s.receiveBuffer {
+		return 0
+	}
+	return s.receiveBuffer - queued
+}
+
+// consumed records that the application has read n bytes from the queue. Once a worthwhile amount of
+// room has opened up since the window that was last advertised, the subprocess is told straight away,
+// since it may be waiting for exactly that.
+func (s *tcpStream) consumed(n int) {
+	atomic.AddUint32(&s.queued, -uint32(n))
+
+	opened := int64(s.receiveWindow()) - int64(atomic.LoadUint32(&s.advertised))
+	if opened >= int64(min(int(s.receiveBuffer/2), s.mss)) {
+		if err := s.sendACK(); err != nil {
+			errorf("error sending window update to subprocess: %v", err)
+		}
+	}
+}
+
+// updateWindow records an acknowledgement and receive window from the subprocess, scaling the window as
+// agreed in the handshake. The segment that carried the acknowledgement may also
+// carry data of its own, in which case it does not count as a duplicate acknowledgement.
+func (s *tcpStream) updateWindow(ack uint32, rawWindow uint16, carriesData bool) {
+	window := uint32(rawWindow) << s.peerShift
+
+	// ignore acknowledgements older than the last one, which may arrive out of order
+	prevAck := atomic.LoadUint32(&s.peerAck)
+	if int32(ack-prevAck) < 0 {
+		return
+	}
+	duplicate := ack == prevAck && window == atomic.LoadUint32(&s.peerWindow) && !carriesData
+	atomic.StoreUint32(&s.peerAck, ack)
+	atomic.StoreUint32(&s.peerWindow, window)
+	if window > atomic.LoadUint32(&s.maxPeerWindow) {
+		atomic.StoreUint32(&s.maxPeerWindow, window)
+	}
+	s.acknowledge(ack, duplicate)
+
+	select {
+	case s.windowUpdates <- struct{}{}:
+	default:
+	}
+}
+
+// sendACK acknowledges the bytes received from the subprocess so far, without sending any data
+func (s *tcpStream) sendACK(options ...layers.TCPOption) error {
+	return s.sendSegment(&layers.TCP{
+		Seq:     atomic.LoadUint32(&s.seq),
+		Ack:     atomic.LoadUint32(&s.ack),
+		ACK:     true,
+		Options: options,
+	}, nil)
+}
+
+// Close the connection by sending a FIN packet
+func (s *tcpStream) Close() error {
+	s.mu.Lock()
+	switch s.state {
+	case StateInit:
+		s.mu.Unlock()
+		errorf("application tried tp close a TCP stream in state %v, returning error", StateInit)
+		return fmt.Errorf("cannot close TCP stream in state %v", StateInit)
+	case StateFinished, StateClosed:
+		verbosef("application tried tp close a TCP stream in state %v, ignoring", s.state)
+		s.mu.Unlock()
+		return nil
+	case StateOtherSideFinished:
+		s.setStateLocked(StateClosed)
+	default:
+		s.setStateLocked(StateFinished)
+	}
+	s.mu.Unlock()
+
+	// send a FIN packet to the subprocess
+	err := s.sendReliable(&layers.TCP{
+		FIN: true,
+		ACK: true,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error sending FIN to subprocess: %w", err)
+	}
+
+	return nil
+}
+
+// Retransmission
+
+// bounds on the retransmission timeout, which is estimated from round trip times as in RFC 6298, the
+// number of times a segment is sent again before the connection is given up on, and the number of
+// duplicate acknowledgements after which a segment is taken to be lost without waiting for the timeout,
+// as in RFC 5681
+const (
+	tcpInitialRTO     = time.Second
+	tcpMinRTO         = 200 * time.Millisecond
+	tcpMaxRTO         = time.Minute
+	tcpMaxRetransmits = 10
+	tcpDupAckLimit    = 3
+)
+
+// unackedSegment is a segment sent to the subprocess that it has not yet acknowledged
+type unackedSegment struct {
+	seq           uint32    // sequence number of the first byte of the segment
+	payload       []byte    // pooled copy of the payload
+	syn, fin      bool      // each of these takes up one sequence number
+	sentAt        time.Time // when the segment was first sent
+	retransmitted bool      // round trip times are not measured for segments sent more than once
+	sacked        bool      // whether the subprocess has selectively acknowledged the segment
+	resent        bool      // whether the segment has been sent again during the current loss recovery
+}
+
+// end returns the sequence number just after the segment
+func (seg *unackedSegment) end() uint32 {
+	n := uint32(len(seg.payload))
+	if seg.syn {
+		n++
+	}
+	if seg.fin {
+		n++
+	}
+	return seg.seq + n
+}
+
+// retransmitQueue holds the segments that may need to be sent again, and the timer that sends them
+type retransmitQueue struct {
+	mu       sync.Mutex        // protects everything below, and the assignment of sequence numbers
+	segments []*unackedSegment // in order of sequence number
+	timer    *time.Timer       // sends the oldest segment again when it fires, nil until first needed
+	rto      time.Duration     // current retransmission timeout
+	srtt     time.Duration     // smoothed round trip time, zero until the first measurement
+	rttvar   time.Duration     // round trip time variation
+	retries  int               // number of times the oldest segment has been sent again
+	dupAcks  int               // number of duplicate acknowledgements of the oldest segment
+	recovery bool              // whether segments are being sent again because some were lost
+	recover  uint32            // the sequence number at which loss recovery ends
+}
+
+// sendReliable sends a segment that takes up sequence numbers, which are assigned here, and keeps a
+// copy of it so that it can be sent again if the subprocess does not acknowledge it in time. Packets
+// written to the TUN device are rarely lost, but the kernel of the subprocess may drop them if its
+// backlog is full.
+func (s *tcpStream) sendReliable(tcp *layers.TCP, payload []byte) error {
+	seg := &unackedSegment{
+		syn:    tcp.SYN,
+		fin:    tcp.FIN,
+		sentAt: time.Now(),
+	}
+	if len(payload) > 0 {
+		seg.payload = getPacket(payload)
+	}
+
+	// assign the sequence number and queue the segment together so that the queue stays in order
+	s.retx.mu.Lock()
+	seg.seq = atomic.LoadUint32(&s.seq)
+	atomic.StoreUint32(&s.seq, seg.end())
+	s.retx.segments = append(s.retx.segments, seg)
+	if s.retx.timer == nil {
+		s.retx.timer = time.AfterFunc(s.retx.rto, s.retransmit)
+	} else if len(s.retx.segments) == 1 {
+		s.retx.timer.Reset(s.retx.rto)
+	}
+	s.retx.mu.Unlock()
+
+	tcp.Seq = seg.seq
+	tcp.Ack = atomic.LoadUint32(&s.ack)
+	return s.sendSegment(tcp, payload)
+}
+
+// acknowledge removes the segments that the subprocess has acknowledged from the retransmission queue,
+// updating the estimate of the round trip time. The subprocess repeats its last acknowledgement for
+// each segment that arrives after a missing one, so several duplicates mean that a segment was lost,
+// which starts loss recovery.
+func (s *tcpStream) acknowledge(ack uint32, duplicate bool) {
+	s.retx.mu.Lock()
+
+	var n int
+	var retransmitted bool
+	for _, seg := range s.retx.segments {
+		if int32(ack-seg.end()) < 0 {
+			break
+		}
+		retransmitted = retransmitted || seg.retransmitted
+		n++
+	}
+
+	if n > 0 {
+		// measure the round trip time from the newest segment acknowledged, unless this acknowledgement
+		// may be for a copy that was sent again, which would give a misleading measurement (Karn's
+		// algorithm)
+		if !retransmitted {
+			s.retx.measure(time.Since(s.retx.segments[n-1].sentAt))
+		}
+		for _, seg := range s.retx.segments[:n] {
+			if seg.payload != nil {
+				putPacket(seg.payload)
+			}
+		}
+		s.retx.segments = slices.Delete(s.retx.segments, 0, n)
+
+		// new data was acknowledged, so start the timer again for the oldest segment still outstanding
+		s.retx.retries = 0
+		s.retx.dupAcks = 0
+		if len(s.retx.segments) == 0 {
+			s.retx.timer.Stop()
+		} else {
+			s.retx.timer.Reset(s.retx.rto)
+		}
+		if s.retx.recovery && int32(ack-s.retx.recover) >= 0 {
+			s.retx.recovery = false
+		}
+	} else if duplicate && len(s.retx.segments) > 0 {
+		s.retx.dupAcks++
+		if s.retx.dupAcks == tcpDupAckLimit && !s.retx.recovery {
+			verbosef("got %d duplicate acks from %v, retransmitting", s.retx.dupAcks, s.subprocess)
+			s.retx.startRecovery(atomic.LoadUint32(&s.seq))
+		}
+	}
+
+	if !s.retx.recovery || len(s.retx.segments) == 0 {
+		s.retx.mu.Unlock()
+		return
+	}
+	s.resend(s.retx.lost()...) // unlocks
+}
+
+// startRecovery starts sending lost segments again, until everything up to seq has been acknowledged.
+// The caller must hold q.mu.
+func (q *retransmitQueue) startRecovery(seq uint32) {
+	q.recovery = true
+	q.recover = seq
+	for _, seg := range q.segments {
+		seg.resent = false
+	}
+}
+
+// lost returns the segments to send again during loss recovery, which have not been sent again already.
+// The oldest segment is taken to be lost, since the subprocess would otherwise have acknowledged it, as
+// in RFC 6582, and so is any segment with several selectively acknowledged segments after it, as in
+// RFC 6675. The caller must hold q.mu.
+func (q *retransmitQueue) lost() []*unackedSegment {
+	var lost []*unackedSegment
+	var sackedAfter int
+	for i := len(q.segments) - 1; i >= 0; i-- {
+		seg := q.segments[i]
+		if seg.sacked {
+			sackedAfter++
+			continue
+		}
+		if !seg.resent && (i == 0 || sackedAfter >= tcpDupAckLimit) {
+			lost = append(lost, seg)
+		}
+	}
+	slices.Reverse(lost)
+	return lost
+}
+
+// measure updates the retransmission timeout with a round trip time, as in section 2 of RFC 6298. The
+// caller must hold q.mu.
+func (q *retransmitQueue) measure(rtt time.Duration) {
+	if q.srtt == 0 {
+		q.srtt = rtt
+		q.rttvar = rtt / 2
+	} else {
+		q.rttvar = (3*q.rttvar + (q.srtt - rtt).Abs()) / 4
+		q.srtt = (7*q.srtt + rtt) / 8
+	}
+	q.rto = min(max(q.srtt+4*q.rttvar, tcpMinRTO), tcpMaxRTO)
+}
+
+// retransmit is called when the retransmission timer fires, and sends the oldest unacknowledged segment
+// again, backing off exponentially each time
+func (s *tcpStream) retransmit() {
+	s.retx.mu.Lock()
+	if len(s.retx.segments) == 0 {
+		s.retx.mu.Unlock()
+		return
+	}
+
+	if s.retx.retries >= tcpMaxRetransmits {
+		verbosef("subprocess did not acknowledge segment after %d retransmissions, giving up on %v => %v", s.retx.retries, s.world, s.subprocess)
+		s.retx.mu.Unlock()
+		s.stopRetransmits()
+		s.setState(StateClosed)
+		return
+	}
+
+	// the subprocess may have discarded data that it selectively acknowledged, so forget about that
+	// once it has stopped responding, as in RFC 2018
+	for _, seg := range s.retx.segments {
+		seg.sacked = false
+	}
+
+	s.retx.retries++
+	s.retx.rto = min(2*s.retx.rto, tcpMaxRTO)
+	s.retx.timer.Reset(s.retx.rto)
+	s.retx.startRecovery(atomic.LoadUint32(&s.seq))
+	s.resend(s.retx.segments[0]) // unlocks
+}
+
+// resend sends segments again. The caller must hold s.retx.mu, which is released before the segments
+// are sent.
+func (s *tcpStream) resend(segs ...*unackedSegment) {
+	type packet struct {
+		tcp     layers.TCP
+		payload []byte
+	}
+	var packets []packet
+	for _, seg := range segs {
+		seg.retransmitted = true
+		seg.resent = true
+
+		tcp := layers.TCP{
+			SYN: seg.syn,
+			FIN: seg.fin,
+			ACK: true,
+			Seq: seg.seq,
+			Ack: atomic.LoadUint32(&s.ack),
+		}
+		if seg.syn {
+			tcp.Options = s.synOptions
+		}
+		// copy the payload, since the segment may be acknowledged and its payload reused meanwhile
+		packets = append(packets, packet{tcp, getPacket(seg.payload)})
+	}
+	s.retx.mu.Unlock()
+
+	for _, p := range packets {
+		verbosef("retransmitting %d bytes at seq %d to %v", len(p.payload), p.tcp.Seq, s.subprocess)
+		err := s.sendSegment(&p.tcp, p.payload)
+		putPacket(p.payload)
+		if err != nil {
+			errorf("error retransmitting tcp packet to subprocess: %v", err)
+		}
+	}
+}
+
+// applySACK marks the segments that the subprocess has selectively acknowledged, so that they are not
+// sent again until the bytes before them have been
+func (s *tcpStream) applySACK(options []layers.TCPOption) {
+	s.retx.mu.Lock()
+	defer s.retx.mu.Unlock()
+
+	for _, opt := range options {
+		if opt.OptionType != layers.TCPOptionKindSACK {
+			continue
+		}
+		for b := opt.OptionData; len(b) >= 8; b = b[8:] {
+			left, right := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+			for _, seg := range s.retx.segments {
+				if int32(seg.seq-left) >= 0 && int32(right-seg.end()) >= 0 {
+					seg.sacked = true
+				}
+			}
+		}
+	}
+}
+
+// stopRetransmits gives up on every unacknowledged segment
+func (s *tcpStream) stopRetransmits() {
+	s.retx.mu.Lock()
+	defer s.retx.mu.Unlock()
+
+	if s.retx.timer != nil {
+		s.retx.timer.Stop()
+	}
+	for _, seg := range s.retx.segments {
+		if seg.payload != nil {
+			putPacket(seg.payload)
+		}
+	}
+	s.retx.segments = nil
+}
+
+// hasUnacked returns whether any segments sent to the subprocess have not been acknowledged yet
+func (s *tcpStream) hasUnacked() bool {
+	s.retx.mu.Lock()
+	defer s.retx.mu.Unlock()
+	return len(s.retx.segments) > 0
+}
+
+// deliverToApplication queues bytes from the subprocess to be read by the application, or returns an
+// error if the queue is full, in which case the bytes must not be acknowledged
+func (s *tcpStream) deliverToApplication(payload []byte) error {
+	if s.readDone {
+		return fmt.Errorf("subprocess already finished sending")
+	}
+	if uint32(len(payload)) > s.receiveWindow() {
+		return fmt.Errorf("receive window is full")
+	}
+
+	// copy the payload because it may be overwritten before the write loop gets to it, into a pooled
+	// buffer that Read returns to the pool
+	cp := getPacket(payload)
+
+	verbosef("stream enqueing %d bytes to send to world", len(payload))
+
+	// send to channel unless it would block, since waiting would hold up packets for every other stream
+	// count the bytes before sending them, since the application may read them straight away
+	atomic.AddUint32(&s.queued, uint32(len(payload)))
+	select {
+	case s.fromSubprocess <- cp:
+		return nil
+	default:
+		atomic.AddUint32(&s.queued, -uint32(len(payload)))
+		putPacket(cp)
+		return fmt.Errorf("queue to application is full")
+	}
+}
+
+// Options
+
+// the receive window that we offer when the subprocess agrees to window scaling, and the scale that
+// makes it fit in the 16-bit window field
+const (
+	tcpScaledReceiveWindow = 1 << 20
+	tcpWindowShift         = 5
+)
+
+// the maximum segment size to assume when the subprocess does not send one, as in RFC 9293, which for
+// IPv6 is based on the minimum MTU of 1280
+const (
+	tcpDefaultMSS  = 536
+	tcpDefaultMSS6 = 1220
+)
+
+// negotiate handles the options in the SYN from the subprocess, and chooses the options for our SYN+ACK.
+// We always offer our maximum segment size, and agree to window scaling and selective acknowledgements
+// if the subprocess offers them, which Linux always does.
+func (s *tcpStream) negotiate(options []layers.TCPOption) {
+	peerMSS := tcpDefaultMSS
+	if s.subprocess.Addr.To4() == nil {
+		peerMSS = tcpDefaultMSS6
+	}
+
+	var windowScale, sackPermitted bool
+	for _, opt := range options {
+		switch opt.OptionType {
+		case layers.TCPOptionKindMSS:
+			if len(opt.OptionData) == 2 {
+				peerMSS = int(binary.BigEndian.Uint16(opt.OptionData))
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(opt.OptionData) == 1 {
+				windowScale = true
+				s.peerShift = min(opt.OptionData[0], 14) // larger shifts are treated as 14, as in RFC 7323
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			sackPermitted = true
+		}
+	}
+
+	// the subprocess must not send segments larger than fit in the MTU of the TUN device, and neither
+	// may we send larger segments than the subprocess can receive
+	s.synOptions = append(s.synOptions, layers.TCPOption{
+		OptionType: layers.TCPOptionKindMSS,
+		OptionData: binary.BigEndian.AppendUint16(nil, uint16(s.mss)),
+	})
+	s.mss = min(s.mss, peerMSS)
+
+	if windowScale {
+		s.windowShift = tcpWindowShift
+		s.receiveBuffer = tcpScaledReceiveWindow
+		s.synOptions = append(s.synOptions, layers.TCPOption{
+			OptionType: layers.TCPOptionKindWindowScale,
+			OptionData: []byte{tcpWindowShift},
+		})
+	}
+
+	if sackPermitted {
+		s.sackOK = true
+		s.synOptions = append(s.synOptions, layers.TCPOption{
+			OptionType: layers.TCPOptionKindSACKPermitted,
+		})
+	}
+}
+
+// sackOption returns an option that selectively acknowledges the data that arrived ahead of a gap, so
+// that the subprocess only sends the missing bytes again, or nothing if there is no such data or the
+// subprocess did not agree to selective acknowledgements. It must only be called by the stack.
+func (s *tcpStream) sackOption() []layers.TCPOption {
+	if !s.sackOK || len(s.pending) == 0 {
+		return nil
+	}
+
+	// merge the held segments into contiguous blocks, of which at most four fit in the TCP header
+	var data []byte
+	left, right := s.pending[0].seq, s.pending[0].seq
+	for _, seg := range s.pending {
+		if int32(seg.seq-right) > 0 {
+			data = binary.BigEndian.AppendUint32(data, left)
+			data = binary.BigEndian.AppendUint32(data, right)
+			left = seg.seq
+		}
+		if end := seg.seq + uint32(len(seg.payload)); int32(end-right) > 0 {
+			right = end
+		}
+	}
+	data = binary.BigEndian.AppendUint32(data, left)
+	data = binary.BigEndian.AppendUint32(data, right)
+
+	return []layers.TCPOption{{
+		OptionType: layers.TCPOptionKindSACK,
+		OptionData: data[:min(len(data), 4*8)],
+	}}
+}
+
+// Reassembly
+
+// pendingSegment is data from the subprocess that arrived before some of the bytes preceding it
+type pendingSegment struct {
+	seq     uint32 // sequence number of the first byte
+	payload []byte // pooled copy of the payload
+}
+
+// receive accepts a segment from the subprocess, delivering its payload to the application if it is the
+// next in sequence, and otherwise holding on to it until the bytes before it arrive. Bytes are
+// acknowledged only once they are queued for the application, so anything that does not fit in the
+// queue is sent again by the subprocess rather than lost. It returns whether every byte before the FIN
+// from the subprocess has now been delivered. It must only be called by the stack.
+func (s *tcpStream) receive(seq uint32, payload []byte, fin bool) bool {
+	if fin && !s.finReceived {
+		s.finReceived = true
+		s.finSeq = seq + uint32(len(payload))
+	}
+
+	// skip over any bytes that were already received, since the subprocess may send a segment again
+	// after its retransmission timer fires even though the first copy arrived
+	ack := atomic.LoadUint32(&s.ack)
+	if skip := ack - seq; int32(skip) > 0 {
+		payload = payload[min(int(skip), len(payload)):]
+		seq = ack
+	}
+
+	switch {
+	case len(payload) == 0:
+	case seq == ack && len(s.pending) == 0:
+		// the common case of a segment arriving in order
+		if err := s.deliverToApplication(payload); err != nil {
+			verbosef("not acknowledging %d tcp bytes from %v: %v", len(payload), s.subprocess, err)
+			break
+		}
+		verbosef("got %d tcp bytes from %v, forwarded to application", len(payload), s.subprocess)
+		atomic.StoreUint32(&s.ack, seq+uint32(len(payload)))
+	case seq-ack+uint32(len(payload)) > s.receiveWindow():
+		verbosef("got %d tcp bytes from %v at seq %d, which is beyond the receive window, ignoring", len(payload), s.subprocess, seq)
+	default:
+		verbosef("got %d tcp bytes from %v at seq %d but expected seq %d, holding on to them", len(payload), s.subprocess, seq, ack)
+		s.addPending(seq, payload)
+	}
+
+	s.deliverPending()
+	return s.finReceived && atomic.LoadUint32(&s.ack) == s.finSeq
+}
+
+// addPending holds on to a copy of a segment that arrived out of order
+func (s *tcpStream) addPending(seq uint32, payload []byte) {
+	ack := atomic.LoadUint32(&s.ack)
+	i, found := slices.BinarySearchFunc(s.pending, seq-ack, func(seg pendingSegment, offset uint32) int {
+		return cmp.Compare(seg.seq-ack, offset)
+	})
+	if found && len(s.pending[i].payload) >= len(payload) {
+		return // already have these bytes
+	}
+	if found {
+		putPacket(s.pending[i].payload)
+		s.pending[i].payload = getPacket(payload)
+		return
+	}
+	s.pending = slices.Insert(s.pending, i, pendingSegment{seq: seq, payload: getPacket(payload)})
+}
+
+// deliverPending delivers held segments to the application for as long as there is no gap before them,
+// trimming any bytes that overlap with bytes already delivered
+func (s *tcpStream) deliverPending() {
+	for len(s.pending) > 0 {
+		seg := s.pending[0]
+		ack := atomic.LoadUint32(&s.ack)
+		if int32(seg.seq-ack) > 0 {
+			break // still waiting for the bytes before this segment
+		}
+
+		end := seg.seq + uint32(len(seg.payload))
+		if int32(end-ack) > 0 {
+			if err := s.deliverToApplication(seg.payload[ack-seg.seq:]); err != nil {
+				verbosef("not acknowledging %d tcp bytes from %v: %v", end-ack, s.subprocess, err)
+				break
+			}
+			verbosef("forwarded %d tcp bytes from %v that arrived out of order to application", end-ack, s.subprocess)
+			atomic.StoreUint32(&s.ack, end)
+		}
+
+		putPacket(seg.payload)
+		s.pending = slices.Delete(s.pending, 0, 1)
+	}
+}
+
+// TCPStack accepts raw packets and handles TCP connections
+type TCPStack struct {
+	mu              sync.Mutex // protects streamsBySrcDst and lastSweep
+	streamsBySrcDst map[string]*tcpStream
+	lastSweep       time.Time   // when closed and idle streams were last removed
+	toSubprocess    chan []byte // data sent to this channel goes to subprocess as raw IP packet
+	app             *Mux
+	mtu             int // the MTU of the TUN device, which limits the size of packets to the subprocess
+}
+
+// NewTCPStack creates a TCP stack that dispatches new connections through app and sends packets for
+// the subprocess to link, which are at most mtu bytes long
+func NewTCPStack(app *Mux, link chan []byte, mtu int) *TCPStack {
+	return &TCPStack{
+		streamsBySrcDst: make(map[string]*tcpStream),
+		lastSweep:       time.Now(),
+		toSubprocess:    link,
+		app:             app,
+		mtu:             mtu,
+	}
+}
+
+// sweep removes streams that are closed and have nothing left to retransmit, or that have been idle for
+// longer than tcpIdleTimeout, telling the application that idle streams are finished. The caller must hold s.mu.
+func (s *TCPStack) sweep(now time.Time) {
+	s.lastSweep = now
+	for srcdst, stream := range s.streamsBySrcDst {
+		stream.mu.Lock()
+		idle := now.Sub(stream.lastActive) > tcpIdleTimeout
+		if idle {
+			stream.setStateLocked(StateClosed)
+		}
+		closed := stream.state == StateClosed
+		stream.mu.Unlock()
+
+		// a stream that we closed last may still be waiting for the subprocess to acknowledge our FIN
+		if closed && (idle || !stream.hasUnacked()) {
+			if idle {
+				verbosef("forgetting tcp stream %v after %v without packets", srcdst, tcpIdleTimeout)
+			}
+			stream.stopRetransmits()
+			stream.closeRead()
+			delete(s.streamsBySrcDst, srcdst)
+		}
+	}
+}
+
+// sendReset answers a packet for a connection that we know nothing about with a RST, as a real TCP
+// stack would, so that the subprocess does not wait on a connection that no longer exists
+func (s *TCPStack) sendReset(srcIP, dstIP net.IP, tcp *layers.TCP) {
+	reply := layers.TCP{
+		SrcPort: tcp.DstPort,
+		DstPort: tcp.SrcPort,
+		RST:     true,
+	}
+	if tcp.ACK {
+		reply.Seq = tcp.Ack
+	} else {
+		reply.ACK = true
+		reply.Ack = tcp.Seq + uint32(len(tcp.Payload))
+	}
+
+	ip := newIPHeader(dstIP, srcIP, layers.IPProtocolTCP)
+	reply.SetNetworkLayerForChecksum(ip)
+
+	verbosef("sending RST to subprocess: %s", summarizeTCP(ip, &reply, nil))
+
+	serialized, err := serializeTCP(ip, &reply, nil, gopacket.NewSerializeBuffer())
+	if err != nil {
+		errorf("error serializing RST: %v", err)
+		return
+	}
+	err = enqueuePacket(s.toSubprocess, getPacket(serialized))
+	if err != nil {
+		errorf("error sending RST to subprocess: %v", err)
+	}
+}
+
+func (s *TCPStack) handlePacket(ip gopacket.NetworkLayer, tcp *layers.TCP, payload []byte) {
+	srcIP, dstIP := ipAddrs(ip)
+
+	// it happens that a process will connect to the same remote service multiple times in from
+	// different source ports so we must key by a descriptor that includes both endpoints
+	dst := AddrPort{Addr: dstIP, Port: uint16(tcp.DstPort)}
+	src := AddrPort{Addr: srcIP, Port: uint16(tcp.SrcPort)}
+
+	// put source address, source port, destination address, and destination port into a human-readable string
+	srcdst := src.String() + " => " + dst.String()
+
+	now := time.Now()
+	s.mu.Lock()
+	if now.Sub(s.lastSweep) > tcpSweepInterval {
+		s.sweep(now)
+	}
+	stream, found := s.streamsBySrcDst[srcdst]
+	if found && tcp.SYN && stream.getState() == StateClosed {
+		found = false // the subprocess is reusing the addresses and ports of a finished connection
+	}
+	if !found && tcp.SYN && !tcp.ACK {
+		// only a SYN starts a new stream
+		stream = newTCPStream(dst, src, s.toSubprocess, s.mtu)
+		stream.ack = tcp.Seq
+		s.streamsBySrcDst[srcdst] = stream
+		found = true
+	}
+	s.mu.Unlock()
+
+	if !found {
+		if !tcp.RST {
+			verbosef("got tcp packet for unknown connection %v, resetting", srcdst)
+			s.sendReset(srcIP, dstIP, tcp)
+		}
+		return
+	}
+
+	stream.mu.Lock()
+	stream.lastActive = now
+	stream.mu.Unlock()
+
+	// the subprocess may abort the connection at any point
+	if tcp.RST {
+		verbosef("got RST to %v:%v, closing stream", dstIP, tcp.DstPort)
+		stream.setState(StateClosed)
+		stream.stopRetransmits()
+		stream.closeRead()
+		return
+	}
+
+	// handle connection establishment
+	if tcp.SYN && stream.getState() == StateInit {
+		stream.setState(StateSynReceived)
+		atomic.StoreUint32(&stream.ack, tcp.Seq+1)
+		atomic.StoreUint32(&stream.peerWindow, uint32(tcp.Window))
+		atomic.StoreUint32(&stream.maxPeerWindow, uint32(tcp.Window))
+		stream.negotiate(tcp.Options)
+		verbosef("got SYN to %v:%v, now state is %v", dstIP, tcp.DstPort, StateSynReceived)
+		s.app.NotifyTCP(stream)
+	}
+
+	// every packet after the SYN acknowledges the bytes that the subprocess has received so far
+	state := stream.getState()
+	if tcp.ACK && state != StateInit {
+		if stream.sackOK {
+			stream.applySACK(tcp.Options)
+		}
+		stream.updateWindow(tcp.Ack, tcp.Window, len(tcp.Payload) > 0 || tcp.SYN || tcp.FIN)
+	}
+
+	if tcp.ACK && state == StateSynReceived {
+		stream.setState(StateConnected)
+		state = StateConnected
+		verbosef("got ACK to %v:%v, now state is %v", dstIP, tcp.DstPort, state)
+
+		// nothing more to do here -- if there is a payload then it will be forwarded
+		// to the subprocess in the block below
+	}
+
+	// payload packets will often have ACK set, which acknowledges previously sent bytes, and the
+	// subprocess may keep sending after we have sent our FIN, or send a segment or its FIN again if our
+	// acknowledgement was lost
+	if !tcp.SYN && (len(tcp.Payload) > 0 || tcp.FIN) && state != StateInit && state != StateSynReceived {
+		// handle connection teardown once every byte before the FIN has been received
+		if stream.receive(tcp.Seq, tcp.Payload, tcp.FIN) {
+			// the application reads EOF once it has read everything before the FIN
+			stream.closeRead()
+
+			// if we have already sent our own FIN then the connection is now closed on both sides
+			stream.mu.Lock()
+			if stream.state == StateFinished {
+				stream.setStateLocked(StateClosed)
+			} else {
+				stream.setStateLocked(StateOtherSideFinished)
+			}
+			state = stream.state
+			stream.mu.Unlock()
+
+			atomic.AddUint32(&stream.ack, 1)
+			verbosef("got FIN to %v:%v, now state is %v", dstIP, tcp.DstPort, state)
+		}
+
+		// acknowledge what we have, which repeats the previous acknowledgement if there is a gap or the
+		// bytes were not taken, and which tells the subprocess which bytes to send again. Our own FIN is
+		// sent when the application closes the stream.
+		if err := stream.sendACK(stream.sackOption()...); err != nil {
+			errorf("error sending ACK to subprocess: %v", err)
+		}
+	}
+}
+
+// serializeTCP serializes a TCP packet
+func serializeTCP(ip gopacket.SerializableLayer, tcp *layers.TCP, payload []byte, tmp gopacket.SerializeBuffer) ([]byte, error) {
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	tmp.Clear()
+
+	// each layer is *prepended*, treating the current buffer data as payload
+	p, err := tmp.AppendBytes(len(payload))
+	if err != nil {
+		return nil, fmt.Errorf("error appending TCP payload to packet (%d bytes): %w", len(payload), err)
+	}
+	copy(p, payload)
+
+	err = tcp.SerializeTo(tmp, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing TCP part of packet: %w", err)
+	}
+
+	err = ip.SerializeTo(tmp, opts)
+	if err != nil {
+		errorf("error serializing IP part of packet: %v", err)
+	}
+
+	return tmp.Bytes(), nil
+}
+
+// summarizeTCP summarizes a TCP packet into a single line for logging
+func summarizeTCP(ip gopacket.NetworkLayer, tcp *layers.TCP, payload []byte) string {
+	srcIP, dstIP := ipAddrs(ip)
+
+	var flags []string
+	if tcp.FIN {
+		flags = append(flags, "FIN")
+	}
+	if tcp.SYN {
+		flags = append(flags, "SYN")
+	}
+	if tcp.RST {
+		flags = append(flags, "RST")
+	}
+	if tcp.ACK {
+		flags = append(flags, "ACK")
+	}
+	if tcp.URG {
+		flags = append(flags, "URG")
+	}
+	if tcp.ECE {
+		flags = append(flags, "ECE")
+	}
+	if tcp.CWR {
+		flags = append(flags, "CWR")
+	}
+	if tcp.NS {
+		flags = append(flags, "NS")
+	}
+	// ignore PSH flag
+
+	flagstr := strings.Join(flags, "+")
+	return fmt.Sprintf("TCP %v:%d => %v:%d %s - Seq %d - Ack %d - Len %d",
+		srcIP, tcp.SrcPort, dstIP, tcp.DstPort, flagstr, tcp.Seq, tcp.Ack, len(tcp.Payload))
+}
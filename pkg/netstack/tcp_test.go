@@ -0,0 +1,397 @@
+package netstack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func mssOption(mss uint16) layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionData: binary.BigEndian.AppendUint16(nil, mss)}
+}
+
+func windowScaleOption(shift byte) layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionData: []byte{shift}}
+}
+
+func sackPermittedOption() layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted}
+}
+
+// sackBlocks decodes the edges in the SACK option of a segment, if there is one
+func sackBlocks(tcp *layers.TCP) [][2]uint32 {
+	var blocks [][2]uint32
+	for _, opt := range tcp.Options {
+		if opt.OptionType != layers.TCPOptionKindSACK {
+			continue
+		}
+		for b := opt.OptionData; len(b) >= 8; b = b[8:] {
+			blocks = append(blocks, [2]uint32{binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])})
+		}
+	}
+	return blocks
+}
+
+func TestHandshakeOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		mtu       int
+		options   []layers.TCPOption
+		wantMSS   uint16
+		wantShift int // -1 for no window scale option
+		wantSACK  bool
+	}{
+		{
+			name:      "no options",
+			mtu:       1500,
+			wantMSS:   1460,
+			wantShift: -1,
+		},
+		{
+			name:      "all options",
+			mtu:       1500,
+			options:   []layers.TCPOption{mssOption(1000), windowScaleOption(7), sackPermittedOption()},
+			wantMSS:   1460,
+			wantShift: tcpWindowShift,
+			wantSACK:  true,
+		},
+		{
+			name:      "jumbo frames",
+			mtu:       9000,
+			options:   []layers.TCPOption{mssOption(8960)},
+			wantMSS:   8960,
+			wantShift: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStack(tt.mtu)
+			synack, c := s.handshake(t, 65535, tt.options...)
+			defer c.conn.Close()
+
+			var gotMSS uint16
+			gotShift := -1
+			var gotSACK bool
+			for _, opt := range synack.Options {
+				switch opt.OptionType {
+				case layers.TCPOptionKindMSS:
+					gotMSS = binary.BigEndian.Uint16(opt.OptionData)
+				case layers.TCPOptionKindWindowScale:
+					gotShift = int(opt.OptionData[0])
+				case layers.TCPOptionKindSACKPermitted:
+					gotSACK = true
+				}
+			}
+			if gotMSS != tt.wantMSS {
+				t.Errorf("MSS got = %v, want %v", gotMSS, tt.wantMSS)
+			}
+			if gotShift != tt.wantShift {
+				t.Errorf("window shift got = %v, want %v", gotShift, tt.wantShift)
+			}
+			if gotSACK != tt.wantSACK {
+				t.Errorf("SACK permitted got = %v, want %v", gotSACK, tt.wantSACK)
+			}
+
+			if got := c.conn.LocalAddr().String(); got != world.String() {
+				t.Errorf("local address got = %v, want %v", got, world)
+			}
+			if got := c.conn.RemoteAddr().String(); got != subprocess.String() {
+				t.Errorf("remote address got = %v, want %v", got, subprocess)
+			}
+		})
+	}
+}
+
+func TestHandshakeIPv6(t *testing.T) {
+	s := newTestStack(1500)
+	listener := s.mux.ListenTCP("*")
+
+	src := AddrPort{Addr: net.ParseIP("fd00::2"), Port: 40000}
+	dst := AddrPort{Addr: net.ParseIP("2001:db8::1"), Port: 443}
+	s.send(t, src, dst, &layers.TCP{
+		SrcPort: layers.TCPPort(src.Port),
+		DstPort: layers.TCPPort(dst.Port),
+		SYN:     true,
+		Seq:     1000,
+		Window:  65535,
+	}, nil)
+
+	synack, _ := s.receiveTCP(t)
+	if !synack.SYN || !synack.ACK {
+		t.Fatalf("expected SYN+ACK but got SYN=%v ACK=%v", synack.SYN, synack.ACK)
+	}
+	for _, opt := range synack.Options {
+		if opt.OptionType == layers.TCPOptionKindMSS {
+			if got := binary.BigEndian.Uint16(opt.OptionData); got != 1440 {
+				t.Errorf("MSS got = %v, want 1440", got)
+			}
+		}
+	}
+
+	s.send(t, src, dst, &layers.TCP{
+		SrcPort: layers.TCPPort(src.Port),
+		DstPort: layers.TCPPort(dst.Port),
+		ACK:     true,
+		Seq:     1001,
+		Ack:     synack.Seq + 1,
+		Window:  65535,
+	}, nil)
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.LocalAddr().String(); got != "[2001:db8::1]:443" {
+		t.Errorf("local address got = %v, want %v", got, "[2001:db8::1]:443")
+	}
+}
+
+func TestReceiveOutOfOrder(t *testing.T) {
+	s := newTestStack(1500)
+	_, c := s.handshake(t, 65535, sackPermittedOption())
+
+	// the second segment arrives first and is selectively acknowledged
+	s.sendTCP(t, layers.TCP{ACK: true, Seq: c.seq + 6, Ack: c.ack, Window: 65535}, []byte("world"))
+	ack, _ := s.receiveTCP(t)
+	if ack.Ack != c.seq {
+		t.Errorf("ack after gap got = %v, want %v", ack.Ack, c.seq)
+	}
+	blocks := sackBlocks(ack)
+	if len(blocks) != 1 || blocks[0] != [2]uint32{c.seq + 6, c.seq + 11} {
+		t.Errorf("SACK blocks got = %v, want %v", blocks, [][2]uint32{{c.seq + 6, c.seq + 11}})
+	}
+
+	// the first segment fills the gap, after which everything is acknowledged
+	s.sendTCP(t, layers.TCP{ACK: true, Seq: c.seq, Ack: c.ack, Window: 65535}, []byte("hello "))
+	ack, _ = s.receiveTCP(t)
+	if ack.Ack != c.seq+11 {
+		t.Errorf("ack after filling gap got = %v, want %v", ack.Ack, c.seq+11)
+	}
+	if blocks := sackBlocks(ack); len(blocks) != 0 {
+		t.Errorf("SACK blocks got = %v, want none", blocks)
+	}
+
+	// a duplicate is acknowledged but not delivered again
+	s.sendTCP(t, layers.TCP{ACK: true, Seq: c.seq, Ack: c.ack, Window: 65535}, []byte("hello "))
+	ack, _ = s.receiveTCP(t)
+	if ack.Ack != c.seq+11 {
+		t.Errorf("ack after duplicate got = %v, want %v", ack.Ack, c.seq+11)
+	}
+
+	// the FIN ends the stream once everything before it has been read
+	s.sendTCP(t, layers.TCP{ACK: true, FIN: true, Seq: c.seq + 11, Ack: c.ack, Window: 65535}, nil)
+	ack, _ = s.receiveTCP(t)
+	if ack.Ack != c.seq+12 {
+		t.Errorf("ack after FIN got = %v, want %v", ack.Ack, c.seq+12)
+	}
+
+	got, err := io.ReadAll(c.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello world" {
+		t.Errorf("data got = %q, want %q", got, "hello world")
+	}
+}
+
+func TestReadSmallBuffer(t *testing.T) {
+	s := newTestStack(1500)
+	_, c := s.handshake(t, 65535)
+
+	// a segment larger than the buffer given to Read is returned over several reads
+	s.sendTCP(t, layers.TCP{ACK: true, Seq: c.seq, Ack: c.ack, Window: 65535}, []byte("hello world"))
+	s.receiveTCP(t)
+
+	var got []byte
+	buf := make([]byte, 4)
+	for len(got) < 11 {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "hello world" {
+		t.Errorf("data got = %q, want %q", got, "hello world")
+	}
+}
+
+func TestWriteSegments(t *testing.T) {
+	s := newTestStack(1500)
+	_, c := s.handshake(t, 65535, mssOption(100))
+
+	payload := bytes.Repeat([]byte("x"), 250)
+	n, err := c.conn.Write(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(payload) {
+		t.Errorf("wrote got = %v, want %v", n, len(payload))
+	}
+
+	seq := c.ack
+	for _, want := range []int{100, 100, 50} {
+		seg, data := s.receiveTCP(t)
+		if seg.Seq != seq {
+			t.Errorf("seq got = %v, want %v", seg.Seq, seq)
+		}
+		if len(data) != want {
+			t.Errorf("segment length got = %v, want %v", len(data), want)
+		}
+		seq += uint32(len(data))
+	}
+	s.expectNothing(t)
+}
+
+func TestWriteWaitsForWindow(t *testing.T) {
+	s := newTestStack(1500)
+	_, c := s.handshake(t, 100)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.conn.Write(bytes.Repeat([]byte("x"), 300))
+		done <- err
+	}()
+
+	// only as much as the subprocess can take is sent
+	seg, data := s.receiveTCP(t)
+	if seg.Seq != c.ack || len(data) != 100 {
+		t.Errorf("first segment got = %v+%d, want %v+100", seg.Seq, len(data), c.ack)
+	}
+	s.expectNothing(t)
+
+	// acknowledging the bytes opens the window again
+	for i := 1; i < 3; i++ {
+		s.sendTCP(t, layers.TCP{ACK: true, Seq: c.seq, Ack: c.ack + uint32(100*i), Window: 100}, nil)
+		seg, data := s.receiveTCP(t)
+		if seg.Seq != c.ack+uint32(100*i) || len(data) != 100 {
+			t.Errorf("segment %d got = %v+%d, want %v+100", i, seg.Seq, len(data), c.ack+uint32(100*i))
+		}
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFastRetransmit(t *testing.T) {
+	s := newTestStack(1500)
+	_, c := s.handshake(t, 65535, mssOption(100), sackPermittedOption())
+
+	if _, err := c.conn.Write(bytes.Repeat([]byte("x"), 500)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		s.receiveTCP(t)
+	}
+
+	// the second segment is lost, and the subprocess says so with duplicate acknowledgements that
+	// selectively acknowledge the segments after it
+	lost := c.ack + 100
+	s.sendTCP(t, layers.TCP{ACK: true, Seq: c.seq, Ack: lost, Window: 65535}, nil)
+	start := time.Now()
+	for i := 2; i < 5; i++ {
+		edges := binary.BigEndian.AppendUint32(nil, lost+100)
+		edges = binary.BigEndian.AppendUint32(edges, c.ack+uint32(100*(i+1)))
+		s.sendTCP(t, layers.TCP{
+			ACK:     true,
+			Seq:     c.seq,
+			Ack:     lost,
+			Window:  65535,
+			Options: []layers.TCPOption{{OptionType: layers.TCPOptionKindSACK, OptionData: edges}},
+		}, nil)
+	}
+
+	seg, data := s.receiveTCP(t)
+	if seg.Seq != lost || len(data) != 100 {
+		t.Errorf("retransmitted segment got = %v+%d, want %v+100", seg.Seq, len(data), lost)
+	}
+	if elapsed := time.Since(start); elapsed >= tcpMinRTO {
+		t.Errorf("retransmitted after %v, want before the retransmission timeout", elapsed)
+	}
+	s.expectNothing(t)
+}
+
+func TestClose(t *testing.T) {
+	s := newTestStack(1500)
+	_, c := s.handshake(t, 65535)
+
+	// the subprocess finishes first, then the application closes
+	s.sendTCP(t, layers.TCP{ACK: true, FIN: true, Seq: c.seq, Ack: c.ack, Window: 65535}, nil)
+	ack, _ := s.receiveTCP(t)
+	if ack.Ack != c.seq+1 {
+		t.Errorf("ack of FIN got = %v, want %v", ack.Ack, c.seq+1)
+	}
+
+	buf := make([]byte, 10)
+	if n, err := c.conn.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("read after FIN got = %d, %v, want 0, EOF", n, err)
+	}
+
+	if err := c.conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fin, _ := s.receiveTCP(t)
+	if !fin.FIN || fin.Seq != c.ack {
+		t.Errorf("got FIN=%v seq=%v, want FIN at %v", fin.FIN, fin.Seq, c.ack)
+	}
+
+	stream := c.conn.(*tcpStream)
+	if got := stream.getState(); got != StateClosed {
+		t.Errorf("state got = %v, want %v", got, StateClosed)
+	}
+
+	// once our FIN is acknowledged there is nothing left to retransmit
+	s.sendTCP(t, layers.TCP{ACK: true, Seq: c.seq + 1, Ack: c.ack + 1, Window: 65535}, nil)
+	if stream.hasUnacked() {
+		t.Error("FIN still waiting to be acknowledged")
+	}
+}
+
+func TestResetUnknownConnection(t *testing.T) {
+	s := newTestStack(1500)
+
+	s.sendTCP(t, layers.TCP{ACK: true, Seq: 1000, Ack: 5000, Window: 65535}, []byte("hello"))
+	rst, _ := s.receiveTCP(t)
+	if !rst.RST {
+		t.Fatal("expected a RST")
+	}
+	if rst.Seq != 5000 {
+		t.Errorf("RST seq got = %v, want 5000", rst.Seq)
+	}
+	if rst.SrcPort != layers.TCPPort(world.Port) || rst.DstPort != layers.TCPPort(subprocess.Port) {
+		t.Errorf("RST ports got = %v => %v, want %v => %v", rst.SrcPort, rst.DstPort, world.Port, subprocess.Port)
+	}
+
+	// a RST is never answered with a RST
+	s.sendTCP(t, layers.TCP{RST: true, Seq: 1000}, nil)
+	s.expectNothing(t)
+}
+
+func TestReject(t *testing.T) {
+	s := newTestStack(1500)
+	s.mux.HandleTCPRequest("*", func(r TCPRequest) { r.Reject() })
+
+	s.sendTCP(t, layers.TCP{SYN: true, Seq: 1000, Window: 65535}, nil)
+	rst, _ := s.receiveTCP(t)
+	if !rst.RST || !rst.ACK || rst.Ack != 1001 {
+		t.Errorf("got RST=%v ACK=%v ack=%v, want RST+ACK of 1001", rst.RST, rst.ACK, rst.Ack)
+	}
+}
+
+func TestAllowTCP(t *testing.T) {
+	s := newTestStack(1500)
+	s.mux.AllowTCP = func(addr net.Addr) bool { return false }
+	s.mux.HandleTCP("*", func(conn net.Conn) { t.Error("handler called for a connection that was not allowed") })
+
+	s.sendTCP(t, layers.TCP{SYN: true, Seq: 1000, Window: 65535}, nil)
+	rst, _ := s.receiveTCP(t)
+	if !rst.RST || !rst.ACK || rst.Ack != 1001 {
+		t.Errorf("got RST=%v ACK=%v ack=%v, want RST+ACK of 1001", rst.RST, rst.ACK, rst.Ack)
+	}
+}
@@ -0,0 +1,283 @@
+package netstack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// UDPStack parses UDP packets with gopacket and dispatches them through a mux
+type UDPStack struct {
+	toSubprocess chan []byte // data sent to this channel goes to subprocess as raw IP packet
+	buf          gopacket.SerializeBuffer
+	bufMu        sync.Mutex // protects buf, which is shared by all flows
+	app          *Mux
+
+	// if not nil, packets to ports for which this returns true are dropped
+	DropPort func(port int) bool
+
+	// the flows seen so far, much like a NAT table, so that each packet is delivered to the connection
+	// for the address and port that it was sent from and to
+	flows     map[udpFlowKey]*udpFlow
+	lastSweep time.Time  // when idle flows were last closed
+	flowsMu   sync.Mutex // protects flows, lastSweep, and the lastActive of each flow
+}
+
+// NewUDPStack creates a UDP stack that dispatches new flows through app and sends packets for the
+// subprocess to link
+func NewUDPStack(app *Mux, link chan []byte) *UDPStack {
+	return &UDPStack{
+		toSubprocess: link,
+		buf:          gopacket.NewSerializeBuffer(),
+		app:          app,
+		flows:        make(map[udpFlowKey]*udpFlow),
+		lastSweep:    time.Now(),
+	}
+}
+
+// UDPIdleTimeout is how long a UDP flow may go without a packet in either direction before it is closed,
+// which is the same as the default for established UDP flows in Linux connection tracking
+const UDPIdleTimeout = 2 * time.Minute
+
+// how often flows are checked for being idle
+const udpSweepInterval = 10 * time.Second
+
+// sweep closes flows that have been idle for longer than UDPIdleTimeout, so that the application stops
+// reading from them. Most flows are a single DNS query and its answer, from a new port each time. The
+// caller must hold s.flowsMu.
+func (s *UDPStack) sweep(now time.Time) {
+	s.lastSweep = now
+	for key, flow := range s.flows {
+		if now.Sub(flow.lastActive) > UDPIdleTimeout {
+			verbosef("closing udp flow from %v to %v after %v without packets", key.src, key.dst, UDPIdleTimeout)
+			delete(s.flows, key)
+			flow.once.Do(func() { close(flow.done) })
+		}
+	}
+}
+
+// udpFlowKey identifies the packets sent from one address and port in the subprocess to one destination
+type udpFlowKey struct {
+	src, dst string
+}
+
+// the number of packets from the subprocess that are queued for a flow before further packets are dropped
+const udpFlowQueue = 64
+
+// udpFlow is a net.Conn for the packets in one flow. Reads return packets sent by the subprocess and
+// writes send packets back to it. Closing a flow removes it from the table, after which the next packet
+// from the subprocess starts a new flow.
+type udpFlow struct {
+	stack   *UDPStack
+	key     udpFlowKey
+	local   *net.UDPAddr // the address that the subprocess sent to
+	remote  *net.UDPAddr // the address of the subprocess
+	w       *udpStackResponder
+	packets chan []byte // pooled packets, owned by whoever receives them
+	done    chan struct{}
+	once    sync.Once
+
+	lastActive time.Time // when the last packet to or from the subprocess was seen
+}
+
+func (f *udpFlow) Read(b []byte) (int, error) {
+	select {
+	case p := <-f.packets:
+		n := copy(b, p)
+		putPacket(p)
+		return n, nil
+	case <-f.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (f *udpFlow) Write(b []byte) (int, error) {
+	select {
+	case <-f.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	f.stack.flowsMu.Lock()
+	f.lastActive = time.Now()
+	f.stack.flowsMu.Unlock()
+
+	f.stack.bufMu.Lock()
+	defer f.stack.bufMu.Unlock()
+	return f.w.Write(b)
+}
+
+func (f *udpFlow) Close() error {
+	f.once.Do(func() { close(f.done) })
+
+	// the flow may already have been removed for being idle, and replaced by a new one
+	f.stack.flowsMu.Lock()
+	if f.stack.flows[f.key] == f {
+		delete(f.stack.flows, f.key)
+	}
+	f.stack.flowsMu.Unlock()
+	return nil
+}
+
+func (f *udpFlow) LocalAddr() net.Addr  { return f.local }
+func (f *udpFlow) RemoteAddr() net.Addr { return f.remote }
+
+// deadlines are not supported by the homegrown stack
+func (f *udpFlow) SetDeadline(t time.Time) error      { return errUDPDeadline }
+func (f *udpFlow) SetReadDeadline(t time.Time) error  { return errUDPDeadline }
+func (f *udpFlow) SetWriteDeadline(t time.Time) error { return errUDPDeadline }
+
+var errUDPDeadline = errors.New("deadlines are not supported for UDP flows in the homegrown stack")
+
+func (s *UDPStack) handlePacket(ip gopacket.NetworkLayer, udp *layers.UDP, payload []byte) {
+	srcIP, dstIP := ipAddrs(ip)
+
+	// the homegrown stack cannot send ICMP, so packets are dropped rather than rejected
+	if s.DropPort != nil && s.DropPort(int(udp.DstPort)) {
+		verbosef("dropping udp packet to %v:%v", dstIP, udp.DstPort)
+		return
+	}
+
+	replyudp := layers.UDP{
+		SrcPort: udp.DstPort,
+		DstPort: udp.SrcPort,
+	}
+
+	w := udpStackResponder{
+		stack:     s,
+		udpheader: &replyudp,
+		ipheader:  newIPHeader(dstIP, srcIP, layers.IPProtocolUDP),
+	}
+
+	// forward the data to application-level listeners
+	verbosef("got %d udp bytes to %v:%v, delivering to application", len(udp.Payload), dstIP, udp.DstPort)
+
+	src := net.UDPAddr{IP: srcIP, Port: int(udp.SrcPort)}
+	dst := net.UDPAddr{IP: dstIP, Port: int(udp.DstPort)}
+	key := udpFlowKey{src: src.String(), dst: dst.String()}
+
+	// look up the flow for this packet, or start a new one, closing idle flows now and then
+	s.flowsMu.Lock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) > udpSweepInterval {
+		s.sweep(now)
+	}
+	flow, ok := s.flows[key]
+	if !ok {
+		flow = &udpFlow{
+			stack:   s,
+			key:     key,
+			local:   &dst,
+			remote:  &src,
+			w:       &w,
+			packets: make(chan []byte, udpFlowQueue),
+			done:    make(chan struct{}),
+		}
+		s.flows[key] = flow
+	}
+	flow.lastActive = now
+	s.flowsMu.Unlock()
+
+	if !ok {
+		s.app.NotifyUDP(flow)
+	}
+
+	// the payload is copied because the buffer that it was read into is reused
+	cp := getPacket(payload)
+	select {
+	case flow.packets <- cp:
+	default:
+		verbosef("dropping udp packet to %v because the queue for this flow is full", key.dst)
+		putPacket(cp)
+	}
+}
+
+// serializeUDP serializes a UDP packet
+func serializeUDP(ip gopacket.SerializableLayer, udp *layers.UDP, payload []byte, tmp gopacket.SerializeBuffer) ([]byte, error) {
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	tmp.Clear()
+
+	// each layer is *prepended*, treating the current buffer data as payload
+	p, err := tmp.AppendBytes(len(payload))
+	if err != nil {
+		return nil, fmt.Errorf("error appending TCP payload to packet (%d bytes): %w", len(payload), err)
+	}
+	copy(p, payload)
+
+	err = udp.SerializeTo(tmp, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing TCP part of packet: %w", err)
+	}
+
+	err = ip.SerializeTo(tmp, opts)
+	if err != nil {
+		errorf("error serializing IP part of packet: %v", err)
+	}
+
+	return tmp.Bytes(), nil
+}
+
+// summarizeUDP summarizes a UDP packet into a single line for logging
+func summarizeUDP(ip gopacket.NetworkLayer, udp *layers.UDP, payload []byte) string {
+	srcIP, dstIP := ipAddrs(ip)
+	return fmt.Sprintf("UDP %v:%d => %v:%d - Len %d",
+		srcIP, udp.SrcPort, dstIP, udp.DstPort, len(udp.Payload))
+}
+
+// udpStackResponder writes UDP packets back to a known sender
+type udpStackResponder struct {
+	stack     *UDPStack
+	udpheader *layers.UDP
+	ipheader  ipHeader
+}
+
+func (r *udpStackResponder) SetSourceIP(ip net.IP) {
+	_, dst := ipAddrs(r.ipheader)
+	r.ipheader = newIPHeader(ip, dst, layers.IPProtocolUDP)
+}
+
+func (r *udpStackResponder) SetSourcePort(port uint16) {
+	r.udpheader.SrcPort = layers.UDPPort(port)
+}
+
+func (r *udpStackResponder) SetDestIP(ip net.IP) {
+	src, _ := ipAddrs(r.ipheader)
+	r.ipheader = newIPHeader(src, ip, layers.IPProtocolUDP)
+}
+
+func (r *udpStackResponder) SetDestPort(port uint16) {
+	r.udpheader.DstPort = layers.UDPPort(port)
+}
+
+func (r *udpStackResponder) Write(payload []byte) (int, error) {
+	// set checksums and lengths
+	r.udpheader.SetNetworkLayerForChecksum(r.ipheader)
+
+	// log
+	verbosef("sending udp packet to subprocess: %s", summarizeUDP(r.ipheader, r.udpheader, payload))
+
+	// serialize the data
+	packet, err := serializeUDP(r.ipheader, r.udpheader, payload, r.stack.buf)
+	if err != nil {
+		return 0, fmt.Errorf("error serializing UDP packet: %w", err)
+	}
+
+	// copy into a pooled buffer because the same buffer will be re-used, and wait for room in the queue
+	// to the subprocess
+	err = enqueuePacket(r.stack.toSubprocess, getPacket(packet))
+	if err != nil {
+		return 0, fmt.Errorf("error sending udp packet to subprocess: %w", err)
+	}
+
+	// return number of bytes passed in, not number of bytes sent to output
+	return len(payload), nil
+}
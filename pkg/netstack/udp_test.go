@@ -0,0 +1,159 @@
+package netstack
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestUDPFlow(t *testing.T) {
+	s := newTestStack(1500)
+	conns := make(chan net.Conn, 1)
+	s.mux.HandleUDP(":53", func(conn net.Conn) { conns <- conn })
+
+	dns := AddrPort{Addr: net.IPv4(8, 8, 8, 8).To4(), Port: 53}
+	udp := func(payload string) {
+		s.send(t, subprocess, dns, &layers.UDP{
+			SrcPort: layers.UDPPort(subprocess.Port),
+			DstPort: layers.UDPPort(dns.Port),
+		}, []byte(payload))
+	}
+
+	// packets between the same addresses and ports belong to one flow
+	udp("query 1")
+	udp("query 2")
+	conn := <-conns
+
+	buf := make([]byte, 100)
+	for _, want := range []string{"query 1", "query 2"} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Errorf("read got = %q, want %q", buf[:n], want)
+		}
+	}
+	select {
+	case <-conns:
+		t.Error("second packet started a new flow")
+	default:
+	}
+
+	// replies go back to the subprocess from the address it sent to
+	if _, err := conn.Write([]byte("answer")); err != nil {
+		t.Fatal(err)
+	}
+	p := <-s.out
+	packet := gopacket.NewPacket(p, ipLayerType(p), gopacket.Default)
+	putPacket(p)
+	reply, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		t.Fatalf("expected a UDP packet but got:\n%v", packet.Dump())
+	}
+	if string(reply.Payload) != "answer" {
+		t.Errorf("reply got = %q, want %q", reply.Payload, "answer")
+	}
+	ip := packet.NetworkLayer().(*layers.IPv4)
+	if !ip.SrcIP.Equal(dns.Addr) || reply.SrcPort != layers.UDPPort(dns.Port) {
+		t.Errorf("reply source got = %v:%v, want %v", ip.SrcIP, reply.SrcPort, dns)
+	}
+	if !ip.DstIP.Equal(subprocess.Addr) || reply.DstPort != layers.UDPPort(subprocess.Port) {
+		t.Errorf("reply destination got = %v:%v, want %v", ip.DstIP, reply.DstPort, subprocess)
+	}
+}
+
+func TestUDPDropPort(t *testing.T) {
+	s := newTestStack(1500)
+	s.udp.DropPort = func(port int) bool { return port == 443 }
+
+	conns := make(chan net.Conn, 2)
+	s.mux.HandleUDP("*", func(conn net.Conn) { conns <- conn })
+
+	for _, port := range []uint16{443, 53} {
+		dst := AddrPort{Addr: world.Addr, Port: port}
+		s.send(t, subprocess, dst, &layers.UDP{
+			SrcPort: layers.UDPPort(subprocess.Port),
+			DstPort: layers.UDPPort(port),
+		}, []byte("hello"))
+	}
+
+	conn := <-conns
+	if got := conn.LocalAddr().(*net.UDPAddr).Port; got != 53 {
+		t.Errorf("port got = %v, want 53", got)
+	}
+	select {
+	case conn := <-conns:
+		t.Errorf("got flow to %v, want it dropped", conn.LocalAddr())
+	default:
+	}
+}
+
+func TestUDPIdleFlow(t *testing.T) {
+	s := newTestStack(1500)
+	conns := make(chan net.Conn, 2)
+	s.mux.HandleUDP(":53", func(conn net.Conn) { conns <- conn })
+
+	dns := AddrPort{Addr: net.IPv4(8, 8, 8, 8).To4(), Port: 53}
+	s.send(t, subprocess, dns, &layers.UDP{
+		SrcPort: layers.UDPPort(subprocess.Port),
+		DstPort: layers.UDPPort(dns.Port),
+	}, []byte("query"))
+	conn := <-conns
+	buf := make([]byte, 100)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// a flow that has been idle for too long is closed and forgotten
+	s.udp.flowsMu.Lock()
+	s.udp.sweep(time.Now().Add(UDPIdleTimeout + time.Second))
+	flows := len(s.udp.flows)
+	s.udp.flowsMu.Unlock()
+	if flows != 0 {
+		t.Errorf("flows after sweep got = %d, want 0", flows)
+	}
+	if _, err := conn.Read(buf); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read from idle flow got err = %v, want %v", err, net.ErrClosed)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPFlowActiveOnReply(t *testing.T) {
+	s := newTestStack(1500)
+	conns := make(chan net.Conn, 1)
+	s.mux.HandleUDP(":53", func(conn net.Conn) { conns <- conn })
+
+	dns := AddrPort{Addr: net.IPv4(8, 8, 8, 8).To4(), Port: 53}
+	s.send(t, subprocess, dns, &layers.UDP{
+		SrcPort: layers.UDPPort(subprocess.Port),
+		DstPort: layers.UDPPort(dns.Port),
+	}, []byte("query"))
+	conn := <-conns
+
+	// a flow that only receives packets from the world is still active
+	start := time.Now()
+	s.udp.flowsMu.Lock()
+	for _, flow := range s.udp.flows {
+		flow.lastActive = start.Add(-time.Second)
+	}
+	s.udp.flowsMu.Unlock()
+	if _, err := conn.Write([]byte("answer")); err != nil {
+		t.Fatal(err)
+	}
+	<-s.out
+
+	s.udp.flowsMu.Lock()
+	s.udp.sweep(start.Add(UDPIdleTimeout))
+	flows := len(s.udp.flows)
+	s.udp.flowsMu.Unlock()
+	if flows != 1 {
+		t.Errorf("flows after sweep got = %d, want 1", flows)
+	}
+}
@@ -0,0 +1,94 @@
+// Package policy decides whether the DNS queries, connections, and HTTP requests of a subprocess are
+// allowed, according to the rules given with --policy. Each is checked against the rules for it in
+// order, and the first rule that allows or denies it decides what happens. Rules that modify an HTTP
+// request change it and let later rules apply too. Anything that no rule decides is allowed.
+package policy
+
+import (
+	"fmt"
+
+	"github.com/monasticacademy/httptap/pkg/filter"
+)
+
+// Verbosef is called to log rules that could not be evaluated. Nothing is logged until it is set.
+var Verbosef = func(format string, args ...any) {}
+
+// Variables are the variables that the expressions of rules can refer to, for each kind of thing that
+// they check
+var Variables = map[string][]string{
+	"dns":     {"name", "type", "host"},
+	"connect": {"proto", "host", "ip", "port"},
+	"http":    {"req", "host", "method", "url", "path"},
+}
+
+// Rule is one rule in a policy. How modify rules change HTTP requests is up to the caller.
+type Rule struct {
+	Name   string `json:"name" yaml:"name"`     // name to report decisions under
+	On     string `json:"on" yaml:"on"`         // dns, connect, or http
+	When   string `json:"when" yaml:"when"`     // expression that must be true for the rule to apply, or empty for always
+	Action string `json:"action" yaml:"action"` // allow, deny, or modify
+	Status int    `json:"status" yaml:"status"` // status code to deny HTTP requests with, or 403 if not given
+	when   *filter.Filter
+}
+
+// Compile checks a rule and compiles its expression. It must be called before the rule is given to
+// Decide.
+func (r *Rule) Compile() error {
+	vars, ok := Variables[r.On]
+	if !ok {
+		return fmt.Errorf("on must be dns, connect, or http, not %q", r.On)
+	}
+	switch r.Action {
+	case "allow", "deny":
+	case "modify":
+		if r.On != "http" {
+			return fmt.Errorf("only http rules can modify")
+		}
+	default:
+		return fmt.Errorf("action must be allow, deny, or modify, not %q", r.Action)
+	}
+	if r.Status != 0 && (r.Action != "deny" || r.On != "http") {
+		return fmt.Errorf("only http rules that deny can have a status")
+	}
+	if r.Status != 0 && (r.Status < 100 || r.Status > 999) {
+		return fmt.Errorf("%d is not a status code", r.Status)
+	}
+	r.when = nil
+	if r.When != "" {
+		f, err := filter.Compile(r.When, vars...)
+		if err != nil {
+			return fmt.Errorf("error in when: %w", err)
+		}
+		r.when = f
+	}
+	return nil
+}
+
+// Decide finds the first rule for a kind of thing that allows or denies it, given the values of the
+// variables that rules for it refer to, calling modify with each modify rule that applies before then.
+// Rules whose expression cannot be evaluated are skipped. It returns nil if no rule decides.
+func Decide(rules []*Rule, on string, vars map[string]any, modify func(*Rule) error) (*Rule, error) {
+	for _, rule := range rules {
+		if rule.On != on {
+			continue
+		}
+		if rule.when != nil {
+			ok, err := rule.when.Match(vars)
+			if err != nil {
+				Verbosef("could not evaluate --policy %v: %v", rule.Name, err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+		}
+		if rule.Action == "modify" {
+			if err := modify(rule); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return rule, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,160 @@
+package policy
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		rule    Rule
+		wantErr string
+	}{
+		{rule: Rule{On: "dns", Action: "deny"}},
+		{rule: Rule{On: "connect", When: `port == 22`, Action: "allow"}},
+		{rule: Rule{On: "http", When: `method != "GET"`, Action: "deny", Status: 405}},
+		{rule: Rule{On: "http", Action: "modify"}},
+		{rule: Rule{On: "tcp", Action: "deny"}, wantErr: "on must be dns, connect, or http"},
+		{rule: Rule{On: "dns", Action: "block"}, wantErr: "action must be allow, deny, or modify"},
+		{rule: Rule{On: "dns", Action: "modify"}, wantErr: "only http rules can modify"},
+		{rule: Rule{On: "connect", Action: "deny", Status: 403}, wantErr: "only http rules that deny can have a status"},
+		{rule: Rule{On: "http", Action: "allow", Status: 200}, wantErr: "only http rules that deny can have a status"},
+		{rule: Rule{On: "http", Action: "deny", Status: 42}, wantErr: "42 is not a status code"},
+		{rule: Rule{On: "dns", When: `port == 53`, Action: "deny"}, wantErr: "error in when"},
+		{rule: Rule{On: "http", When: `method ==`, Action: "deny"}, wantErr: "error in when"},
+	}
+	for _, tt := range tests {
+		err := tt.rule.Compile()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("Compile(%+v) got = %v, want nil", tt.rule, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("Compile(%+v) got = %v, want an error containing %q", tt.rule, err, tt.wantErr)
+		}
+	}
+}
+
+func compile(t *testing.T, rules ...Rule) []*Rule {
+	var compiled []*Rule
+	for _, rule := range rules {
+		if err := rule.Compile(); err != nil {
+			t.Fatalf("error compiling %v: %v", rule.Name, err)
+		}
+		compiled = append(compiled, &rule)
+	}
+	return compiled
+}
+
+func TestDecide(t *testing.T) {
+	rules := compile(t,
+		Rule{Name: "no telemetry", On: "dns", When: `host.endsWith("telemetry.example.com")`, Action: "deny"},
+		Rule{Name: "ssh", On: "connect", When: `port == 22 && ip == "10.0.0.1"`, Action: "allow"},
+		Rule{Name: "no ssh", On: "connect", When: `port == 22`, Action: "deny"},
+		Rule{Name: "tag", On: "http", When: `host == "api.example.com"`, Action: "modify"},
+		// none of the requests below have this header, so this rule cannot be evaluated and is skipped
+		Rule{Name: "counted", On: "http", When: `req.headers["X-Count"] > 3`, Action: "deny"},
+		Rule{Name: "health", On: "http", When: `path == "/health"`, Action: "allow"},
+		Rule{Name: "trace", On: "http", Action: "modify"},
+		Rule{Name: "read only", On: "http", When: `method != "GET"`, Action: "deny", Status: 405},
+	)
+
+	tests := []struct {
+		name         string
+		on           string
+		vars         map[string]any
+		want         string // the name of the rule that decides, or empty if none does
+		wantModified []string
+	}{
+		{
+			name: "denied name",
+			on:   "dns",
+			vars: map[string]any{"name": "eu.telemetry.example.com", "type": "A", "host": "eu.telemetry.example.com"},
+			want: "no telemetry",
+		},
+		{
+			name: "undecided name",
+			on:   "dns",
+			vars: map[string]any{"name": "example.com", "type": "A", "host": "example.com"},
+		},
+		{
+			name: "earlier rule allows",
+			on:   "connect",
+			vars: map[string]any{"proto": "tcp", "host": "", "ip": "10.0.0.1", "port": int64(22)},
+			want: "ssh",
+		},
+		{
+			name: "later rule denies",
+			on:   "connect",
+			vars: map[string]any{"proto": "tcp", "host": "", "ip": "10.0.0.2", "port": int64(22)},
+			want: "no ssh",
+		},
+		{
+			name:         "modify rules before the one that decides",
+			on:           "http",
+			vars:         httpVars("POST", "api.example.com", "/v1/items"),
+			want:         "read only",
+			wantModified: []string{"tag", "trace"},
+		},
+		{
+			name: "allowed before any modify rule",
+			on:   "http",
+			vars: httpVars("GET", "example.com", "/health"),
+			want: "health",
+		},
+		{
+			name:         "modified but undecided",
+			on:           "http",
+			vars:         httpVars("GET", "example.com", "/"),
+			wantModified: []string{"trace"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var modified []string
+			rule, err := Decide(rules, tt.on, tt.vars, func(r *Rule) error {
+				modified = append(modified, r.Name)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if rule != nil {
+				got = rule.Name
+			}
+			if got != tt.want {
+				t.Errorf("Decide() got = %q, want %q", got, tt.want)
+			}
+			if !slices.Equal(modified, tt.wantModified) {
+				t.Errorf("modify rules got = %q, want %q", modified, tt.wantModified)
+			}
+		})
+	}
+}
+
+func httpVars(method, host, path string) map[string]any {
+	return map[string]any{
+		"req":    map[string]any{"headers": map[string]any{}},
+		"host":   host,
+		"method": method,
+		"url":    "https://" + host + path,
+		"path":   path,
+	}
+}
+
+// an error from a modify rule stops the request
+func TestDecideModifyError(t *testing.T) {
+	rules := compile(t,
+		Rule{Name: "rewrite", On: "http", Action: "modify"},
+		Rule{Name: "deny", On: "http", Action: "deny"},
+	)
+	errRewrite := errors.New("rewrite failed")
+	rule, err := Decide(rules, "http", httpVars("GET", "example.com", "/"), func(*Rule) error {
+		return errRewrite
+	})
+	if rule != nil || !errors.Is(err, errRewrite) {
+		t.Errorf("Decide() got = %v, %v, want nil, %v", rule, err, errRewrite)
+	}
+}
@@ -0,0 +1,97 @@
+// Package reqmatch decides which HTTP requests the rules given with --rules apply to, and matches host
+// names against patterns such as "*.example.com" in the way that every flag that takes hosts does.
+package reqmatch
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Match says which requests a rule applies to. Every field that is set must match.
+type Match struct {
+	Host    string            `json:"host" yaml:"host"`       // host name, with wildcards such as *.example.com
+	Path    string            `json:"path" yaml:"path"`       // regular expression that the path must match
+	Method  string            `json:"method" yaml:"method"`   // method such as GET
+	Headers map[string]string `json:"headers" yaml:"headers"` // regular expressions that header values must match
+}
+
+// Matcher is a Match with its regular expressions compiled
+type Matcher struct {
+	method  string
+	host    string
+	path    *regexp.Regexp
+	headers map[string]*regexp.Regexp
+}
+
+// Compile checks a Match and compiles its regular expressions
+func Compile(m Match) (*Matcher, error) {
+	c := &Matcher{
+		method:  strings.ToUpper(m.Method),
+		host:    m.Host,
+		headers: make(map[string]*regexp.Regexp),
+	}
+	if m.Path != "" {
+		re, err := regexp.Compile(m.Path)
+		if err != nil {
+			return nil, fmt.Errorf("error in path: %w", err)
+		}
+		c.path = re
+	}
+	for name, pattern := range m.Headers {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("error in header %v: %w", name, err)
+		}
+		c.headers[name] = re
+	}
+	return c, nil
+}
+
+// Matches reports whether a request is one that the Match applies to
+func (m *Matcher) Matches(req *http.Request) bool {
+	if m.host != "" && !Host(m.host, req.URL.Hostname()) {
+		return false
+	}
+	if m.method != "" && m.method != req.Method {
+		return false
+	}
+	if m.path != nil && !m.path.MatchString(req.URL.Path) {
+		return false
+	}
+	for name, re := range m.headers {
+		if !re.MatchString(req.Header.Get(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Submatches returns a path followed by the submatches of the path pattern in it, or nil if there is no
+// path pattern or it does not match
+func (m *Matcher) Submatches(path string) []string {
+	if m.path == nil {
+		return nil
+	}
+	return m.path.FindStringSubmatch(path)
+}
+
+// Expand replaces $1 and ${name} in template with the submatches of the path pattern in a path, in the
+// way of regexp.Regexp.Expand. The template is returned as it is if there is no path pattern.
+func (m *Matcher) Expand(template, path string) string {
+	if m.path == nil {
+		return template
+	}
+	match := m.path.FindStringSubmatchIndex(path)
+	return string(m.path.ExpandString(nil, template, path, match))
+}
+
+// Host checks whether a host name matches a pattern such as "example.com" or "*.bank.com", ignoring
+// case and any trailing dot
+func Host(pattern, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ok, _ := path.Match(strings.ToLower(pattern), host)
+	return ok
+}
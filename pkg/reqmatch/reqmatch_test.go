@@ -0,0 +1,179 @@
+package reqmatch
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "example.com", host: "example.com", want: true},
+		{pattern: "example.com", host: "EXAMPLE.com.", want: true},
+		{pattern: "Example.COM", host: "example.com", want: true},
+		{pattern: "example.com", host: "api.example.com", want: false},
+		{pattern: "*.example.com", host: "api.example.com", want: true},
+		{pattern: "*.example.com", host: "example.com", want: false},
+		{pattern: "*.example.com", host: "a.b.example.com", want: true}, // a wildcard covers any number of labels
+		{pattern: "*", host: "localhost", want: true},
+		{pattern: "10.0.0.?", host: "10.0.0.7", want: true},
+		{pattern: "[", host: "[", want: false},
+	}
+	for _, tt := range tests {
+		if got := Host(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("Host(%q, %q) got = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func newRequest(t *testing.T, method, url string, header ...string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return req
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		match Match
+		req   *http.Request
+		want  bool
+	}{
+		{
+			name: "empty match",
+			req:  newRequest(t, "POST", "https://example.com/"),
+			want: true,
+		},
+		{
+			name:  "host wildcard",
+			match: Match{Host: "*.example.com"},
+			req:   newRequest(t, "GET", "https://api.example.com:8443/v1"),
+			want:  true,
+		},
+		{
+			name:  "other host",
+			match: Match{Host: "*.example.com"},
+			req:   newRequest(t, "GET", "https://example.org/v1"),
+			want:  false,
+		},
+		{
+			name:  "method in lower case",
+			match: Match{Method: "post"},
+			req:   newRequest(t, "POST", "https://example.com/"),
+			want:  true,
+		},
+		{
+			name:  "other method",
+			match: Match{Method: "GET"},
+			req:   newRequest(t, "POST", "https://example.com/"),
+			want:  false,
+		},
+		{
+			name:  "path",
+			match: Match{Path: "^/v1/users/[0-9]+$"},
+			req:   newRequest(t, "GET", "https://example.com/v1/users/42?expand=1"),
+			want:  true,
+		},
+		{
+			name:  "other path",
+			match: Match{Path: "^/v1/users/[0-9]+$"},
+			req:   newRequest(t, "GET", "https://example.com/v1/users/me"),
+			want:  false,
+		},
+		{
+			name:  "header",
+			match: Match{Headers: map[string]string{"content-type": "^application/json"}},
+			req:   newRequest(t, "POST", "https://example.com/", "Content-Type", "application/json; charset=utf-8"),
+			want:  true,
+		},
+		{
+			name:  "missing header",
+			match: Match{Headers: map[string]string{"Authorization": "^Bearer "}},
+			req:   newRequest(t, "GET", "https://example.com/"),
+			want:  false,
+		},
+		{
+			name:  "header that can be empty",
+			match: Match{Headers: map[string]string{"Authorization": ".*"}},
+			req:   newRequest(t, "GET", "https://example.com/"),
+			want:  true,
+		},
+		{
+			name:  "every field",
+			match: Match{Host: "example.com", Method: "PUT", Path: "^/items/", Headers: map[string]string{"X-Env": "^prod$"}},
+			req:   newRequest(t, "PUT", "https://example.com/items/1", "X-Env", "prod"),
+			want:  true,
+		},
+		{
+			name:  "every field but one",
+			match: Match{Host: "example.com", Method: "PUT", Path: "^/items/", Headers: map[string]string{"X-Env": "^prod$"}},
+			req:   newRequest(t, "PUT", "https://example.com/items/1", "X-Env", "staging"),
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Compile(tt.match)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Matches(tt.req); got != tt.want {
+				t.Errorf("Matches() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		match   Match
+		wantErr string
+	}{
+		{match: Match{Path: "("}, wantErr: "error in path"},
+		{match: Match{Headers: map[string]string{"Accept": "[a-"}}, wantErr: "error in header Accept"},
+	}
+	for _, tt := range tests {
+		_, err := Compile(tt.match)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Compile(%+v) got = %v, want an error containing %q", tt.match, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSubmatches(t *testing.T) {
+	m, err := Compile(Match{Path: `^/v1/(?P<resource>[a-z]+)/(\d+)`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.Submatches("/v1/users/42"), []string{"/v1/users/42", "users", "42"}; !slices.Equal(got, want) {
+		t.Errorf("Submatches() got = %q, want %q", got, want)
+	}
+	if got := m.Submatches("/v2/users/42"); got != nil {
+		t.Errorf("Submatches() of a path that does not match got = %q, want nil", got)
+	}
+	if got, want := m.Expand("https://staging.example.com/${resource}/$2", "/v1/users/42"), "https://staging.example.com/users/42"; got != want {
+		t.Errorf("Expand() got = %v, want %v", got, want)
+	}
+
+	// without a path pattern there is nothing to expand
+	m, err = Compile(Match{Host: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Submatches("/v1/users/42"); got != nil {
+		t.Errorf("Submatches() without a path got = %q, want nil", got)
+	}
+	if got, want := m.Expand("https://staging.example.com/$1", "/v1/users/42"), "https://staging.example.com/$1"; got != want {
+		t.Errorf("Expand() without a path got = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,254 @@
+package scrub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// member is a key and value in a JSON object. Objects are decoded as slices of members rather than
+// maps so that scrubbed bodies keep the order of their keys.
+type member struct {
+	key   string
+	value any
+}
+
+// object is a decoded JSON object
+type object []member
+
+// decodeJSON parses a JSON document into objects, []any, strings, json.Numbers, bools, and nil
+func decodeJSON(body []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	v, err := decodeValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+func decodeValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+	switch delim {
+	case '{':
+		obj := object{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, member{key: key.(string), value: value})
+		}
+		_, err := dec.Token() // the closing brace
+		return obj, err
+	case '[':
+		arr := []any{}
+		for dec.More() {
+			value, err := decodeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		_, err := dec.Token() // the closing bracket
+		return arr, err
+	}
+	return nil, fmt.Errorf("unexpected %v", delim)
+}
+
+// encodeJSON writes a document produced by decodeJSON
+func encodeJSON(w *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case object:
+		w.WriteByte('{')
+		for i, m := range v {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			if err := encodeJSON(w, m.key); err != nil {
+				return err
+			}
+			w.WriteByte(':')
+			if err := encodeJSON(w, m.value); err != nil {
+				return err
+			}
+		}
+		w.WriteByte('}')
+	case []any:
+		w.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			if err := encodeJSON(w, elem); err != nil {
+				return err
+			}
+		}
+		w.WriteByte(']')
+	default:
+		// json.Encoder escapes <, >, and & unless told not to, and adds a newline that we remove
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	}
+	return nil
+}
+
+type segmentKind int
+
+const (
+	segmentName segmentKind = iota
+	segmentIndex
+	segmentWildcard
+)
+
+// segment is one step of a JSONPath expression
+type segment struct {
+	kind    segmentKind
+	name    string // for segmentName
+	index   int    // for segmentIndex, counting from the end if negative
+	descend bool   // whether this step matches at any depth, as in ..name
+}
+
+// matches checks whether a segment selects the child of an object with the given key, or the
+// element of an array of the given length with the given index
+func (seg *segment) matches(key string, isKey bool, index, length int) bool {
+	switch seg.kind {
+	case segmentName:
+		return isKey && key == seg.name
+	case segmentIndex:
+		return !isKey && (index == seg.index || seg.index < 0 && index == length+seg.index)
+	default:
+		return true
+	}
+}
+
+// parsePath parses a JSONPath expression into segments
+func parsePath(path string) ([]segment, error) {
+	fail := func(msg string, args ...any) ([]segment, error) {
+		return nil, fmt.Errorf("invalid JSONPath %q: %s", path, fmt.Sprintf(msg, args...))
+	}
+	if !strings.HasPrefix(path, "$") {
+		return fail("must start with $")
+	}
+
+	var segs []segment
+	s := path[1:]
+	for len(s) > 0 {
+		var seg segment
+		switch {
+		case strings.HasPrefix(s, ".."):
+			seg.descend = true
+			s = s[2:]
+			if strings.HasPrefix(s, "[") {
+				break // a bracketed segment follows
+			}
+			fallthrough
+		case strings.HasPrefix(s, "."):
+			s = strings.TrimPrefix(s, ".")
+			if strings.HasPrefix(s, "*") {
+				seg.kind = segmentWildcard
+				s = s[1:]
+				segs = append(segs, seg)
+				continue
+			}
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			if end == 0 {
+				return fail("expected a name at position %d", len(path)-len(s))
+			}
+			seg.kind = segmentName
+			seg.name = s[:end]
+			s = s[end:]
+			segs = append(segs, seg)
+			continue
+		case strings.HasPrefix(s, "["):
+		default:
+			return fail("unexpected %q at position %d", s[0], len(path)-len(s))
+		}
+
+		// a bracketed segment: [*], [3], ['name'], or ["name"]
+		end := strings.Index(s, "]")
+		if !strings.HasPrefix(s, "[") || end < 0 {
+			return fail("expected [...] at position %d", len(path)-len(s))
+		}
+		inner := s[1:end]
+		s = s[end+1:]
+		switch {
+		case inner == "*":
+			seg.kind = segmentWildcard
+		case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+			seg.kind = segmentName
+			seg.name = inner[1 : len(inner)-1]
+		default:
+			n, err := strconv.Atoi(inner)
+			if err != nil {
+				return fail("expected an index, a quoted name, or * between brackets but got %q", inner)
+			}
+			seg.kind = segmentIndex
+			seg.index = n
+		}
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// apply replaces the values that a path selects in a document with a string, reporting whether
+// anything was replaced. Objects and arrays are changed in place.
+func apply(v any, segs []segment, replace string) (any, bool) {
+	if len(segs) == 0 {
+		return replace, true
+	}
+	seg, rest := &segs[0], segs[1:]
+
+	var changed bool
+	visit := func(child any, key string, isKey bool, index, length int) any {
+		var ch bool
+		if seg.descend {
+			// look for matches further down before replacing this child as a whole
+			child, ch = apply(child, segs, replace)
+			changed = changed || ch
+		}
+		if seg.matches(key, isKey, index, length) {
+			child, ch = apply(child, rest, replace)
+			changed = changed || ch
+		}
+		return child
+	}
+
+	switch v := v.(type) {
+	case object:
+		for i := range v {
+			v[i].value = visit(v[i].value, v[i].key, true, i, len(v))
+		}
+	case []any:
+		for i := range v {
+			v[i] = visit(v[i], "", false, i, len(v))
+		}
+	}
+	return v, changed
+}
@@ -0,0 +1,144 @@
+// Package scrub removes sensitive information such as personal data from HTTP bodies, according to
+// rules that either match a regular expression anywhere in a body or select values in a JSON body
+// with a JSONPath expression such as
+//
+//	$.user.email
+//	$..password
+//	$.cards[*].number
+//
+// The JSONPath support is a subset: the root $, child names (.name or ['name']), wildcards (.* or [*]),
+// array indices ([0], or [-1] for the last element), and recursive descent (..name or ..*).
+package scrub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// DefaultReplacement is what matched text and values are replaced with when a rule does not say
+const DefaultReplacement = "[REDACTED]"
+
+// Rule is a single scrub rule as written in a rules file. Exactly one of Regex and JSONPath must be set.
+type Rule struct {
+	// Regex is a regular expression in the syntax of the regexp package. Each match is replaced
+	// with Replace, in which $1 and ${name} refer to submatches.
+	Regex string `json:"regex,omitempty"`
+	// JSONPath selects values in JSON bodies, each of which is replaced with the string Replace.
+	// Bodies that are not JSON are left alone.
+	JSONPath string `json:"jsonpath,omitempty"`
+	// Replace is the replacement, or DefaultReplacement if empty.
+	Replace string `json:"replace,omitempty"`
+}
+
+type regexRule struct {
+	re      *regexp.Regexp
+	replace []byte
+}
+
+type pathRule struct {
+	path    []segment
+	replace string
+}
+
+// Scrubber applies a set of rules to bodies. A nil Scrubber leaves bodies unchanged.
+type Scrubber struct {
+	regexes []regexRule
+	paths   []pathRule
+}
+
+// New compiles a set of rules
+func New(rules []Rule) (*Scrubber, error) {
+	var s Scrubber
+	for i, rule := range rules {
+		replace := rule.Replace
+		if replace == "" {
+			replace = DefaultReplacement
+		}
+		switch {
+		case rule.Regex != "" && rule.JSONPath != "":
+			return nil, fmt.Errorf("rule %d has both a regex and a jsonpath", i+1)
+		case rule.Regex != "":
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i+1, err)
+			}
+			s.regexes = append(s.regexes, regexRule{re: re, replace: []byte(replace)})
+		case rule.JSONPath != "":
+			path, err := parsePath(rule.JSONPath)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i+1, err)
+			}
+			s.paths = append(s.paths, pathRule{path: path, replace: replace})
+		default:
+			return nil, fmt.Errorf("rule %d has neither a regex nor a jsonpath", i+1)
+		}
+	}
+	return &s, nil
+}
+
+// Load reads rules from a file containing a JSON array of rules, such as
+//
+//	[
+//	  {"jsonpath": "$..password"},
+//	  {"regex": "\\b\\d{3}-\\d{2}-\\d{4}\\b", "replace": "[SSN]"}
+//	]
+func Load(path string) (*Scrubber, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("error parsing %v: %w", path, err)
+	}
+	s, err := New(rules)
+	if err != nil {
+		return nil, fmt.Errorf("error in %v: %w", path, err)
+	}
+	return s, nil
+}
+
+// Scrub returns a body with the rules applied. JSONPath rules are applied first, then regular
+// expressions. A JSON body that some JSONPath rule changed is re-encoded without insignificant
+// whitespace. The body passed in is never modified, and is returned as is if no rule matched.
+func (s *Scrubber) Scrub(body []byte) []byte {
+	if s == nil || len(body) == 0 {
+		return body
+	}
+
+	if len(s.paths) > 0 && looksLikeJSON(body) {
+		if doc, err := decodeJSON(body); err == nil {
+			var changed bool
+			for _, rule := range s.paths {
+				var ch bool
+				doc, ch = apply(doc, rule.path, rule.replace)
+				changed = changed || ch
+			}
+			if changed {
+				var buf bytes.Buffer
+				if err := encodeJSON(&buf, doc); err == nil {
+					body = buf.Bytes()
+				}
+			}
+		}
+	}
+
+	for _, rule := range s.regexes {
+		if rule.re.Match(body) {
+			body = rule.re.ReplaceAll(body, rule.replace)
+		}
+	}
+	return body
+}
+
+// looksLikeJSON checks whether a body starts with an object or array, so that we do not try to parse
+// every body as JSON
+func looksLikeJSON(body []byte) bool {
+	body = bytes.TrimLeft(body, " \t\r\n")
+	return len(body) > 0 && (body[0] == '{' || body[0] == '[')
+}
@@ -0,0 +1,136 @@
+package scrub
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		body  string
+		want  string
+	}{
+		{
+			name:  "child",
+			rules: []Rule{{JSONPath: "$.user.email"}},
+			body:  `{"user": {"name": "ann", "email": "ann@example.com"}, "id": 1}`,
+			want:  `{"user":{"name":"ann","email":"[REDACTED]"},"id":1}`,
+		},
+		{
+			name:  "recursive descent",
+			rules: []Rule{{JSONPath: "$..password", Replace: "***"}},
+			body:  `{"password": "a", "accounts": [{"password": "b"}, {"password": {"old": "c"}}]}`,
+			want:  `{"password":"***","accounts":[{"password":"***"},{"password":"***"}]}`,
+		},
+		{
+			name:  "wildcard and index",
+			rules: []Rule{{JSONPath: "$.cards[*].number"}, {JSONPath: "$.phones[-1]"}},
+			body:  `{"cards": [{"number": "4111"}, {"number": "5500"}], "phones": ["1", "2"]}`,
+			want:  `{"cards":[{"number":"[REDACTED]"},{"number":"[REDACTED]"}],"phones":["1","[REDACTED]"]}`,
+		},
+		{
+			name:  "quoted name",
+			rules: []Rule{{JSONPath: "$['api key']"}},
+			body:  `{"api key": "xyz", "n": 1.50}`,
+			want:  `{"api key":"[REDACTED]","n":1.50}`,
+		},
+		{
+			name:  "no match leaves body as is",
+			rules: []Rule{{JSONPath: "$.missing"}},
+			body:  `{ "a" : "<b>" }`,
+			want:  `{ "a" : "<b>" }`,
+		},
+		{
+			name:  "not json",
+			rules: []Rule{{JSONPath: "$.a"}},
+			body:  `{"a": "truncat`,
+			want:  `{"a": "truncat`,
+		},
+		{
+			name:  "regex",
+			rules: []Rule{{Regex: `\b\d{3}-\d{2}-\d{4}\b`, Replace: "[SSN]"}},
+			body:  "ssn=123-45-6789&other=1234-56-789",
+			want:  "ssn=[SSN]&other=1234-56-789",
+		},
+		{
+			name:  "regex submatch",
+			rules: []Rule{{Regex: `\d{12}(\d{4})`, Replace: "************$1"}},
+			body:  "card 4111111111111111",
+			want:  "card ************1111",
+		},
+		{
+			name:  "jsonpath then regex",
+			rules: []Rule{{Regex: `secret`}, {JSONPath: "$.token"}},
+			body:  `{"token": "abc", "note": "a secret"}`,
+			want:  `{"token":"[REDACTED]","note":"a [REDACTED]"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := []byte(tt.body)
+			got := s.Scrub(body)
+			if string(got) != tt.want {
+				t.Errorf("Scrub() got = %s, want %s", got, tt.want)
+			}
+			if string(body) != tt.body {
+				t.Errorf("Scrub() modified its input to %s", body)
+			}
+		})
+	}
+}
+
+func TestNewError(t *testing.T) {
+	tests := []struct {
+		rule    Rule
+		wantErr string
+	}{
+		{Rule{}, "neither a regex nor a jsonpath"},
+		{Rule{Regex: "a", JSONPath: "$.a"}, "both a regex and a jsonpath"},
+		{Rule{Regex: "("}, "missing closing )"},
+		{Rule{JSONPath: "a.b"}, "must start with $"},
+		{Rule{JSONPath: "$.a["}, "expected [...]"},
+		{Rule{JSONPath: "$[x]"}, "expected an index"},
+		{Rule{JSONPath: "$a"}, `unexpected 'a'`},
+		{Rule{JSONPath: "$.a."}, "expected a name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantErr, func(t *testing.T) {
+			_, err := New([]Rule{tt.rule})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("New() error got = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	err := os.WriteFile(path, []byte(`[{"jsonpath": "$.a"}, {"regex": "b+", "replace": "B"}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s.Scrub([]byte(`{"a":"x","c":"bbb"}`))); got != `{"a":"[REDACTED]","c":"B"}` {
+		t.Errorf("Scrub() got = %v, want %v", got, `{"a":"[REDACTED]","c":"B"}`)
+	}
+
+	// misspelled fields are caught
+	err = os.WriteFile(path, []byte(`[{"jsonpth": "$.a"}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Errorf("Load() error got = %v, want unknown field", err)
+	}
+}
@@ -0,0 +1,49 @@
+// Package shellquote quotes strings and bytes for a POSIX shell, so that commands such as the ones printed
+// by --curl can be pasted into a terminal and run as they are.
+package shellquote
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Quote quotes a string for a POSIX shell, leaving it as is if that is safe
+func Quote(s string) string {
+	safe := s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./-_", r))
+	}) < 0
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Printf quotes bytes as a format for printf, which prints them exactly. Bytes other than printable
+// ASCII are written as octal escapes, which any POSIX printf understands.
+func Printf(b []byte) string {
+	var s strings.Builder
+	for _, c := range b {
+		switch {
+		case c == '%':
+			s.WriteString("%%")
+		case c == '\\':
+			s.WriteString(`\\`)
+		case c >= ' ' && c <= '~':
+			s.WriteByte(c)
+		default:
+			fmt.Fprintf(&s, `\%03o`, c)
+		}
+	}
+	return Quote(s.String())
+}
+
+// IsPlainText returns true if b is UTF-8 text without control characters other than tabs and newlines,
+// so that it can be given on the command line as it is
+func IsPlainText(b []byte) bool {
+	return utf8.Valid(b) && !slices.ContainsFunc([]rune(string(b)), func(r rune) bool {
+		return unicode.IsControl(r) && r != '\t' && r != '\n'
+	})
+}
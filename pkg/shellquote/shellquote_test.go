@@ -0,0 +1,85 @@
+package shellquote
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{s: "https://example.com/a?b=c", want: "'https://example.com/a?b=c'"},
+		{s: "https://example.com/a/b.json", want: "https://example.com/a/b.json"},
+		{s: "@/tmp/body", want: "@/tmp/body"},
+		{s: "", want: "''"},
+		{s: "Accept: */*", want: "'Accept: */*'"},
+		{s: "it's", want: `'it'\''s'`},
+		{s: "$HOME `id` \\n", want: "'$HOME `id` \\n'"},
+	}
+	for _, tt := range tests {
+		if got := Quote(tt.s); got != tt.want {
+			t.Errorf("Quote(%q) got = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestIsPlainText(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want bool
+	}{
+		{b: []byte(`{"name": "café"}`), want: true},
+		{b: []byte("a\tb\nc"), want: true},
+		{b: []byte("a\rb"), want: false},
+		{b: []byte{0x1f, 0x8b, 0x08, 0x00}, want: false},
+		{b: []byte("\xff\xfe"), want: false},
+	}
+	for _, tt := range tests {
+		if got := IsPlainText(tt.b); got != tt.want {
+			t.Errorf("IsPlainText(%q) got = %v, want %v", tt.b, got, tt.want)
+		}
+	}
+}
+
+// what is quoted must come out of a real shell byte for byte
+func TestShell(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	var all []byte
+	for c := 0; c < 256; c++ {
+		all = append(all, byte(c))
+	}
+	tests := [][]byte{
+		[]byte("hello"),
+		[]byte("it's a 'quote'"),
+		[]byte(`$HOME "$(id)" ` + "`id`" + ` \n %s %d \\`),
+		[]byte("line one\nline two\n"),
+		[]byte("café ☕"),
+		{0x1f, 0x8b, 0x08, 0x00, '%', '\\', 0x7f},
+		all,
+	}
+	for _, b := range tests {
+		if bytes.IndexByte(b, 0) < 0 {
+			// arguments cannot contain NUL, so only printf can pass every byte
+			got, err := exec.Command("sh", "-c", "printf %s "+Quote(string(b))).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, b) {
+				t.Errorf("sh -c printf %%s %v got = %q, want %q", Quote(string(b)), got, b)
+			}
+		}
+
+		got, err := exec.Command("sh", "-c", "printf "+Printf(b)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, b) {
+			t.Errorf("sh -c printf %v got = %q, want %q", Printf(b), got, b)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Package tlsfingerprint computes the JA3 and JA4 fingerprints of TLS ClientHello messages, which
+// identify the TLS library that a client uses whatever server it connects to. JA3 is described at
+// https://github.com/salesforce/ja3 and JA4 at https://github.com/FoxIO-LLC/ja4.
+package tlsfingerprint
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Fingerprint identifies the TLS library that a client uses from the ClientHello that it sends
+type Fingerprint struct {
+	JA3 string // MD5 hash of the JA3 string
+	JA4 string
+}
+
+// Parse computes the fingerprints of the ClientHello at the start of records, which are the bytes
+// that a client sends at the start of a TLS connection
+func Parse(records []byte) (*Fingerprint, error) {
+	h, err := parseClientHello(records)
+	if err != nil {
+		return nil, err
+	}
+	return &Fingerprint{JA3: ja3(h), JA4: ja4(h)}, nil
+}
+
+// clientHello contains the parts of a TLS ClientHello that fingerprints are computed from, in the
+// order that they were sent
+type clientHello struct {
+	version      uint16   // the legacy version field
+	ciphers      []uint16 // cipher suites
+	extensions   []uint16 // extension types
+	curves       []uint16 // from the supported_groups extension
+	pointFormats []uint8  // from the ec_point_formats extension
+	sigAlgs      []uint16 // from the signature_algorithms extension
+	versions     []uint16 // from the supported_versions extension
+	alpn         []string // from the application_layer_protocol_negotiation extension
+	hasSNI       bool
+}
+
+// extension types that are treated specially by fingerprints
+const (
+	extServerName        = 0
+	extSupportedGroups   = 10
+	extPointFormats      = 11
+	extSignatureAlgs     = 13
+	extALPN              = 16
+	extSupportedVersions = 43
+)
+
+// parseClientHello parses the TLS records at the start of a connection that contain the ClientHello
+func parseClientHello(records []byte) (*clientHello, error) {
+	// the handshake message may be split across several records, so join their payloads
+	var msg []byte
+	for len(records) >= 5 && records[0] == 0x16 {
+		n := int(records[3])<<8 | int(records[4])
+		if len(records) < 5+n {
+			break
+		}
+		msg = append(msg, records[5:5+n]...)
+		records = records[5+n:]
+	}
+
+	s := cryptobyte.String(msg)
+	var msgType uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&body) {
+		return nil, errors.New("not a complete ClientHello")
+	}
+
+	var h clientHello
+	var sessionID, ciphers, compression cryptobyte.String
+	if !body.ReadUint16(&h.version) ||
+		!body.Skip(32) || // random
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&ciphers) ||
+		!body.ReadUint8LengthPrefixed(&compression) {
+		return nil, errors.New("malformed ClientHello")
+	}
+	for !ciphers.Empty() {
+		var c uint16
+		if !ciphers.ReadUint16(&c) {
+			return nil, errors.New("malformed cipher suites in ClientHello")
+		}
+		h.ciphers = append(h.ciphers, c)
+	}
+
+	// the extensions are optional
+	var extensions cryptobyte.String
+	if body.Empty() {
+		return &h, nil
+	}
+	if !body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errors.New("malformed extensions in ClientHello")
+	}
+	for !extensions.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&typ) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errors.New("malformed extension in ClientHello")
+		}
+		h.extensions = append(h.extensions, typ)
+
+		// a malformed extension body is left out of the fingerprint rather than rejecting the hello
+		switch typ {
+		case extServerName:
+			h.hasSNI = true
+		case extSupportedGroups:
+			h.curves = readUint16List(data)
+		case extPointFormats:
+			var formats cryptobyte.String
+			if data.ReadUint8LengthPrefixed(&formats) {
+				h.pointFormats = formats
+			}
+		case extSignatureAlgs:
+			h.sigAlgs = readUint16List(data)
+		case extSupportedVersions:
+			var versions cryptobyte.String
+			if data.ReadUint8LengthPrefixed(&versions) {
+				for !versions.Empty() {
+					var v uint16
+					if !versions.ReadUint16(&v) {
+						break
+					}
+					h.versions = append(h.versions, v)
+				}
+			}
+		case extALPN:
+			var protos cryptobyte.String
+			if data.ReadUint16LengthPrefixed(&protos) {
+				for !protos.Empty() {
+					var proto cryptobyte.String
+					if !protos.ReadUint8LengthPrefixed(&proto) {
+						break
+					}
+					h.alpn = append(h.alpn, string(proto))
+				}
+			}
+		}
+	}
+	return &h, nil
+}
+
+// readUint16List reads a list of 16-bit values preceded by a 16-bit length
+func readUint16List(data cryptobyte.String) []uint16 {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) {
+		return nil
+	}
+	var vs []uint16
+	for !list.Empty() {
+		var v uint16
+		if !list.ReadUint16(&v) {
+			break
+		}
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+// isGREASE checks whether a value is one of the reserved values that clients send at random to make
+// sure that servers tolerate unknown values (RFC 8701), which are left out of fingerprints
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns the values that are not GREASE values
+func withoutGREASE(vs []uint16) []uint16 {
+	var out []uint16
+	for _, v := range vs {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// joinValues formats each value with format and joins them with sep
+func joinValues[T uint8 | uint16](vs []T, format func(T) string, sep string) string {
+	parts := make([]string, len(vs))
+	for i, v := range vs {
+		parts[i] = format(v)
+	}
+	return strings.Join(parts, sep)
+}
+
+func decimal[T uint8 | uint16](v T) string { return strconv.Itoa(int(v)) }
+func hex4(v uint16) string                 { return fmt.Sprintf("%04x", v) }
+
+// ja3 computes the JA3 fingerprint of a ClientHello, which is the MD5 hash of
+// "version,ciphers,extensions,curves,point formats" with each list joined by dashes
+func ja3(h *clientHello) string {
+	s := strings.Join([]string{
+		decimal(h.version),
+		joinValues(withoutGREASE(h.ciphers), decimal, "-"),
+		joinValues(withoutGREASE(h.extensions), decimal, "-"),
+		joinValues(withoutGREASE(h.curves), decimal, "-"),
+		joinValues(h.pointFormats, decimal, "-"),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// the two characters that JA4 uses for each TLS version
+var ja4Versions = map[uint16]string{
+	tls.VersionTLS13: "13",
+	tls.VersionTLS12: "12",
+	tls.VersionTLS11: "11",
+	tls.VersionTLS10: "10",
+	tls.VersionSSL30: "s3",
+}
+
+// ja4 computes the JA4 fingerprint of a ClientHello sent over TCP, as specified by FoxIO
+func ja4(h *clientHello) string {
+	// the highest version offered, preferring the supported_versions extension
+	version := h.version
+	if versions := withoutGREASE(h.versions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	v, ok := ja4Versions[version]
+	if !ok {
+		v = "00"
+	}
+
+	sni := "i"
+	if h.hasSNI {
+		sni = "d"
+	}
+
+	// the first and last characters of the first ALPN protocol, or of its hex if those are not alphanumeric
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		p := h.alpn[0]
+		if isAlphanumeric(p[0]) && isAlphanumeric(p[len(p)-1]) {
+			alpn = string(p[0]) + string(p[len(p)-1])
+		} else {
+			x := hex.EncodeToString([]byte(p))
+			alpn = string(x[0]) + string(x[len(x)-1])
+		}
+	}
+
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+	a := fmt.Sprintf("t%s%s%02d%02d%s", v, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	// the cipher suites, sorted
+	b := "000000000000"
+	if len(ciphers) > 0 {
+		b = ja4Hash(joinValues(slices.Sorted(slices.Values(ciphers)), hex4, ","))
+	}
+
+	// the extensions other than SNI and ALPN, sorted, followed by the signature algorithms in order
+	c := "000000000000"
+	extensions = slices.DeleteFunc(extensions, func(e uint16) bool { return e == extServerName || e == extALPN })
+	if len(extensions) > 0 {
+		slices.Sort(extensions)
+		s := joinValues(extensions, hex4, ",")
+		if sigAlgs := withoutGREASE(h.sigAlgs); len(sigAlgs) > 0 {
+			s += "_" + joinValues(sigAlgs, hex4, ",")
+		}
+		c = ja4Hash(s)
+	}
+
+	return a + "_" + b + "_" + c
+}
+
+// ja4Hash is the first 12 hex characters of the SHA256 hash of s
+func ja4Hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
@@ -0,0 +1,211 @@
+package tlsfingerprint
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// extension is the type and body of an extension in a ClientHello
+type extension struct {
+	typ  uint16
+	data []byte
+}
+
+// uint16List encodes values as a list preceded by its length in bytes
+func uint16List(vs ...uint16) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, v := range vs {
+			b.AddUint16(v)
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+// serverName encodes the body of a server_name extension
+func serverName(name string) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(0) // host_name
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(name))
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+// alpn encodes the body of an application_layer_protocol_negotiation extension
+func alpn(protos ...string) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, p := range protos {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes([]byte(p))
+			})
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+// supportedVersions encodes the body of a supported_versions extension
+func supportedVersions(vs ...uint16) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, v := range vs {
+			b.AddUint16(v)
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+// clientHelloRecords encodes a ClientHello handshake message in TLS records of at most recordSize bytes
+func clientHelloRecords(version uint16, ciphers []uint16, extensions []extension, recordSize int) []byte {
+	var msg cryptobyte.Builder
+	msg.AddUint8(1) // client_hello
+	msg.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(version)
+		b.AddBytes(make([]byte, 32)) // random
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, c := range ciphers {
+				b.AddUint16(c)
+			}
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8(0) // null compression
+		})
+		if extensions != nil {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, e := range extensions {
+					b.AddUint16(e.typ)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(e.data)
+					})
+				}
+			})
+		}
+	})
+	handshake := msg.BytesOrPanic()
+
+	var records []byte
+	for len(handshake) > 0 {
+		n := min(len(handshake), recordSize)
+		records = append(records, 0x16, 0x03, 0x01, byte(n>>8), byte(n))
+		records = append(records, handshake[:n]...)
+		handshake = handshake[n:]
+	}
+	return records
+}
+
+// the ClientHello from the JA3 README, whose JA3 string is
+// 769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0
+var ja3Hello = clientHelloRecords(
+	0x0301,
+	[]uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+	[]extension{
+		{0, serverName("example.com")},
+		{10, uint16List(23, 24, 25)},
+		{11, []byte{1, 0}},
+	},
+	1<<14,
+)
+
+// a ClientHello from Chrome, with GREASE values, whose JA4 is given in the JA4 technical details as
+// t13d1516h2_8daaf6152771_e5627efa2ab1
+var chromeCiphers = []uint16{
+	0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+	0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+}
+
+var chromeExtensions = []extension{
+	{0x0a0a, nil},
+	{0x0000, serverName("example.com")},
+	{0x0017, nil},
+	{0xff01, []byte{0}},
+	{0x000a, uint16List(0x2a2a, 0x001d, 0x0017, 0x0018)},
+	{0x000b, []byte{1, 0}},
+	{0x0023, nil},
+	{0x0010, alpn("h2", "http/1.1")},
+	{0x0005, []byte{1, 0, 0, 0, 0}},
+	{0x000d, uint16List(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)},
+	{0x0012, nil},
+	{0x0033, nil},
+	{0x002d, []byte{1, 1}},
+	{0x002b, supportedVersions(0x1a1a, 0x0304, 0x0303)},
+	{0x001b, []byte{2, 0, 2}},
+	{0x0015, make([]byte, 16)},
+	{0x4469, nil},
+	{0x3a3a, []byte{0}},
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []byte
+		wantJA3 string // not checked if empty
+		wantJA4 string // not checked if empty
+		wantErr bool
+	}{
+		{
+			name:    "ja3 readme",
+			records: ja3Hello,
+			wantJA3: "ada70206e40642a3e4461f35503241d5",
+		},
+		{
+			name:    "chrome",
+			records: clientHelloRecords(0x0303, chromeCiphers, chromeExtensions, 1<<14),
+			wantJA4: "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name:    "chrome split across records",
+			records: clientHelloRecords(0x0303, chromeCiphers, chromeExtensions, 100),
+			wantJA4: "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name:    "no extensions",
+			records: clientHelloRecords(0x0303, []uint16{0x1301, 0x1302}, nil, 1<<14),
+			wantJA4: "t12i020000_62ed6f6ca7ad_000000000000",
+		},
+		{
+			name:    "truncated",
+			records: ja3Hello[:len(ja3Hello)-10],
+			wantErr: true,
+		},
+		{
+			name:    "not a handshake",
+			records: []byte("GET / HTTP/1.1\r\n\r\n"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.records)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.wantJA3 != "" && got.JA3 != tt.wantJA3 {
+				t.Errorf("Parse().JA3 got = %v, want %v", got.JA3, tt.wantJA3)
+			}
+			if tt.wantJA4 != "" && got.JA4 != tt.wantJA4 {
+				t.Errorf("Parse().JA4 got = %v, want %v", got.JA4, tt.wantJA4)
+			}
+		})
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	for _, v := range []uint16{0x0a0a, 0x1a1a, 0x2a2a, 0xfafa} {
+		if !isGREASE(v) {
+			t.Errorf("isGREASE(%#04x) got = false, want true", v)
+		}
+	}
+	for _, v := range []uint16{0x0000, 0x0a1a, 0x1301, 0xc02b} {
+		if isGREASE(v) {
+			t.Errorf("isGREASE(%#04x) got = true, want false", v)
+		}
+	}
+}
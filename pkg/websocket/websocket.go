@@ -0,0 +1,184 @@
+// package websocket parses websocket frames out of a byte stream, for observing websocket
+// connections that are being relayed byte-for-byte by a proxy, and writes the frames that a server
+// sends, for serving simple websocket endpoints.
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Opcode identifies the kind of a websocket frame
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xa
+)
+
+func (op Opcode) String() string {
+	switch op {
+	case OpContinuation:
+		return "continuation"
+	case OpText:
+		return "text"
+	case OpBinary:
+		return "binary"
+	case OpClose:
+		return "close"
+	case OpPing:
+		return "ping"
+	case OpPong:
+		return "pong"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(op))
+	}
+}
+
+// MaxPayload is the maximum number of payload bytes kept for each frame. Longer payloads are
+// truncated, though Frame.Length always reports the length on the wire.
+const MaxPayload = 1 << 20
+
+// Frame is a single websocket frame
+type Frame struct {
+	Fin        bool      // whether this is the last frame in a message
+	Compressed bool      // whether the payload is compressed (the RSV1 bit used by permessage-deflate)
+	Opcode     Opcode    // the kind of frame
+	Length     int64     // the length of the payload on the wire
+	Payload    []byte    // the unmasked payload, truncated to MaxPayload bytes
+	Time       time.Time // the time at which the frame was parsed
+}
+
+// ReadFrame reads one frame from r
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	frame := Frame{
+		Fin:        header[0]&0x80 != 0,
+		Compressed: header[0]&0x40 != 0,
+		Opcode:     Opcode(header[0] & 0x0f),
+		Length:     int64(header[1] & 0x7f),
+	}
+	masked := header[1]&0x80 != 0
+
+	// lengths 126 and 127 mean that the real length follows in the next 2 or 8 bytes
+	switch frame.Length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		frame.Length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		frame.Length = int64(binary.BigEndian.Uint64(ext[:]))
+		if frame.Length < 0 {
+			return nil, fmt.Errorf("invalid websocket frame length")
+		}
+	}
+
+	// frames sent by clients are always masked, frames sent by servers never are
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	// read the part of the payload that we keep, then discard the rest
+	keep := min(frame.Length, MaxPayload)
+	frame.Payload = make([]byte, keep)
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, frame.Length-keep); err != nil {
+		return nil, err
+	}
+
+	if masked {
+		for i := range frame.Payload {
+			frame.Payload[i] ^= mask[i%4]
+		}
+	}
+
+	frame.Time = time.Now()
+	return &frame, nil
+}
+
+// WriteFrame writes one frame as a server sends it, which is without a mask. The whole payload is
+// written, and the Length of the frame is ignored.
+func WriteFrame(w io.Writer, frame *Frame) error {
+	var header [10]byte
+	header[0] = byte(frame.Opcode) & 0x0f
+	if frame.Fin {
+		header[0] |= 0x80
+	}
+	if frame.Compressed {
+		header[0] |= 0x40
+	}
+
+	// lengths of 126 or more are written in the next 2 or 8 bytes
+	n := len(frame.Payload)
+	size := 2
+	switch {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+		size += 2
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+		size += 8
+	}
+
+	if _, err := w.Write(header[:size]); err != nil {
+		return err
+	}
+	_, err := w.Write(frame.Payload)
+	return err
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept header with which a server answers the
+// Sec-WebSocket-Key header of a client's opening handshake
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Tap returns a writer that parses whatever is written to it as a sequence of websocket frames, and
+// calls fn for each frame. If the stream cannot be parsed then the rest of it is discarded. The caller
+// must call Close when the stream ends.
+func Tap(fn func(*Frame)) io.WriteCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		br := bufio.NewReader(pr)
+		for {
+			frame, err := ReadFrame(br)
+			if err != nil {
+				// keep reading so that writers are never blocked
+				io.Copy(io.Discard, br)
+				return
+			}
+			fn(frame)
+		}
+	}()
+	return pw
+}
@@ -0,0 +1,123 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		opcode  Opcode
+		fin     bool
+		payload string
+	}{
+		{
+			name:    "unmasked text",
+			data:    []byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o'},
+			opcode:  OpText,
+			fin:     true,
+			payload: "hello",
+		},
+		{
+			name:    "masked text",
+			data:    []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58},
+			opcode:  OpText,
+			fin:     true,
+			payload: "Hello",
+		},
+		{
+			name:    "fragment",
+			data:    []byte{0x01, 0x03, 'H', 'e', 'l'},
+			opcode:  OpText,
+			fin:     false,
+			payload: "Hel",
+		},
+		{
+			name:    "ping",
+			data:    []byte{0x89, 0x00},
+			opcode:  OpPing,
+			fin:     true,
+			payload: "",
+		},
+		{
+			name:    "16-bit length",
+			data:    append([]byte{0x82, 0x7e, 0x01, 0x00}, bytes.Repeat([]byte{'x'}, 256)...),
+			opcode:  OpBinary,
+			fin:     true,
+			payload: string(bytes.Repeat([]byte{'x'}, 256)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := ReadFrame(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.Opcode != tt.opcode {
+				t.Errorf("opcode got = %v, want %v", frame.Opcode, tt.opcode)
+			}
+			if frame.Fin != tt.fin {
+				t.Errorf("fin got = %v, want %v", frame.Fin, tt.fin)
+			}
+			if string(frame.Payload) != tt.payload {
+				t.Errorf("payload got = %q, want %q", frame.Payload, tt.payload)
+			}
+		})
+	}
+}
+
+func TestReadFrame_Truncated(t *testing.T) {
+	_, err := ReadFrame(bytes.NewReader([]byte{0x81, 0x05, 'h', 'e'}))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("got err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestTap(t *testing.T) {
+	frames := make(chan *Frame, 2)
+	tap := Tap(func(f *Frame) { frames <- f })
+
+	// write two frames split at an awkward boundary
+	tap.Write([]byte{0x81, 0x02, 'h'})
+	tap.Write([]byte{'i', 0x82, 0x01, 0xff})
+	tap.Close()
+
+	first, second := <-frames, <-frames
+	if first.Opcode != OpText || string(first.Payload) != "hi" {
+		t.Errorf("first frame got = %v %q", first.Opcode, first.Payload)
+	}
+	if second.Opcode != OpBinary || !bytes.Equal(second.Payload, []byte{0xff}) {
+		t.Errorf("second frame got = %v %q", second.Opcode, second.Payload)
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	for _, n := range []int{0, 5, 125, 126, 256, 70000} {
+		payload := bytes.Repeat([]byte{'x'}, n)
+		var b bytes.Buffer
+		if err := WriteFrame(&b, &Frame{Fin: true, Opcode: OpText, Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+		frame, err := ReadFrame(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !frame.Fin || frame.Opcode != OpText || frame.Length != int64(n) || !bytes.Equal(frame.Payload, payload) {
+			t.Errorf("frame of %d bytes got = fin %v, %v, %d bytes", n, frame.Fin, frame.Opcode, frame.Length)
+		}
+		if b.Len() != 0 {
+			t.Errorf("frame of %d bytes left %d bytes unread", n, b.Len())
+		}
+	}
+}
+
+func TestAcceptKey(t *testing.T) {
+	// the example from RFC 6455
+	got := AcceptKey("dGhlIHNhbXBsZSBub25jZQ==")
+	if want := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("got = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// whether --plain was given, in which case each event is printed on one line by the functions below
+var plainOutput bool
+
+// plainLine joins the fields of an event for --plain. Each line starts with the kind of event and the
+// time in UTC, and the fields for each kind always come in the same order so that lines can be split
+// with awk or cut. Empty fields are printed as "-" and fields containing spaces or quotes are quoted
+// as Go strings, so that a line always has the same number of fields.
+func plainLine(kind string, t time.Time, fields ...string) string {
+	parts := []string{kind, t.UTC().Format("2006-01-02T15:04:05.000Z")}
+	for _, f := range fields {
+		switch {
+		case f == "":
+			f = "-"
+		case strings.Contains(f, " ") || strconv.Quote(f) != `"`+f+`"`:
+			f = strconv.Quote(f)
+		}
+		parts = append(parts, f)
+	}
+	return strings.Join(parts, " ") + "\n"
+}
+
+// plainHTTP formats an HTTP call as
+//
+//	http TIME METHOD URL STATUS REQUEST_BYTES RESPONSE_BYTES DURATION_MS
+func plainHTTP(c *HTTPCall) string {
+	return plainLine("http", c.Start, c.Request.Method, c.Request.URL, strconv.Itoa(c.Response.StatusCode),
+		strconv.FormatInt(c.Request.Size, 10), strconv.FormatInt(c.Response.Size, 10), plainMillis(c.Duration))
+}
+
+// plainDNS formats a DNS query as
+//
+//	dns TIME NAME TYPE ANSWERS ERROR
+//
+// where ANSWERS are separated by commas, or as the following for a query blocked by --dns-block
+//
+//	dns-blocked TIME NAME TYPE
+func plainDNS(c *DNSCall) string {
+	if c.Blocked {
+		return plainLine("dns-blocked", c.Time, c.Name, c.Type)
+	}
+	return plainLine("dns", c.Time, c.Name, c.Type, strings.Join(c.Answers, ","), c.Error)
+}
+
+// plainPassthrough formats a TLS connection relayed without interception as
+//
+//	tls-passthrough TIME SERVER_NAME ADDR SENT_BYTES RECEIVED_BYTES
+func plainPassthrough(p *TLSPassthrough) string {
+	return plainLine("tls-passthrough", p.End, p.ServerName, p.Addr,
+		strconv.FormatInt(p.Sent, 10), strconv.FormatInt(p.Received, 10))
+}
+
+// plainViolation formats a TLS handshake rejected by the policy as
+//
+//	tls-rejected TIME SERVER_NAME ADDR REASON
+func plainViolation(v *TLSViolation) string {
+	return plainLine("tls-rejected", v.Time, v.ServerName, v.Addr, v.Reason)
+}
+
+// plainEgress formats a DNS query or connection not allowed by --allow as
+//
+//	egress-refused TIME KIND HOST ADDR
+//
+// or as egress-reported if it was only reported because --enforce was not given
+func plainEgress(v *EgressViolation) string {
+	kind := "egress-reported"
+	if v.Refused {
+		kind = "egress-refused"
+	}
+	return plainLine(kind, v.Time, v.Kind, v.Host, v.Addr)
+}
+
+// plainPolicy formats a DNS query, connection, or HTTP request that --policy denied or modified as
+//
+//	policy-deny TIME ON SUBJECT RULE
+//
+// or as policy-modify if the rule modified it
+func plainPolicy(d *PolicyDecision) string {
+	return plainLine("policy-"+d.Action, d.Time, d.On, d.Subject, d.Rule)
+}
+
+// plainWebSocket formats a websocket message as
+//
+//	ws TIME DIRECTION OPCODE URL LENGTH
+func plainWebSocket(m *WebSocketMessage) string {
+	return plainLine("ws", m.Time, m.Direction, m.Opcode, m.URL, strconv.FormatInt(m.Length, 10))
+}
+
+// plainMillis formats a duration as a number of milliseconds with three decimal places
+func plainMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/monasticacademy/httptap/pkg/policy"
+	"gopkg.in/yaml.v3"
+)
+
+// how often the --policy file is checked for changes
+const policyReloadInterval = time.Second
+
+// policyRule is one rule in a --policy file, which is decided on by pkg/policy. Each DNS query,
+// connection, and HTTP request from the subprocess is checked against the rules for it in order, and the
+// first rule that allows or denies it decides what happens. Anything that no rule decides is allowed.
+type policyRule struct {
+	policy.Rule `yaml:",inline"`
+	Modify      ruleRequest `json:"modify" yaml:"modify"` // how a modify rule changes HTTP requests
+}
+
+// compiledPolicy is the rules of a --policy file, with the changes that modify rules make compiled
+type compiledPolicy struct {
+	rules  []*policy.Rule
+	modify map[*policy.Rule]*compiledRule
+}
+
+// the rules in effect, which are replaced as a whole when the --policy file changes
+var policyRules atomic.Pointer[compiledPolicy]
+
+// errDeniedByPolicy is returned for DNS queries that a --policy rule denies
+var errDeniedByPolicy = errors.New("denied by --policy")
+
+// loadPolicy reads policy rules from a JSON or YAML file, according to its extension, such as
+//
+//	[
+//	  {"name": "no telemetry", "on": "dns", "when": "host.endsWith(\"telemetry.example.com\")", "action": "deny"},
+//	  {"name": "read only", "on": "http", "when": "method != \"GET\"", "action": "deny", "status": 405}
+//	]
+func loadPolicy(path string) (*compiledPolicy, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []policyRule
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(buf))
+		dec.KnownFields(true)
+		err = dec.Decode(&rules)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&rules)
+	}
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error parsing %v: %w", path, err)
+	}
+
+	compiled := &compiledPolicy{modify: make(map[*policy.Rule]*compiledRule)}
+	for i := range rules {
+		rule := &rules[i].Rule
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if err := rule.Compile(); err != nil {
+			return nil, fmt.Errorf("error in %v of %v: %w", rule.Name, path, err)
+		}
+		if rule.Action == "modify" {
+			modify, err := compileRule(rewriteRule{Request: rules[i].Modify}, "")
+			if err != nil {
+				return nil, fmt.Errorf("error in %v of %v: error in modify: %w", rule.Name, path, err)
+			}
+			compiled.modify[rule] = modify
+		}
+		compiled.rules = append(compiled.rules, rule)
+	}
+	return compiled, nil
+}
+
+// watchPolicy loads the rules in a --policy file again each time that the file changes, keeping the
+// rules in effect if the new ones cannot be loaded
+func watchPolicy(ctx context.Context, path string) {
+	stat, _ := os.Stat(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(policyReloadInterval):
+		}
+
+		s, err := os.Stat(path)
+		if err != nil || (stat != nil && s.ModTime().Equal(stat.ModTime()) && s.Size() == stat.Size()) {
+			continue
+		}
+		stat = s
+
+		rules, err := loadPolicy(path)
+		if err != nil {
+			errorf("error reloading --policy, keeping the rules in effect: %v", err)
+			continue
+		}
+		policyRules.Store(rules)
+		log.Printf("reloaded %d rules from %v", len(rules.rules), path)
+	}
+}
+
+// PolicyDecision describes a DNS query, connection, or HTTP request that a --policy rule denied or
+// modified
+type PolicyDecision struct {
+	On      string    `json:"on"`      // dns, connect, or http
+	Subject string    `json:"subject"` // the name looked up, the address connected to, or the method and URL
+	Action  string    `json:"action"`  // deny or modify
+	Rule    string    `json:"rule"`
+	Time    time.Time `json:"time"`
+}
+
+// policyDecisionWatcher receives information about each decision of a --policy rule
+type policyDecisionWatcher func(*PolicyDecision)
+
+// the watchers waiting for decisions of --policy rules
+var policyDecisionWatchers []policyDecisionWatcher
+
+// the mutex that protects the above slice
+var policyDecisionMu sync.Mutex
+
+// add a watcher that will be called for each decision of a --policy rule
+func watchPolicyDecisions(w policyDecisionWatcher) {
+	policyDecisionMu.Lock()
+	defer policyDecisionMu.Unlock()
+
+	policyDecisionWatchers = append(policyDecisionWatchers, w)
+}
+
+// call each policy decision watcher
+func notifyPolicyDecisionWatchers(d *PolicyDecision) {
+	policyDecisionMu.Lock()
+	defer policyDecisionMu.Unlock()
+
+	for _, w := range policyDecisionWatchers {
+		w(d)
+	}
+}
+
+// evalPolicy finds the first rule in effect for a kind of thing that allows or denies it, calling modify
+// with each modify rule that applies before then and the change that it makes. It returns nil if no rule
+// decides.
+func evalPolicy(on string, vars map[string]any, modify func(*policy.Rule, *compiledRule) error) (*policy.Rule, error) {
+	p := policyRules.Load()
+	if p == nil {
+		return nil, nil
+	}
+	return policy.Decide(p.rules, on, vars, func(rule *policy.Rule) error {
+		return modify(rule, p.modify[rule])
+	})
+}
+
+// checkPolicyDNS checks whether a --policy rule denies a DNS query, returning errDeniedByPolicy if so
+func checkPolicyDNS(question dns.Question) error {
+	name := normalizeHost(question.Name)
+	rule, _ := evalPolicy("dns", map[string]any{
+		"name": name,
+		"type": dnsTypeCode(question.Qtype),
+		"host": name,
+	}, nil)
+	if rule == nil || rule.Action != "deny" {
+		return nil
+	}
+	notifyPolicyDecisionWatchers(&PolicyDecision{On: "dns", Subject: name, Action: "deny", Rule: rule.Name, Time: time.Now()})
+	return errDeniedByPolicy
+}
+
+// checkPolicyConn checks whether --policy rules allow the subprocess to connect to an address. DNS
+// queries are checked by checkPolicyDNS instead.
+func checkPolicyConn(proto string, addr net.Addr) bool {
+	if policyRules.Load() == nil {
+		return true
+	}
+	ip, portstr, err := net.SplitHostPort(addr.String())
+	if err != nil || portstr == "53" {
+		return true
+	}
+	port, _ := strconv.Atoi(portstr)
+	rule, _ := evalPolicy("connect", map[string]any{
+		"proto": proto,
+		"host":  destinationHost(addr.String()),
+		"ip":    ip,
+		"port":  int64(port),
+	}, nil)
+	if rule == nil || rule.Action != "deny" {
+		return true
+	}
+	notifyPolicyDecisionWatchers(&PolicyDecision{On: "connect", Subject: addr.String(), Action: "deny", Rule: rule.Name, Time: time.Now()})
+	return false
+}
+
+// policyTransport applies --policy rules to HTTP requests that pass through it
+type policyTransport struct {
+	next http.RoundTripper
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	vars := map[string]any{
+		"req":    policyRequestVariables(req),
+		"host":   req.URL.Hostname(),
+		"method": req.Method,
+		"url":    req.URL.String(),
+		"path":   req.URL.Path,
+	}
+	subject := req.Method + " " + req.URL.String()
+	original := req
+	rule, err := evalPolicy("http", vars, func(rule *policy.Rule, change *compiledRule) error {
+		if req == original {
+			// rules must not change the request they were given, which is still used to report the call
+			req = req.Clone(req.Context())
+		}
+		var err error
+		req, err = change.rewriteRequest(req)
+		if err != nil {
+			return err
+		}
+		notifyPolicyDecisionWatchers(&PolicyDecision{On: "http", Subject: subject, Action: "modify", Rule: rule.Name, Time: time.Now()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil || rule.Action != "deny" {
+		return t.next.RoundTrip(req)
+	}
+
+	notifyPolicyDecisionWatchers(&PolicyDecision{On: "http", Subject: subject, Action: "deny", Rule: rule.Name, Time: time.Now()})
+	status := rule.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	return (&ruleFault{Status: status}).respond(req)
+}
+
+// policyRequestVariables makes the "req" variable that http policy rules are evaluated with, which is the
+// same as for --filter except that the body is left out since the request has not been sent yet
+func policyRequestVariables(req *http.Request) map[string]any {
+	return map[string]any{
+		"method":  req.Method,
+		"url":     req.URL.String(),
+		"scheme":  req.URL.Scheme,
+		"host":    req.URL.Hostname(),
+		"path":    req.URL.Path,
+		"query":   req.URL.RawQuery,
+		"headers": headerVariables(req.Header),
+	}
+}
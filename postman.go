@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// the schema of the Postman collections written by --dump-postman, which Insomnia can also import
+const postmanSchema = "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"
+
+// headers that Postman works out for itself when it sends a request, so they are left out of collections
+var postmanOmitHeaders = []string{"Content-Length", "Transfer-Encoding", "Connection", "Content-Encoding", "Host"}
+
+// postmanCollection is the part of the Postman collection format that --dump-postman writes
+type postmanCollection struct {
+	Info     postmanInfo       `json:"info"`
+	Item     []*postmanFolder  `json:"item"`
+	Variable []postmanVariable `json:"variable"`
+}
+
+type postmanInfo struct {
+	Name   string `json:"name"`
+	Schema string `json:"schema"`
+}
+
+// postmanFolder holds the requests to one host
+type postmanFolder struct {
+	Name string         `json:"name"`
+	Item []*postmanItem `json:"item"`
+}
+
+type postmanItem struct {
+	Name     string             `json:"name"`
+	Request  *postmanRequest    `json:"request"`
+	Response []*postmanResponse `json:"response,omitempty"`
+}
+
+type postmanRequest struct {
+	Method string          `json:"method"`
+	Header []postmanHeader `json:"header"`
+	URL    postmanURL      `json:"url"`
+	Body   *postmanBody    `json:"body,omitempty"`
+}
+
+type postmanHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type postmanURL struct {
+	Raw   string          `json:"raw"`
+	Host  []string        `json:"host"`
+	Path  []string        `json:"path,omitempty"`
+	Query []postmanHeader `json:"query,omitempty"`
+}
+
+type postmanBody struct {
+	Mode    string          `json:"mode"`
+	Raw     string          `json:"raw"`
+	Options *postmanOptions `json:"options,omitempty"`
+}
+
+type postmanOptions struct {
+	Raw struct {
+		Language string `json:"language"`
+	} `json:"raw"`
+}
+
+// postmanResponse is a response saved as an example of a request
+type postmanResponse struct {
+	Name            string          `json:"name"`
+	OriginalRequest *postmanRequest `json:"originalRequest"`
+	Status          string          `json:"status"`
+	Code            int             `json:"code"`
+	Header          []postmanHeader `json:"header"`
+	Body            string          `json:"body"`
+}
+
+type postmanVariable struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Enabled bool   `json:"enabled,omitempty"`
+}
+
+// postmanEnvironment is a Postman environment that sets the base URL of each host
+type postmanEnvironment struct {
+	Name   string            `json:"name"`
+	Values []postmanVariable `json:"values"`
+	Scope  string            `json:"_postman_variable_scope"`
+}
+
+// postmanEnvironmentPath is where the environment for a collection is written, such as
+// capture.postman_environment.json for capture.json
+func postmanEnvironmentPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".postman_environment.json"
+}
+
+// postmanHostVariable names the collection variable that holds the base URL of a host, such as
+// api_example_com for https://api.example.com, so that all requests to a host can be pointed elsewhere
+// by changing one variable or overriding it in an environment
+func postmanHostVariable(host string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == ':' || r == '-' {
+			return '_'
+		}
+		return r
+	}, host)
+}
+
+// postmanHeaders converts a header, leaving out those that Postman works out for itself
+func postmanHeaders(h http.Header) []postmanHeader {
+	headers := []postmanHeader{}
+	for _, k := range sortedKeys(h) {
+		if slices.Contains(postmanOmitHeaders, k) {
+			continue
+		}
+		for _, v := range h[k] {
+			headers = append(headers, postmanHeader{Key: k, Value: v})
+		}
+	}
+	return headers
+}
+
+// postmanRequestFor converts the request of an HTTP call, with the scheme and host replaced by a variable
+func postmanRequestFor(c *HTTPCall, u *url.URL) *postmanRequest {
+	variable := "{{" + postmanHostVariable(u.Host) + "}}"
+	r := &postmanRequest{
+		Method: c.Request.Method,
+		Header: postmanHeaders(c.Request.Header),
+		URL: postmanURL{
+			Raw:  variable + u.RequestURI(),
+			Host: []string{variable},
+		},
+	}
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		r.URL.Path = strings.Split(p, "/")
+	}
+	for _, kv := range strings.Split(u.RawQuery, "&") {
+		if kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		r.URL.Query = append(r.URL.Query, postmanHeader{Key: k, Value: v})
+	}
+
+	if len(c.Request.Body) > 0 && utf8.Valid(c.Request.Body) {
+		r.Body = &postmanBody{Mode: "raw", Raw: string(c.Request.Body)}
+		if mediaType, _, _ := mime.ParseMediaType(c.Request.Header.Get("Content-Type")); mediaType == "application/json" {
+			r.Body.Options = &postmanOptions{}
+			r.Body.Options.Raw.Language = "json"
+		}
+	} else if len(c.Request.Body) > 0 {
+		verbosef("leaving the binary request body of %v %v out of the Postman collection", c.Request.Method, c.Request.URL)
+	}
+	return r
+}
+
+// writePostman converts the HTTP calls made so far to a Postman collection, with a folder for each host
+// and the response to each request saved as an example, and writes it to a file. It also writes an
+// environment that sets the base URL of each host, which can be copied and edited to send the same
+// requests to another server, such as a staging one.
+func writePostman(path string) error {
+	httpMu.Lock()
+	calls := slices.Clone(httpCalls)
+	httpMu.Unlock()
+
+	collection := postmanCollection{
+		Info:     postmanInfo{Name: "httptap capture", Schema: postmanSchema},
+		Item:     []*postmanFolder{},
+		Variable: []postmanVariable{},
+	}
+	environment := postmanEnvironment{
+		Name:   "httptap capture",
+		Values: []postmanVariable{},
+		Scope:  "environment",
+	}
+	folders := make(map[string]*postmanFolder)
+	for _, c := range calls {
+		u, err := url.Parse(c.Request.URL)
+		if err != nil {
+			continue
+		}
+
+		folder := folders[u.Host]
+		if folder == nil {
+			folder = &postmanFolder{Name: u.Host}
+			folders[u.Host] = folder
+			collection.Item = append(collection.Item, folder)
+			variable := postmanVariable{Key: postmanHostVariable(u.Host), Value: u.Scheme + "://" + u.Host}
+			collection.Variable = append(collection.Variable, variable)
+			variable.Enabled = true
+			environment.Values = append(environment.Values, variable)
+		}
+
+		req := postmanRequestFor(c, u)
+		item := &postmanItem{Name: c.Request.Method + " " + u.Path, Request: req}
+		resp := &postmanResponse{
+			Name:            c.Response.Status,
+			OriginalRequest: req,
+			Status:          strings.TrimSpace(strings.TrimPrefix(c.Response.Status, fmt.Sprint(c.Response.StatusCode))),
+			Code:            c.Response.StatusCode,
+			Header:          postmanHeaders(c.Response.Header),
+		}
+		if utf8.Valid(c.Response.Body) {
+			resp.Body = string(c.Response.Body)
+		}
+		item.Response = append(item.Response, resp)
+		folder.Item = append(folder.Item, item)
+	}
+
+	if err := writeJSONFile(path, collection); err != nil {
+		return fmt.Errorf("error writing Postman collection: %w", err)
+	}
+	if err := writeJSONFile(postmanEnvironmentPath(path), environment); err != nil {
+		return fmt.Errorf("error writing Postman environment: %w", err)
+	}
+	return nil
+}
+
+// writeJSONFile writes a value to a file as indented JSON
+func writeJSONFile(path string, v any) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return f.Close()
+}
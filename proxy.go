@@ -1,8 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/monasticacademy/httptap/pkg/netstack"
+	"github.com/monasticacademy/httptap/pkg/reqmatch"
 )
 
 // proxyConn proxies data received on one TCP connection to the world, and back the other way.
@@ -20,9 +31,15 @@ func proxyConn(network, addr string, subprocess net.Conn) {
 	go proxyBytes(world, subprocess)
 }
 
+// proxyBufs holds the buffers used by proxyBytes, which are large enough that allocating one for each
+// direction of each connection shows up in garbage collection
+var proxyBufs = sync.Pool{New: func() any { return new([1 << 20]byte) }}
+
 // proxyBytes copies data between the world and the subprocess
 func proxyBytes(w io.Writer, r io.Reader) {
-	buf := make([]byte, 1<<20)
+	pooled := proxyBufs.Get().(*[1 << 20]byte)
+	defer proxyBufs.Put(pooled)
+	buf := pooled[:]
 	for {
 		n, err := r.Read(buf)
 		if err == io.EOF {
@@ -42,3 +59,203 @@ func proxyBytes(w io.Writer, r io.Reader) {
 		}
 	}
 }
+
+// if true then UDP to port 443 is rejected, so that clients fall back from QUIC to TCP
+var blockQUIC bool
+
+// isQUICBlocked checks whether UDP to a port should be rejected because of --block-quic
+func isQUICBlocked(port int) bool {
+	return blockQUIC && port == 443
+}
+
+// udpRelayBufs holds the buffers used by proxyUDP, one for each direction of each flow, each large
+// enough for any datagram
+var udpRelayBufs = sync.Pool{New: func() any { return new([65535]byte) }}
+
+// proxyUDP relays datagrams between the subprocess and the world for one UDP flow, such as NTP, syslog,
+// or statsd, until the flow has been idle for netstack.UDPIdleTimeout
+func proxyUDP(addr string, subprocess net.Conn) {
+	defer subprocess.Close()
+
+	world, err := net.Dial("udp", addr)
+	if err != nil {
+		verbosef("error dialing %v for UDP: %v", addr, err)
+		return
+	}
+	defer world.Close()
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	// relay copies one datagram per read, so that message boundaries are preserved
+	relay := func(dst io.Writer, src io.Reader) {
+		pooled := udpRelayBufs.Get().(*[65535]byte)
+		defer udpRelayBufs.Put(pooled)
+		buf := pooled[:]
+		for {
+			n, err := src.Read(buf)
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue // the world sent an ICMP port unreachable for an earlier datagram
+			}
+			if err != nil {
+				return
+			}
+			lastActive.Store(time.Now().UnixNano())
+			if _, err := dst.Write(buf[:n]); err != nil {
+				verbosef("error relaying %d bytes of UDP to or from %v: %v, dropping", n, addr, err)
+			}
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	go func() { relay(world, subprocess); done <- struct{}{} }()
+	go func() { relay(subprocess, world); done <- struct{}{} }()
+
+	ticker := time.NewTicker(netstack.UDPIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, lastActive.Load())) > netstack.UDPIdleTimeout {
+				verbosef("UDP flow to %v has been idle for %v, closing", addr, netstack.UDPIdleTimeout)
+				return
+			}
+		}
+	}
+}
+
+// worldAddr translates an address that the subprocess tried to reach into the address to dial. In order
+// for processes in the network namespace to reach "localhost" in the host's network they use
+// "host.httptap.local" or 169.254.77.65, which are routed to 127.0.0.1. In fake-IP mode, fake IPs are
+// replaced with the names that they were handed out for, and names given with --resolve or --hosts-file
+// are replaced with the addresses chosen for them.
+func worldAddr(addr string) string {
+	addr = staticHostAddr(fakeIPHost(addr))
+	addr = strings.Replace(addr, specialHostName, "127.0.0.1", 1)
+	addr = strings.Replace(addr, specialHostIP, "127.0.0.1", 1)
+	return addr
+}
+
+// TLSPassthrough describes a TLS connection that was relayed without interception
+type TLSPassthrough struct {
+	ServerName string    `json:"server_name"`
+	Addr       string    `json:"addr"`
+	Sent       int64     `json:"sent"`     // bytes sent by the subprocess
+	Received   int64     `json:"received"` // bytes received by the subprocess
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+}
+
+// passthroughWatcher receives information about each TLS connection relayed without interception
+type passthroughWatcher func(*TLSPassthrough)
+
+// the watchers waiting for passthrough connections
+var passthroughWatchers []passthroughWatcher
+
+// the mutex that protects the above slice
+var passthroughMu sync.Mutex
+
+// add a watcher that will be called when each passthrough connection finishes
+func watchPassthrough(w passthroughWatcher) {
+	passthroughMu.Lock()
+	defer passthroughMu.Unlock()
+
+	passthroughWatchers = append(passthroughWatchers, w)
+}
+
+// call each passthrough watcher
+func notifyPassthroughWatchers(p *TLSPassthrough) {
+	if !isCapturedHost(p.ServerName) {
+		return
+	}
+
+	passthroughMu.Lock()
+	defer passthroughMu.Unlock()
+
+	for _, w := range passthroughWatchers {
+		w(p)
+	}
+}
+
+// host patterns such as "example.com" or "*.bank.com" for which TLS is relayed without interception
+var passthroughHosts []string
+
+// isPassthrough checks whether the TLS connection for a server name should be relayed untouched
+func isPassthrough(serverName string) bool {
+	for _, pattern := range passthroughHosts {
+		if reqmatch.Host(pattern, serverName) {
+			return true
+		}
+	}
+	return false
+}
+
+// errHelloPeeked aborts the handshake started by peekServerName once the ClientHello has been read
+var errHelloPeeked = errors.New("client hello peeked")
+
+// peekServerName reads the TLS ClientHello sent by the subprocess and returns the server name that it
+// asks for, together with a connection from which the ClientHello will be read again
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	var serverName string
+	err := tls.Server(&readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloPeeked
+		},
+	}).Handshake()
+
+	replay := &bufferedConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+	if !errors.Is(err, errHelloPeeked) {
+		return "", replay, err
+	}
+	return serverName, replay, nil
+}
+
+// readOnlyConn reads from r and discards writes, so that a TLS handshake can be started on a
+// connection without anything being sent back to the subprocess
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *readOnlyConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// proxyPassthrough relays a TLS connection byte-for-byte to its destination without interception, and
+// notifies passthrough watchers with the connection metadata once both directions are finished
+func proxyPassthrough(serverName string, subprocess net.Conn) {
+	defer subprocess.Close()
+
+	addr := worldAddr(subprocess.LocalAddr().String())
+
+	p := TLSPassthrough{ServerName: serverName, Addr: addr, Start: time.Now()}
+	world, err := net.Dial("tcp", addr)
+	if err != nil {
+		errorf("error dialing %v for TLS passthrough of %q: %v", addr, serverName, err)
+		return
+	}
+	defer world.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.Sent, _ = io.Copy(world, subprocess)
+		// let the world know that the subprocess is done sending
+		if tcp, ok := world.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		p.Received, _ = io.Copy(subprocess, world)
+		subprocess.Close()
+	}()
+	wg.Wait()
+
+	p.End = time.Now()
+	notifyPassthroughWatchers(&p)
+}
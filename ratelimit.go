@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monasticacademy/httptap/pkg/reqmatch"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitUnits are the periods that --rate-limit accepts after the slash
+var rateLimitUnits = map[string]time.Duration{
+	"s":      time.Second,
+	"sec":    time.Second,
+	"second": time.Second,
+	"m":      time.Minute,
+	"min":    time.Minute,
+	"minute": time.Minute,
+	"h":      time.Hour,
+	"hour":   time.Hour,
+}
+
+// rateLimit is a budget for the HTTP requests to matching hosts, shared by all of the requests so that
+// they add up to the given rate
+type rateLimit struct {
+	host    string // host pattern such as "*.example.com", or empty for all hosts
+	limiter *rate.Limiter
+}
+
+// parseRateLimitFlag parses a --rate-limit value, which is either HOST=N/PERIOD to limit the requests to
+// matching hosts, or N/PERIOD to limit all requests, such as api.github.com=10/min. The whole budget for a
+// period may be spent at once, after which requests are let through evenly as it is replenished.
+func parseRateLimitFlag(s string) (*rateLimit, error) {
+	host, spec, ok := strings.Cut(s, "=")
+	if !ok {
+		host, spec = "", s
+	}
+	count, unit, ok := strings.Cut(spec, "/")
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	period, known := rateLimitUnits[strings.ToLower(strings.TrimSpace(unit))]
+	if !ok || err != nil || n <= 0 || !known {
+		return nil, fmt.Errorf("error in --rate-limit %q: expected N/PERIOD such as 10/min, optionally after HOST=", s)
+	}
+	return &rateLimit{host: host, limiter: rate.NewLimiter(rate.Every(period/time.Duration(n)), n)}, nil
+}
+
+// rateLimitTransport holds back or rejects HTTP requests that exceed the budgets given with --rate-limit
+type rateLimitTransport struct {
+	limits []*rateLimit
+	reject bool // answer requests over budget with 429 Too Many Requests rather than holding them back
+	next   http.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reservations []*rate.Reservation
+	var wait time.Duration
+	for _, limit := range t.limits {
+		if limit.host != "" && !reqmatch.Host(limit.host, req.URL.Hostname()) {
+			continue
+		}
+		r := limit.limiter.Reserve()
+		reservations = append(reservations, r)
+		wait = max(wait, r.Delay())
+	}
+	if wait == 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	if t.reject {
+		// give back the budget, since the request is not sent
+		for _, r := range reservations {
+			r.Cancel()
+		}
+		verbosef("rejecting %v %v, which is over --rate-limit", req.Method, req.URL)
+		return tooManyRequests(req, wait), nil
+	}
+
+	verbosef("holding back %v %v for %v, which is over --rate-limit", req.Method, req.URL, wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-req.Context().Done():
+		for _, r := range reservations {
+			r.Cancel()
+		}
+		return nil, req.Context().Err()
+	}
+	return t.next.RoundTrip(req.WithContext(context.WithValue(req.Context(), rateLimitedContextKey, "queued")))
+}
+
+// tooManyRequests makes the response to a request that is rejected by --rate-limit, which says when to
+// try again. The request body is read so that it is captured as it would be if the request had been sent.
+func tooManyRequests(req *http.Request, retryAfter time.Duration) *http.Response {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	body := []byte(http.StatusText(http.StatusTooManyRequests) + "\n")
+	header := make(http.Header)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Status:        fmt.Sprintf("%d %s", http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests)),
+		StatusCode:    http.StatusTooManyRequests,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		Request:       req.WithContext(context.WithValue(req.Context(), rateLimitedContextKey, "rejected")),
+	}
+}
+
+// rateLimited returns "queued" if a request was held back by --rate-limit, "rejected" if it was answered
+// with 429 Too Many Requests instead of being sent, or else the empty string
+func rateLimited(resp *http.Response) string {
+	if resp == nil || resp.Request == nil {
+		return ""
+	}
+	s, _ := resp.Request.Context().Value(rateLimitedContextKey).(string)
+	return s
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/monasticacademy/httptap/pkg/harlog"
+	"github.com/monasticacademy/httptap/pkg/scrub"
+)
+
+// the headers given with --redact-header, whose values are replaced in everything that we print and record
+var redactHeaders []string
+
+// the headers redacted by --redact-default, which commonly carry credentials
+var defaultRedactHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// redactHeader returns a copy of a header with the values given by --redact-header replaced, or the
+// header itself if there is nothing to replace, so that the header sent over the network is never changed
+func redactHeader(h http.Header) http.Header {
+	var out http.Header
+	for _, name := range redactHeaders {
+		vs, ok := h[http.CanonicalHeaderKey(name)]
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = h.Clone()
+		}
+		redacted := make([]string, len(vs))
+		for i := range redacted {
+			redacted[i] = harlog.Redacted
+		}
+		out[http.CanonicalHeaderKey(name)] = redacted
+	}
+	if out == nil {
+		return h
+	}
+	return out
+}
+
+// redactCall returns a copy of an HTTP call with the headers and trailers given by --redact-header replaced
+func redactCall(call *HTTPCall) *HTTPCall {
+	if len(redactHeaders) == 0 {
+		return call
+	}
+	redacted := *call
+	if redacted.sent == nil {
+		redacted.sent = &sentRequest{header: call.Request.Header, body: call.Request.Body}
+	}
+	redacted.Request.Header = redactHeader(call.Request.Header)
+	redacted.Request.Trailer = redactHeader(call.Request.Trailer)
+	redacted.Request.InjectedHeader = redactHeader(call.Request.InjectedHeader)
+	redacted.Response.Header = redactHeader(call.Response.Header)
+	redacted.Response.Trailer = redactHeader(call.Response.Trailer)
+	return &redacted
+}
+
+// the rules loaded with --scrub-rules, or nil to leave bodies as they are
+var bodyScrubber *scrub.Scrubber
+
+// scrubText applies --scrub-rules to a body given as a string, as HAR files store them
+func scrubText(text string) string {
+	return string(bodyScrubber.Scrub([]byte(text)))
+}
+
+// scrubMessages applies --scrub-rules to each of a list of gRPC messages decoded to JSON
+func scrubMessages(messages []json.RawMessage) []json.RawMessage {
+	if bodyScrubber == nil {
+		return messages
+	}
+	scrubbed := make([]json.RawMessage, len(messages))
+	for i, msg := range messages {
+		scrubbed[i] = bodyScrubber.Scrub(msg)
+	}
+	return scrubbed
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// the most bytes of a binary body that are hex-dumped to the terminal
+const maxHexDump = 512
+
+// renderBody formats a body for the terminal according to its content type. JSON is indented, form
+// fields are listed one per line, other text is shown as it is, and anything else is hex-dumped up to
+// maxHexDump bytes. It also returns a line describing the body, such as
+// "body: application/json, gzip, 1204 bytes". Bodies have already been decompressed by the proxy
+// unless they were truncated, in which case they are hex-dumped as they are.
+func renderBody(header http.Header, body []byte, size int64) (string, []string) {
+	encoding := strings.Join(header.Values("Content-Encoding"), ", ")
+
+	contentType := header.Get("Content-Type")
+	detected := contentType == ""
+	if detected {
+		contentType = http.DetectContentType(body)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	desc := "body: " + contentType
+	if detected {
+		desc += " (detected)"
+	}
+	if encoding != "" {
+		desc += ", " + encoding
+	}
+	desc += fmt.Sprintf(", %d bytes", size)
+
+	switch {
+	case !isText(body):
+		return desc, hexLines(body)
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var b bytes.Buffer
+		if err := json.Indent(&b, body, "", "  "); err == nil {
+			return desc, textLines(b.Bytes())
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		if lines, ok := formLines(body); ok {
+			return desc, lines
+		}
+	}
+	return desc, textLines(body)
+}
+
+// isText checks whether a body is UTF-8 without control characters other than whitespace, so that it
+// can be printed to the terminal as it is
+func isText(body []byte) bool {
+	if !utf8.Valid(body) {
+		return false
+	}
+	for _, r := range string(body) {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// textLines splits text into lines, leaving out a final newline
+func textLines(body []byte) []string {
+	return strings.Split(strings.TrimRight(string(body), "\r\n"), "\n")
+}
+
+// formLines lists the fields of a form-encoded body as "name: value" in the order they were sent, or
+// returns false if the body is not form-encoded after all
+func formLines(body []byte) ([]string, bool) {
+	var lines []string
+	for _, field := range strings.Split(strings.TrimSpace(string(body)), "&") {
+		if field == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(field, "=")
+		name, err := url.QueryUnescape(name)
+		if err != nil {
+			return nil, false
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return nil, false
+		}
+		lines = append(lines, name+": "+value)
+	}
+	return lines, true
+}
+
+// hexLines hex-dumps the first maxHexDump bytes of a body, noting how many bytes were left out
+func hexLines(body []byte) []string {
+	lines := textLines([]byte(hex.Dump(body[:min(len(body), maxHexDump)])))
+	if len(body) > maxHexDump {
+		lines = append(lines, fmt.Sprintf("(%d more bytes not shown)", len(body)-maxHexDump))
+	}
+	return lines
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monasticacademy/httptap/pkg/harlog"
+)
+
+// response headers that change from one request to the next, so they are not compared by replay
+var volatileHeaders = []string{
+	"Age", "Alt-Svc", "Cf-Ray", "Content-Length", "Date", "Expires", "Last-Modified", "Nel", "Report-To",
+	"Server-Timing", "Set-Cookie", "X-Amz-Cf-Id", "X-Request-Id", "X-Runtime",
+}
+
+// request headers that are not copied from the HAR file when a request is replayed, because the
+// transport works them out for itself
+var replayOmitHeaders = []string{"Accept-Encoding", "Connection", "Content-Length", "Host", "Transfer-Encoding"}
+
+// replayResult is the outcome of sending one request from a HAR file again
+type replayResult struct {
+	method      string
+	url         string
+	oldStatus   int
+	newStatus   int
+	differences []string
+	err         error
+}
+
+// replayMain implements "httptap replay", which sends the requests in a HAR file again and reports how
+// the responses differ from those that were recorded
+func replayMain(argv []string) error {
+	var args struct {
+		HAR         string        `arg:"positional,required" help:"HAR file to read requests from"`
+		BaseURL     string        `arg:"--base-url" help:"send every request to this scheme and host instead of the one it was recorded with (e.g. http://localhost:8080)"`
+		Concurrency int           `arg:"--concurrency" default:"1" help:"number of requests to send at once"`
+		Rate        float64       `arg:"--rate" help:"most requests to send per second (0 for no limit)"`
+		Timeout     time.Duration `arg:"--timeout" default:"30s" help:"how long to wait for each response"`
+		Insecure    bool          `arg:"--insecure" help:"do not verify the certificates of servers"`
+	}
+	if err := parseSubcommand("replay", argv, &args); err != nil {
+		return err
+	}
+	if args.Concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+	var base *url.URL
+	if args.BaseURL != "" {
+		u, err := url.Parse(args.BaseURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("--base-url must be a URL such as http://localhost:8080")
+		}
+		base = u
+	}
+
+	har, err := readHAR(args.HAR)
+	if err != nil {
+		return err
+	}
+	entries := har.Log.Entries
+
+	client := &http.Client{
+		Timeout: args.Timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: args.Insecure},
+		},
+		// report redirects as they were recorded rather than following them
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// send the requests from a pool of workers, starting each one no sooner than --rate allows
+	var interval time.Duration
+	if args.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / args.Rate)
+	}
+	results := make([]*replayResult, len(entries))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for range args.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				r := replayEntry(client, entries[i], base)
+				mu.Lock()
+				results[i] = r
+				printReplayResult(r)
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range entries {
+		if i > 0 && interval > 0 {
+			time.Sleep(interval)
+		}
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	var differed, failed int
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			failed++
+		case len(r.differences) > 0:
+			differed++
+		}
+	}
+	log.Printf("\nreplayed %d requests: %d the same, %d different, %d failed", len(results), len(results)-differed-failed, differed, failed)
+	if differed > 0 || failed > 0 {
+		return fmt.Errorf("%d of %d replayed requests differed or failed", differed+failed, len(results))
+	}
+	return nil
+}
+
+// replayEntry sends the request in a HAR entry again and compares the response with the one recorded
+func replayEntry(client *http.Client, entry *harlog.Entry, base *url.URL) *replayResult {
+	r := &replayResult{method: entry.Request.Method, url: entry.Request.URL}
+	if entry.Response != nil {
+		r.oldStatus = entry.Response.Status
+	}
+
+	u, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if base != nil {
+		u.Scheme = base.Scheme
+		u.Host = base.Host
+		u.Path = strings.TrimSuffix(base.Path, "/") + u.Path
+		r.url = u.String()
+	}
+
+	body, err := harRequestBody(entry.Request)
+	if err != nil {
+		r.err = fmt.Errorf("error reading request body: %w", err)
+		return r
+	}
+	req, err := http.NewRequest(entry.Request.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		r.err = err
+		return r
+	}
+	for _, h := range entry.Request.Headers {
+		name := http.CanonicalHeaderKey(h.Name)
+		// the body has had any content encoding removed, and is sent as it is
+		if strings.HasPrefix(name, ":") || slices.Contains(replayOmitHeaders, name) || name == "Content-Encoding" {
+			continue
+		}
+		req.Header.Add(name, h.Value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	defer resp.Body.Close()
+	newBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		r.err = fmt.Errorf("error reading response body: %w", err)
+		return r
+	}
+	r.newStatus = resp.StatusCode
+
+	if entry.Response == nil {
+		r.differences = append(r.differences, "no response was recorded")
+		return r
+	}
+	oldBody, err := harResponseBody(entry.Response)
+	if err != nil {
+		r.err = fmt.Errorf("error reading recorded response body: %w", err)
+		return r
+	}
+	r.differences = compareResponses(entry.Response, oldBody, resp.Header, newBody)
+	if r.oldStatus != r.newStatus {
+		r.differences = append([]string{fmt.Sprintf("status %d became %d", r.oldStatus, r.newStatus)}, r.differences...)
+	}
+	return r
+}
+
+// compareResponses lists the differences between a recorded response and a new one, leaving out the
+// headers that change from one request to the next
+func compareResponses(old *harlog.Response, oldBody []byte, header http.Header, newBody []byte) []string {
+	oldHeader := make(http.Header)
+	for _, h := range old.Headers {
+		oldHeader.Add(h.Name, h.Value)
+	}
+	// the recorded body has had its content encoding removed, as has the new one by the transport
+	oldHeader.Del("Content-Encoding")
+	header = header.Clone()
+	header.Del("Content-Encoding")
+
+	var diffs []string
+	names := append(sortedKeys(oldHeader), sortedKeys(header)...)
+	slices.Sort(names)
+	for _, name := range slices.Compact(names) {
+		if slices.Contains(volatileHeaders, name) {
+			continue
+		}
+		a, b := strings.Join(oldHeader[name], ", "), strings.Join(header[name], ", ")
+		switch {
+		case a == b:
+		case a == "":
+			diffs = append(diffs, fmt.Sprintf("header %s added: %s", name, b))
+		case b == "":
+			diffs = append(diffs, fmt.Sprintf("header %s removed: %s", name, a))
+		default:
+			diffs = append(diffs, fmt.Sprintf("header %s changed: %s became %s", name, a, b))
+		}
+	}
+
+	if !sameBody(oldBody, newBody) {
+		diffs = append(diffs, fmt.Sprintf("body changed: %d bytes became %d bytes", len(oldBody), len(newBody)))
+	}
+	return diffs
+}
+
+// sameBody compares two bodies, treating JSON documents that differ only in formatting and the order of
+// object keys as the same
+func sameBody(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
+
+// printReplayResult prints one line for a replayed request, followed by its differences
+func printReplayResult(r *replayResult) {
+	switch {
+	case r.err != nil:
+		log.Printf("failed   %v %v: %v", r.method, r.url, r.err)
+	case len(r.differences) > 0:
+		log.Printf("changed  %v %v (%d)", r.method, r.url, r.newStatus)
+		for _, d := range r.differences {
+			log.Printf("  %s", d)
+		}
+	default:
+		log.Printf("same     %v %v (%d)", r.method, r.url, r.newStatus)
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/monasticacademy/httptap/pkg/reqmatch"
+	"gopkg.in/yaml.v3"
+)
+
+// rewriteRule is one rule in a --rules file. Every rule whose match applies to a request changes the
+// request before it is sent and the response before it is delivered to the subprocess, in the order in
+// which the rules appear in the file.
+type rewriteRule struct {
+	Match    reqmatch.Match `json:"match" yaml:"match"`
+	Request  ruleRequest    `json:"request" yaml:"request"`
+	Response ruleResponse   `json:"response" yaml:"response"`
+	Mock     *ruleMock      `json:"mock" yaml:"mock"`
+	Fault    *ruleFault     `json:"fault" yaml:"fault"`
+	Delay    string         `json:"delay" yaml:"delay"` // hold back responses by this long, such as 300ms, or 200ms-400ms for a random delay
+}
+
+// ruleRequest says how a rule changes requests
+type ruleRequest struct {
+	URL           string            `json:"url" yaml:"url"`                     // new URL, in which $1 and ${name} refer to submatches of the path
+	Host          string            `json:"host" yaml:"host"`                   // host to send the request to instead, keeping the scheme, path, and query
+	SetHeaders    map[string]string `json:"setHeaders" yaml:"setHeaders"`       // headers to set, replacing any values they had
+	RemoveHeaders []string          `json:"removeHeaders" yaml:"removeHeaders"` // headers to remove
+	Body          *string           `json:"body" yaml:"body"`                   // new body
+}
+
+// ruleResponse says how a rule changes responses
+type ruleResponse struct {
+	Status        int               `json:"status" yaml:"status"`               // new status code
+	SetHeaders    map[string]string `json:"setHeaders" yaml:"setHeaders"`       // headers to set, replacing any values they had
+	RemoveHeaders []string          `json:"removeHeaders" yaml:"removeHeaders"` // headers to remove
+	Body          *string           `json:"body" yaml:"body"`                   // new body
+}
+
+// ruleMock is a response that a rule answers requests with, instead of sending them to the world
+type ruleMock struct {
+	Status   int               `json:"status" yaml:"status"`     // status code, or 200 if not given
+	Headers  map[string]string `json:"headers" yaml:"headers"`   // headers of the response
+	Body     string            `json:"body" yaml:"body"`         // body of the response
+	BodyFile string            `json:"bodyFile" yaml:"bodyFile"` // file to read the body from, relative to the rules file
+	Template bool              `json:"template" yaml:"template"` // whether the body is a Go template, executed with a mockRequest
+}
+
+// mockRequest is what the body of a mock response can refer to when it is a template, such as
+// {{.Query.Get "id"}} or {{index .Match 1}}
+type mockRequest struct {
+	Method string
+	URL    string
+	Host   string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   string
+	Match  []string // the path followed by its submatches, if the rule matches a path
+}
+
+// compiledRule is a rule with its regular expressions compiled and its mock body loaded
+type compiledRule struct {
+	rewriteRule
+	match        *reqmatch.Matcher
+	mockBody     []byte
+	mockTemplate *template.Template
+	delay        *delayRange
+}
+
+// loadRules reads rules from a JSON or YAML file, according to its extension, such as
+//
+//	[
+//	  {
+//	    "match": {"host": "api.example.com", "path": "^/v1/(.*)"},
+//	    "request": {"url": "https://staging.example.com/v1/$1"},
+//	    "response": {"setHeaders": {"Cache-Control": "no-store"}}
+//	  }
+//	]
+func loadRules(path string) ([]*compiledRule, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ext := filepath.Ext(path)
+	return parseRules(buf, ext == ".yaml" || ext == ".yml", filepath.Dir(path), path)
+}
+
+// parseRules parses and compiles rules written in YAML or JSON, reading the files they refer to relative
+// to dir. The name says where the rules came from in errors.
+func parseRules(buf []byte, isYAML bool, dir, name string) ([]*compiledRule, error) {
+	var rules []rewriteRule
+	var err error
+	if isYAML {
+		dec := yaml.NewDecoder(bytes.NewReader(buf))
+		dec.KnownFields(true)
+		err = dec.Decode(&rules)
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&rules)
+	}
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error parsing %v: %w", name, err)
+	}
+
+	var compiled []*compiledRule
+	for i, rule := range rules {
+		c, err := compileRule(rule, dir)
+		if err != nil {
+			return nil, fmt.Errorf("error in rule %d of %v: %w", i+1, name, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// compileRule checks a rule, compiles its regular expressions, and loads the body of its mock response,
+// reading files relative to dir
+func compileRule(rule rewriteRule, dir string) (*compiledRule, error) {
+	match, err := reqmatch.Compile(rule.Match)
+	if err != nil {
+		return nil, err
+	}
+	c := &compiledRule{rewriteRule: rule, match: match}
+	if rule.Request.URL != "" && !strings.Contains(rule.Request.URL, "$") {
+		if u, err := url.Parse(rule.Request.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("the new URL %q is not an absolute URL", rule.Request.URL)
+		}
+	}
+	if rule.Request.URL != "" && rule.Request.Host != "" {
+		return nil, fmt.Errorf("a request can have a new url or a new host but not both")
+	}
+	if strings.ContainsAny(rule.Request.Host, "/?#@ ") {
+		return nil, fmt.Errorf("the new host %q is not a host name with an optional port", rule.Request.Host)
+	}
+	if rule.Response.Status != 0 && (rule.Response.Status < 100 || rule.Response.Status > 999) {
+		return nil, fmt.Errorf("%d is not a status code", rule.Response.Status)
+	}
+	if rule.Fault != nil {
+		if err := rule.Fault.check(); err != nil {
+			return nil, err
+		}
+	}
+	if rule.Delay != "" {
+		d, err := parseDelay(rule.Delay)
+		if err != nil {
+			return nil, err
+		}
+		c.delay = d
+	}
+	if m := rule.Mock; m != nil {
+		if m.Status != 0 && (m.Status < 100 || m.Status > 999) {
+			return nil, fmt.Errorf("%d is not a status code", m.Status)
+		}
+		if m.Body != "" && m.BodyFile != "" {
+			return nil, fmt.Errorf("a mock can have a body or a bodyFile but not both")
+		}
+		c.mockBody = []byte(m.Body)
+		if m.BodyFile != "" {
+			path := m.BodyFile
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			body, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("error reading mock body: %w", err)
+			}
+			c.mockBody = body
+		}
+		if m.Template {
+			t, err := template.New("mock").Parse(string(c.mockBody))
+			if err != nil {
+				return nil, fmt.Errorf("error in mock body template: %w", err)
+			}
+			c.mockTemplate = t
+		}
+	}
+	return c, nil
+}
+
+// rewriteRequest applies the request part of a rule to a request
+func (r *compiledRule) rewriteRequest(req *http.Request) (*http.Request, error) {
+	if r.Request.URL != "" {
+		target := r.match.Expand(r.Request.URL, req.URL.Path)
+		u, err := url.Parse(target)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("rule rewrote %v to %q, which is not an absolute URL", req.URL, target)
+		}
+		if u.RawQuery == "" && !strings.HasSuffix(target, "?") {
+			u.RawQuery = req.URL.RawQuery
+		}
+		req = redirectRequest(req, u)
+	}
+	if r.Request.Host != "" {
+		u := *req.URL
+		u.Host = r.Request.Host
+		req = redirectRequest(req, &u)
+	}
+	for name, value := range r.Request.SetHeaders {
+		req.Header.Set(name, value)
+	}
+	for _, name := range r.Request.RemoveHeaders {
+		req.Header.Del(name)
+	}
+	if r.Request.Body != nil {
+		if req.Body != nil {
+			// read the original body so that it is still captured as the subprocess sent it
+			io.Copy(io.Discard, req.Body)
+			req.Body.Close()
+		}
+		req.Body = io.NopCloser(strings.NewReader(*r.Request.Body))
+		req.ContentLength = int64(len(*r.Request.Body))
+		req.TransferEncoding = nil
+		req.Header.Del("Content-Encoding")
+	}
+	return req, nil
+}
+
+// rewriteResponse applies the response part of a rule to a response
+func (r *compiledRule) rewriteResponse(resp *http.Response) {
+	if r.Response.Status != 0 {
+		resp.StatusCode = r.Response.Status
+		resp.Status = fmt.Sprintf("%d %s", r.Response.Status, http.StatusText(r.Response.Status))
+	}
+	for name, value := range r.Response.SetHeaders {
+		resp.Header.Set(name, value)
+	}
+	for _, name := range r.Response.RemoveHeaders {
+		resp.Header.Del(name)
+	}
+	if r.Response.Body != nil {
+		resp.Body.Close()
+		resp.Body = io.NopCloser(strings.NewReader(*r.Response.Body))
+		resp.ContentLength = int64(len(*r.Response.Body))
+		resp.TransferEncoding = nil
+		resp.Uncompressed = true
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+	}
+}
+
+// mockResponse makes the response that a rule answers a request with. The request body is read so that
+// it is captured as it would be if the request had been sent.
+func (r *compiledRule) mockResponse(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading request body: %w", err)
+		}
+	}
+
+	body := r.mockBody
+	if r.mockTemplate != nil {
+		data := mockRequest{
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Host:   req.URL.Host,
+			Path:   req.URL.Path,
+			Query:  req.URL.Query(),
+			Header: req.Header,
+			Body:   string(reqBody),
+			Match:  r.match.Submatches(req.URL.Path),
+		}
+		var b bytes.Buffer
+		if err := r.mockTemplate.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("error executing mock body template: %w", err)
+		}
+		body = b.Bytes()
+	}
+
+	status := r.Mock.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := make(http.Header)
+	for name, value := range r.Mock.Headers {
+		header.Set(name, value)
+	}
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		Request:       req.WithContext(context.WithValue(req.Context(), mockedContextKey, true)),
+	}, nil
+}
+
+// mockedResponse reports whether a response was made up by a mock rule rather than sent by a server
+func mockedResponse(resp *http.Response) bool {
+	if resp == nil || resp.Request == nil {
+		return false
+	}
+	mocked, _ := resp.Request.Context().Value(mockedContextKey).(bool)
+	return mocked
+}
+
+// effectiveURL returns the URL that a request was sent to, if rules sent it somewhere other than the URL
+// that the subprocess asked for, or else the empty string
+func effectiveURL(req *http.Request, resp *http.Response) string {
+	if resp == nil || resp.Request == nil || resp.Request.URL == nil {
+		return ""
+	}
+	if u := resp.Request.URL.String(); u != req.URL.String() {
+		return u
+	}
+	return ""
+}
+
+// injectedHeaders returns the headers that rules added to a request or changed before it was sent, with
+// the values that were sent, or nil if there were none
+func injectedHeaders(req *http.Request, resp *http.Response) http.Header {
+	if resp == nil || resp.Request == nil {
+		return nil
+	}
+	var injected http.Header
+	for name, values := range resp.Request.Header {
+		if slices.Equal(values, req.Header[name]) {
+			continue
+		}
+		if injected == nil {
+			injected = make(http.Header)
+		}
+		injected[name] = values
+	}
+	return injected
+}
+
+// parseSetHeaderFlag makes a rule from a --set-header value, which is a header such as
+// "Authorization: Bearer abc" to set on every request before it is sent
+func parseSetHeaderFlag(s string) (*compiledRule, error) {
+	name, value, err := parseHeaderFlag("--set-header", s)
+	if err != nil {
+		return nil, err
+	}
+	return compileRule(rewriteRule{Request: ruleRequest{SetHeaders: map[string]string{name: value}}}, "")
+}
+
+// parseSetResponseHeaderFlag makes a rule from a --set-response-header value, which is a header such as
+// "Cache-Control: no-store" to set on every response before it is delivered to the subprocess
+func parseSetResponseHeaderFlag(s string) (*compiledRule, error) {
+	name, value, err := parseHeaderFlag("--set-response-header", s)
+	if err != nil {
+		return nil, err
+	}
+	return compileRule(rewriteRule{Response: ruleResponse{SetHeaders: map[string]string{name: value}}}, "")
+}
+
+// parseRemoveResponseHeaderFlag makes a rule from a --remove-response-header value, which is a
+// comma-separated list of headers such as Strict-Transport-Security,Content-Security-Policy to remove
+// from every response before it is delivered to the subprocess
+func parseRemoveResponseHeaderFlag(s string) (*compiledRule, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t:") {
+			return nil, fmt.Errorf("error in --remove-response-header %q: expected a list of header names, such as Strict-Transport-Security,Content-Security-Policy", s)
+		}
+		names = append(names, name)
+	}
+	return compileRule(rewriteRule{Response: ruleResponse{RemoveHeaders: names}}, "")
+}
+
+// parseHeaderFlag splits a header given to a flag, such as "Authorization: Bearer abc", into its name
+// and value
+func parseHeaderFlag(flag, s string) (name, value string, err error) {
+	name, value, ok := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return "", "", fmt.Errorf("error in %s %q: expected NAME: VALUE, such as \"Authorization: Bearer abc\"", flag, s)
+	}
+	return name, strings.TrimSpace(value), nil
+}
+
+// parseMapRemoteFlag makes a rule from a --map-remote value, which is FROM=TO to send requests for hosts
+// matching FROM to the host TO instead, such as api.example.com=staging.example.com:8443
+func parseMapRemoteFlag(s string) (*compiledRule, error) {
+	from, to, ok := strings.Cut(s, "=")
+	if !ok || from == "" || to == "" {
+		return nil, fmt.Errorf("error in --map-remote %q: expected FROM=TO, such as api.example.com=staging.example.com", s)
+	}
+	rule, err := compileRule(rewriteRule{Match: reqmatch.Match{Host: from}, Request: ruleRequest{Host: to}}, "")
+	if err != nil {
+		return nil, fmt.Errorf("error in --map-remote %q: %w", s, err)
+	}
+	return rule, nil
+}
+
+// redirectRequest points a request at another URL, and sends it to the host in that URL rather than
+// to the address that the subprocess connected to
+func redirectRequest(req *http.Request, u *url.URL) *http.Request {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	ctx := context.WithValue(req.Context(), dialToContextKey, net.JoinHostPort(u.Hostname(), port))
+	ctx = context.WithValue(ctx, serverNameContextKey, u.Hostname())
+	req = req.WithContext(ctx)
+	req.URL = u
+	req.Host = u.Host
+	return req
+}
+
+// rulesTransport applies --rules to requests and responses that pass through it. Rules can be added
+// while requests pass through it, with "httptap ctl add-rules".
+type rulesTransport struct {
+	mu    sync.RWMutex
+	rules []*compiledRule
+	next  http.RoundTripper
+}
+
+// add appends rules to those that apply to later requests
+func (t *rulesTransport) add(rules ...*compiledRule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rules = append(t.rules, rules...)
+}
+
+// list returns the rules that apply to requests, in the order in which they are applied
+func (t *rulesTransport) list() []rewriteRule {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rules := make([]rewriteRule, len(t.rules))
+	for i, rule := range t.rules {
+		rules[i] = rule.rewriteRule
+	}
+	return rules
+}
+
+func (t *rulesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.RLock()
+	rules := t.rules
+	t.mu.RUnlock()
+
+	var matched, damages []*compiledRule
+	var answer *compiledRule // the rule whose mock or fault takes the place of sending the request
+	for _, rule := range rules {
+		if !rule.match.Matches(req) {
+			continue
+		}
+		if len(matched) == 0 {
+			// rules must not change the request they were given, which is still used to report the call
+			req = req.Clone(req.Context())
+		}
+		matched = append(matched, rule)
+		var err error
+		req, err = rule.rewriteRequest(req)
+		if err != nil {
+			return nil, err
+		}
+
+		// the first rule with a mock or a fault that replaces the response answers the request, so
+		// later rules do not apply
+		if rule.Fault != nil && rule.Fault.fires() {
+			if rule.Fault.replaces() {
+				answer = rule
+				break
+			}
+			damages = append(damages, rule)
+		}
+		if rule.Mock != nil {
+			answer = rule
+			break
+		}
+	}
+	if len(matched) > 0 {
+		verbosef("%d rules apply to %v %v", len(matched), req.Method, req.URL)
+	}
+
+	var resp *http.Response
+	var err error
+	switch {
+	case answer != nil && answer.Mock != nil:
+		resp, err = answer.mockResponse(req)
+	case answer != nil:
+		verbosef("bringing about a fault for %v %v", req.Method, req.URL)
+		resp, err = answer.Fault.respond(req)
+	default:
+		resp, err = t.next.RoundTrip(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range matched {
+		rule.rewriteResponse(resp)
+	}
+	for _, rule := range damages {
+		verbosef("bringing about a fault for %v %v", req.Method, req.URL)
+		if err := rule.Fault.damage(resp); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range matched {
+		if rule.delay == nil {
+			continue
+		}
+		if err := rule.delay.wait(req.Context()); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return resp, nil
+}
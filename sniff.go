@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// how long to wait for the subprocess to send something on a new connection before giving up on
+// detecting the protocol; in protocols such as SMTP the server speaks first, so the wait must be short
+const sniffTimeout = 200 * time.Millisecond
+
+// the well-known ports of protocols in which the server speaks first, which are not sniffed unless
+// --server-first-ports says otherwise, so that their connections are not held up for sniffTimeout: 21
+// for FTP, 22 for SSH, 23 for Telnet, 25, 587, and 2525 for SMTP, 110 for POP3, 143 for IMAP, 3306 for
+// MySQL, and 5900 for VNC
+var defaultServerFirstPorts = []int{21, 22, 23, 25, 110, 143, 587, 2525, 3306, 5900}
+
+// isServerFirst checks whether a connection to addr is on one of ports, on which the server is expected
+// to speak first
+func isServerFirst(addr net.Addr, ports []int) bool {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && slices.Contains(ports, n)
+}
+
+// sniff waits briefly for the first bytes sent by the subprocess on conn, and returns them together
+// with a connection from which those same bytes will be read again. If nothing arrives within the
+// timeout then it returns no bytes, and the read continues in the background. This works with TCP
+// stacks that do not implement read deadlines.
+func sniff(conn net.Conn, timeout time.Duration) (net.Conn, []byte) {
+	pending := make(chan sniffResult, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		pending <- sniffResult{buf[:n], err}
+	}()
+
+	sniffed := &sniffedConn{Conn: conn, pending: pending}
+	select {
+	case r := <-pending:
+		sniffed.pending = nil
+		sniffed.buf, sniffed.err = r.buf, r.err
+		return sniffed, r.buf
+	case <-time.After(timeout):
+		return sniffed, nil
+	}
+}
+
+// sniffResult is the outcome of the first read from a connection
+type sniffResult struct {
+	buf []byte
+	err error
+}
+
+// sniffedConn is a net.Conn that returns the result of the first read made by sniff, then continues
+// reading from the underlying connection
+type sniffedConn struct {
+	net.Conn
+	pending chan sniffResult // not nil while the first read is still in progress
+	buf     []byte           // bytes from the first read that have not yet been returned
+	err     error            // error from the first read, returned once buf is empty
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	if c.pending != nil {
+		r := <-c.pending
+		c.pending = nil
+		c.buf, c.err = r.buf, r.err
+	}
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		err := c.err
+		c.err = nil
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// looksLikeTLS checks whether the first bytes of a connection are a TLS handshake record, as sent
+// by a client beginning with a ClientHello
+func looksLikeTLS(b []byte) bool {
+	// record type 22 (handshake), then a major version of 3, then a minor version of at most 4,
+	// then the record length, then handshake type 1 (ClientHello)
+	return len(b) >= 6 && b[0] == 0x16 && b[1] == 0x03 && b[2] <= 0x04 && b[5] == 0x01
+}
+
+// the methods that an HTTP request line may begin with, including the start of the HTTP/2 preface
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH", "PRI"}
+
+// looksLikeHTTP checks whether the first bytes of a connection are the request line of an HTTP/1.x
+// request, or the HTTP/2 connection preface
+func looksLikeHTTP(b []byte) bool {
+	line, _, _ := bytes.Cut(b, []byte("\r\n"))
+	method, rest, ok := bytes.Cut(line, []byte(" "))
+	if !ok {
+		return false
+	}
+
+	if !slices.Contains(httpMethods, string(method)) {
+		return false
+	}
+
+	// the request line ends with the protocol version, but it may not have arrived yet
+	_, version, ok := bytes.Cut(rest, []byte(" "))
+	return !ok || bytes.HasPrefix(version, []byte("HTTP/"))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// hostSummary collects the statistics about the HTTP calls to one host that --summary prints
+type hostSummary struct {
+	host      string
+	requests  int
+	errors    int // responses with status 400 or above, including failures to reach the server
+	up        int64
+	down      int64
+	durations []time.Duration
+}
+
+// printSummary prints statistics about the HTTP calls made so far, for --summary
+func printSummary() {
+	log.Print("\n" + summaryText())
+}
+
+// summaryText formats statistics about the HTTP calls made so far as tables by host and by status code
+func summaryText() string {
+	httpMu.Lock()
+	calls := slices.Clone(httpCalls)
+	httpMu.Unlock()
+
+	total := hostSummary{host: "total"}
+	byHost := make(map[string]*hostSummary)
+	statuses := make(map[int]int)
+	for _, c := range calls {
+		host := c.Request.Host
+		if u, err := url.Parse(c.Request.URL); err == nil {
+			host = u.Host
+		}
+		h, ok := byHost[host]
+		if !ok {
+			h = &hostSummary{host: host}
+			byHost[host] = h
+		}
+		for _, s := range []*hostSummary{h, &total} {
+			s.requests++
+			s.up += c.Request.Size
+			s.down += c.Response.Size
+			s.durations = append(s.durations, c.Duration)
+			if c.Response.StatusCode >= 400 {
+				s.errors++
+			}
+		}
+		statuses[c.Response.StatusCode]++
+	}
+
+	// hosts with the most requests come first
+	hosts := make([]*hostSummary, 0, len(byHost))
+	for _, h := range byHost {
+		hosts = append(hosts, h)
+	}
+	slices.SortFunc(hosts, func(a, b *hostSummary) int {
+		return cmp.Or(cmp.Compare(b.requests, a.requests), strings.Compare(a.host, b.host))
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "summary of %d HTTP calls:\n\n", total.requests)
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tREQUESTS\tERRORS\tUP\tDOWN\tP50\tP95")
+	for _, h := range append(hosts, &total) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%v\t%v\t%v\t%v\n", h.host, h.requests, h.errors, byteSize(h.up), byteSize(h.down),
+			roundDuration(percentile(h.durations, 50)), roundDuration(percentile(h.durations, 95)))
+	}
+	w.Flush()
+
+	// status codes in numerical order
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	b.WriteString("\n")
+	w = tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tCOUNT")
+	for _, code := range codes {
+		fmt.Fprintf(w, "%d\t%d\n", code, statuses[code])
+	}
+	w.Flush()
+	return b.String()
+}
+
+// percentile returns the p-th percentile of a list of durations by the nearest-rank method, or zero if
+// the list is empty. The list is sorted in place.
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	slices.Sort(durations)
+	rank := int(math.Ceil(p / 100 * float64(len(durations))))
+	return durations[max(rank, 1)-1]
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/monasticacademy/httptap/pkg/reqmatch"
+	"golang.org/x/time/rate"
+)
+
+// throttleProfiles are the named rates that --throttle accepts in place of a number, as download and
+// upload rates in bits per second, roughly following the network profiles in browser developer tools
+var throttleProfiles = map[string][2]float64{
+	"gprs":  {50e3, 20e3},
+	"2g":    {250e3, 50e3},
+	"3g":    {1.6e6, 750e3},
+	"4g":    {9e6, 9e6},
+	"dsl":   {2e6, 1e6},
+	"cable": {50e6, 10e6},
+}
+
+// throttle limits the bandwidth of TCP connections to matching hosts. The limiters are shared by all of
+// the connections, so that they add up to the given rate as they would on a slow network.
+type throttle struct {
+	host     string        // host pattern such as "*.example.com", or empty for all hosts
+	down, up *rate.Limiter // bytes delivered to the subprocess, and bytes sent by the subprocess
+}
+
+// the throttles given with --throttle
+var throttles []*throttle
+
+// parseRate parses a rate in bits per second such as "500kbps" or "1mbps"
+func parseRate(s string) (float64, error) {
+	t := strings.ToLower(strings.TrimSpace(s))
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(t, "gbps"):
+		multiplier = 1e9
+	case strings.HasSuffix(t, "mbps"):
+		multiplier = 1e6
+	case strings.HasSuffix(t, "kbps"):
+		multiplier = 1e3
+	case !strings.HasSuffix(t, "bps"):
+		return 0, fmt.Errorf("%q is not a rate such as 500kbps or 1mbps", s)
+	}
+	t = strings.TrimSpace(strings.TrimRight(t, "kmgbps"))
+	n, err := strconv.ParseFloat(t, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a rate such as 500kbps or 1mbps", s)
+	}
+	return n * multiplier, nil
+}
+
+// newLimiter makes a limiter for a rate in bits per second, which lets through bursts of a tenth of a
+// second of traffic at a time
+func newLimiter(bps float64) *rate.Limiter {
+	bytes := bps / 8
+	return rate.NewLimiter(rate.Limit(bytes), max(int(bytes/10), 512))
+}
+
+// parseThrottleFlag parses a --throttle value, which is either HOST=RATE to limit traffic to matching
+// hosts, or RATE to limit all traffic. The rate is in bits per second, such as "1mbps", or the name of a
+// profile such as "3g", or DOWN/UP to give different rates for each direction, such as "2mbps/500kbps".
+func parseThrottleFlag(s string) (*throttle, error) {
+	host, spec, ok := strings.Cut(s, "=")
+	if !ok {
+		host, spec = "", s
+	}
+
+	rates, ok := throttleProfiles[strings.ToLower(spec)]
+	if !ok {
+		down, up, asymmetric := strings.Cut(spec, "/")
+		var err error
+		rates[0], err = parseRate(down)
+		if err != nil {
+			return nil, fmt.Errorf("error in --throttle %q: %w", s, err)
+		}
+		rates[1] = rates[0]
+		if asymmetric {
+			rates[1], err = parseRate(up)
+			if err != nil {
+				return nil, fmt.Errorf("error in --throttle %q: %w", s, err)
+			}
+		}
+	}
+	return &throttle{host: host, down: newLimiter(rates[0]), up: newLimiter(rates[1])}, nil
+}
+
+// throttleConn limits the bandwidth of a TCP connection from the subprocess according to the throttles
+// that match the host it was made to. If no throttles match then the connection is returned unchanged.
+func throttleConn(conn net.Conn) net.Conn {
+	if len(throttles) == 0 {
+		return conn
+	}
+	host := destinationHost(conn.LocalAddr().String())
+	var matched []*throttle
+	for _, t := range throttles {
+		if t.host == "" || reqmatch.Host(t.host, host) {
+			matched = append(matched, t)
+		}
+	}
+	if len(matched) == 0 {
+		return conn
+	}
+	verbosef("throttling connection to %v", host)
+	return &throttledConn{Conn: conn, throttles: matched}
+}
+
+// throttledConn is a connection from the subprocess whose reads and writes wait for throttles
+type throttledConn struct {
+	net.Conn
+	throttles []*throttle
+}
+
+// NetConn returns the connection that is throttled
+func (c *throttledConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Read reads at most one burst from the subprocess, then waits until the throttles let it through
+func (c *throttledConn) Read(b []byte) (int, error) {
+	for _, t := range c.throttles {
+		if len(b) > t.up.Burst() {
+			b = b[:t.up.Burst()]
+		}
+	}
+	n, err := c.Conn.Read(b)
+	for _, t := range c.throttles {
+		t.up.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+// Write delivers bytes to the subprocess one burst at a time, as fast as the throttles let them through
+func (c *throttledConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		for _, t := range c.throttles {
+			if len(chunk) > t.down.Burst() {
+				chunk = chunk[:t.down.Burst()]
+			}
+		}
+		for _, t := range c.throttles {
+			t.down.WaitN(context.Background(), len(chunk))
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// throttlesByHost reports whether any throttle is for particular hosts
+func throttlesByHost() bool {
+	for _, t := range throttles {
+		if t.host != "" {
+			return true
+		}
+	}
+	return false
+}
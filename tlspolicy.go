@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the lowest TLS version that the subprocess may negotiate with us, or zero for the crypto/tls default
+var minTLSVersion uint16
+
+// cipher suites that the subprocess may not negotiate with us
+var forbiddenCiphers []uint16
+
+// TLSViolation describes a TLS handshake from the subprocess that was rejected because it did not meet
+// the policy given by --min-tls and --forbid-ciphers
+type TLSViolation struct {
+	ServerName string    `json:"server_name"`
+	Addr       string    `json:"addr"`
+	Reason     string    `json:"reason"`
+	Time       time.Time `json:"time"`
+}
+
+// tlsViolationWatcher receives information about each rejected handshake
+type tlsViolationWatcher func(*TLSViolation)
+
+// the watchers waiting for rejected handshakes
+var tlsViolationWatchers []tlsViolationWatcher
+
+// the mutex that protects the above slice
+var tlsViolationMu sync.Mutex
+
+// add a watcher that will be called when a handshake is rejected
+func watchTLSViolations(w tlsViolationWatcher) {
+	tlsViolationMu.Lock()
+	defer tlsViolationMu.Unlock()
+
+	tlsViolationWatchers = append(tlsViolationWatchers, w)
+}
+
+// call each TLS violation watcher
+func notifyTLSViolationWatchers(v *TLSViolation) {
+	if !isCapturedHost(v.ServerName) {
+		return
+	}
+
+	tlsViolationMu.Lock()
+	defer tlsViolationMu.Unlock()
+
+	for _, w := range tlsViolationWatchers {
+		w(v)
+	}
+}
+
+// reportTLSViolation notifies watchers of a rejected handshake and returns an error describing it
+func reportTLSViolation(serverName, addr, reason string) error {
+	notifyTLSViolationWatchers(&TLSViolation{
+		ServerName: serverName,
+		Addr:       addr,
+		Reason:     reason,
+		Time:       time.Now(),
+	})
+	return fmt.Errorf("TLS policy violation: %s", reason)
+}
+
+// parseTLSVersion parses a TLS version such as "1.2"
+func parseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(s), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q (expected 1.0, 1.1, 1.2, or 1.3)", s)
+}
+
+// parseCipherSuite parses the name of a cipher suite known to crypto/tls, such as
+// "TLS_RSA_WITH_AES_128_CBC_SHA"
+func parseCipherSuite(name string) (uint16, error) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if strings.EqualFold(suite.Name, name) {
+			return suite.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+// allowedCipherSuites returns the secure cipher suites that are not forbidden, or nil for the crypto/tls
+// default. Cipher suites for TLS 1.3 cannot be configured, so although they are included here, forbidden
+// TLS 1.3 suites are checked after the handshake by checkTLSPolicy.
+func allowedCipherSuites() []uint16 {
+	if len(forbiddenCiphers) == 0 {
+		return nil
+	}
+	var allowed []uint16
+	for _, suite := range tls.CipherSuites() {
+		if !slices.Contains(forbiddenCiphers, suite.ID) {
+			allowed = append(allowed, suite.ID)
+		}
+	}
+	return allowed
+}
+
+// checkHelloPolicy checks that the subprocess offered at least one version and one cipher suite that
+// the policy allows. It returns a description of the violation, or an empty string.
+func checkHelloPolicy(hello *tls.ClientHelloInfo) string {
+	if minTLSVersion != 0 && len(hello.SupportedVersions) > 0 && slices.Max(hello.SupportedVersions) < minTLSVersion {
+		return fmt.Sprintf("subprocess offered at most %v but %v is required",
+			tls.VersionName(slices.Max(hello.SupportedVersions)), tls.VersionName(minTLSVersion))
+	}
+
+	if len(forbiddenCiphers) > 0 {
+		allowed := allowedCipherSuites()
+		ok := slices.ContainsFunc(hello.CipherSuites, func(c uint16) bool {
+			return slices.Contains(allowed, c)
+		})
+		if !ok {
+			return "subprocess offered no cipher suites other than forbidden or insecure ones"
+		}
+	}
+	return ""
+}
+
+// serverMinVersion returns the lowest TLS version that we accept from the subprocess. When a policy is
+// given we accept every version that crypto/tls supports, so that handshakes below the required version
+// get far enough to be reported by checkHelloPolicy.
+func serverMinVersion() uint16 {
+	if minTLSVersion != 0 {
+		return tls.VersionTLS10
+	}
+	return 0
+}
+
+// checkTLSPolicy checks a completed handshake against the policy. It returns a description of the
+// violation, or an empty string.
+func checkTLSPolicy(state tls.ConnectionState) string {
+	if minTLSVersion != 0 && state.Version < minTLSVersion {
+		return fmt.Sprintf("negotiated %v but %v is required", tls.VersionName(state.Version), tls.VersionName(minTLSVersion))
+	}
+	if slices.Contains(forbiddenCiphers, state.CipherSuite) {
+		return fmt.Sprintf("negotiated forbidden cipher suite %v", tls.CipherSuiteName(state.CipherSuite))
+	}
+	return ""
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+	"golang.org/x/sys/unix"
+)
+
+// the views that the terminal UI can show
+type tuiMode int
+
+const (
+	tuiList   tuiMode = iota // the list of calls, with the details of the selected call below it
+	tuiDetail                // the details of the selected call, using the whole screen
+	tuiOutput                // the output of the subprocess and of httptap itself
+)
+
+// tui is the interactive viewer shown with --tui. It lists HTTP calls as they are made, shows the
+// details of the selected call, and shows everything that would otherwise have been printed to the
+// terminal in a separate view. All of its state is owned by the goroutine that calls run.
+type tui struct {
+	in       *os.File
+	out      *os.File
+	oldState *unix.Termios
+	oldLog   io.Writer
+	oldDiag  io.Writer
+	oldColor io.Writer
+	closed   bool
+
+	output *outputLog
+	keys   chan string
+	winch  chan os.Signal
+
+	calls     []*HTTPCall
+	visible   []int // indices into calls of those that match the filter
+	selected  int   // index into visible
+	top       int   // the first row of visible shown in the list
+	follow    bool  // whether to keep the newest call selected as calls arrive
+	filter    string
+	editing   bool // whether the filter is being typed
+	mode      tuiMode
+	scroll    int // the first line shown in the detail and output views
+	status    string
+	width     int
+	height    int
+	listRows  int
+	bodyLines int
+}
+
+// newTUI puts the terminal into raw mode, switches to the alternate screen, and arranges for log
+// output to be collected for the output view rather than written to the terminal
+func newTUI(in, out *os.File) (*tui, error) {
+	oldState, err := unix.IoctlGetTermios(int(in.Fd()), unix.TCGETS)
+	if err != nil {
+		return nil, fmt.Errorf("standard input is not a terminal")
+	}
+	if _, err := unix.IoctlGetWinsize(int(out.Fd()), unix.TIOCGWINSZ); err != nil {
+		return nil, fmt.Errorf("standard output is not a terminal")
+	}
+
+	raw := *oldState
+	raw.Iflag &^= unix.ICRNL | unix.IXON
+	raw.Lflag &^= unix.ECHO | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(int(in.Fd()), unix.TCSETS, &raw); err != nil {
+		return nil, fmt.Errorf("error putting terminal into raw mode: %w", err)
+	}
+
+	t := tui{
+		in:       in,
+		out:      out,
+		oldState: oldState,
+		oldLog:   log.Writer(),
+		oldDiag:  logOutput,
+		oldColor: color.Output,
+		output:   newOutputLog(),
+		keys:     make(chan string, 16),
+		winch:    make(chan os.Signal, 1),
+		follow:   true,
+		status:   "running",
+	}
+	log.SetOutput(t.output)
+	color.Output = t.output
+	if logFile == nil {
+		logOutput = t.output
+	}
+
+	signal.Notify(t.winch, syscall.SIGWINCH)
+	t.resize()
+	io.WriteString(out, "\x1b[?1049h\x1b[?25l") // alternate screen, hidden cursor
+	go t.readKeys()
+	return &t, nil
+}
+
+// close restores the terminal and log output. It is safe to call more than once.
+func (t *tui) close() {
+	if t.closed {
+		return
+	}
+	t.closed = true
+	signal.Stop(t.winch)
+	io.WriteString(t.out, "\x1b[?25h\x1b[?1049l")
+	unix.IoctlSetTermios(int(t.in.Fd()), unix.TCSETS, t.oldState)
+	log.SetOutput(t.oldLog)
+	color.Output = t.oldColor
+	logOutput = t.oldDiag
+}
+
+// prepare sets up the command for the subprocess to run underneath the UI, with its output going to
+// the output view, no input, and its own process group so that it can be stopped when the UI is quit
+func (t *tui) prepare(cmd *exec.Cmd) {
+	cmd.Stdin = nil
+	cmd.Stdout = t.output
+	cmd.Stderr = t.output
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// run shows the UI until the user quits. If the subprocess exits first then the UI stays open so that
+// its calls can still be browsed, and its error is returned once the user quits. If the user quits
+// first then the subprocess is killed.
+func (t *tui) run(cmd *exec.Cmd) error {
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	calls, history := listenHTTP()
+	for _, c := range history {
+		t.add(c)
+	}
+
+	running := true
+	var waitErr error
+	for {
+		t.draw()
+		select {
+		case key := <-t.keys:
+			if t.handleKey(key) {
+				if running {
+					unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+					<-exited
+					return nil
+				}
+				return waitErr
+			}
+		case c, ok := <-calls:
+			if !ok {
+				calls = nil
+				continue
+			}
+			t.add(c)
+		case <-t.output.changed:
+		case <-t.winch:
+			t.resize()
+		case waitErr = <-exited:
+			running = false
+			var exitErr *exec.ExitError
+			switch {
+			case waitErr == nil:
+				t.status = "exited"
+			case errors.As(waitErr, &exitErr):
+				t.status = fmt.Sprintf("exited with status %d", exitErr.ExitCode())
+			default:
+				t.status = fmt.Sprintf("error: %v", waitErr)
+			}
+		}
+	}
+}
+
+// add appends a call to the list, selecting it if the newest call is being followed
+func (t *tui) add(c *HTTPCall) {
+	t.calls = append(t.calls, c)
+	if t.matches(c) {
+		t.visible = append(t.visible, len(t.calls)-1)
+		if t.follow {
+			t.selected = len(t.visible) - 1
+		}
+	}
+}
+
+// matches checks whether a call contains the filter text, ignoring case
+func (t *tui) matches(c *HTTPCall) bool {
+	if t.filter == "" {
+		return true
+	}
+	s := fmt.Sprintf("%d %s %s", c.Response.StatusCode, c.Request.Method, c.Request.URL)
+	return strings.Contains(strings.ToLower(s), strings.ToLower(t.filter))
+}
+
+// refilter recomputes which calls are visible after the filter changed, keeping the same call
+// selected if it is still visible
+func (t *tui) refilter() {
+	current := -1
+	if t.selected < len(t.visible) {
+		current = t.visible[t.selected]
+	}
+	t.visible = t.visible[:0]
+	t.selected = 0
+	for i, c := range t.calls {
+		if t.matches(c) {
+			if i <= current {
+				t.selected = len(t.visible)
+			}
+			t.visible = append(t.visible, i)
+		}
+	}
+	if t.follow {
+		t.selected = max(len(t.visible)-1, 0)
+	}
+}
+
+// handleKey updates the UI for a key press, returning true if the user asked to quit
+func (t *tui) handleKey(key string) bool {
+	if key == "ctrl-c" {
+		return true
+	}
+
+	if t.editing {
+		switch key {
+		case "enter":
+			t.editing = false
+		case "esc":
+			t.editing = false
+			t.filter = ""
+		case "backspace":
+			if _, size := utf8.DecodeLastRuneInString(t.filter); size > 0 {
+				t.filter = t.filter[:len(t.filter)-size]
+			}
+		default:
+			if utf8.RuneCountInString(key) == 1 {
+				t.filter += key
+			}
+		}
+		t.refilter()
+		return false
+	}
+
+	if t.mode != tuiList {
+		switch key {
+		case "q", "esc", "enter":
+			t.mode = tuiList
+		case "up", "k":
+			t.scroll--
+		case "down", "j":
+			t.scroll++
+		case "pgup":
+			t.scroll -= t.height - 2
+		case "pgdown", " ":
+			t.scroll += t.height - 2
+		case "home", "g":
+			t.scroll = 0
+		case "end", "G":
+			t.scroll = 1 << 30
+		}
+		return false
+	}
+
+	last := len(t.visible) - 1
+	switch key {
+	case "q":
+		return true
+	case "up", "k":
+		t.selected--
+	case "down", "j":
+		t.selected++
+	case "pgup":
+		t.selected -= t.listRows
+	case "pgdown", " ":
+		t.selected += t.listRows
+	case "home", "g":
+		t.selected = 0
+	case "end", "G":
+		t.selected = last
+	case "enter":
+		if len(t.visible) > 0 {
+			t.mode = tuiDetail
+			t.scroll = 0
+		}
+	case "o":
+		t.mode = tuiOutput
+		t.scroll = 1 << 30
+	case "/":
+		t.editing = true
+	case "esc":
+		t.filter = ""
+		t.refilter()
+	}
+	t.selected = max(min(t.selected, last), 0)
+	t.follow = t.selected == last
+	return false
+}
+
+// resize reads the size of the terminal and lays out the list view to fit
+func (t *tui) resize() {
+	ws, err := unix.IoctlGetWinsize(int(t.out.Fd()), unix.TIOCGWINSZ)
+	if err != nil || ws.Row == 0 || ws.Col == 0 {
+		t.width, t.height = 80, 24
+	} else {
+		t.width, t.height = int(ws.Col), int(ws.Row)
+	}
+
+	// the list gets about 40% of the rows under its header, and the detail pane gets the rest
+	// except for a separator and the status bar
+	t.listRows = max((t.height-3)*2/5, 1)
+	t.bodyLines = max(t.height-3-t.listRows, 0)
+	io.WriteString(t.out, "\x1b[2J")
+}
+
+// draw renders the whole screen
+func (t *tui) draw() {
+	var rows []string
+	switch t.mode {
+	case tuiList:
+		t.top = min(max(t.top, t.selected-t.listRows+1), t.selected)
+		t.top = max(t.top, 0)
+		rows = append(rows, reverse(pad(fmt.Sprintf("%-12s  %3s  %-7s  %8s  %9s  %s", "TIME", "ST", "METHOD", "SIZE", "DURATION", "URL"), t.width)))
+		for i := t.top; i < t.top+t.listRows; i++ {
+			if i >= len(t.visible) {
+				rows = append(rows, "")
+				continue
+			}
+			rows = append(rows, t.listRow(t.calls[t.visible[i]], i == t.selected))
+		}
+		var detail []string
+		if t.selected < len(t.visible) {
+			detail = callDetail(t.calls[t.visible[t.selected]])
+		}
+		rows = append(rows, strings.Repeat("─", t.width))
+		for i := 0; i < t.bodyLines; i++ {
+			if i < len(detail) {
+				rows = append(rows, fit(detail[i], t.width))
+			} else {
+				rows = append(rows, "")
+			}
+		}
+	case tuiDetail:
+		if t.selected < len(t.visible) {
+			rows = t.page(callDetail(t.calls[t.visible[t.selected]]))
+		}
+	case tuiOutput:
+		rows = t.page(t.output.lines())
+	}
+
+	for len(rows) < t.height-1 {
+		rows = append(rows, "")
+	}
+	rows = append(rows[:t.height-1], t.statusBar())
+
+	var b bytes.Buffer
+	b.WriteString("\x1b[H")
+	for i, row := range rows {
+		b.WriteString(row)
+		b.WriteString("\x1b[K")
+		if i < len(rows)-1 {
+			b.WriteString("\r\n")
+		}
+	}
+	t.out.Write(b.Bytes())
+}
+
+// page returns the lines of a full-screen view starting from the scroll position, which it clamps
+func (t *tui) page(lines []string) []string {
+	rows := t.height - 1
+	t.scroll = max(min(t.scroll, len(lines)-rows), 0)
+	var out []string
+	for _, line := range lines[t.scroll:min(t.scroll+rows, len(lines))] {
+		out = append(out, fit(line, t.width))
+	}
+	return out
+}
+
+// listRow formats a call for the list
+func (t *tui) listRow(c *HTTPCall, selected bool) string {
+	status := fmt.Sprintf("%3d", c.Response.StatusCode)
+	row := fmt.Sprintf("%-12s  %s  %-7s  %8v  %9v  %s", c.Start.Format("15:04:05.000"), status, c.Request.Method,
+		byteSize(c.Response.Size), roundDuration(c.Duration), c.Request.URL)
+	row = pad(fit(row, t.width), t.width)
+	if selected {
+		return reverse(row)
+	}
+
+	// color the status code in the same way as the arrows that are printed without --tui
+	if color.NoColor {
+		return row
+	}
+	code := "32" // green
+	switch {
+	case c.Response.StatusCode >= 500:
+		code = "31" // red
+	case c.Response.StatusCode >= 400:
+		code = "33" // yellow
+	case c.Response.StatusCode >= 300:
+		code = "35" // magenta
+	}
+	i := strings.Index(row, status)
+	return row[:i] + "\x1b[" + code + "m" + status + "\x1b[0m" + row[i+len(status):]
+}
+
+// statusBar formats the last row of the screen
+func (t *tui) statusBar() string {
+	var help string
+	switch {
+	case t.editing:
+		help = "type to filter  enter done  esc clear"
+	case t.mode == tuiList:
+		help = "↑↓ select  enter details  / filter  o output  q quit"
+	default:
+		help = "↑↓ scroll  esc back  ctrl-c quit"
+	}
+	s := fmt.Sprintf(" %d calls", len(t.calls))
+	if t.filter != "" || t.editing {
+		s += fmt.Sprintf(", %d shown, filter: %s", len(t.visible), t.filter)
+		if t.editing {
+			s += "_"
+		}
+	}
+	s += " | subprocess " + t.status + " | " + help
+	return reverse(pad(fit(s, t.width), t.width))
+}
+
+// callDetail formats the request and response of a call as lines of text
+func callDetail(c *HTTPCall) []string {
+	lines := []string{c.Request.Method + " " + c.Request.URL}
+	for _, k := range sortedKeys(c.Request.Header) {
+		for _, v := range c.Request.Header[k] {
+			lines = append(lines, "> "+k+": "+v)
+		}
+	}
+	lines = append(lines, bodyLines(c.Request.Header, c.Request.Body, c.Request.Size, c.Request.Truncated)...)
+	lines = append(lines, "", fmt.Sprintf("%s (%d bytes, %v)", c.Response.Status, c.Response.Size, roundDuration(c.Duration)))
+	for _, k := range sortedKeys(c.Response.Header) {
+		for _, v := range c.Response.Header[k] {
+			lines = append(lines, "< "+k+": "+v)
+		}
+	}
+	for _, k := range sortedKeys(c.Response.Trailer) {
+		for _, v := range c.Response.Trailer[k] {
+			lines = append(lines, "< "+k+": "+v+" (trailer)")
+		}
+	}
+	return append(lines, bodyLines(c.Response.Header, c.Response.Body, c.Response.Size, c.Response.Truncated)...)
+}
+
+// bodyLines formats a body for callDetail, preceded by a blank line, or returns nothing if the body is empty
+func bodyLines(header http.Header, body []byte, size int64, truncated bool) []string {
+	if len(body) == 0 {
+		return nil
+	}
+	desc, rendered := renderBody(header, body, size)
+	lines := append([]string{"", desc}, rendered...)
+	if truncated {
+		lines = append(lines, fmt.Sprintf("(body truncated to %d of %d bytes)", len(body), size))
+	}
+	return lines
+}
+
+// fit makes a line safe to print and cuts it to a width, counting each rune as one column
+func fit(s string, width int) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		if n >= width {
+			break
+		}
+		switch {
+		case r == '\t':
+			r = ' '
+		case r < 0x20 || r == 0x7f || r == utf8.RuneError:
+			r = '·'
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
+
+// pad adds spaces to a line produced by fit so that it fills a width
+func pad(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+// reverse shows a line in reverse video
+func reverse(s string) string {
+	return "\x1b[7m" + s + "\x1b[0m"
+}
+
+// readKeys reads key presses from the terminal and sends them to the keys channel, translating
+// escape sequences into names such as "up" and "pgdown"
+func (t *tui) readKeys() {
+	buf := make([]byte, 256)
+	for {
+		n, err := t.in.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, key := range parseKeys(buf[:n]) {
+			t.keys <- key
+		}
+	}
+}
+
+// the escape sequences sent by terminals for the keys that the UI uses
+var escapeKeys = map[string]string{
+	"[A": "up", "OA": "up",
+	"[B": "down", "OB": "down",
+	"[5~": "pgup",
+	"[6~": "pgdown",
+	"[H":  "home", "OH": "home", "[1~": "home",
+	"[F": "end", "OF": "end", "[4~": "end",
+}
+
+// parseKeys splits what was read from the terminal into key presses
+func parseKeys(p []byte) []string {
+	var keys []string
+	for len(p) > 0 {
+		switch {
+		case p[0] == 0x1b && len(p) == 1:
+			keys = append(keys, "esc")
+			p = p[1:]
+		case p[0] == 0x1b && (p[1] == '[' || p[1] == 'O'):
+			// an escape sequence ends with a byte in the range @ to ~
+			end := 2
+			for end < len(p) && (p[end] < 0x40 || p[end] > 0x7e) {
+				end++
+			}
+			end = min(end+1, len(p))
+			if key, ok := escapeKeys[string(p[1:end])]; ok {
+				keys = append(keys, key)
+			}
+			p = p[end:]
+		case p[0] == 0x1b:
+			keys = append(keys, "esc")
+			p = p[1:]
+		case p[0] == 3:
+			keys = append(keys, "ctrl-c")
+			p = p[1:]
+		case p[0] == '\r' || p[0] == '\n':
+			keys = append(keys, "enter")
+			p = p[1:]
+		case p[0] == 0x7f || p[0] == 8:
+			keys = append(keys, "backspace")
+			p = p[1:]
+		default:
+			r, size := utf8.DecodeRune(p)
+			if r >= 0x20 {
+				keys = append(keys, string(r))
+			}
+			p = p[size:]
+		}
+	}
+	return keys
+}
+
+// the most lines that the output view keeps
+const maxOutputLines = 10000
+
+// matches the escape sequences that programs use for colors and cursor movement
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
+// outputLog collects the lines written to it for the output view of the terminal UI
+type outputLog struct {
+	mu      sync.Mutex
+	done    []string
+	partial []byte
+	changed chan struct{} // receives a value when lines have been written since the last draw
+}
+
+func newOutputLog() *outputLog {
+	return &outputLog{changed: make(chan struct{}, 1)}
+}
+
+func (o *outputLog) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		o.done = append(o.done, cleanLine(o.partial[:i]))
+		o.partial = o.partial[i+1:]
+	}
+	if len(o.done) > maxOutputLines {
+		o.done = append([]string(nil), o.done[len(o.done)-maxOutputLines:]...)
+	}
+	o.mu.Unlock()
+
+	select {
+	case o.changed <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// lines returns the lines written so far, including any line that has not been finished
+func (o *outputLog) lines() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	lines := append([]string(nil), o.done...)
+	if len(o.partial) > 0 {
+		lines = append(lines, cleanLine(o.partial))
+	}
+	return lines
+}
+
+// cleanLine removes escape sequences from a line of output, and anything before a carriage return,
+// which programs use to redraw progress bars
+func cleanLine(line []byte) string {
+	line = ansiEscape.ReplaceAll(line, nil)
+	line = bytes.TrimRight(line, "\r")
+	if i := bytes.LastIndexByte(line, '\r'); i >= 0 {
+		line = line[i+1:]
+	}
+	return string(line)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/monasticacademy/httptap/pkg/reqmatch"
+)
+
+// if true, certificates presented by servers in the world are not verified
+var insecureUpstream bool
+
+// the certificate authorities trusted for servers in the world, which must be loaded before the system
+// certificate files are overlaid with our own certificate authority
+var upstreamRoots *x509.CertPool
+
+// the client certificate presented to servers that ask for one, if any
+var clientCert *tls.Certificate
+
+// client certificates for particular hosts, which take precedence over clientCert
+var clientCertRules []clientCertRule
+
+// clientCertRule chooses the client certificate presented to servers with names matching a pattern
+type clientCertRule struct {
+	pattern string // such as "api.example.com" or "*.corp.example"
+	cert    *tls.Certificate
+}
+
+// parseClientCertRule parses a rule in the form PATTERN=CERTFILE,KEYFILE
+func parseClientCertRule(s string) (clientCertRule, error) {
+	pattern, files, ok := strings.Cut(s, "=")
+	certPath, keyPath, ok2 := strings.Cut(files, ",")
+	if !ok || !ok2 || pattern == "" {
+		return clientCertRule{}, fmt.Errorf("expected PATTERN=CERTFILE,KEYFILE but got %q", s)
+	}
+
+	cert, err := loadClientCert(certPath, keyPath)
+	if err != nil {
+		return clientCertRule{}, err
+	}
+	return clientCertRule{pattern: pattern, cert: cert}, nil
+}
+
+// loadClientCert loads a client certificate and its private key from PEM files
+func loadClientCert(certPath, keyPath string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading client certificate from %v and %v: %w", certPath, keyPath, err)
+	}
+	return &cert, nil
+}
+
+// clientCertificate returns the client certificate to present to the named server, or nil if there is none
+func clientCertificate(serverName string) *tls.Certificate {
+	for _, rule := range clientCertRules {
+		if reqmatch.Host(rule.pattern, serverName) {
+			return rule.cert
+		}
+	}
+	return clientCert
+}
+
+// getClientCertificate returns a function for tls.Config.GetClientCertificate that presents the client
+// certificate for serverName, or for the server named in the handshake context if serverName is empty
+func getClientCertificate(serverName string) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		name := serverName
+		if name == "" {
+			name, _ = info.Context().Value(serverNameContextKey).(string)
+		}
+
+		cert := clientCertificate(name)
+		if cert == nil {
+			verbosef("%v asked for a client certificate but none was configured for it", name)
+			// an empty certificate means that we have none to send
+			return &tls.Certificate{}, nil
+		}
+		verbosef("presenting client certificate to %v", name)
+		return cert, nil
+	}
+}
+
+// private keys for client certificates that the subprocess may present, which allow httptap to present
+// those same certificates to servers in the world
+var forwardKeys []crypto.PrivateKey
+
+// forwardedClientCert returns the certificate chain that the subprocess presented on an intercepted
+// connection together with its private key, or nil if the subprocess presented no certificate or the
+// key is not among forwardKeys
+func forwardedClientCert(state *tls.ConnectionState) *tls.Certificate {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := state.PeerCertificates[0]
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil
+	}
+
+	for _, key := range forwardKeys {
+		signer, ok := key.(crypto.Signer)
+		if !ok || !pub.Equal(signer.Public()) {
+			continue
+		}
+
+		cert := tls.Certificate{PrivateKey: key, Leaf: leaf}
+		for _, c := range state.PeerCertificates {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+		return &cert
+	}
+	return nil
+}
+
+// withClientCert adds the client certificate presented by the subprocess on conn to a context under
+// clientCertContextKey, if conn is an intercepted TLS connection and the certificate can be forwarded
+func withClientCert(ctx context.Context, conn net.Conn) context.Context {
+	if fc, ok := conn.(*fingerprintedConn); ok {
+		state := fc.ConnectionState()
+		if cert := forwardedClientCert(&state); cert != nil {
+			verbosef("will forward client certificate for %v presented by subprocess", cert.Leaf.Subject)
+			return context.WithValue(ctx, clientCertContextKey, cert)
+		}
+	}
+	return ctx
+}
+
+// clientCertTransport sends requests that carry a forwarded client certificate under clientCertContextKey
+// over connections that present that certificate, and other requests through the base transport. Each
+// certificate gets its own transport so that connections are never shared between certificates.
+type clientCertTransport struct {
+	base   *http.Transport
+	mu     sync.Mutex
+	byCert map[[sha256.Size]byte]*http.Transport
+}
+
+func newClientCertTransport(base *http.Transport) *clientCertTransport {
+	return &clientCertTransport{base: base, byCert: make(map[[sha256.Size]byte]*http.Transport)}
+}
+
+func (t *clientCertTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cert, ok := req.Context().Value(clientCertContextKey).(*tls.Certificate)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	key := sha256.Sum256(cert.Certificate[0])
+	t.mu.Lock()
+	transport, ok := t.byCert[key]
+	if !ok {
+		transport = t.base.Clone()
+		transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+		t.byCert[key] = transport
+	}
+	t.mu.Unlock()
+
+	return transport.RoundTrip(req)
+}
+
+// upstreamTLSConfig returns the TLS configuration for connections to servers in the world
+func upstreamTLSConfig() *tls.Config {
+	return &tls.Config{
+		RootCAs:              upstreamRoots,
+		InsecureSkipVerify:   insecureUpstream,
+		GetClientCertificate: getClientCertificate(""),
+	}
+}
+
+// isUpstreamCertError checks whether err came from a server in the world presenting a certificate that
+// could not be verified. The certificate is checked by the transport on the very connection that the
+// request is sent over, so it is the certificate of wherever --map-remote and any upstream proxy sent it.
+func isUpstreamCertError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	return errors.As(err, &certErr)
+}
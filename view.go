@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/monasticacademy/httptap/pkg/harlog"
+)
+
+// viewMain implements "httptap view", which serves the web UI for a capture recorded earlier
+func viewMain(argv []string) error {
+	var args struct {
+		HAR  string `arg:"positional,required" help:"HAR file to show"`
+		Addr string `arg:"--addr" default:"localhost:8040" help:"address and port to serve the web UI on"`
+	}
+	if err := parseSubcommand("view", argv, &args); err != nil {
+		return err
+	}
+
+	har, err := readHAR(args.HAR)
+	if err != nil {
+		return err
+	}
+	var calls []*HTTPCall
+	for _, entry := range har.Log.Entries {
+		call, err := httpCallFromHAR(entry)
+		if err != nil {
+			errorf("leaving out %v %v: %v", entry.Request.Method, entry.Request.URL, err)
+			continue
+		}
+		calls = append(calls, call)
+	}
+
+	ui := &webUI{
+		listen:  func() (httpListener, []*HTTPCall, func()) { return nil, calls, func() {} },
+		history: func() []*HTTPCall { return calls },
+		addr:    args.Addr,
+		cors:    []string{"*"},
+	}
+	l, err := net.Listen("tcp", args.Addr)
+	if err != nil {
+		return fmt.Errorf("error listening for the web UI: %w", err)
+	}
+	log.Printf("showing %d HTTP calls from %v at http://%v", len(calls), args.HAR, l.Addr())
+	return http.Serve(l, ui.handler())
+}
+
+// httpCallFromHAR converts an entry of a HAR file back to the form in which HTTP calls are printed and
+// served to the web UI
+func httpCallFromHAR(entry *harlog.Entry) (*HTTPCall, error) {
+	if entry.Request == nil || entry.Response == nil {
+		return nil, fmt.Errorf("the entry has no request or no response")
+	}
+	reqBody, err := harRequestBody(entry.Request)
+	if err != nil {
+		return nil, fmt.Errorf("error reading request body: %w", err)
+	}
+	respBody, err := harResponseBody(entry.Response)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	var host string
+	if u, err := url.Parse(entry.Request.URL); err == nil {
+		host = u.Host
+	}
+	status := entry.Response.StatusText
+	if status == "" {
+		status = http.StatusText(entry.Response.Status)
+	}
+	return &HTTPCall{
+		Request: HTTPRequest{
+			Method: entry.Request.Method,
+			URL:    entry.Request.URL,
+			Host:   host,
+			Header: harHeader(entry.Request.Headers),
+			Body:   reqBody,
+			Size:   int64(len(reqBody)),
+
+			EffectiveURL:   entry.Request.EffectiveURL,
+			InjectedHeader: harHeader(entry.Request.InjectedHeaders),
+			RateLimited:    entry.Request.RateLimited,
+		},
+		Response: HTTPResponse{
+			StatusCode: entry.Response.Status,
+			Status:     fmt.Sprintf("%d %s", entry.Response.Status, status),
+			Header:     harHeader(entry.Response.Headers),
+			Body:       respBody,
+			Size:       int64(len(respBody)),
+			Mocked:     entry.Response.Mocked,
+		},
+		Start:    time.Time(entry.StartedDateTime),
+		Duration: time.Duration(entry.Time),
+	}, nil
+}
+
+// harHeader converts the headers of a HAR entry to an http.Header, leaving out HTTP/2 pseudo-headers
+func harHeader(nvps []*harlog.NVP) http.Header {
+	h := make(http.Header)
+	for _, nvp := range nvps {
+		if !strings.HasPrefix(nvp.Name, ":") {
+			h.Add(nvp.Name, nvp.Value)
+		}
+	}
+	return h
+}
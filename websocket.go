@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/monasticacademy/httptap/pkg/websocket"
+)
+
+// WebSocketMessage models a single websocket frame relayed after an intercepted upgrade
+type WebSocketMessage struct {
+	URL       string    `json:"url"`
+	Direction string    `json:"direction"` // "send" for subprocess to world, "receive" for world to subprocess
+	Opcode    string    `json:"opcode"`
+	Length    int64     `json:"length"`
+	Payload   []byte    `json:"payload"`
+	Time      time.Time `json:"time"`
+}
+
+// webSocketWatcher receives information about each websocket frame relayed between the subprocess and the world
+type webSocketWatcher func(*WebSocketMessage)
+
+// the watchers waiting for websocket messages
+var webSocketWatchers []webSocketWatcher
+
+// the mutex that protects the above slice
+var webSocketMu sync.Mutex
+
+// add a watcher that will be called for each websocket frame
+func watchWebSocket(w webSocketWatcher) {
+	webSocketMu.Lock()
+	defer webSocketMu.Unlock()
+
+	webSocketWatchers = append(webSocketWatchers, w)
+}
+
+// call each websocket watcher
+func notifyWebSocketWatchers(msg *WebSocketMessage) {
+	if u, err := url.Parse(msg.URL); err == nil && !isCapturedHost(u.Hostname()) {
+		return
+	}
+
+	webSocketMu.Lock()
+	defer webSocketMu.Unlock()
+
+	for _, w := range webSocketWatchers {
+		w(msg)
+	}
+}
+
+// webSocketURL converts an http or https URL to the equivalent ws or wss URL for display
+func webSocketURL(u *url.URL) string {
+	cp := *u
+	switch cp.Scheme {
+	case "http":
+		cp.Scheme = "ws"
+	case "https":
+		cp.Scheme = "wss"
+	}
+	return cp.String()
+}
+
+// proxyWebSocket relays bytes between the subprocess and the world after a successful upgrade,
+// notifying websocket watchers of each frame in each direction. It returns when either side
+// finishes; the caller is responsible for closing both connections.
+func proxyWebSocket(fromSubprocess io.Reader, toSubprocess io.Writer, world io.ReadWriter, u *url.URL) {
+	wsurl := webSocketURL(u)
+	notify := func(direction string) func(*websocket.Frame) {
+		return func(frame *websocket.Frame) {
+			payload := frame.Payload
+			if frame.Opcode == websocket.OpText && !frame.Compressed {
+				payload = bodyScrubber.Scrub(payload)
+			}
+			notifyWebSocketWatchers(&WebSocketMessage{
+				URL:       wsurl,
+				Direction: direction,
+				Opcode:    frame.Opcode.String(),
+				Length:    frame.Length,
+				Payload:   payload,
+				Time:      frame.Time,
+			})
+		}
+	}
+
+	send := websocket.Tap(notify("send"))
+	defer send.Close()
+
+	receive := websocket.Tap(notify("receive"))
+	defer receive.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, err := io.Copy(io.MultiWriter(world, send), fromSubprocess)
+		if err != nil {
+			verbosef("websocket relay from subprocess to %v ended: %v", wsurl, err)
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		_, err := io.Copy(io.MultiWriter(toSubprocess, receive), world)
+		if err != nil {
+			verbosef("websocket relay from %v to subprocess ended: %v", wsurl, err)
+		}
+		done <- struct{}{}
+	}()
+
+	// when either side is finished the caller closes both connections, which unblocks the other side
+	<-done
+	verbosef("websocket connection to %v finished", wsurl)
+}
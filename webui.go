@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/monasticacademy/httptap/pkg/reqmatch"
+)
+
+// the single page of the web UI, which shows the HTTP calls streamed from /api/calls
+//
+//go:embed webui/index.html
+var webUIPage []byte
+
+// webUI serves the web UI and the API behind it. It streams HTTP calls from listen, which returns the
+// calls made so far together with a channel of those made from then on, or a nil channel if no more
+// calls will be made, as when viewing a capture from a file, and a function to call when done. The
+// calls made so far are also served a page at a time from history.
+type webUI struct {
+	listen  func() (httpListener, []*HTTPCall, func())
+	history func() []*HTTPCall
+
+	addr  string   // the address that the web UI listens on, such as "localhost:8040"
+	token string   // the token that clients must give, if not empty
+	cors  []string // the origins of pages that may use the API, or "*" for any
+
+	// the API that controls a running httptap, which is not served if these are nil
+	control   *controller
+	events    *eventHub
+	transport http.RoundTripper // what replayed requests are sent through
+}
+
+// handler returns the routes of the web UI
+func (ui *webUI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(webUIPage)
+	})
+	mux.HandleFunc("GET /api/calls", ui.serveCalls)
+	mux.HandleFunc("GET /api/history", ui.serveHistory)
+	if ui.control != nil {
+		ui.handleAPI(mux)
+	}
+	return ui.protect(mux)
+}
+
+// protect lets pages from the origins given with --webui-cors use the API, and turns away requests
+// without the token given with --webui-token. The token can be sent as a bearer token, for scripts, or as
+// the password of basic auth, with any user name, so that browsers can ask for it.
+//
+// CORS only keeps other pages from reading responses, not from sending simple requests such as form
+// posts, so requests that change anything are also turned away if they come from pages of other origins
+// or have a body that is neither JSON nor YAML.
+//
+// Before any of that, requests are turned away if their Host header is not one that the web UI can be
+// reached at, since a page whose name has been rebound to a local address is otherwise of the same
+// origin as the web UI.
+func (ui *webUI) protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ui.allowsHost(r.Host) {
+			writeAPIError(w, http.StatusForbidden, fmt.Errorf("the web UI is not served as %v, use %v or a loopback address", r.Host, ui.addr))
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+			if err := ui.checkSender(r); err != nil {
+				writeAPIError(w, http.StatusForbidden, err)
+				return
+			}
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" && ui.allowsOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			if r.Method == http.MethodOptions {
+				// preflight requests never carry credentials
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		if ui.token != "" {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				_, given, ok = r.BasicAuth()
+			}
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(ui.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="httptap"`)
+				writeAPIError(w, http.StatusUnauthorized, fmt.Errorf("this web UI needs the token given with --webui-token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkSender returns an error if a request that changes something comes from a page of another
+// origin that is not allowed with --webui-cors, or has a content type that a form could send
+func (ui *webUI) checkSender(r *http.Request) error {
+	if !ui.sameOrAllowedOrigin(r) {
+		return fmt.Errorf("pages from %v may not use the API, see --webui-cors", r.Header.Get("Origin"))
+	}
+	if typ := r.Header.Get("Content-Type"); typ != "" && !strings.Contains(typ, "json") && !strings.Contains(typ, "yaml") {
+		return fmt.Errorf("requests that change anything must be sent as application/json or YAML, not %v", typ)
+	}
+	return nil
+}
+
+// sameOrAllowedOrigin checks whether a request was sent by a page served by us or from an origin allowed
+// with --webui-cors, or by something other than a browser, which sends no Origin header
+func (ui *webUI) sameOrAllowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || ui.allowsOrigin(origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// allowsOrigin checks whether a page from an origin such as "http://localhost:3000" may use the API
+func (ui *webUI) allowsOrigin(origin string) bool {
+	return slices.Contains(ui.cors, "*") || slices.Contains(ui.cors, origin)
+}
+
+// allowsHost checks whether a Host header such as "localhost:8040" is one that the web UI can be reached
+// at: the listen address, a loopback name, or an IP address, none of which a DNS rebinding attack can
+// produce. Other names are only allowed with --webui-token, which pages of other origins do not know.
+func (ui *webUI) allowsHost(host string) bool {
+	if ui.token != "" {
+		return true
+	}
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		name = host
+	}
+	name = strings.TrimSuffix(strings.Trim(name, "[]"), ".")
+	if strings.EqualFold(name, "localhost") || net.ParseIP(name) != nil {
+		return true
+	}
+	listen, _, err := net.SplitHostPort(ui.addr)
+	return err == nil && listen != "" && strings.EqualFold(name, listen)
+}
+
+// isLoopbackAddr checks whether a listen address such as "localhost:8040" only accepts connections from
+// this machine
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// callQuery keeps the HTTP calls that match the query parameters of /api/calls and /api/history
+type callQuery struct {
+	host      string         // a pattern such as "*.example.com"
+	method    string         // such as "POST"
+	minStatus int            // the lowest status code, or zero
+	maxStatus int            // the highest status code, or zero
+	path      *regexp.Regexp // an expression that the path must contain a match for
+}
+
+// parseCallQuery reads the query parameters "host", "method", "status", which is a code such as 404, a
+// class such as 4xx, or a range such as 400-499, and "path", which is a regular expression
+func parseCallQuery(query url.Values) (*callQuery, error) {
+	q := callQuery{host: query.Get("host"), method: query.Get("method")}
+	if s := query.Get("status"); s != "" {
+		lo, hi, isRange := strings.Cut(s, "-")
+		if class, ok := strings.CutSuffix(strings.ToLower(s), "xx"); ok && len(class) == 1 && !isRange {
+			lo, hi = class+"00", class+"99"
+		} else if !isRange {
+			hi = lo
+		}
+		var err error
+		q.minStatus, err = strconv.Atoi(lo)
+		if err == nil {
+			q.maxStatus, err = strconv.Atoi(hi)
+		}
+		if err != nil || q.minStatus > q.maxStatus {
+			return nil, fmt.Errorf("status must be a code such as 404, a class such as 4xx, or a range such as 400-499, not %q", s)
+		}
+	}
+	if s := query.Get("path"); s != "" {
+		var err error
+		q.path, err = regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("error in path expression: %w", err)
+		}
+	}
+	return &q, nil
+}
+
+// matches checks whether a call matches every parameter that was given
+func (q *callQuery) matches(call *HTTPCall) bool {
+	if q.method != "" && !strings.EqualFold(q.method, call.Request.Method) {
+		return false
+	}
+	if q.maxStatus != 0 && (call.Response.StatusCode < q.minStatus || call.Response.StatusCode > q.maxStatus) {
+		return false
+	}
+	if q.host != "" || q.path != nil {
+		u, err := url.Parse(call.Request.URL)
+		if err != nil {
+			return false
+		}
+		if q.host != "" && !reqmatch.Host(q.host, u.Hostname()) {
+			return false
+		}
+		if q.path != nil && !q.path.MatchString(u.Path) {
+			return false
+		}
+	}
+	return true
+}
+
+// serveCalls streams the HTTP calls made so far, and then each new call as it is made, as server-sent
+// events whose IDs are the positions of the calls in the history. Only the calls that match the query
+// parameters read by parseCallQuery are sent, with the same IDs as if all were.
+func (ui *webUI) serveCalls(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	query, err := parseCallQuery(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	calls, history, stop := ui.listen()
+	defer stop()
+	var n int
+	send := func(call *HTTPCall) error {
+		id := n
+		n++
+		if !query.matches(call) {
+			return nil
+		}
+		data, err := json.Marshal(call)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", id, data)
+		return err
+	}
+
+	for _, call := range history {
+		if err := send(call); err != nil {
+			verbosef("error sending HTTP call to web UI: %v", err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case call, ok := <-calls:
+			if !ok {
+				// either no more calls will be made, or this client fell behind, in which case it
+				// reconnects and is sent the history again
+				return
+			}
+			if err := send(call); err != nil {
+				verbosef("error sending HTTP call to web UI: %v", err)
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// historyPage is what GET /api/history returns
+type historyPage struct {
+	Total  int         `json:"total"`  // the number of calls that matched, across all pages
+	Offset int         `json:"offset"` // the position of the first call in this page among those that matched
+	Calls  []*HTTPCall `json:"calls"`
+}
+
+// serveHistory writes the HTTP calls made so far as JSON, oldest first. The query parameters "offset"
+// and "limit" choose a page, by default the first 100 calls, among those that match the query parameters
+// read by parseCallQuery.
+func (ui *webUI) serveHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	match, err := parseCallQuery(query)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	offset, limit := 0, 100
+	for name, n := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if s := query.Get(name); s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 0 {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("%s must be a number that is not negative, not %q", name, s))
+				return
+			}
+			*n = v
+		}
+	}
+
+	var calls []*HTTPCall
+	for _, call := range ui.history() {
+		if match.matches(call) {
+			calls = append(calls, call)
+		}
+	}
+
+	page := historyPage{Total: len(calls), Offset: offset, Calls: []*HTTPCall{}}
+	if offset < len(calls) {
+		page.Calls = calls[offset:min(offset+limit, len(calls))]
+	}
+	writeAPIResponse(w, http.StatusOK, page)
+}